@@ -0,0 +1,142 @@
+package accesslog
+
+import (
+	"io"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/logging"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+const (
+	TypeConnectionOpened = "connection_opened"
+	TypeConnectionClosed = "connection_closed"
+	TypeEvent            = "event"
+	TypeReq              = "req"
+	TypeClose            = "close"
+)
+
+// Logger writes one JSON line per client request and relay decision. A nil Logger is valid and logs nothing
+type Logger struct {
+	logger       zerolog.Logger
+	sampleRate   float64
+	pubkeyLookup func(connectionId string) string
+	// file is the log file written to, nil when writing to stdout or a given writer
+	file io.Closer
+	sync.RWMutex
+}
+
+// New creates the access log from the configuration. Lines are written to stdout unless a path is configured
+func New(cfg config.AccessLog) (*Logger, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Path == "" {
+		return NewLogger(os.Stdout, cfg.SampleRate), nil
+	}
+	w, err := logging.NewRotatingWriter(cfg.Path, cfg.MaxSize, cfg.MaxAge, cfg.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l := NewLogger(w, cfg.SampleRate)
+	l.file = w
+	return l, nil
+}
+
+// NewLogger creates an access log writing to the given writer. A sample rate between 0 and 1 only logs that fraction of REQ, CLOSE and accepted EVENT lines
+func NewLogger(w io.Writer, sampleRate float64) *Logger {
+	return &Logger{
+		logger:     zerolog.New(w).With().Timestamp().Logger(),
+		sampleRate: sampleRate,
+	}
+}
+
+// CloseFile closes the log file opened by New, if any. Nothing is written once it is closed
+func (l *Logger) CloseFile() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// SetPubkeyLookup stores the function used to find the pubkey a connection authenticated as
+func (l *Logger) SetPubkeyLookup(pubkeyLookup func(connectionId string) string) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.pubkeyLookup = pubkeyLookup
+}
+
+// sampled decides if a sampled line should be written
+func (l *Logger) sampled() bool {
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+// entry starts a new line with the fields common to every line. Lines are written without a level so they are unaffected by the log level
+func (l *Logger) entry(lineType, connectionId, ip string) *zerolog.Event {
+	l.RLock()
+	pubkeyLookup := l.pubkeyLookup
+	l.RUnlock()
+	e := l.logger.Log().Str("type", lineType).Str("connection_id", connectionId).Str("ip", ip)
+	if pubkeyLookup != nil {
+		if pubkey := pubkeyLookup(connectionId); pubkey != "" {
+			e = e.Str("authed_pubkey", pubkey)
+		}
+	}
+	return e
+}
+
+// ConnectionOpened records a new websocket connection
+func (l *Logger) ConnectionOpened(connectionId, ip, userAgent string) {
+	if l == nil {
+		return
+	}
+	l.entry(TypeConnectionOpened, connectionId, ip).Str("user_agent", userAgent).Send()
+}
+
+// ConnectionClosed records the end of a websocket connection
+func (l *Logger) ConnectionClosed(connectionId, ip string, duration time.Duration, bytesIn, bytesOut uint64) {
+	if l == nil {
+		return
+	}
+	l.entry(TypeConnectionClosed, connectionId, ip).Dur("duration", duration).Uint64("bytes_in", bytesIn).Uint64("bytes_out", bytesOut).Send()
+}
+
+// Event records the decision taken on an EVENT. Rejections are never sampled out
+func (l *Logger) Event(connectionId, ip string, event nostr.Event, accepted bool, reason string) {
+	if l == nil || (accepted && !l.sampled()) {
+		return
+	}
+	e := l.entry(TypeEvent, connectionId, ip).Str("event_id", event.ID).Int("kind", event.Kind).Str("pubkey", event.PubKey).Bool("accepted", accepted)
+	if reason != "" {
+		e = e.Str("reason", reason)
+	}
+	e.Send()
+}
+
+// Req records a REQ along with how many stored events were sent and how long it took. Rejected REQs carry a reason and are never sampled out
+func (l *Logger) Req(connectionId, ip, subscriptionId string, filters nostr.Filters, resultCount int, duration time.Duration, reason string) {
+	if l == nil || (reason == "" && !l.sampled()) {
+		return
+	}
+	e := l.entry(TypeReq, connectionId, ip).Str("subscription_id", subscriptionId).RawJSON("filters", []byte(filters.String())).Int("result_count", resultCount).Dur("duration", duration)
+	if reason != "" {
+		e = e.Str("reason", reason)
+	}
+	e.Send()
+}
+
+// Close records a CLOSE
+func (l *Logger) Close(connectionId, ip, subscriptionId string) {
+	if l == nil || !l.sampled() {
+		return
+	}
+	l.entry(TypeClose, connectionId, ip).Str("subscription_id", subscriptionId).Send()
+}
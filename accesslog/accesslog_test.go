@@ -0,0 +1,116 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type accessLogTestCase struct {
+	name           string
+	sampleRate     float64
+	log            func(l *Logger)
+	expectedFields []map[string]any
+}
+
+var (
+	testConnId         = "conn-1"
+	testIP             = "127.0.0.1"
+	testAuthedPubkey   = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	testEvent          = nostr.Event{ID: "abcd", Kind: 1, PubKey: "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"}
+	accessLogTestCases = []accessLogTestCase{
+		{
+			name:       "ConnectionLifecycle",
+			sampleRate: 1,
+			log: func(l *Logger) {
+				l.ConnectionOpened(testConnId, testIP, "test-agent")
+				l.ConnectionClosed(testConnId, testIP, time.Second, 10, 20)
+			},
+			expectedFields: []map[string]any{
+				{"type": TypeConnectionOpened, "connection_id": testConnId, "ip": testIP, "user_agent": "test-agent", "authed_pubkey": testAuthedPubkey},
+				{"type": TypeConnectionClosed, "bytes_in": float64(10), "bytes_out": float64(20), "duration": float64(1000)},
+			},
+		},
+		{
+			name:       "EventAndReq",
+			sampleRate: 1,
+			log: func(l *Logger) {
+				l.Event(testConnId, testIP, testEvent, false, "blocked: pubkey is banned")
+				l.Req(testConnId, testIP, "sub", nostr.Filters{{Kinds: []int{1}}}, 3, time.Millisecond, "")
+				l.Close(testConnId, testIP, "sub")
+			},
+			expectedFields: []map[string]any{
+				{"type": TypeEvent, "event_id": "abcd", "kind": float64(1), "accepted": false, "reason": "blocked: pubkey is banned"},
+				{"type": TypeReq, "subscription_id": "sub", "result_count": float64(3), "filters": []any{map[string]any{"kinds": []any{float64(1)}}}},
+				{"type": TypeClose, "subscription_id": "sub"},
+			},
+		},
+		{
+			name:       "SamplingKeepsRejections",
+			sampleRate: 0.0000001,
+			log: func(l *Logger) {
+				for i := 0; i < 10; i++ {
+					l.Event(testConnId, testIP, testEvent, true, "")
+					l.Close(testConnId, testIP, "sub")
+				}
+				l.Event(testConnId, testIP, testEvent, false, "rate-limited: slow down, too many events")
+				l.Req(testConnId, testIP, "sub", nil, 0, 0, "error: subscription id too large")
+			},
+			expectedFields: []map[string]any{
+				{"type": TypeEvent, "accepted": false},
+				{"type": TypeReq, "reason": "error: subscription id too large"},
+			},
+		},
+	}
+)
+
+// TestAccessLog ensures the expected lines and fields are written to the access log
+func TestAccessLog(t *testing.T) {
+	for _, testCase := range accessLogTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		var buf bytes.Buffer
+		l := NewLogger(&buf, testCase.sampleRate)
+		l.SetPubkeyLookup(func(connectionId string) string {
+			if connectionId == testConnId {
+				return testAuthedPubkey
+			}
+			return ""
+		})
+		testCase.log(l)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != len(testCase.expectedFields) {
+			t.Fatalf("unexpected number of lines: expected %v, got %v (%s)", len(testCase.expectedFields), len(lines), buf.String())
+		}
+		for i, line := range lines {
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("unexpected error when parsing line %s: %v", line, err)
+			}
+			if _, ok := fields["level"]; ok {
+				t.Errorf("unexpected level in line %s", line)
+			}
+			for key, expected := range testCase.expectedFields[i] {
+				expectedJSON, _ := json.Marshal(expected)
+				actualJSON, _ := json.Marshal(fields[key])
+				if !bytes.Equal(expectedJSON, actualJSON) {
+					t.Errorf("unexpected value for %s: expected %s, got %s", key, expectedJSON, actualJSON)
+				}
+			}
+		}
+	}
+}
+
+// TestNilAccessLog ensures a disabled access log can be used safely
+func TestNilAccessLog(t *testing.T) {
+	var l *Logger
+	l.SetPubkeyLookup(func(string) string { return "" })
+	l.ConnectionOpened(testConnId, testIP, "")
+	l.ConnectionClosed(testConnId, testIP, 0, 0, 0)
+	l.Event(testConnId, testIP, testEvent, true, "")
+	l.Req(testConnId, testIP, "sub", nil, 0, 0, "")
+	l.Close(testConnId, testIP, "sub")
+}
@@ -0,0 +1,107 @@
+package bus
+
+import (
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Topic names a kind of message published on the bus, T is the type of its payload
+type Topic[T any] struct {
+	name string
+}
+
+// String returns the name of the topic
+func (t Topic[T]) String() string {
+	return t.name
+}
+
+var (
+	// EventAccepted is published for every event accepted by the relay, once it is stored and sent to the filter manager
+	EventAccepted = Topic[Event]{name: "eventAccepted"}
+	// EventDeleted is published for every event removed from storage, whether it was replaced, deleted by a group admin or by moderation
+	EventDeleted = Topic[Event]{name: "eventDeleted"}
+	// ConnectionOpened is published when a websocket connection is accepted
+	ConnectionOpened = Topic[Connection]{name: "connectionOpened"}
+	// ConnectionClosed is published once a websocket connection is closed
+	ConnectionClosed = Topic[Connection]{name: "connectionClosed"}
+	// SubscriptionOpened is published when a REQ is registered, after its stored events were sent. A REQ reusing a subscription id replaces the subscription and is published again
+	SubscriptionOpened = Topic[Subscription]{name: "subscriptionOpened"}
+	// SubscriptionClosed is published when a subscription is closed by the client or ends with its connection
+	SubscriptionClosed = Topic[Subscription]{name: "subscriptionClosed"}
+)
+
+// Event is the payload of the event topics. The connection id names the source of the event, it is empty for events signed or deleted by the relay itself
+type Event struct {
+	ConnectionId string
+	Event        nostr.Event
+}
+
+// Connection is the payload of the connection topics
+type Connection struct {
+	ConnectionId string
+	RemoteIP     string
+	UserAgent    string
+}
+
+// Subscription is the payload of the subscription topics
+type Subscription struct {
+	ConnectionId   string
+	SubscriptionId string
+	Filters        nostr.Filters
+}
+
+// handler is a function subscribed to a topic
+type handler struct {
+	id int
+	fn any
+}
+
+// Bus is an in-process publish/subscribe bus letting modules learn about what happens in the relay without being wired to the modules it happens in. Handlers are called synchronously by the publishing goroutine, in the order they subscribed, and must not block. A nil bus drops everything published to it
+type Bus struct {
+	handlers map[string][]handler
+	nextId   int
+	sync.RWMutex
+}
+
+// New creates an empty bus
+func New() *Bus {
+	return &Bus{handlers: make(map[string][]handler)}
+}
+
+// Subscribe calls the handler with the payload of every message published on the topic until the returned function is called
+func Subscribe[T any](b *Bus, topic Topic[T], fn func(T)) (unsubscribe func()) {
+	if b == nil {
+		return func() {}
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.nextId++
+	id := b.nextId
+	b.handlers[topic.name] = append(b.handlers[topic.name], handler{id: id, fn: fn})
+	return func() {
+		b.Lock()
+		defer b.Unlock()
+		handlers := b.handlers[topic.name]
+		for i, h := range handlers {
+			if h.id == id {
+				// a copy is made so a publish iterating over the previous slice isn't affected
+				b.handlers[topic.name] = append(handlers[:i:i], handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish calls every handler subscribed to the topic with the payload
+func Publish[T any](b *Bus, topic Topic[T], payload T) {
+	if b == nil {
+		return
+	}
+	b.RLock()
+	handlers := b.handlers[topic.name]
+	b.RUnlock()
+	for _, h := range handlers {
+		h.fn.(func(T))(payload)
+	}
+}
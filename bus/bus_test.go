@@ -0,0 +1,39 @@
+package bus
+
+import (
+	"slices"
+	"testing"
+)
+
+// TestBus ensures handlers only receive the messages of the topics they subscribed to, in order, until they unsubscribe
+func TestBus(t *testing.T) {
+	b := New()
+	var received []string
+	unsubscribeOpened := Subscribe(b, ConnectionOpened, func(c Connection) { received = append(received, "opened:"+c.ConnectionId) })
+	Subscribe(b, ConnectionOpened, func(c Connection) { received = append(received, "opened again:"+c.ConnectionId) })
+	Subscribe(b, ConnectionClosed, func(c Connection) { received = append(received, "closed:"+c.ConnectionId) })
+	Subscribe(b, SubscriptionOpened, func(s Subscription) { received = append(received, "sub:"+s.SubscriptionId) })
+	Publish(b, ConnectionOpened, Connection{ConnectionId: "a"})
+	Publish(b, SubscriptionOpened, Subscription{ConnectionId: "a", SubscriptionId: "notes"})
+	unsubscribeOpened()
+	unsubscribeOpened()
+	Publish(b, ConnectionOpened, Connection{ConnectionId: "b"})
+	Publish(b, ConnectionClosed, Connection{ConnectionId: "a"})
+	Publish(b, EventAccepted, Event{ConnectionId: "a"})
+	expected := []string{"opened:a", "opened again:a", "sub:notes", "opened again:b", "closed:a"}
+	if !slices.Equal(received, expected) {
+		t.Errorf("unexpected messages received: expected %v got %v", expected, received)
+	}
+}
+
+// TestNilBus ensures a nil bus can be subscribed and published to
+func TestNilBus(t *testing.T) {
+	var b *Bus
+	called := false
+	unsubscribe := Subscribe(b, EventAccepted, func(Event) { called = true })
+	Publish(b, EventAccepted, Event{})
+	unsubscribe()
+	if called {
+		t.Error("unexpected call of handler subscribed to a nil bus")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/TheRebelOfBabylon/tandem/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+var (
+	ErrMissingSecretKey = errors.New("no admin key configured")
+	ErrInvalidSecretKey = errors.New("invalid admin key")
+	ErrNotBanned        = errors.New("pubkey is not banned")
+	defaultRelayURL     = "http://localhost:5000"
+	adminNsecEnv        = "TANDEM_ADMIN_NSEC"
+	adminRelayEnv       = "TANDEM_RELAY_URL"
+	adminUsage          = `usage: tandem admin [-relay <url>] [-nsec-file <path>] <command> [arguments]
+
+commands:
+  ban-pubkey <pubkey|npub> [reason]        reject all events from a pubkey
+  unban-pubkey <pubkey|npub>               lift the ban of a banned pubkey
+  delete-event <id|note|nevent> [reason]   delete an event and reject it in the future
+  block-ip <ip> [reason]                   disconnect and refuse connections from an ip address
+  unblock-ip <ip>                          lift the block of an ip address
+  list-connections                         list open connections
+  list-bans                                list banned pubkeys, banned events and blocked ip addresses
+  stats                                    show relay statistics
+
+The admin key is read from the file given with -nsec-file or from the ` + adminNsecEnv + ` env var, as an nsec or in hex.
+Its pubkey must be listed in http.admin_pubkeys of the relay configuration.`
+)
+
+type adminClient struct {
+	relayURL   string
+	secretKey  string
+	httpClient *http.Client
+}
+
+// runAdminCommand runs the admin subcommands against the management API of a running relay and returns the process exit code
+func runAdminCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprintln(stderr, adminUsage) }
+	relayURL := fs.String("relay", envOrDefault(adminRelayEnv, defaultRelayURL), "url of the relay, env var: "+adminRelayEnv)
+	nsecFile := fs.String("nsec-file", "", "path to a file containing the admin nsec")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	secretKey, err := loadSecretKey(*nsecFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to load admin key: %v\n", err)
+		return 1
+	}
+	client := &adminClient{
+		relayURL:   httpURL(*relayURL),
+		secretKey:  secretKey,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if err := client.run(fs.Arg(0), fs.Args()[1:], stdout); errors.Is(err, flag.ErrHelp) {
+		fs.Usage()
+		return 2
+	} else if err != nil {
+		fmt.Fprintf(stderr, "%s failed: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+// envOrDefault returns the value of the given env var or the default value if it isn't set
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// httpURL converts a websocket relay url to the url of its HTTP endpoints
+func httpURL(relayURL string) string {
+	relayURL = strings.TrimSuffix(relayURL, "/")
+	if rest, ok := strings.CutPrefix(relayURL, "wss://"); ok {
+		return "https://" + rest
+	}
+	if rest, ok := strings.CutPrefix(relayURL, "ws://"); ok {
+		return "http://" + rest
+	}
+	return relayURL
+}
+
+// loadSecretKey reads the admin key from the given file or the env var and returns it in hex
+func loadSecretKey(nsecFile string) (string, error) {
+	key := os.Getenv(adminNsecEnv)
+	if nsecFile != "" {
+		keyBytes, err := os.ReadFile(nsecFile)
+		if err != nil {
+			return "", err
+		}
+		key = string(keyBytes)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("%w: use -nsec-file or set %s", ErrMissingSecretKey, adminNsecEnv)
+	}
+	if strings.HasPrefix(key, "nsec1") {
+		prefix, value, err := nip19.Decode(key)
+		if err != nil || prefix != "nsec" {
+			return "", fmt.Errorf("%w: failed to decode nsec", ErrInvalidSecretKey)
+		}
+		key = value.(string)
+	}
+	if !nostr.IsValid32ByteHex(key) {
+		return "", fmt.Errorf("%w: must be an nsec or 64 character hex", ErrInvalidSecretKey)
+	}
+	return key, nil
+}
+
+// decodeHex accepts the hex form of a pubkey or event id as well as their NIP-19 forms
+func decodeHex(value string) (string, error) {
+	if nostr.IsValid32ByteHex(value) {
+		return value, nil
+	}
+	prefix, decoded, err := nip19.Decode(value)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither hex nor a valid NIP-19 identifier", value)
+	}
+	switch prefix {
+	case "npub", "note":
+		return decoded.(string), nil
+	case "nprofile":
+		return decoded.(nostr.ProfilePointer).PublicKey, nil
+	case "nevent":
+		return decoded.(nostr.EventPointer).ID, nil
+	}
+	return "", fmt.Errorf("unsupported NIP-19 identifier %s", prefix)
+}
+
+// reason joins the optional reason arguments
+func reason(args []string) string {
+	return strings.Join(args, " ")
+}
+
+// run executes the given command
+func (c *adminClient) run(command string, args []string, w io.Writer) error {
+	switch command {
+	case "ban-pubkey", "unban-pubkey":
+		if len(args) == 0 {
+			return flag.ErrHelp
+		}
+		pubkey, err := decodeHex(args[0])
+		if err != nil {
+			return err
+		}
+		method := "banpubkey"
+		if command == "unban-pubkey" {
+			// allowpubkey adds a pubkey which isn't banned to the allowlist, which would lock out everyone else
+			if err := c.checkBanned(pubkey); err != nil {
+				return err
+			}
+			method = "allowpubkey"
+		}
+		if err := c.call(method, []any{pubkey, reason(args[1:])}, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: done\n", pubkey)
+	case "delete-event":
+		if len(args) == 0 {
+			return flag.ErrHelp
+		}
+		id, err := decodeHex(args[0])
+		if err != nil {
+			return err
+		}
+		if err := c.call("banevent", []any{id, reason(args[1:])}, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: deleted\n", id)
+	case "block-ip", "unblock-ip":
+		if len(args) == 0 {
+			return flag.ErrHelp
+		}
+		method := "blockip"
+		if command == "unblock-ip" {
+			method = "unblockip"
+		}
+		if err := c.call(method, []any{args[0], reason(args[1:])}, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: done\n", args[0])
+	case "list-connections":
+		var infos []websocket.ConnectionInfo
+		if err := c.get("/admin/connections", &infos); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tIP\tCONNECTED\tSUBS\tIN\tOUT\tPUBKEYS\tUSER AGENT")
+		for _, info := range infos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%v\t%s\t%s\n", info.Id, info.RemoteIP, time.Since(info.ConnectedAt).Round(time.Second), info.SubscriptionCount, info.BytesIn, info.BytesOut, strings.Join(info.AuthedPubkeys, ","), info.UserAgent)
+		}
+		return tw.Flush()
+	case "list-bans":
+		var (
+			pubkeys []nip86.PubKeyReason
+			events  []nip86.IDReason
+			ips     []nip86.IPReason
+		)
+		if err := c.call("listbannedpubkeys", nil, &pubkeys); err != nil {
+			return err
+		}
+		if err := c.call("listbannedevents", nil, &events); err != nil {
+			return err
+		}
+		if err := c.call("listblockedips", nil, &ips); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TYPE\tVALUE\tREASON")
+		for _, p := range pubkeys {
+			fmt.Fprintf(tw, "pubkey\t%s\t%s\n", p.PubKey, p.Reason)
+		}
+		for _, e := range events {
+			fmt.Fprintf(tw, "event\t%s\t%s\n", e.ID, e.Reason)
+		}
+		for _, ip := range ips {
+			fmt.Fprintf(tw, "ip\t%s\t%s\n", ip.IP, ip.Reason)
+		}
+		return tw.Flush()
+	case "stats":
+		var stats websocket.Stats
+		if err := c.get("/admin/stats", &stats); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "started at\t%s\n", stats.StartedAt.Format(time.RFC3339))
+		fmt.Fprintf(tw, "uptime\t%s\n", stats.Uptime)
+		fmt.Fprintf(tw, "connections\t%v\n", stats.Connections)
+		fmt.Fprintf(tw, "subscriptions\t%v\n", stats.Subscriptions)
+		fmt.Fprintf(tw, "bytes in\t%v\n", stats.BytesIn)
+		fmt.Fprintf(tw, "bytes out\t%v\n", stats.BytesOut)
+		fmt.Fprintf(tw, "dropped messages\t%v\n", stats.DroppedMessages)
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+	return nil
+}
+
+// checkBanned returns ErrNotBanned unless the given pubkey is banned
+func (c *adminClient) checkBanned(pubkey string) error {
+	var banned []nip86.PubKeyReason
+	if err := c.call("listbannedpubkeys", nil, &banned); err != nil {
+		return err
+	}
+	for _, p := range banned {
+		if p.PubKey == pubkey {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotBanned, pubkey)
+}
+
+// do sends the given request signed with a NIP-98 authorization and returns the response body
+func (c *adminClient) do(method, path, contentType string, body []byte) (*http.Response, []byte, error) {
+	url := c.relayURL + path
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	header, err := nip98.CreateAuthHeader(c.secretKey, url, method, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", header)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	return resp, respBody, err
+}
+
+// call calls a management API method and decodes its result into result, if not nil
+func (c *adminClient) call(method string, params []any, result any) error {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(nip86.Request{Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp, respBody, err := c.do(http.MethodPost, "/", "application/nostr+json+rpc", body)
+	if err != nil {
+		return err
+	}
+	var rpcResp struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
+		return fmt.Errorf("unexpected response from relay (%s): %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if rpcResp.Error != "" {
+		return errors.New(rpcResp.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from relay: %s", resp.Status)
+	}
+	if result == nil || len(rpcResp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(rpcResp.Result, result)
+}
+
+// get fetches an admin endpoint and decodes its JSON response into result
+func (c *adminClient) get(path string, result any) error {
+	resp, respBody, err := c.do(http.MethodGet, path, "", nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from relay (%s): %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return json.Unmarshal(respBody, result)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/TheRebelOfBabylon/tandem/storage/memory"
+	"github.com/TheRebelOfBabylon/tandem/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/rs/zerolog"
+)
+
+var (
+	adminSecretKey = "6b911fd37cdf5c81d4c0adb1ab7fa822ed253ab0ad9aa18d77257c88b29b718e"
+	testPubkey     = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+)
+
+// startAdminRelay serves the management API and admin endpoints of a websocket server administered by adminSecretKey, it is stopped when the test ends
+func startAdminRelay(t *testing.T) (*httptest.Server, *moderation.Store) {
+	adminPubkey, _ := nostr.GetPublicKey(adminSecretKey)
+	cfg := config.HTTP{
+		WriteQueueSize:     16,
+		SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+		WriteWait:          time.Second,
+		ShutdownTimeout:    time.Second,
+		MaxMessageSize:     4096,
+		AdminPubkeys:       []string{adminPubkey},
+	}
+	repo, _ := memory.NewModerationRepository("")
+	store, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation store: %v", err)
+	}
+	wsServer := websocket.NewWebsocketServer(cfg, zerolog.Nop(), make(chan msg.Msg), make(chan msg.Msg)).(*websocket.WebsocketServer)
+	wsServer.SetModeration(store)
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	t.Cleanup(func() {
+		srvr.Close()
+		wsServer.Stop()
+	})
+	return srvr, store
+}
+
+// TestAdminUnbanPubkey ensures unban-pubkey lifts a ban and refuses pubkeys which aren't banned instead of adding them to the allowlist
+func TestAdminUnbanPubkey(t *testing.T) {
+	srvr, store := startAdminRelay(t)
+	client := &adminClient{relayURL: srvr.URL, secretKey: adminSecretKey, httpClient: srvr.Client()}
+	var out bytes.Buffer
+	if err := client.run("unban-pubkey", []string{testPubkey}, &out); !errors.Is(err, ErrNotBanned) {
+		t.Errorf("unexpected error when unbanning a pubkey which isn't banned: %v", err)
+	}
+	if allowed := store.AllowedPubkeys(); len(allowed) != 0 {
+		t.Errorf("expected allowlist to stay empty, got %v", allowed)
+	}
+	if err := client.run("ban-pubkey", []string{testPubkey, "spam"}, &out); err != nil {
+		t.Fatalf("unexpected error when banning pubkey: %v", err)
+	}
+	if err := client.run("unban-pubkey", []string{testPubkey}, &out); err != nil {
+		t.Fatalf("unexpected error when unbanning pubkey: %v", err)
+	}
+	if banned, allowed := store.BannedPubkeys(), store.AllowedPubkeys(); len(banned) != 0 || len(allowed) != 0 {
+		t.Errorf("unexpected moderation state after unbanning: banned %v, allowed %v", banned, allowed)
+	}
+}
+
+type decodeHexTestCase struct {
+	name     string
+	value    string
+	expected string
+	err      bool
+}
+
+var (
+	testEventId        = "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+	adminNsec, _       = nip19.EncodePrivateKey(adminSecretKey)
+	testNpub, _        = nip19.EncodePublicKey(testPubkey)
+	testNprofile, _    = nip19.EncodeProfile(testPubkey, []string{"wss://relay.example.com"})
+	testNote, _        = nip19.EncodeNote(testEventId)
+	testNevent, _      = nip19.EncodeEvent(testEventId, nil, "")
+	decodeHexTestCases = []decodeHexTestCase{
+		{name: "HexPubkey", value: testPubkey, expected: testPubkey},
+		{name: "Npub", value: testNpub, expected: testPubkey},
+		{name: "Nprofile", value: testNprofile, expected: testPubkey},
+		{name: "Note", value: testNote, expected: testEventId},
+		{name: "Nevent", value: testNevent, expected: testEventId},
+		{name: "Nsec", value: adminNsec, err: true},
+		{name: "Invalid", value: "not a pubkey", err: true},
+		{name: "ShortHex", value: testPubkey[:62], err: true},
+	}
+)
+
+// TestDecodeHex ensures pubkeys and event ids are accepted in hex and in their NIP-19 forms
+func TestDecodeHex(t *testing.T) {
+	for _, testCase := range decodeHexTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		decoded, err := decodeHex(testCase.value)
+		if (err != nil) != testCase.err {
+			t.Errorf("unexpected error for test case %s: %v", testCase.name, err)
+		}
+		if decoded != testCase.expected {
+			t.Errorf("unexpected value for test case %s: expected %s, got %s", testCase.name, testCase.expected, decoded)
+		}
+	}
+}
+
+type loadSecretKeyTestCase struct {
+	name        string
+	env         string
+	file        string
+	expectedErr error
+}
+
+var loadSecretKeyTestCases = []loadSecretKeyTestCase{
+	{name: "HexEnv", env: adminSecretKey},
+	{name: "NsecEnv", env: adminNsec},
+	{name: "NsecFile", file: adminNsec + "\n"},
+	{name: "FileOverridesEnv", env: "invalid", file: adminSecretKey},
+	{name: "Missing", expectedErr: ErrMissingSecretKey},
+	{name: "InvalidHex", env: "abcd", expectedErr: ErrInvalidSecretKey},
+	{name: "InvalidNsec", env: "nsec1invalid", expectedErr: ErrInvalidSecretKey},
+}
+
+// TestLoadSecretKey ensures the admin key is read from the file or the env var, as an nsec or in hex
+func TestLoadSecretKey(t *testing.T) {
+	for _, testCase := range loadSecretKeyTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		t.Setenv(adminNsecEnv, testCase.env)
+		nsecFile := ""
+		if testCase.file != "" {
+			nsecFile = filepath.Join(t.TempDir(), "admin.nsec")
+			if err := os.WriteFile(nsecFile, []byte(testCase.file), 0600); err != nil {
+				t.Fatalf("unexpected error when writing key file: %v", err)
+			}
+		}
+		key, err := loadSecretKey(nsecFile)
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("unexpected error for test case %s: expected %v, got %v", testCase.name, testCase.expectedErr, err)
+		}
+		if err == nil && key != adminSecretKey {
+			t.Errorf("unexpected key for test case %s: %s", testCase.name, key)
+		}
+	}
+	if _, err := loadSecretKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for a missing key file")
+	}
+}
+
+// TestHTTPURL ensures websocket relay urls are converted to the url of their HTTP endpoints
+func TestHTTPURL(t *testing.T) {
+	for relayURL, expected := range map[string]string{
+		"wss://relay.example.com/":  "https://relay.example.com",
+		"ws://localhost:5000":       "http://localhost:5000",
+		"https://relay.example.com": "https://relay.example.com",
+		"http://localhost:5000/":    "http://localhost:5000",
+	} {
+		if got := httpURL(relayURL); got != expected {
+			t.Errorf("unexpected url for %s: expected %s, got %s", relayURL, expected, got)
+		}
+	}
+}
+
+// TestAdminAuthHeader ensures every request is signed with a NIP-98 authorization matching its url, method and body
+func TestAdminAuthHeader(t *testing.T) {
+	adminPubkey, _ := nostr.GetPublicKey(adminSecretKey)
+	replays := nip98.NewReplayCache()
+	var requests []string
+	srvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pubkey, err := nip98.ValidateRequest(r, body, time.Now(), replays)
+		if err != nil || pubkey != adminPubkey {
+			t.Errorf("unexpected authorization for %s %s: pubkey %s, error %v", r.Method, r.URL, pubkey, err)
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+		if r.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(websocket.Stats{Uptime: "1s"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"result": []any{}})
+	}))
+	defer srvr.Close()
+	client := &adminClient{relayURL: srvr.URL, secretKey: adminSecretKey, httpClient: srvr.Client()}
+	var out bytes.Buffer
+	for _, command := range [][]string{{"stats"}, {"list-bans"}} {
+		if err := client.run(command[0], command[1:], &out); err != nil {
+			t.Fatalf("unexpected error for command %s: %v", command[0], err)
+		}
+	}
+	expected := []string{
+		"GET /admin/stats ",
+		"POST / application/nostr+json+rpc",
+		"POST / application/nostr+json+rpc",
+		"POST / application/nostr+json+rpc",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected requests: expected %q, got %q", expected, requests)
+	}
+}
+
+type adminCommandTestCase struct {
+	name             string
+	args             []string
+	expectedCode     int
+	expectedOutput   string
+	expectedErrorOut string
+}
+
+var adminCommandTestCases = []adminCommandTestCase{
+	{name: "NoCommand", expectedCode: 2, expectedErrorOut: "usage: tandem admin"},
+	{name: "MissingArgument", args: []string{"ban-pubkey"}, expectedCode: 2, expectedErrorOut: "usage: tandem admin"},
+	{name: "UnknownCommand", args: []string{"frobnicate"}, expectedCode: 1, expectedErrorOut: "unknown command frobnicate"},
+	{name: "InvalidPubkey", args: []string{"ban-pubkey", "nobody"}, expectedCode: 1, expectedErrorOut: "neither hex nor a valid NIP-19 identifier"},
+	{name: "BanPubkey", args: []string{"ban-pubkey", testPubkey, "spam"}, expectedOutput: testPubkey + ": done"},
+	{name: "DeleteEvent", args: []string{"delete-event", testEventId, "illegal"}, expectedOutput: testEventId + ": deleted"},
+	{name: "BlockIP", args: []string{"block-ip", "203.0.113.7", "abuse"}, expectedOutput: "203.0.113.7: done"},
+	{name: "ListBans", args: []string{"list-bans"}, expectedOutput: "pubkey  " + testPubkey + "  spam"},
+	{name: "UnblockIP", args: []string{"unblock-ip", "203.0.113.7"}, expectedOutput: "203.0.113.7: done"},
+	{name: "UnbanPubkey", args: []string{"unban-pubkey", testPubkey}, expectedOutput: testPubkey + ": done"},
+	{name: "UnbanPubkeyNotBanned", args: []string{"unban-pubkey", testPubkey}, expectedCode: 1, expectedErrorOut: "pubkey is not banned"},
+	{name: "ListConnections", args: []string{"list-connections"}, expectedOutput: "ID  IP  CONNECTED"},
+	{name: "Stats", args: []string{"stats"}, expectedOutput: "connections       0"},
+}
+
+// TestAdminCommands ensures the admin commands change the moderation state of a relay and report errors with the right exit code
+func TestAdminCommands(t *testing.T) {
+	srvr, _ := startAdminRelay(t)
+	t.Setenv(adminNsecEnv, adminNsec)
+	for _, testCase := range adminCommandTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		var stdout, stderr bytes.Buffer
+		code := runAdminCommand(append([]string{"-relay", "ws" + strings.TrimPrefix(srvr.URL, "http")}, testCase.args...), &stdout, &stderr)
+		if code != testCase.expectedCode {
+			t.Errorf("unexpected exit code for test case %s: expected %v, got %v (%s)", testCase.name, testCase.expectedCode, code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), testCase.expectedOutput) {
+			t.Errorf("unexpected output for test case %s: expected %q in %q", testCase.name, testCase.expectedOutput, stdout.String())
+		}
+		if !strings.Contains(stderr.String(), testCase.expectedErrorOut) {
+			t.Errorf("unexpected error output for test case %s: expected %q in %q", testCase.name, testCase.expectedErrorOut, stderr.String())
+		}
+	}
+	// requests signed by another key are refused
+	t.Setenv(adminNsecEnv, nostr.GeneratePrivateKey())
+	var stdout, stderr bytes.Buffer
+	if code := runAdminCommand([]string{"-relay", srvr.URL, "list-bans"}, &stdout, &stderr); code != 1 || !strings.Contains(stderr.String(), "pubkey is not an admin of this relay") {
+		t.Errorf("unexpected result for a non-admin key: exit code %v, %s", code, stderr.String())
+	}
+}
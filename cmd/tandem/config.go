@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/BurntSushi/toml"
+	"github.com/TheRebelOfBabylon/tandem/config"
+)
+
+// runConfigCommand runs the config subcommands and returns the process exit code
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(stderr, "usage: tandem config check [-config <path_to_toml_file>]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("config", *cfgFilePath, "path to the TOML config file")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	return runConfigCheck(*path, stdout)
+}
+
+// runConfigCheck validates the config file and prints every problem along with the effective configuration (file, env var overrides and defaults) with secrets redacted
+func runConfigCheck(path string, w io.Writer) int {
+	fmt.Fprintf(w, "checking configuration file %s...\n", path)
+	cfg, err := config.ReadConfig(path)
+	if err != nil {
+		fmt.Fprintf(w, "failed to read config file: %v\n", err)
+		return 1
+	}
+	exitCode := 0
+	err = cfg.Validate()
+	var validationErrs config.ValidationErrors
+	switch {
+	case errors.As(err, &validationErrs):
+		fmt.Fprintf(w, "found %v problem(s):\n", len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			fmt.Fprintf(w, "  - %v\n", fieldErr)
+		}
+		exitCode = 1
+	case err != nil:
+		fmt.Fprintf(w, "invalid configuration: %v\n", err)
+		exitCode = 1
+	default:
+		fmt.Fprintln(w, "configuration is valid")
+	}
+	fmt.Fprintln(w, "\neffective configuration (secrets redacted):")
+	if err := toml.NewEncoder(w).Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(w, "failed to encode configuration: %v\n", err)
+		return 1
+	}
+	return exitCode
+}
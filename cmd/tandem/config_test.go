@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type configCheckTestCase struct {
+	name             string
+	config           string
+	expectedCode     int
+	expectedOutput   []string
+	unexpectedOutput []string
+}
+
+var (
+	testAdminToken       = "supersecrettoken"
+	testRelaySecretKey   = "5ee1c8000ab28edd64d74a7d951ac2dd559814887b1b9e1ac7c5f89e96125c12"
+	configCheckTestCases = []configCheckTestCase{
+		{
+			name: "Valid",
+			config: `[storage]
+uri="memory://"
+[http]
+admin_token="` + testAdminToken + `"
+[relay]
+secret_key="` + testRelaySecretKey + `"
+`,
+			expectedOutput:   []string{"configuration is valid", "effective configuration (secrets redacted)", `admin_token = "REDACTED"`, `secret_key = "REDACTED"`, `write_queue_size = 256`},
+			unexpectedOutput: []string{testAdminToken, testRelaySecretKey},
+		},
+		{
+			name: "Invalid",
+			config: `[storage]
+uri="memory://"
+[http]
+admin_token="` + testAdminToken + `"
+slow_consumer_policy="drop"
+[log]
+level="debg"
+`,
+			expectedCode:     1,
+			expectedOutput:   []string{"found 2 problem(s)", "log.level", "http.slow_consumer_policy", `admin_token = "REDACTED"`},
+			unexpectedOutput: []string{"configuration is valid", testAdminToken},
+		},
+		{
+			name: "UnknownKey",
+			config: `[storage]
+uri="memory://"
+[http]
+prot=5000
+`,
+			expectedCode:     1,
+			expectedOutput:   []string{"found 1 problem(s)", "http.prot", "http.port"},
+			unexpectedOutput: []string{"configuration is valid"},
+		},
+		{
+			name:             "Malformed",
+			config:           `[storage`,
+			expectedCode:     1,
+			expectedOutput:   []string{"failed to read config file"},
+			unexpectedOutput: []string{"effective configuration"},
+		},
+	}
+)
+
+// TestConfigCheck ensures config check reports every problem with a non zero exit code and prints the effective configuration without its secrets
+func TestConfigCheck(t *testing.T) {
+	for _, testCase := range configCheckTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		path := filepath.Join(t.TempDir(), "tandem.toml")
+		if err := os.WriteFile(path, []byte(testCase.config), 0600); err != nil {
+			t.Fatalf("unexpected error when writing config file: %v", err)
+		}
+		var out bytes.Buffer
+		if code := runConfigCheck(path, &out); code != testCase.expectedCode {
+			t.Errorf("unexpected exit code for test case %s: expected %v, got %v", testCase.name, testCase.expectedCode, code)
+		}
+		for _, expected := range testCase.expectedOutput {
+			if !strings.Contains(out.String(), expected) {
+				t.Errorf("expected %q in the output of test case %s: %s", expected, testCase.name, out.String())
+			}
+		}
+		for _, unexpected := range testCase.unexpectedOutput {
+			if strings.Contains(out.String(), unexpected) {
+				t.Errorf("unexpected %q in the output of test case %s: %s", unexpected, testCase.name, out.String())
+			}
+		}
+	}
+}
+
+// TestConfigCommand ensures the config command parses its arguments and reports missing files
+func TestConfigCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runConfigCommand(nil, &stdout, &stderr); code != 2 || !strings.Contains(stderr.String(), "usage: tandem config check") {
+		t.Errorf("unexpected result without a subcommand: exit code %v, %s", code, stderr.String())
+	}
+	stderr.Reset()
+	if code := runConfigCommand([]string{"check", "-unknown"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unexpected exit code for an unknown flag: %v", code)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.toml")
+	if code := runConfigCommand([]string{"check", "-config", missing}, &stdout, &stderr); code != 1 || !strings.Contains(stdout.String(), "failed to read config file") {
+		t.Errorf("unexpected result for a missing config file: exit code %v, %s", code, stdout.String())
+	}
+}
@@ -1,41 +1,42 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"slices"
+	"fmt"
+	"os"
 	"strings"
 
+	"github.com/TheRebelOfBabylon/tandem"
 	"github.com/TheRebelOfBabylon/tandem/config"
-	"github.com/TheRebelOfBabylon/tandem/filter"
-	"github.com/TheRebelOfBabylon/tandem/ingester"
 	"github.com/TheRebelOfBabylon/tandem/logging"
 	"github.com/TheRebelOfBabylon/tandem/signal"
-	"github.com/TheRebelOfBabylon/tandem/storage"
-	"github.com/TheRebelOfBabylon/tandem/websocket"
+	"github.com/rs/zerolog"
 )
 
-type Module interface {
-	Start() error
-	Stop() error
-}
-
 var (
 	cfgFilePath = flag.String("config", "tandem.toml", "path to the TOML config file")
-	modules     = []Module{}
-	stopModules = func(logger logging.Logger) {
-		slices.Reverse(modules) // we shut down in reverse order
-		for _, m := range modules {
-			if err := m.Stop(); err != nil {
-				logger.Fatal().Err(err).Msg("failed to safely shutdown")
-			}
+	// reloadConfig re-reads the config file and applies reloadable settings. The running config is kept if the new one is invalid
+	reloadConfig = func(relay *tandem.Relay, logger logging.Logger) {
+		logger.Info().Msgf("reloading configuration file %s...", *cfgFilePath)
+		newCfg, err := config.ReadConfig(*cfgFilePath)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to read config file, keeping the running configuration")
+			return
 		}
-	}
-	startModules = func(logger logging.Logger) {
-		for _, m := range modules {
-			if err := m.Start(); err != nil {
-				logger.Fatal().Err(err).Msg("failed to start modules")
-			}
+		if err := newCfg.Validate(); err != nil {
+			logger.Error().Err(err).Msg("failed to validate config, keeping the running configuration")
+			return
+		}
+		if err := relay.Reload(newCfg); err != nil {
+			logger.Error().Err(err).Msg("failed to reload module")
 		}
+		cfg := relay.Config()
+		if err := logger.SetLevels(cfg.Log.Level, cfg.Log.Modules); err != nil {
+			logger.Error().Err(err).Msg("failed to set log levels")
+		}
+		logger.Info().Msgf("configuration reloaded, using log level %s", strings.ToUpper(cfg.Log.Level))
 	}
 )
 
@@ -43,7 +44,21 @@ func main() {
 	// parse command line flags
 	flag.Parse()
 
-	// initialize logging
+	// run subcommands
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "config":
+			os.Exit(runConfigCommand(args[1:], os.Stdout, os.Stderr))
+		case "admin":
+			os.Exit(runAdminCommand(args[1:], os.Stdout, os.Stderr))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %s\n", args[0])
+			os.Exit(2)
+		}
+	}
+
+	// initialize logging, the log levels of the relay are set on its logger so the global level lets everything through
+	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	logger := logging.NewLogger()
 
 	// read and validate config
@@ -54,54 +69,50 @@ func main() {
 	}
 	logger.Info().Msg("validating configuration file...")
 	if err := cfg.Validate(); err != nil {
-		logger.Fatal().Err(err).Msg("failed to validate config")
+		var validationErrs config.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			for _, fieldErr := range validationErrs {
+				logger.Error().Str("field", fieldErr.Field).Msg(fieldErr.Error())
+			}
+		}
+		logger.Fatal().Err(err).Msgf("failed to validate config, run `tandem -config %s config check` for details", *cfgFilePath)
 	}
 
 	// configure Logging
 	logger, err = logger.Configure(cfg.Log)
 	if err != nil {
-		logger.Warn().Err(err).Msg("failed to set log level")
+		logger.Warn().Err(err).Msg("failed to configure logging")
+	}
+	logger.Info().Msgf("using log level %s", strings.ToUpper(cfg.Log.Level))
+	for module, lvl := range cfg.Log.Modules {
+		logger.Info().Msgf("using log level %s for module %s", strings.ToUpper(lvl), module)
 	}
-	logger.Info().Msgf("using log level %s", strings.ToUpper(logger.GetLevel().String()))
 
 	// initialize signal handler
-	interruptHandler := signal.NewInterruptHandler(logger.With().Str("module", "interruptHandler").Logger())
-
-	// initialize ingester
-	logger.Info().Msg("initializing ingester...")
-	ingest := ingester.NewIngester(logger.With().Str("module", "ingester").Logger())
-	modules = append(modules, ingest)
+	interruptHandler := signal.NewInterruptHandler(logger.Module("interruptHandler"))
 
-	// initialize connection to storage backend
-	logger.Info().Msg("initializing connection to storage backend...")
-	storageBackend, err := storage.Connect(cfg.Storage, logger.With().Str("module", "storageBackend").Logger(), ingest.SendToDBChannel())
+	// assemble and start the relay
+	relay, err := tandem.New(tandem.WithConfig(cfg), tandem.WithLogger(logger))
 	if err != nil {
-		logger.Fatal().Err(err).Msg("failed to connect to storage backend")
+		logger.Fatal().Err(err).Msg("failed to initialize relay")
+	}
+	if err := relay.Start(context.Background()); err != nil {
+		logger.Fatal().Err(err).Msg("failed to start relay")
 	}
-	modules = append(modules, storageBackend)
-	ingest.SetQueryFunc(storageBackend.Store.QueryEvents)
-
-	// initialize filter manager
-	logger.Info().Msg("initializing filter manager...")
-	filterManager := filter.NewFilterManager(ingest.SendToFilterManager(), storageBackend, logger.With().Str("module", "filterManager").Logger())
-	modules = append(modules, filterManager)
-
-	// initialize websocket handler
-	logger.Info().Msg("initializing websocket server...")
-	wsHandler := websocket.NewWebsocketServer(cfg.HTTP, logger.With().Str("module", "websocketServer").Logger(), ingest.SendToWSHandlerChannel(), filterManager.SendChannel())
-	modules = append(modules, wsHandler)
-
-	// ingester and websocket handler now communicating bi-directionally
-	ingest.SetRecvChannel(wsHandler.SendChannel())
-
-	// start modules
-	logger.Info().Msg("starting modules...")
-	startModules(logger)
 
-	// hang until we shutdown
-	<-interruptHandler.ShutdownDoneChannel()
+	// hang until we shutdown, reloading the configuration on SIGHUP
+loop:
+	for {
+		select {
+		case <-interruptHandler.ReloadChannel():
+			reloadConfig(relay, logger)
+		case <-interruptHandler.ShutdownDoneChannel():
+			break loop
+		}
+	}
 
-	// shutdown
-	stopModules(logger)
-	logger.Info().Msg("shutdown complete")
+	// shutdown, the websocket server gives clients until http.shutdown_timeout to disconnect
+	if err := relay.Stop(context.Background()); err != nil {
+		logger.Fatal().Err(err).Msg("failed to safely shutdown")
+	}
 }
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"reflect"
+)
+
+type restartOnlySetting struct {
+	name  string
+	field func(c *Config) any
+}
+
+// restartOnlySettings are the settings which are only read when the relay starts. Every setting not listed here is applied live on reload
+var restartOnlySettings = []restartOnlySetting{
+	{name: "http.host", field: func(c *Config) any { return &c.HTTP.Host }},
+	{name: "http.port", field: func(c *Config) any { return &c.HTTP.Port }},
+	{name: "http.read_buffer_size", field: func(c *Config) any { return &c.HTTP.ReadBufferSize }},
+	{name: "http.write_buffer_size", field: func(c *Config) any { return &c.HTTP.WriteBufferSize }},
+	{name: "http.compression", field: func(c *Config) any { return &c.HTTP.Compression }},
+	{name: "http.tls", field: func(c *Config) any { return &c.HTTP.TLS }},
+	{name: "http.proxy_protocol", field: func(c *Config) any { return &c.HTTP.ProxyProtocol }},
+	{name: "log.format", field: func(c *Config) any { return &c.Log.Format }},
+	{name: "log.log_file_path", field: func(c *Config) any { return &c.Log.LogFilePath }},
+	{name: "log.max_size", field: func(c *Config) any { return &c.Log.MaxSize }},
+	{name: "log.max_age", field: func(c *Config) any { return &c.Log.MaxAge }},
+	{name: "log.max_backups", field: func(c *Config) any { return &c.Log.MaxBackups }},
+	{name: "access_log", field: func(c *Config) any { return &c.AccessLog }},
+	{name: "moderation.state_path", field: func(c *Config) any { return &c.Moderation.StatePath }},
+	{name: "storage", field: func(c *Config) any { return &c.Storage }},
+	{name: "relay.secret_key", field: func(c *Config) any { return &c.Relay.SecretKey }},
+	{name: "groups", field: func(c *Config) any { return &c.Groups }},
+	{name: "negentropy", field: func(c *Config) any { return &c.Negentropy }},
+	{name: "replication", field: func(c *Config) any { return &c.Replication }},
+	{name: "webhooks", field: func(c *Config) any { return &c.Webhooks }},
+}
+
+// MergeReload merges a freshly read and validated configuration into the running one. Settings which require a restart keep their running value and are reported by name
+func (c *Config) MergeReload(newCfg *Config) (*Config, []string) {
+	merged := *newCfg
+	var restartRequired []string
+	for _, setting := range restartOnlySettings {
+		current, next := reflect.ValueOf(setting.field(c)).Elem(), reflect.ValueOf(setting.field(&merged)).Elem()
+		if !reflect.DeepEqual(current.Interface(), next.Interface()) {
+			restartRequired = append(restartRequired, setting.name)
+			next.Set(current)
+		}
+	}
+	return &merged, restartRequired
+}
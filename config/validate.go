@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	redacted = "REDACTED"
+)
+
+// FieldError is a single configuration problem
+type FieldError struct {
+	Field      string
+	Err        error
+	Detail     string
+	Suggestion string
+}
+
+// Error formats the problem as "field: error: detail (suggestion)"
+func (e *FieldError) Error() string {
+	msg := fmt.Sprintf("%s: %v", e.Field, e.Err)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Suggestion != "" {
+		msg += " (" + e.Suggestion + ")"
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is to match the sentinel error
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is the list of every problem found in a configuration
+type ValidationErrors []*FieldError
+
+// add records a new problem
+func (v *ValidationErrors) add(field string, err error, detail, suggestion string) {
+	*v = append(*v, &FieldError{Field: field, Err: err, Detail: detail, Suggestion: suggestion})
+}
+
+// sort orders the problems by field so reports are stable
+func (v ValidationErrors) sort() {
+	sort.SliceStable(v, func(i, j int) bool {
+		return v[i].Field < v[j].Field
+	})
+}
+
+// Error joins every problem on a single line
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, err := range v {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap allows errors.Is and errors.As to match any of the problems
+func (v ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(v))
+	for i, err := range v {
+		errs[i] = err
+	}
+	return errs
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggest returns a "did you mean" hint for the candidate closest to the given value, or lists the candidates if none is close
+func suggest(value string, candidates []string) string {
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		if d := levenshtein(strings.ToLower(value), candidate); bestDistance < 0 || d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best != "" && bestDistance <= max(2, len(value)/3) {
+		return fmt.Sprintf("did you mean %q?", best)
+	}
+	if len(candidates) > 10 {
+		return ""
+	}
+	return "must be one of " + strings.Join(candidates, "|")
+}
+
+// pubkeySuggestion hints at the most common mistake when entering a pubkey
+func pubkeySuggestion(pubkey string) string {
+	if strings.HasPrefix(pubkey, "npub1") {
+		return "use the 64 character hex form of the pubkey instead of the npub"
+	}
+	return "must be a 64 character hex pubkey"
+}
+
+// knownKeys lists the dotted path of every setting which can be set in the config file
+func knownKeys() []string {
+	var keys []string
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("toml")
+			if !field.IsExported() || tag == "" {
+				continue
+			}
+			key := prefix + tag
+			if field.Type.Kind() == reflect.Struct && field.Type.PkgPath() == t.PkgPath() {
+				walk(field.Type, key+".")
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	walk(reflect.TypeOf(Config{}), "")
+	return keys
+}
+
+// redactURI hides the password of a URI
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.User == nil {
+		return uri
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// Redacted returns a copy of the configuration with secrets hidden so it can be printed
+func (c Config) Redacted() Config {
+	c.Storage.Uri = redactURI(c.Storage.Uri)
+	if c.HTTP.AdminToken != "" {
+		c.HTTP.AdminToken = redacted
+	}
+	if c.Relay.SecretKey != "" {
+		c.Relay.SecretKey = redacted
+	}
+	// the endpoints are copied so the secrets of the original configuration are kept
+	endpoints := make([]Endpoint, 0, len(c.Webhooks.Endpoints))
+	for _, endpoint := range c.Webhooks.Endpoints {
+		if endpoint.Secret != "" {
+			endpoint.Secret = redacted
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	c.Webhooks.Endpoints = endpoints
+	return c
+}
@@ -7,9 +7,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/accesslog"
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/groups"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
 	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/search"
 	"github.com/TheRebelOfBabylon/tandem/storage"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
 	"github.com/rs/zerolog"
 )
 
@@ -24,7 +31,18 @@ type FilterManager struct {
 	filters          map[string][]*nostr.ReqEnvelope
 	dbConn           *storage.StorageBackend
 	logger           zerolog.Logger
-	stopping         bool
+	accessLog        *accesslog.Logger
+	groups           *groups.Manager
+	moderation       *moderation.Store
+	searcher         *search.Searcher
+	authedPubkeys    func(connectionId string) []string
+	negentropy       config.Negentropy
+	bus              *bus.Bus
+	// negSessions holds the NIP-77 sessions of each connection by subscription id, only the manage routine uses them
+	negSessions map[string]map[string]*negentropySession
+	// negResults receives the sessions opened by negentropy workers
+	negResults chan negentropyResult
+	stopping   bool
 	sync.WaitGroup
 	sync.RWMutex
 }
@@ -33,6 +51,8 @@ type FilterManager struct {
 func NewFilterManager(recvFromIngester chan msg.ParsedMsg, dbConn *storage.StorageBackend, logger zerolog.Logger) *FilterManager {
 	return &FilterManager{
 		filters:          make(map[string][]*nostr.ReqEnvelope),
+		negSessions:      make(map[string]map[string]*negentropySession),
+		negResults:       make(chan negentropyResult),
 		recvFromIngester: recvFromIngester,
 		sendToWSHandler:  make(chan msg.Msg),
 		quit:             make(chan struct{}),
@@ -42,6 +62,36 @@ func NewFilterManager(recvFromIngester chan msg.ParsedMsg, dbConn *storage.Stora
 	}
 }
 
+// SetAccessLog stores the access log to which REQ and CLOSE messages are written
+func (f *FilterManager) SetAccessLog(accessLog *accesslog.Logger) {
+	f.accessLog = accessLog
+}
+
+// SetGroups stores the group manager deciding which group events a connection may read
+func (f *FilterManager) SetGroups(manager *groups.Manager) {
+	f.groups = manager
+}
+
+// SetModeration stores the moderation state hiding reported events and the events of shadow banned pubkeys
+func (f *FilterManager) SetModeration(store *moderation.Store) {
+	f.moderation = store
+}
+
+// SetSearcher stores the searcher answering NIP-50 search filters
+func (f *FilterManager) SetSearcher(searcher *search.Searcher) {
+	f.searcher = searcher
+}
+
+// SetBus stores the bus on which opened and closed subscriptions are published
+func (f *FilterManager) SetBus(b *bus.Bus) {
+	f.bus = b
+}
+
+// SetAuthedPubkeysFunc stores the function returning the pubkeys a connection authenticated as
+func (f *FilterManager) SetAuthedPubkeysFunc(authedPubkeys func(connectionId string) []string) {
+	f.authedPubkeys = authedPubkeys
+}
+
 // Start will start the filter manager
 func (f *FilterManager) Start() error {
 	f.logger.Info().Msg("starting up...")
@@ -67,29 +117,47 @@ func (f *FilterManager) contains(connectionId, subscriptionId string) bool {
 	return false
 }
 
-// endSubscription is called when we receive a CLOSE message from a client for a given subscription
+// SubscriptionCount returns the number of active subscriptions held by the given connectionId
+func (f *FilterManager) SubscriptionCount(connectionId string) int {
+	f.RLock()
+	defer f.RUnlock()
+	return len(f.filters[connectionId])
+}
+
+// endSubscription is called when we receive a CLOSE message from a client for a given subscription. The closed subscription is published on the bus
 func (f *FilterManager) endSubscription(connectionId, subscriptionId string) {
 	f.Lock()
-	defer f.Unlock()
 	filters, ok := f.filters[connectionId]
 	if !ok {
+		f.Unlock()
 		return
 	}
 	newFilters := []*nostr.ReqEnvelope{}
+	var closed *nostr.ReqEnvelope
 	for _, filter := range filters {
 		if filter.SubscriptionID == subscriptionId {
+			closed = filter
 			continue
 		}
 		newFilters = append(newFilters, filter)
 	}
 	f.filters[connectionId] = newFilters
+	f.Unlock()
+	if closed != nil {
+		bus.Publish(f.bus, bus.SubscriptionClosed, bus.Subscription{ConnectionId: connectionId, SubscriptionId: closed.SubscriptionID, Filters: closed.Filters})
+	}
 }
 
-// endConnection removes a given connectionId from the map
+// endConnection removes a given connectionId from the map and publishes the subscriptions it ended
 func (f *FilterManager) endConnection(connectionId string) {
 	f.Lock()
-	defer f.Unlock()
+	subscriptions := f.filters[connectionId]
 	delete(f.filters, connectionId)
+	delete(f.negSessions, connectionId)
+	f.Unlock()
+	for _, subscription := range subscriptions {
+		bus.Publish(f.bus, bus.SubscriptionClosed, bus.Subscription{ConnectionId: connectionId, SubscriptionId: subscription.SubscriptionID, Filters: subscription.Filters})
+	}
 }
 
 // addSubscription appends a filter to the given list of filters for a given connectionId
@@ -113,7 +181,7 @@ func (f *FilterManager) addSubscription(connectionId string, subscription *nostr
 	f.filters[connectionId] = filters
 }
 
-// matchAndSend is run as a goroutine. It will iterate over all filters for each connection Id and send the event to the Websocket handler as soon as there's a match
+// matchAndSend is run as a goroutine. It will iterate over all subscriptions of each connection Id and send the event to the Websocket handler, labeled with the subscription id, for every subscription it matches
 func (f *FilterManager) matchAndSend(event *nostr.EventEnvelope, sendChan chan msg.Msg) {
 	defer f.Done()
 	f.RLock()
@@ -122,19 +190,34 @@ func (f *FilterManager) matchAndSend(event *nostr.EventEnvelope, sendChan chan m
 		f.logger.Warn().Msg("unable to send events, filterManager currently stopping")
 		return
 	}
-	eventBytes, err := event.MarshalJSON()
-	if err != nil {
-		f.logger.Panic().Err(err).Msg("failed to JSON encode event")
-	}
 	for connectionId, filters := range f.filters {
-	innerLoop:
 		for _, filter := range filters {
-			if filter.Match(&event.Event) {
-				sendChan <- msg.Msg{ConnectionId: connectionId, Data: eventBytes}
-				break innerLoop // break as soon as we have a match to not accidentally send the same client the same event multiple times
+			if !f.matches(filter, &event.Event) {
+				continue
+			}
+			if !f.canRead(connectionId, &event.Event) {
+				break
+			}
+			eventBytes, err := nostr.EventEnvelope{SubscriptionID: &filter.SubscriptionID, Event: event.Event}.MarshalJSON()
+			if err != nil {
+				f.logger.Panic().Err(err).Msg("failed to JSON encode event")
 			}
+			sendChan <- msg.Msg{ConnectionId: connectionId, Data: eventBytes, Live: true}
+		}
+	}
+}
+
+// matches checks if an event matches any filter of a subscription, the text and extensions of search filters included
+func (f *FilterManager) matches(subscription *nostr.ReqEnvelope, event *nostr.Event) bool {
+	for _, filter := range subscription.Filters {
+		if !filter.Matches(event) {
+			continue
+		}
+		if filter.Search == "" || f.searcher == nil || f.searcher.Matches(context.TODO(), filter.Search, event) {
+			return true
 		}
 	}
+	return false
 }
 
 // manage is the main go routine to receive messages from the ingester
@@ -169,14 +252,20 @@ loop:
 				go f.matchAndSend(envelope, f.sendToWSHandler)
 			case *nostr.ReqEnvelope:
 				// perform db query
-				f.logger.Debug().Msgf("received from ingester: %v", envelope)
+				f.logger.Trace().Msgf("received from ingester: %v", envelope)
+				start := time.Now()
+				resultCount := 0
 			filterLoop:
 				for _, filter := range envelope.Filters {
 					// skip querying for stored events if limit is 0
 					if filter.LimitZero {
 						continue filterLoop
 					}
-					rcvChan, err := f.dbConn.Store.QueryEvents(context.TODO(), filter)
+					queryFunc := f.dbConn.Store.QueryEvents
+					if filter.Search != "" && f.searcher != nil {
+						queryFunc = f.searcher.QueryEvents
+					}
+					rcvChan, err := queryFunc(context.TODO(), filter)
 					if err != nil {
 						f.logger.Error().Err(err).Msg("failed to query database for events")
 						continue
@@ -190,6 +279,9 @@ loop:
 							if !ok || event == nil {
 								break innerLoop
 							}
+							if !f.canRead(message.ConnectionId, event) {
+								continue innerLoop
+							}
 							eventEnv := nostr.EventEnvelope{SubscriptionID: &envelope.SubscriptionID, Event: *event}
 							eventBytes, err := eventEnv.MarshalJSON()
 							if err != nil {
@@ -197,6 +289,7 @@ loop:
 							}
 							f.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("sending to websocket server: %v", event)
 							f.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: eventBytes}
+							resultCount++
 						case <-timeOut.C:
 							f.logger.Warn().Str("connectionId", message.ConnectionId).Msgf("timeout reading all events queried for this filter: %s", filter.String())
 							break innerLoop
@@ -205,10 +298,15 @@ loop:
 				}
 				// send EOSE
 				f.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: []byte(fmt.Sprintf(`["EOSE", "%s"]`, envelope.SubscriptionID))}
+				f.accessLog.Req(message.ConnectionId, message.RemoteIP, envelope.SubscriptionID, envelope.Filters, resultCount, time.Since(start), "")
 				f.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("registering new subscription with id %v...", envelope.SubscriptionID)
 				f.addSubscription(message.ConnectionId, envelope)
+				bus.Publish(f.bus, bus.SubscriptionOpened, bus.Subscription{ConnectionId: message.ConnectionId, SubscriptionId: envelope.SubscriptionID, Filters: envelope.Filters})
 				f.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("new subscription with id %v registered", envelope.SubscriptionID)
 			case *nostr.CloseEnvelope:
+				if envelope != nil {
+					f.accessLog.Close(message.ConnectionId, message.RemoteIP, string(*envelope))
+				}
 				if envelope != nil && f.contains(message.ConnectionId, string(*envelope)) {
 					f.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("attemtping to close subscription with id %s...", string(*envelope))
 					// remove it from our map
@@ -216,13 +314,29 @@ loop:
 					// f.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: []byte(fmt.Sprintf(`["CLOSED", "%s", ""]`, string(*envelope)))}
 					f.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("subscription with id %s successfully closed", string(*envelope))
 				}
+			case *nip77.OpenEnvelope, *nip77.MessageEnvelope, *nip77.CloseEnvelope, *nip77.ErrorEnvelope:
+				f.sendNegentropy(message.ConnectionId, f.handleNegentropy(message.ConnectionId, envelope))
 			default:
 				f.logger.Fatal().Msgf("unexpected type received from ingester: %T", envelope)
 			}
+		case result := <-f.negResults:
+			f.sendNegentropy(result.connectionId, f.finishNegentropy(result))
 		}
 	}
 }
 
+// sendNegentropy sends the reply to a negentropy message to the websocket handler, if there is one
+func (f *FilterManager) sendNegentropy(connectionId string, reply nostr.Envelope) {
+	if reply == nil {
+		return
+	}
+	replyBytes, err := marshalNegentropy(reply)
+	if err != nil {
+		f.logger.Fatal().Err(err).Msg("failed to marshal negentropy message")
+	}
+	f.sendToWSHandler <- msg.Msg{ConnectionId: connectionId, Data: replyBytes}
+}
+
 // Stop safely stops the FilterManager instance
 func (f *FilterManager) Stop() error {
 	f.logger.Info().Msg("shutting down...")
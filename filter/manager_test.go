@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/bus"
 	"github.com/TheRebelOfBabylon/tandem/config"
 	"github.com/TheRebelOfBabylon/tandem/msg"
 	"github.com/TheRebelOfBabylon/tandem/storage"
@@ -21,6 +22,8 @@ func initFilterManager(recvChan chan msg.ParsedMsg, filters map[string][]*nostr.
 		sendToWSHandler:  make(chan msg.Msg),
 		quit:             make(chan struct{}),
 		filters:          filters,
+		negSessions:      make(map[string]map[string]*negentropySession),
+		negResults:       make(chan negentropyResult),
 		dbConn:           dbConn,
 		logger:           logger,
 		stopping:         false,
@@ -1059,3 +1062,50 @@ func TestFilterManager(t *testing.T) {
 		testCase.validationFunc(t, filterMgr, filterMgrChan)
 	}
 }
+
+// TestMatchAndSend ensures a live event is sent once for every subscription it matches, labeled with the subscription id
+func TestMatchAndSend(t *testing.T) {
+	f := initFilterManager(nil, map[string][]*nostr.ReqEnvelope{
+		"connection": {
+			{SubscriptionID: "notes", Filters: nostr.Filters{{Kinds: []int{1}}}},
+			{SubscriptionID: "author", Filters: nostr.Filters{{Authors: []string{authorPubkey}}}},
+			{SubscriptionID: "other", Filters: nostr.Filters{{Kinds: []int{7}}}},
+		},
+	}, zerolog.Nop(), nil)
+	event := &nostr.EventEnvelope{Event: nostr.Event{ID: "live", PubKey: authorPubkey, Kind: 1}}
+	sendChan := make(chan msg.Msg, 3)
+	f.Add(1)
+	f.matchAndSend(event, sendChan)
+	close(sendChan)
+	subscriptionIds := []string{}
+	for message := range sendChan {
+		envelope, ok := nostr.ParseMessage(message.Data).(*nostr.EventEnvelope)
+		if !ok || envelope.SubscriptionID == nil {
+			t.Fatalf("unexpected message: %s", message.Data)
+		}
+		subscriptionIds = append(subscriptionIds, *envelope.SubscriptionID)
+	}
+	slices.Sort(subscriptionIds)
+	if !slices.Equal(subscriptionIds, []string{"author", "notes"}) {
+		t.Errorf("unexpected subscriptions: %v", subscriptionIds)
+	}
+}
+
+// TestSubscriptionClosedBus ensures subscriptions ended by a CLOSE or by their connection are published on the bus
+func TestSubscriptionClosedBus(t *testing.T) {
+	filterMgr := NewFilterManager(nil, nil, zerolog.Nop())
+	eventBus := bus.New()
+	filterMgr.SetBus(eventBus)
+	var closed []string
+	bus.Subscribe(eventBus, bus.SubscriptionClosed, func(s bus.Subscription) { closed = append(closed, s.ConnectionId+":"+s.SubscriptionId) })
+	for _, subscriptionId := range []string{"notes", "reactions", "profiles"} {
+		filterMgr.addSubscription("conn", &nostr.ReqEnvelope{SubscriptionID: subscriptionId, Filters: nostr.Filters{{Kinds: []int{1}}}})
+	}
+	filterMgr.endSubscription("conn", "reactions")
+	filterMgr.endSubscription("conn", "unknown")
+	filterMgr.endConnection("conn")
+	filterMgr.endConnection("unknown")
+	if expected := []string{"conn:reactions", "conn:notes", "conn:profiles"}; !slices.Equal(closed, expected) {
+		t.Errorf("unexpected subscriptions closed: expected %v got %v", expected, closed)
+	}
+}
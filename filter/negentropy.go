@@ -0,0 +1,225 @@
+package filter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+)
+
+var (
+	// negentropyPageSize is the number of events read from storage at once when listing the events of a session. It must not exceed the query limit of any storage backend so a shorter page means every matching event was read
+	negentropyPageSize = 100
+	ErrTooManyRecords  = errors.New("too many records")
+	// ErrTooManyTies is returned when a page only holds events sharing one timestamp, those past the page can't be reached by paging on time
+	ErrTooManyTies = errors.New("too many events share a timestamp")
+)
+
+// SetNegentropy stores the limits of NIP-77 sessions. Negentropy messages are answered with an error unless enabled
+func (f *FilterManager) SetNegentropy(cfg config.Negentropy) {
+	f.negentropy = cfg
+}
+
+// negentropySession is a NIP-77 session of a connection. neg stays nil while the events covered by the session are being listed
+type negentropySession struct {
+	neg *negentropy.Negentropy
+}
+
+// negentropyResult is the outcome of opening a session, posted back to the manage routine by the worker listing its events
+type negentropyResult struct {
+	connectionId   string
+	subscriptionId string
+	session        *negentropySession
+	// neg is nil when the session couldn't be opened, reply then holds the NEG-ERR
+	neg   *negentropy.Negentropy
+	reply nostr.Envelope
+}
+
+// handleNegentropy runs the NIP-77 message of a connection against its sessions and returns the reply to send, if any. It is only called by the manage routine, which owns the sessions. Opened sessions are answered once their events are listed by a worker, see finishNegentropy
+func (f *FilterManager) handleNegentropy(connectionId string, envelope nostr.Envelope) nostr.Envelope {
+	switch envelope := envelope.(type) {
+	case *nip77.OpenEnvelope:
+		// opening a session with the id of an open one replaces it
+		f.closeNegentropy(connectionId, envelope.SubscriptionID)
+		if len(envelope.SubscriptionID) > 64 {
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "error: subscription id exceeds 64 character limit"}
+		}
+		if !f.negentropy.Enabled {
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: negentropy is disabled on this relay"}
+		}
+		if len(f.negSessions[connectionId]) >= f.negentropy.MaxSessions {
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: too many open negentropy sessions"}
+		}
+		if len(envelope.Message)/2 > f.negentropy.FrameSizeLimit {
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: message exceeds the frame size limit"}
+		}
+		// the session counts against the limit while its events are listed
+		session := &negentropySession{}
+		if f.negSessions[connectionId] == nil {
+			f.negSessions[connectionId] = make(map[string]*negentropySession)
+		}
+		f.negSessions[connectionId][envelope.SubscriptionID] = session
+		f.Add(1)
+		go f.openNegentropy(connectionId, session, envelope)
+	case *nip77.MessageEnvelope:
+		session, ok := f.negSessions[connectionId][envelope.SubscriptionID]
+		if !ok {
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "closed: unknown negentropy session"}
+		}
+		if session.neg == nil {
+			f.closeNegentropy(connectionId, envelope.SubscriptionID)
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "error: negentropy session is still opening"}
+		}
+		if len(envelope.Message)/2 > f.negentropy.FrameSizeLimit {
+			f.closeNegentropy(connectionId, envelope.SubscriptionID)
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: message exceeds the frame size limit"}
+		}
+		reply, err := session.neg.Reconcile(envelope.Message)
+		if err != nil {
+			f.closeNegentropy(connectionId, envelope.SubscriptionID)
+			return &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "error: " + err.Error()}
+		}
+		return &nip77.MessageEnvelope{SubscriptionID: envelope.SubscriptionID, Message: reply}
+	case *nip77.CloseEnvelope:
+		f.closeNegentropy(connectionId, envelope.SubscriptionID)
+	case *nip77.ErrorEnvelope:
+		// a peer relay syncing with us gave up on the session
+		f.closeNegentropy(connectionId, envelope.SubscriptionID)
+	}
+	return nil
+}
+
+// openNegentropy is run as a goroutine for every opened session so listing its events doesn't hold up the manage routine. It reconciles the first message and posts the result back to the manage routine
+func (f *FilterManager) openNegentropy(connectionId string, session *negentropySession, envelope *nip77.OpenEnvelope) {
+	defer f.Done()
+	result := negentropyResult{connectionId: connectionId, subscriptionId: envelope.SubscriptionID, session: session}
+	vec, err := f.negentropyVector(connectionId, envelope.Filter)
+	switch {
+	case errors.Is(err, ErrTooManyRecords):
+		result.reply = &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: this query is too big"}
+	case errors.Is(err, ErrTooManyTies):
+		result.reply = &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "blocked: too many events share a timestamp"}
+	case err != nil:
+		f.logger.Error().Err(err).Str("connectionId", connectionId).Msg("failed to list events for negentropy")
+		result.reply = &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "error: failed to query events"}
+	default:
+		neg := negentropy.New(vec, f.negentropy.FrameSizeLimit)
+		reply, err := neg.Reconcile(envelope.Message)
+		if err != nil {
+			result.reply = &nip77.ErrorEnvelope{SubscriptionID: envelope.SubscriptionID, Reason: "error: " + err.Error()}
+			break
+		}
+		result.neg, result.reply = neg, &nip77.MessageEnvelope{SubscriptionID: envelope.SubscriptionID, Message: reply}
+	}
+	select {
+	case f.negResults <- result:
+	case <-f.quit:
+	}
+}
+
+// finishNegentropy completes a session once its events are listed and returns the reply to send, if any. Results of sessions closed, replaced or whose connection ended in the meantime are dropped. It is only called by the manage routine
+func (f *FilterManager) finishNegentropy(result negentropyResult) nostr.Envelope {
+	if f.negSessions[result.connectionId][result.subscriptionId] != result.session {
+		return nil
+	}
+	if result.neg == nil {
+		f.closeNegentropy(result.connectionId, result.subscriptionId)
+	}
+	result.session.neg = result.neg
+	return result.reply
+}
+
+// marshalNegentropy encodes a reply to a negentropy message, escaping the subscription id and using the NEG-ERR label of NIP-77 for errors
+func marshalNegentropy(envelope nostr.Envelope) ([]byte, error) {
+	switch envelope := envelope.(type) {
+	case *nip77.MessageEnvelope:
+		return json.Marshal([]string{"NEG-MSG", envelope.SubscriptionID, envelope.Message})
+	case *nip77.ErrorEnvelope:
+		return json.Marshal([]string{"NEG-ERR", envelope.SubscriptionID, envelope.Reason})
+	}
+	return envelope.MarshalJSON()
+}
+
+// closeNegentropy ends a session of a connection
+func (f *FilterManager) closeNegentropy(connectionId, subscriptionId string) {
+	delete(f.negSessions[connectionId], subscriptionId)
+	if len(f.negSessions[connectionId]) == 0 {
+		delete(f.negSessions, connectionId)
+	}
+}
+
+// negentropyVector lists the (created_at, id) of the stored events matching the filter of a session which the connection may read, the newest ones first when the filter has a limit. The storage backend caps the number of events returned by a query so they are read page by page, going back in time
+func (f *FilterManager) negentropyVector(connectionId string, filter nostr.Filter) (*vector.Vector, error) {
+	maxRecords, limited := f.negentropy.MaxRecords, false
+	if filter.Limit > 0 && filter.Limit <= maxRecords {
+		maxRecords, limited = filter.Limit, true
+	}
+	filter.Search = ""
+	filter.Limit = negentropyPageSize
+	vec := vector.New()
+	seen := make(map[string]struct{})
+pageLoop:
+	for {
+		rcvChan, err := f.dbConn.Store.QueryEvents(context.TODO(), filter)
+		if err != nil {
+			return nil, err
+		}
+		count, atOldest := 0, 0
+		var oldest nostr.Timestamp
+		timeOut := time.NewTimer(15 * time.Second) // TODO - Make this timeout configurable
+	innerLoop:
+		for {
+			select {
+			case event, ok := <-rcvChan:
+				if !ok || event == nil {
+					break innerLoop
+				}
+				count++
+				if count == 1 || event.CreatedAt < oldest {
+					oldest, atOldest = event.CreatedAt, 0
+				}
+				if event.CreatedAt == oldest {
+					atOldest++
+				}
+				// pages overlap on the timestamp they start at
+				if _, ok := seen[event.ID]; ok {
+					continue innerLoop
+				}
+				seen[event.ID] = struct{}{}
+				if len(event.ID) != 64 || !f.canRead(connectionId, event) {
+					continue innerLoop
+				}
+				if vec.Size() == maxRecords {
+					timeOut.Stop()
+					if limited {
+						break pageLoop
+					}
+					return nil, ErrTooManyRecords
+				}
+				vec.Insert(event.CreatedAt, event.ID)
+			case <-timeOut.C:
+				return nil, errors.New("timed out while querying storage")
+			case <-f.quit:
+				timeOut.Stop()
+				return nil, errors.New("filter manager stopping")
+			}
+		}
+		timeOut.Stop()
+		if count < negentropyPageSize {
+			break
+		}
+		// the next page starts at the oldest event seen since others may share its timestamp, unless the whole page shares it
+		if atOldest == count {
+			return nil, ErrTooManyTies
+		}
+		filter.Until = &oldest
+	}
+	vec.Seal()
+	return vec, nil
+}
@@ -0,0 +1,243 @@
+package filter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/storage"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+	"github.com/rs/zerolog"
+)
+
+var testNegentropy = config.Negentropy{Enabled: true, FrameSizeLimit: 4096, MaxSessions: 2, MaxRecords: 10000}
+
+// negentropyEvent creates a kind 1 event with an id derived from the given number. Events share their timestamp three by three
+func negentropyEvent(i int) nostr.Event {
+	id := sha256.Sum256([]byte(fmt.Sprint(i)))
+	return nostr.Event{ID: hex.EncodeToString(id[:]), PubKey: authorPubkey, Kind: 1, CreatedAt: nostr.Timestamp(1000 + i/3)}
+}
+
+// newNegentropyFilterManager creates a filter manager over a memory storage backend holding the first count negentropy events
+func newNegentropyFilterManager(t *testing.T, cfg config.Negentropy, count int) *FilterManager {
+	dbConn, err := storage.Connect(config.Storage{Uri: "memory://"}, zerolog.Nop(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error when connecting to storage: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		event := negentropyEvent(i)
+		if err := dbConn.Store.SaveEvent(context.Background(), &event); err != nil {
+			t.Fatalf("unexpected error when saving event: %v", err)
+		}
+	}
+	f := initFilterManager(nil, nil, zerolog.Nop(), dbConn)
+	f.SetNegentropy(cfg)
+	return f
+}
+
+// negentropyRequest runs a negentropy message through the filter manager and returns its reply, waiting for the events to be listed when it opens a session
+func negentropyRequest(f *FilterManager, request nostr.Envelope) nostr.Envelope {
+	reply := f.handleNegentropy("connection", request)
+	if _, ok := request.(*nip77.OpenEnvelope); ok && reply == nil {
+		reply = f.finishNegentropy(<-f.negResults)
+	}
+	return reply
+}
+
+// TestNegentropyReconcile ensures a client learns which events it is missing and which ones the relay is missing, over several round trips when the frame size limit is reached
+func TestNegentropyReconcile(t *testing.T) {
+	// the relay holds events 0 to 1199, the client 100 to 1299
+	f := newNegentropyFilterManager(t, testNegentropy, 1200)
+	clientVector := vector.New()
+	for i := 100; i < 1300; i++ {
+		event := negentropyEvent(i)
+		clientVector.Insert(event.CreatedAt, event.ID)
+	}
+	clientVector.Seal()
+	client := negentropy.New(clientVector, 0)
+	var haves, haveNots []string
+	done := make(chan struct{}, 2)
+	go func() {
+		for id := range client.Haves {
+			haves = append(haves, id)
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		for id := range client.HaveNots {
+			haveNots = append(haveNots, id)
+		}
+		done <- struct{}{}
+	}()
+	var request nostr.Envelope = &nip77.OpenEnvelope{SubscriptionID: "sync", Filter: nostr.Filter{Kinds: []int{1}}, Message: client.Start()}
+	roundTrips := 0
+	for request != nil {
+		roundTrips++
+		reply, ok := negentropyRequest(f, request).(*nip77.MessageEnvelope)
+		if !ok {
+			t.Fatalf("unexpected reply after %v round trips: %v", roundTrips, reply)
+		}
+		if len(reply.Message)/2 > testNegentropy.FrameSizeLimit {
+			t.Fatalf("reply of %v bytes exceeds the frame size limit", len(reply.Message)/2)
+		}
+		next, err := client.Reconcile(reply.Message)
+		if err != nil {
+			t.Fatalf("unexpected error when reconciling: %v", err)
+		}
+		request = nil
+		if next != "" {
+			request = &nip77.MessageEnvelope{SubscriptionID: "sync", Message: next}
+		}
+	}
+	<-done
+	<-done
+	if roundTrips < 2 {
+		t.Errorf("expected the frame size limit to split the reconciliation, got %v round trips", roundTrips)
+	}
+	for name, ids := range map[string]struct {
+		got   []string
+		start int
+	}{"haves": {haves, 1200}, "haveNots": {haveNots, 0}} {
+		if len(ids.got) != 100 {
+			t.Errorf("unexpected number of %s: %v", name, len(ids.got))
+			continue
+		}
+		for i := ids.start; i < ids.start+100; i++ {
+			if !slices.Contains(ids.got, negentropyEvent(i).ID) {
+				t.Errorf("expected event %v in %s", i, name)
+			}
+		}
+	}
+	f.handleNegentropy("connection", &nip77.CloseEnvelope{SubscriptionID: "sync"})
+	if len(f.negSessions) != 0 {
+		t.Errorf("expected session to be closed, got %v", f.negSessions)
+	}
+}
+
+type negentropyErrorTestCase struct {
+	name           string
+	cfg            config.Negentropy
+	requests       []nostr.Envelope
+	expectedReason string
+}
+
+var (
+	emptyMessage             = negentropy.New(vector.New(), 0).Start()
+	negentropyErrorTestCases = []negentropyErrorTestCase{
+		{
+			name:           "Disabled",
+			cfg:            config.Negentropy{},
+			requests:       []nostr.Envelope{&nip77.OpenEnvelope{SubscriptionID: "sync", Message: emptyMessage}},
+			expectedReason: "blocked: negentropy is disabled on this relay",
+		},
+		{
+			name: "TooManySessions",
+			cfg:  testNegentropy,
+			requests: []nostr.Envelope{
+				&nip77.OpenEnvelope{SubscriptionID: "one", Message: emptyMessage},
+				&nip77.OpenEnvelope{SubscriptionID: "two", Message: emptyMessage},
+				&nip77.OpenEnvelope{SubscriptionID: "three", Message: emptyMessage},
+			},
+			expectedReason: "blocked: too many open negentropy sessions",
+		},
+		{
+			name:           "TooManyRecords",
+			cfg:            config.Negentropy{Enabled: true, FrameSizeLimit: 4096, MaxSessions: 1, MaxRecords: 100},
+			requests:       []nostr.Envelope{&nip77.OpenEnvelope{SubscriptionID: "sync", Message: emptyMessage}},
+			expectedReason: "blocked: this query is too big",
+		},
+		{
+			name:           "FrameSizeLimit",
+			cfg:            testNegentropy,
+			requests:       []nostr.Envelope{&nip77.OpenEnvelope{SubscriptionID: "sync", Message: emptyMessage + string(make([]byte, 8192))}},
+			expectedReason: "blocked: message exceeds the frame size limit",
+		},
+		{
+			name:           "UnknownSession",
+			cfg:            testNegentropy,
+			requests:       []nostr.Envelope{&nip77.MessageEnvelope{SubscriptionID: "sync", Message: emptyMessage}},
+			expectedReason: "closed: unknown negentropy session",
+		},
+		{
+			name:           "InvalidMessage",
+			cfg:            testNegentropy,
+			requests:       []nostr.Envelope{&nip77.OpenEnvelope{SubscriptionID: "sync", Message: "zz"}},
+			expectedReason: "error: failed to read pv: encoding/hex: invalid byte: U+007A 'z'",
+		},
+	}
+)
+
+// TestNegentropyErrors ensures sessions are refused with a NEG-ERR when they break the configured limits
+func TestNegentropyErrors(t *testing.T) {
+	for _, testCase := range negentropyErrorTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		f := newNegentropyFilterManager(t, testCase.cfg, 300)
+		var reply nostr.Envelope
+		for _, request := range testCase.requests {
+			reply = negentropyRequest(f, request)
+		}
+		errReply, ok := reply.(*nip77.ErrorEnvelope)
+		if !ok {
+			t.Errorf("expected error for test case %s, got %v", testCase.name, reply)
+			continue
+		}
+		if errReply.Reason != testCase.expectedReason {
+			t.Errorf("unexpected reason for test case %s: expected %q, got %q", testCase.name, testCase.expectedReason, errReply.Reason)
+		}
+		replyBytes, err := marshalNegentropy(reply)
+		if err != nil {
+			t.Fatalf("unexpected error when marshalling reply: %v", err)
+		}
+		if expected := fmt.Sprintf(`["NEG-ERR","%s","%s"]`, errReply.SubscriptionID, errReply.Reason); string(replyBytes) != expected {
+			t.Errorf("unexpected NEG-ERR for test case %s: %s", testCase.name, replyBytes)
+		}
+	}
+}
+
+// TestNegentropyTimestampTies ensures events sharing a timestamp across pages are all listed, and sessions are refused when a whole page shares one timestamp instead of silently missing events
+func TestNegentropyTimestampTies(t *testing.T) {
+	defer func(pageSize int) { negentropyPageSize = pageSize }(negentropyPageSize)
+	f := newNegentropyFilterManager(t, testNegentropy, 300)
+	// events share their timestamp three by three so pages of four split them
+	negentropyPageSize = 4
+	vec, err := f.negentropyVector("connection", nostr.Filter{Kinds: []int{1}})
+	if err != nil {
+		t.Fatalf("unexpected error when listing events: %v", err)
+	}
+	if vec.Size() != 300 {
+		t.Errorf("unexpected number of listed events: expected 300 got %v", vec.Size())
+	}
+	negentropyPageSize = 3
+	reply, ok := negentropyRequest(f, &nip77.OpenEnvelope{SubscriptionID: "sync", Message: emptyMessage}).(*nip77.ErrorEnvelope)
+	if !ok {
+		t.Fatalf("expected error when a page shares one timestamp, got %v", reply)
+	}
+	if expected := "blocked: too many events share a timestamp"; reply.Reason != expected {
+		t.Errorf("unexpected reason: expected %q got %q", expected, reply.Reason)
+	}
+	if len(f.negSessions) != 0 {
+		t.Errorf("expected refused session to be closed, got %v", f.negSessions)
+	}
+}
+
+// TestNegentropyStaleOpen ensures the listed events of a session closed while they were being listed are dropped
+func TestNegentropyStaleOpen(t *testing.T) {
+	f := newNegentropyFilterManager(t, testNegentropy, 300)
+	if reply := f.handleNegentropy("connection", &nip77.OpenEnvelope{SubscriptionID: "sync", Message: emptyMessage}); reply != nil {
+		t.Fatalf("unexpected reply before the events are listed: %v", reply)
+	}
+	f.handleNegentropy("connection", &nip77.CloseEnvelope{SubscriptionID: "sync"})
+	if reply := f.finishNegentropy(<-f.negResults); reply != nil {
+		t.Errorf("unexpected reply for a closed session: %v", reply)
+	}
+	if len(f.negSessions) != 0 {
+		t.Errorf("expected session to stay closed, got %v", f.negSessions)
+	}
+}
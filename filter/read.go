@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// privateKinds are the kinds only readable by their recipients: NIP-04 direct messages and NIP-59 gift wraps
+var privateKinds = []int{nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap}
+
+// canRead checks if the given event may be sent to the given connection, both for stored events and live ones
+func (f *FilterManager) canRead(connectionId string, event *nostr.Event) bool {
+	authedPubkeys := func() []string {
+		if f.authedPubkeys == nil {
+			return nil
+		}
+		return f.authedPubkeys(connectionId)
+	}
+	if !canReadPrivate(event, authedPubkeys) || !f.moderation.CanRead(event, authedPubkeys) {
+		return false
+	}
+	return f.groups.CanRead(event, authedPubkeys)
+}
+
+// canReadPrivate checks that private events are only read by connections authenticated as a p tagged recipient or, for direct messages, as the author. The pubkeys are only looked up for private events
+func canReadPrivate(event *nostr.Event, authedPubkeys func() []string) bool {
+	if !slices.Contains(privateKinds, event.Kind) {
+		return true
+	}
+	for _, pubkey := range authedPubkeys() {
+		if event.Kind == nostr.KindEncryptedDirectMessage && pubkey == event.PubKey {
+			return true
+		}
+		for _, tag := range event.Tags.GetAll([]string{"p", ""}) {
+			if tag.Value() == pubkey {
+				return true
+			}
+		}
+	}
+	return false
+}
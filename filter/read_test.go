@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+type readTestCase struct {
+	name          string
+	event         nostr.Event
+	authedPubkeys []string
+	canRead       bool
+}
+
+var (
+	authorPubkey    = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	recipientPubkey = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	strangerPubkey  = "da66d621d05bb7a7d64c1adfe0ea6421ca7db60d1089cd98b06ccfcd0ea2ed78"
+	directMessage   = nostr.Event{PubKey: authorPubkey, Kind: nostr.KindEncryptedDirectMessage, Tags: nostr.Tags{{"p", recipientPubkey}}}
+	giftWrap        = nostr.Event{PubKey: strangerPubkey, Kind: nostr.KindGiftWrap, Tags: nostr.Tags{{"p", recipientPubkey}}}
+	readTestCases   = []readTestCase{
+		{
+			name:    "PublicEvent",
+			event:   nostr.Event{PubKey: authorPubkey, Kind: 1, Tags: nostr.Tags{{"p", recipientPubkey}}},
+			canRead: true,
+		},
+		{
+			name:    "DirectMessageUnauthenticated",
+			event:   directMessage,
+			canRead: false,
+		},
+		{
+			name:          "DirectMessageRecipient",
+			event:         directMessage,
+			authedPubkeys: []string{strangerPubkey, recipientPubkey},
+			canRead:       true,
+		},
+		{
+			name:          "DirectMessageAuthor",
+			event:         directMessage,
+			authedPubkeys: []string{authorPubkey},
+			canRead:       true,
+		},
+		{
+			name:          "DirectMessageStranger",
+			event:         directMessage,
+			authedPubkeys: []string{strangerPubkey},
+			canRead:       false,
+		},
+		{
+			name:          "GiftWrapRecipient",
+			event:         giftWrap,
+			authedPubkeys: []string{recipientPubkey},
+			canRead:       true,
+		},
+		{
+			name:          "GiftWrapAuthor",
+			event:         giftWrap,
+			authedPubkeys: []string{strangerPubkey},
+			canRead:       false,
+		},
+		{
+			name:          "GiftWrapPrefix",
+			event:         giftWrap,
+			authedPubkeys: []string{recipientPubkey[:10]},
+			canRead:       false,
+		},
+	}
+)
+
+// TestCanRead ensures direct messages and gift wraps are only served to connections authenticated as their recipients
+func TestCanRead(t *testing.T) {
+	for _, testCase := range readTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		f := initFilterManager(nil, nil, zerolog.Nop(), nil)
+		f.SetAuthedPubkeysFunc(func(connectionId string) []string {
+			if connectionId != "some-id" {
+				return nil
+			}
+			return testCase.authedPubkeys
+		})
+		if canRead := f.canRead("some-id", &testCase.event); canRead != testCase.canRead {
+			t.Errorf("unexpected result for test case %s: expected %v, got %v", testCase.name, testCase.canRead, canRead)
+		}
+	}
+	f := initFilterManager(nil, nil, zerolog.Nop(), nil)
+	if f.canRead("some-id", &giftWrap) {
+		t.Error("expected gift wrap to be hidden when authentication isn't available")
+	}
+}
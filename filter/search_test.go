@@ -0,0 +1,31 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/search"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// TestMatchesSearch ensures live events only match search filters whose text they match
+func TestMatchesSearch(t *testing.T) {
+	f := initFilterManager(nil, nil, zerolog.Nop(), nil)
+	f.SetSearcher(search.NewSearcher(search.NewInvertedIndex(), nil, zerolog.Nop()))
+	event := &nostr.Event{PubKey: authorPubkey, Kind: 1, Content: "running a nostr relay"}
+	for _, testCase := range []struct {
+		filters nostr.Filters
+		matches bool
+	}{
+		{filters: nostr.Filters{{Kinds: []int{1}}}, matches: true},
+		{filters: nostr.Filters{{Search: "nostr relay"}}, matches: true},
+		{filters: nostr.Filters{{Search: "run*"}}, matches: true},
+		{filters: nostr.Filters{{Search: "bitcoin"}}, matches: false},
+		{filters: nostr.Filters{{Search: "nostr", Kinds: []int{0}}}, matches: false},
+		{filters: nostr.Filters{{Search: "bitcoin"}, {Search: "relay"}}, matches: true},
+	} {
+		if matches := f.matches(&nostr.ReqEnvelope{Filters: testCase.filters}, event); matches != testCase.matches {
+			t.Errorf("unexpected match for filters %v: expected %v, got %v", testCase.filters, testCase.matches, matches)
+		}
+	}
+}
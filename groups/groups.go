@@ -0,0 +1,498 @@
+package groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrGroupExists     = errors.New("group already exists")
+	ErrUnknownGroup    = errors.New("unknown group")
+	ErrInvalidKey      = errors.New("invalid relay secret key")
+	ErrQueryFuncNotSet = errors.New("query function not set")
+	// loadBatchSize is the number of events queried at once when loading the group state. It stays below the query limit of every storage backend
+	loadBatchSize = 100
+	// validGroupId is the character set NIP-29 recommends for group ids
+	validGroupId = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	adminRole    = &nip29.Role{Name: "admin", Description: "can moderate the group"}
+)
+
+// group is the state of a single group along with what the relay needs to manage it
+type group struct {
+	nip29.Group
+	// invites are the invite codes which let pubkeys join the group while it is closed
+	invites map[string]struct{}
+	// stateEvents holds the id of the latest relay signed event of each state kind
+	stateEvents map[int]string
+	// updatedAt is the created_at of the latest state event. New state events must be strictly newer to replace the previous ones
+	updatedAt nostr.Timestamp
+}
+
+// newGroup instantiates an empty group
+func newGroup(id string) *group {
+	return &group{
+		Group: nip29.Group{
+			Address: nip29.GroupAddress{ID: id},
+			Name:    id,
+			Members: make(map[string][]*nip29.Role),
+			Roles:   []*nip29.Role{adminRole},
+		},
+		invites:     make(map[string]struct{}),
+		stateEvents: make(map[int]string),
+	}
+}
+
+// isMember checks if the given pubkey is a member, admins included
+func (g *group) isMember(pubkey string) bool {
+	_, ok := g.Members[pubkey]
+	return ok
+}
+
+// isAdmin checks if the given pubkey holds a role in the group
+func (g *group) isAdmin(pubkey string) bool {
+	return len(g.Members[pubkey]) > 0
+}
+
+// Result lists what the rest of the relay must do after a group event was applied
+type Result struct {
+	// Events are the new relay signed state events to store and send to subscribers
+	Events []nostr.Event
+	// Delete are the ids of the events to remove from storage
+	Delete []string
+}
+
+// Manager keeps the state of the NIP-29 groups hosted by the relay. A nil Manager is valid and leaves every event alone
+type Manager struct {
+	secretKey string
+	pubkey    string
+	creators  map[string]struct{}
+	groups    map[string]*group
+	// deleted holds the ids of deleted groups. Their remaining events are never readable and the ids can't be reused
+	deleted map[string]struct{}
+	logger  zerolog.Logger
+	sync.RWMutex
+}
+
+// NewManager instantiates a group manager signing the group state with the given relay secret key
+func NewManager(cfg config.Groups, secretKey string, logger zerolog.Logger) (*Manager, error) {
+	pubkey, err := nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	creators := make(map[string]struct{}, len(cfg.CreatorPubkeys))
+	for _, creator := range cfg.CreatorPubkeys {
+		creators[creator] = struct{}{}
+	}
+	return &Manager{
+		secretKey: secretKey,
+		pubkey:    pubkey,
+		creators:  creators,
+		groups:    make(map[string]*group),
+		deleted:   make(map[string]struct{}),
+		logger:    logger,
+	}, nil
+}
+
+// Pubkey returns the pubkey the group state is signed with
+func (m *Manager) Pubkey() string {
+	return m.pubkey
+}
+
+// groupId returns the group an event belongs to: the h tag for events sent by members and the d tag for the relay signed state
+func groupId(event *nostr.Event) string {
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		return event.Tags.GetD()
+	}
+	if tag := event.Tags.GetFirst([]string{"h", ""}); tag != nil {
+		return tag.Value()
+	}
+	return ""
+}
+
+// isModerationKind checks if the given kind is in the range reserved for group moderation events
+func isModerationKind(kind int) bool {
+	return kind >= 9000 && kind <= 9020
+}
+
+// taggedPubkeys returns the valid pubkeys of the p tags of an event along with the roles which follow them
+func taggedPubkeys(event nostr.Event) map[string][]string {
+	pubkeys := make(map[string][]string)
+	for _, tag := range event.Tags.GetAll([]string{"p", ""}) {
+		if nostr.IsValidPublicKey(tag[1]) {
+			pubkeys[tag[1]] = tag[2:]
+		}
+	}
+	return pubkeys
+}
+
+// Check returns the reason, prefixed as per NIP-01, for which the given event is rejected or an empty string if it is accepted
+func (m *Manager) Check(event nostr.Event) string {
+	if m == nil {
+		return ""
+	}
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		if event.PubKey != m.pubkey {
+			return "blocked: group state is managed by the relay"
+		}
+		return ""
+	}
+	id := groupId(&event)
+	if id == "" {
+		if isModerationKind(event.Kind) || event.Kind == nostr.KindSimpleGroupJoinRequest || event.Kind == nostr.KindSimpleGroupLeaveRequest {
+			return "invalid: missing h tag"
+		}
+		return ""
+	}
+	m.RLock()
+	defer m.RUnlock()
+	g, exists := m.groups[id]
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if _, ok := m.creators[event.PubKey]; len(m.creators) > 0 && !ok {
+			return "restricted: not allowed to create groups on this relay"
+		}
+		if exists {
+			return "duplicate: group already exists"
+		}
+		if _, ok := m.deleted[id]; ok {
+			return "blocked: group was deleted"
+		}
+		if !validGroupId.MatchString(id) {
+			return "invalid: group id may only contain a-z, 0-9, - and _"
+		}
+		return ""
+	}
+	if !exists {
+		return "invalid: unknown group"
+	}
+	switch {
+	case event.Kind == nostr.KindSimpleGroupJoinRequest:
+		if g.isMember(event.PubKey) {
+			return "duplicate: already a member of this group"
+		}
+	case event.Kind == nostr.KindSimpleGroupLeaveRequest:
+		if !g.isMember(event.PubKey) {
+			return "invalid: not a member of this group"
+		}
+	case isModerationKind(event.Kind):
+		if !g.isAdmin(event.PubKey) {
+			return "restricted: only group admins may moderate this group"
+		}
+		return checkModerationEvent(event)
+	default:
+		if !g.isMember(event.PubKey) {
+			return "restricted: not a member of this group"
+		}
+	}
+	return ""
+}
+
+// checkModerationEvent checks that a moderation event carries what it needs to be applied
+func checkModerationEvent(event nostr.Event) string {
+	switch event.Kind {
+	case nostr.KindSimpleGroupPutUser, nostr.KindSimpleGroupRemoveUser:
+		if len(taggedPubkeys(event)) == 0 {
+			return "invalid: missing p tag"
+		}
+	case nostr.KindSimpleGroupDeleteEvent:
+		if event.Tags.GetFirst([]string{"e", ""}) == nil {
+			return "invalid: missing e tag"
+		}
+	case nostr.KindSimpleGroupCreateInvite:
+		if event.Tags.GetFirst([]string{"code", ""}) == nil {
+			return "invalid: missing code tag"
+		}
+	case nostr.KindSimpleGroupEditMetadata, nostr.KindSimpleGroupDeleteGroup:
+	default:
+		return fmt.Sprintf("invalid: unsupported group moderation event of kind %v", event.Kind)
+	}
+	return ""
+}
+
+// Apply changes the group state according to an accepted event and returns the resulting relay signed state events. Events which don't change the group state return an empty result
+func (m *Manager) Apply(event nostr.Event) (Result, error) {
+	var result Result
+	if m == nil {
+		return result, nil
+	}
+	id := groupId(&event)
+	if id == "" || nip29.MetadataEventKinds.Includes(event.Kind) {
+		return result, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	g, exists := m.groups[id]
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if exists {
+			return result, fmt.Errorf("%w: %s", ErrGroupExists, id)
+		}
+		g = newGroup(id)
+		g.Members[event.PubKey] = []*nip29.Role{adminRole}
+		m.groups[id] = g
+		return m.sign(g, nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers, nostr.KindSimpleGroupRoles)
+	}
+	if !exists {
+		return result, fmt.Errorf("%w: %s", ErrUnknownGroup, id)
+	}
+	switch event.Kind {
+	case nostr.KindSimpleGroupPutUser:
+		for pubkey, roleNames := range taggedPubkeys(event) {
+			roles := []*nip29.Role{}
+			for _, roleName := range roleNames {
+				roles = append(roles, g.GetRoleByName(roleName))
+			}
+			g.Members[pubkey] = roles
+		}
+		return m.sign(g, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+	case nostr.KindSimpleGroupRemoveUser:
+		for pubkey := range taggedPubkeys(event) {
+			delete(g.Members, pubkey)
+		}
+		return m.sign(g, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+	case nostr.KindSimpleGroupEditMetadata:
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{{"name", &g.Name}, {"about", &g.About}, {"picture", &g.Picture}} {
+			if tag := event.Tags.GetFirst([]string{field.name, ""}); tag != nil {
+				*field.value = tag.Value()
+			}
+		}
+		if event.Tags.GetFirst([]string{"private"}) != nil {
+			g.Private = true
+		} else if event.Tags.GetFirst([]string{"public"}) != nil {
+			g.Private = false
+		}
+		if event.Tags.GetFirst([]string{"closed"}) != nil {
+			g.Closed = true
+		} else if event.Tags.GetFirst([]string{"open"}) != nil {
+			g.Closed = false
+		}
+		return m.sign(g, nostr.KindSimpleGroupMetadata)
+	case nostr.KindSimpleGroupDeleteEvent:
+		for _, tag := range event.Tags.GetAll([]string{"e", ""}) {
+			result.Delete = append(result.Delete, tag.Value())
+		}
+	case nostr.KindSimpleGroupDeleteGroup:
+		for _, stateEventId := range g.stateEvents {
+			result.Delete = append(result.Delete, stateEventId)
+		}
+		slices.Sort(result.Delete)
+		delete(m.groups, id)
+		m.deleted[id] = struct{}{}
+	case nostr.KindSimpleGroupCreateInvite:
+		g.invites[event.Tags.GetFirst([]string{"code", ""}).Value()] = struct{}{}
+	case nostr.KindSimpleGroupJoinRequest:
+		if g.isMember(event.PubKey) {
+			return result, nil
+		}
+		if g.Closed {
+			code := event.Tags.GetFirst([]string{"code", ""})
+			if code == nil {
+				// the request stays stored for the admins to review
+				return result, nil
+			}
+			if _, ok := g.invites[code.Value()]; !ok {
+				return result, nil
+			}
+		}
+		g.Members[event.PubKey] = nil
+		return m.sign(g, nostr.KindSimpleGroupMembers)
+	case nostr.KindSimpleGroupLeaveRequest:
+		if !g.isMember(event.PubKey) {
+			return result, nil
+		}
+		wasAdmin := g.isAdmin(event.PubKey)
+		delete(g.Members, event.PubKey)
+		if wasAdmin {
+			return m.sign(g, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers)
+		}
+		return m.sign(g, nostr.KindSimpleGroupMembers)
+	}
+	return result, nil
+}
+
+// sign creates the relay signed state events of the given kinds for a group. The caller must hold the write lock
+func (m *Manager) sign(g *group, kinds ...int) (Result, error) {
+	var result Result
+	now := nostr.Now()
+	if now <= g.updatedAt {
+		now = g.updatedAt + 1
+	}
+	g.updatedAt = now
+	for _, kind := range kinds {
+		var event *nostr.Event
+		switch kind {
+		case nostr.KindSimpleGroupMetadata:
+			event = g.ToMetadataEvent()
+		case nostr.KindSimpleGroupAdmins:
+			event = g.ToAdminsEvent()
+		case nostr.KindSimpleGroupMembers:
+			event = g.ToMembersEvent()
+		case nostr.KindSimpleGroupRoles:
+			event = g.ToRolesEvent()
+		}
+		event.CreatedAt = now
+		if err := event.Sign(m.secretKey); err != nil {
+			return Result{}, fmt.Errorf("failed to sign group state: %w", err)
+		}
+		g.stateEvents[kind] = event.ID
+		result.Events = append(result.Events, *event)
+	}
+	return result, nil
+}
+
+// CanRead checks if an event may be sent to a connection authenticated as the given pubkeys. Events of private groups are only readable by members, invite codes only by admins and events of deleted groups by no one. The pubkeys are only looked up when needed
+func (m *Manager) CanRead(event *nostr.Event, authedPubkeys func() []string) bool {
+	if m == nil || nip29.MetadataEventKinds.Includes(event.Kind) {
+		return true
+	}
+	id := groupId(event)
+	if id == "" {
+		return true
+	}
+	m.RLock()
+	defer m.RUnlock()
+	if _, deleted := m.deleted[id]; deleted {
+		return false
+	}
+	g, ok := m.groups[id]
+	if !ok || (!g.Private && event.Kind != nostr.KindSimpleGroupCreateInvite) {
+		return true
+	}
+	for _, pubkey := range authedPubkeys() {
+		if event.Kind == nostr.KindSimpleGroupCreateInvite && g.isAdmin(pubkey) {
+			return true
+		}
+		if event.Kind != nostr.KindSimpleGroupCreateInvite && g.isMember(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load rebuilds the group state from the relay signed state events, the invites and the group deletions found in storage
+func (m *Manager) Load(queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) error {
+	if queryFunc == nil {
+		return ErrQueryFuncNotSet
+	}
+	stateEvents, err := queryAll(queryFunc, nostr.Filter{Kinds: nip29.MetadataEventKinds, Authors: []string{m.pubkey}})
+	if err != nil {
+		return err
+	}
+	inviteEvents, err := queryAll(queryFunc, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupCreateInvite}})
+	if err != nil {
+		return err
+	}
+	// a stored deletion was checked against the admins of the group when it was accepted
+	deleteEvents, err := queryAll(queryFunc, nostr.Filter{Kinds: []int{nostr.KindSimpleGroupDeleteGroup}})
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.groups = make(map[string]*group)
+	m.deleted = make(map[string]struct{})
+	// the metadata creates the group and the roles are needed to resolve those of the admins
+	order := []int{nostr.KindSimpleGroupMetadata, nostr.KindSimpleGroupRoles, nostr.KindSimpleGroupAdmins, nostr.KindSimpleGroupMembers}
+	slices.SortFunc(stateEvents, func(a, b *nostr.Event) int { return slices.Index(order, a.Kind) - slices.Index(order, b.Kind) })
+	for _, event := range stateEvents {
+		id := event.Tags.GetD()
+		g, ok := m.groups[id]
+		if !ok && event.Kind != nostr.KindSimpleGroupMetadata {
+			m.logger.Warn().Str("eventId", event.ID).Msgf("ignoring state of unknown group %s", id)
+			continue
+		}
+		switch event.Kind {
+		case nostr.KindSimpleGroupMetadata:
+			g = newGroup(id)
+			err = g.MergeInMetadataEvent(event)
+			m.groups[id] = g
+		case nostr.KindSimpleGroupAdmins:
+			err = g.MergeInAdminsEvent(event)
+		case nostr.KindSimpleGroupMembers:
+			err = g.MergeInMembersEvent(event)
+		case nostr.KindSimpleGroupRoles:
+			g.Roles = nil
+			for _, tag := range event.Tags.GetAll([]string{"role", ""}) {
+				role := g.GetRoleByName(tag[1])
+				if len(tag) > 2 {
+					role.Description = tag[2]
+				}
+				g.Roles = append(g.Roles, role)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load state of group %s: %w", id, err)
+		}
+		g.stateEvents[event.Kind] = event.ID
+		g.updatedAt = max(g.updatedAt, event.CreatedAt)
+	}
+	for _, event := range inviteEvents {
+		if g, ok := m.groups[groupId(event)]; ok && g.isAdmin(event.PubKey) {
+			if code := event.Tags.GetFirst([]string{"code", ""}); code != nil {
+				g.invites[code.Value()] = struct{}{}
+			}
+		}
+	}
+	for _, event := range deleteEvents {
+		if id := groupId(event); id != "" {
+			if _, ok := m.groups[id]; !ok {
+				m.deleted[id] = struct{}{}
+			}
+		}
+	}
+	m.logger.Info().Msgf("loaded %v groups", len(m.groups))
+	return nil
+}
+
+// queryAll queries storage page by page, newest first, until every event matching the filter was returned
+func queryAll(queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter) ([]*nostr.Event, error) {
+	seen := make(map[string]struct{})
+	events := []*nostr.Event{}
+	filter.Limit = loadBatchSize
+	for {
+		rcvChan, err := queryFunc(context.Background(), filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query storage for group state: %w", err)
+		}
+		timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+		newEvents := 0
+		var oldest nostr.Timestamp
+	queryLoop:
+		for {
+			select {
+			case event, ok := <-rcvChan:
+				if !ok || event == nil {
+					break queryLoop
+				}
+				if oldest == 0 || event.CreatedAt < oldest {
+					oldest = event.CreatedAt
+				}
+				if _, ok := seen[event.ID]; ok {
+					continue
+				}
+				seen[event.ID] = struct{}{}
+				events = append(events, event)
+				newEvents++
+			case <-timer.C:
+				return nil, errors.New("timed out while querying storage for group state")
+			}
+		}
+		timer.Stop()
+		if newEvents == 0 {
+			return events, nil
+		}
+		// events sharing the timestamp of the oldest event may not all fit in this page, so the next one starts at that timestamp again
+		filter.Until = &oldest
+	}
+}
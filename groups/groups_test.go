@@ -0,0 +1,322 @@
+package groups
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	relaySecretKey    = nostr.GeneratePrivateKey()
+	adminSecretKey    = nostr.GeneratePrivateKey()
+	memberSecretKey   = nostr.GeneratePrivateKey()
+	strangerSecretKey = nostr.GeneratePrivateKey()
+	adminPubkey, _    = nostr.GetPublicKey(adminSecretKey)
+	memberPubkey, _   = nostr.GetPublicKey(memberSecretKey)
+	strangerPubkey, _ = nostr.GetPublicKey(strangerSecretKey)
+)
+
+// fakeStore stores events in memory and answers queries the way the storage backends do
+type fakeStore struct {
+	events []*nostr.Event
+}
+
+func (s *fakeStore) query(_ context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	matches := []*nostr.Event{}
+	for _, event := range s.events {
+		if filter.Matches(event) {
+			matches = append(matches, event)
+		}
+	}
+	slices.SortFunc(matches, func(a, b *nostr.Event) int { return int(b.CreatedAt - a.CreatedAt) })
+	if filter.Limit > 0 && len(matches) > filter.Limit {
+		matches = matches[:filter.Limit]
+	}
+	rcvChan := make(chan *nostr.Event, len(matches))
+	for _, event := range matches {
+		rcvChan <- event
+	}
+	close(rcvChan)
+	return rcvChan, nil
+}
+
+// store saves the given events, replacing the previous state event of the same kind and group
+func (s *fakeStore) store(events ...nostr.Event) {
+	for _, event := range events {
+		s.events = slices.DeleteFunc(s.events, func(stored *nostr.Event) bool {
+			return stored.Kind == event.Kind && stored.Kind >= 30000 && stored.Tags.GetD() == event.Tags.GetD()
+		})
+		s.events = append(s.events, &event)
+	}
+}
+
+// groupEvent creates an event of the given kind for the group signed with the given secret key
+func groupEvent(secretKey string, kind int, groupId string, tags ...nostr.Tag) nostr.Event {
+	event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: append(nostr.Tags{{"h", groupId}}, tags...)}
+	event.Sign(secretKey)
+	return event
+}
+
+// newTestManager creates a manager hosting the group test, created by the admin and joined by the member
+func newTestManager(t *testing.T, store *fakeStore, closed bool) *Manager {
+	m, err := NewManager(config.Groups{Enabled: true}, relaySecretKey, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating manager: %v", err)
+	}
+	editTags := nostr.Tags{{"private"}}
+	if closed {
+		editTags = append(editTags, nostr.Tag{"closed"})
+	}
+	for _, event := range []nostr.Event{
+		groupEvent(adminSecretKey, nostr.KindSimpleGroupCreateGroup, "test"),
+		groupEvent(adminSecretKey, nostr.KindSimpleGroupPutUser, "test", nostr.Tag{"p", memberPubkey}),
+		groupEvent(adminSecretKey, nostr.KindSimpleGroupEditMetadata, "test", editTags...),
+		groupEvent(adminSecretKey, nostr.KindSimpleGroupCreateInvite, "test", nostr.Tag{"code", "secret"}),
+	} {
+		if reason := m.Check(event); reason != "" {
+			t.Fatalf("unexpected rejection of event of kind %v: %s", event.Kind, reason)
+		}
+		result, err := m.Apply(event)
+		if err != nil {
+			t.Fatalf("unexpected error when applying event of kind %v: %v", event.Kind, err)
+		}
+		store.store(event)
+		store.store(result.Events...)
+	}
+	return m
+}
+
+type checkTestCase struct {
+	name   string
+	event  nostr.Event
+	reason string
+}
+
+var checkTestCases = []checkTestCase{
+	{
+		name:   "MemberMessage",
+		event:  groupEvent(memberSecretKey, 9, "test"),
+		reason: "",
+	},
+	{
+		name:   "StrangerMessage",
+		event:  groupEvent(strangerSecretKey, 9, "test"),
+		reason: "restricted: not a member of this group",
+	},
+	{
+		name:   "NoGroup",
+		event:  nostr.Event{PubKey: strangerPubkey, Kind: 1},
+		reason: "",
+	},
+	{
+		name:   "UnknownGroup",
+		event:  groupEvent(memberSecretKey, 9, "unknown"),
+		reason: "invalid: unknown group",
+	},
+	{
+		name:   "ForgedState",
+		event:  nostr.Event{PubKey: adminPubkey, Kind: nostr.KindSimpleGroupMembers, Tags: nostr.Tags{{"d", "test"}}},
+		reason: "blocked: group state is managed by the relay",
+	},
+	{
+		name:   "ModerationWithoutGroup",
+		event:  nostr.Event{PubKey: adminPubkey, Kind: nostr.KindSimpleGroupPutUser},
+		reason: "invalid: missing h tag",
+	},
+	{
+		name:   "MemberModeration",
+		event:  groupEvent(memberSecretKey, nostr.KindSimpleGroupRemoveUser, "test", nostr.Tag{"p", adminPubkey}),
+		reason: "restricted: only group admins may moderate this group",
+	},
+	{
+		name:   "ModerationWithoutPubkey",
+		event:  groupEvent(adminSecretKey, nostr.KindSimpleGroupRemoveUser, "test"),
+		reason: "invalid: missing p tag",
+	},
+	{
+		name:   "UnsupportedModeration",
+		event:  groupEvent(adminSecretKey, 9020, "test"),
+		reason: "invalid: unsupported group moderation event of kind 9020",
+	},
+	{
+		name:   "ExistingGroup",
+		event:  groupEvent(strangerSecretKey, nostr.KindSimpleGroupCreateGroup, "test"),
+		reason: "duplicate: group already exists",
+	},
+	{
+		name:   "InvalidGroupId",
+		event:  groupEvent(strangerSecretKey, nostr.KindSimpleGroupCreateGroup, "Not Valid"),
+		reason: "invalid: group id may only contain a-z, 0-9, - and _",
+	},
+	{
+		name:   "MemberJoin",
+		event:  groupEvent(memberSecretKey, nostr.KindSimpleGroupJoinRequest, "test"),
+		reason: "duplicate: already a member of this group",
+	},
+	{
+		name:   "StrangerLeave",
+		event:  groupEvent(strangerSecretKey, nostr.KindSimpleGroupLeaveRequest, "test"),
+		reason: "invalid: not a member of this group",
+	},
+}
+
+// TestCheck ensures events are only accepted from the pubkeys allowed to send them to a group
+func TestCheck(t *testing.T) {
+	m := newTestManager(t, &fakeStore{}, false)
+	for _, testCase := range checkTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		if reason := m.Check(testCase.event); reason != testCase.reason {
+			t.Errorf("unexpected reason for test case %s: expected %q, got %q", testCase.name, testCase.reason, reason)
+		}
+	}
+	var nilManager *Manager
+	if reason := nilManager.Check(checkTestCases[1].event); reason != "" {
+		t.Errorf("unexpected reason from nil manager: %q", reason)
+	}
+}
+
+// TestCreators ensures only the configured pubkeys may create groups
+func TestCreators(t *testing.T) {
+	m, err := NewManager(config.Groups{Enabled: true, CreatorPubkeys: []string{adminPubkey}}, relaySecretKey, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating manager: %v", err)
+	}
+	if reason := m.Check(groupEvent(strangerSecretKey, nostr.KindSimpleGroupCreateGroup, "other")); reason != "restricted: not allowed to create groups on this relay" {
+		t.Errorf("unexpected reason for group created by stranger: %q", reason)
+	}
+	if reason := m.Check(groupEvent(adminSecretKey, nostr.KindSimpleGroupCreateGroup, "other")); reason != "" {
+		t.Errorf("unexpected reason for group created by creator: %q", reason)
+	}
+}
+
+// TestApply ensures moderation and membership events change the group state and produce signed state events
+func TestApply(t *testing.T) {
+	store := &fakeStore{}
+	m := newTestManager(t, store, true)
+	for _, event := range store.events {
+		if event.Kind >= nostr.KindSimpleGroupMetadata && event.PubKey != m.Pubkey() {
+			t.Errorf("state event of kind %v not signed by the relay", event.Kind)
+		}
+		if ok, _ := event.CheckSignature(); !ok {
+			t.Errorf("invalid signature on event of kind %v", event.Kind)
+		}
+	}
+	// a closed group needs an invite
+	if result, _ := m.Apply(groupEvent(strangerSecretKey, nostr.KindSimpleGroupJoinRequest, "test")); len(result.Events) != 0 {
+		t.Error("expected join request without invite to be left for review")
+	}
+	if result, _ := m.Apply(groupEvent(strangerSecretKey, nostr.KindSimpleGroupJoinRequest, "test", nostr.Tag{"code", "wrong"})); len(result.Events) != 0 {
+		t.Error("expected join request with wrong invite to be left for review")
+	}
+	result, err := m.Apply(groupEvent(strangerSecretKey, nostr.KindSimpleGroupJoinRequest, "test", nostr.Tag{"code", "secret"}))
+	if err != nil || len(result.Events) != 1 || result.Events[0].Kind != nostr.KindSimpleGroupMembers {
+		t.Fatalf("unexpected result for join request with invite: %v, %v", result, err)
+	}
+	if !slices.ContainsFunc(result.Events[0].Tags, func(tag nostr.Tag) bool { return tag.Value() == strangerPubkey }) {
+		t.Error("expected new member in members event")
+	}
+	if reason := m.Check(groupEvent(strangerSecretKey, 9, "test")); reason != "" {
+		t.Errorf("unexpected reason for new member: %q", reason)
+	}
+	// leaving
+	if _, err := m.Apply(groupEvent(strangerSecretKey, nostr.KindSimpleGroupLeaveRequest, "test")); err != nil {
+		t.Fatalf("unexpected error when leaving group: %v", err)
+	}
+	if reason := m.Check(groupEvent(strangerSecretKey, 9, "test")); reason == "" {
+		t.Error("expected former member to be rejected")
+	}
+	// deleting events
+	result, _ = m.Apply(groupEvent(adminSecretKey, nostr.KindSimpleGroupDeleteEvent, "test", nostr.Tag{"e", "abc"}))
+	if !slices.Equal(result.Delete, []string{"abc"}) {
+		t.Errorf("unexpected deleted events: %v", result.Delete)
+	}
+	// deleting the group removes its state
+	result, _ = m.Apply(groupEvent(adminSecretKey, nostr.KindSimpleGroupDeleteGroup, "test"))
+	if len(result.Delete) != 4 {
+		t.Errorf("expected the 4 state events to be deleted, got %v", result.Delete)
+	}
+	if reason := m.Check(groupEvent(memberSecretKey, 9, "test")); reason != "invalid: unknown group" {
+		t.Errorf("unexpected reason for deleted group: %q", reason)
+	}
+}
+
+// TestLoad ensures the group state is rebuilt from storage
+func TestLoad(t *testing.T) {
+	store := &fakeStore{}
+	newTestManager(t, store, true)
+	m, _ := NewManager(config.Groups{Enabled: true}, relaySecretKey, zerolog.Nop())
+	if err := m.Load(nil); err != ErrQueryFuncNotSet {
+		t.Errorf("unexpected error without query function: %v", err)
+	}
+	loadBatchSize = 2
+	defer func() { loadBatchSize = 100 }()
+	if err := m.Load(store.query); err != nil {
+		t.Fatalf("unexpected error when loading groups: %v", err)
+	}
+	for _, testCase := range checkTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		if reason := m.Check(testCase.event); reason != testCase.reason {
+			t.Errorf("unexpected reason for test case %s after load: expected %q, got %q", testCase.name, testCase.reason, reason)
+		}
+	}
+	g := m.groups["test"]
+	if !g.Private || !g.Closed || !g.isAdmin(adminPubkey) {
+		t.Errorf("unexpected group state after load: %v", g.Group)
+	}
+	if _, ok := g.invites["secret"]; !ok {
+		t.Error("expected invite to be loaded")
+	}
+}
+
+// TestCanRead ensures the events of private groups are only sent to members
+func TestCanRead(t *testing.T) {
+	m := newTestManager(t, &fakeStore{}, false)
+	message := groupEvent(memberSecretKey, 9, "test")
+	invite := groupEvent(adminSecretKey, nostr.KindSimpleGroupCreateInvite, "test", nostr.Tag{"code", "other"})
+	authedAs := func(pubkeys ...string) func() []string { return func() []string { return pubkeys } }
+	if m.CanRead(&message, authedAs()) || m.CanRead(&message, authedAs(strangerPubkey)) {
+		t.Error("expected private message to be hidden from non members")
+	}
+	if !m.CanRead(&message, authedAs(strangerPubkey, memberPubkey)) {
+		t.Error("expected private message to be readable by members")
+	}
+	if m.CanRead(&invite, authedAs(memberPubkey)) || !m.CanRead(&invite, authedAs(adminPubkey)) {
+		t.Error("expected invite to be readable by admins only")
+	}
+	public := nostr.Event{Kind: 1}
+	if !m.CanRead(&public, authedAs()) {
+		t.Error("expected events outside of groups to be readable")
+	}
+}
+
+// TestDeletedGroup ensures the remaining events of a deleted private group stay unreadable, also after a restart, and its id can't be reused
+func TestDeletedGroup(t *testing.T) {
+	store := &fakeStore{}
+	m := newTestManager(t, store, false)
+	message := groupEvent(memberSecretKey, 9, "test")
+	store.store(message)
+	deleteGroup := groupEvent(adminSecretKey, nostr.KindSimpleGroupDeleteGroup, "test")
+	result, err := m.Apply(deleteGroup)
+	if err != nil {
+		t.Fatalf("unexpected error when deleting group: %v", err)
+	}
+	store.store(deleteGroup)
+	store.events = slices.DeleteFunc(store.events, func(event *nostr.Event) bool { return slices.Contains(result.Delete, event.ID) })
+	authedAs := func(pubkeys ...string) func() []string { return func() []string { return pubkeys } }
+	loaded, _ := NewManager(config.Groups{Enabled: true}, relaySecretKey, zerolog.Nop())
+	if err := loaded.Load(store.query); err != nil {
+		t.Fatalf("unexpected error when loading groups: %v", err)
+	}
+	for name, manager := range map[string]*Manager{"deleting": m, "loaded": loaded} {
+		if manager.CanRead(&message, authedAs()) || manager.CanRead(&message, authedAs(memberPubkey, adminPubkey)) {
+			t.Errorf("expected message of deleted group to be unreadable by the %s manager", name)
+		}
+		if reason := manager.Check(groupEvent(strangerSecretKey, nostr.KindSimpleGroupCreateGroup, "test")); reason != "blocked: group was deleted" {
+			t.Errorf("unexpected reason for recreating deleted group with the %s manager: %q", name, reason)
+		}
+	}
+}
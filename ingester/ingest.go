@@ -4,17 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/accesslog"
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/groups"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
 	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
 	"github.com/rs/zerolog"
 )
 
 var (
 	ErrRecvChanNotSet = errors.New("receive channel not set")
 	ErrSubIdTooLarge  = errors.New("subscription id too large")
+	// ErrDuplicateEvent is returned for an event which is already stored. Such events are acknowledged but neither stored nor forwarded
+	ErrDuplicateEvent = errors.New("already have this event")
+	// ErrStaleEvent is returned for a replaceable event which doesn't replace the stored version. Such events are rejected
+	ErrStaleEvent = errors.New("have a newer version of this event")
 )
 
 type Ingester struct {
@@ -25,6 +37,16 @@ type Ingester struct {
 	sendToFilterMgr   chan msg.ParsedMsg
 	quit              chan struct{}
 	queryFunc         func(context.Context, nostr.Filter) (chan *nostr.Event, error)
+	policy            *policy
+	reports           config.Reports
+	trust             *trustGraph
+	moderation        *moderation.Store
+	groups            *groups.Manager
+	authFunc          func(connectionId string, event nostr.Event) error
+	authedPubkeys     func(connectionId string) []string
+	accessLog         *accesslog.Logger
+	limiter           *rateLimiter
+	bus               *bus.Bus
 	stopping          bool
 	sync.WaitGroup
 	sync.RWMutex
@@ -38,6 +60,9 @@ func NewIngester(logger zerolog.Logger) *Ingester {
 		sendToDB:        make(chan msg.ParsedMsg),
 		sendToFilterMgr: make(chan msg.ParsedMsg),
 		quit:            make(chan struct{}),
+		policy:          newPolicy(config.Policy{}),
+		trust:           newTrustGraph(),
+		limiter:         newRateLimiter(0),
 		stopping:        false,
 	}
 }
@@ -51,6 +76,199 @@ func (i *Ingester) SetQueryFunc(queryFunc func(context.Context, nostr.Filter) (c
 	i.queryFunc = queryFunc
 }
 
+// SetAccessLog stores the access log to which EVENT decisions are written
+func (i *Ingester) SetAccessLog(accessLog *accesslog.Logger) {
+	i.accessLog = accessLog
+}
+
+// SetModeration stores the moderation state which new events are checked against after the policy
+func (i *Ingester) SetModeration(store *moderation.Store) {
+	i.moderation = store
+}
+
+// SetGroups stores the group manager which checks and applies the events of NIP-29 groups
+func (i *Ingester) SetGroups(manager *groups.Manager) {
+	i.groups = manager
+}
+
+// SetAuthFunc stores the function validating NIP-42 AUTH messages for a connection
+func (i *Ingester) SetAuthFunc(authFunc func(connectionId string, event nostr.Event) error) {
+	i.authFunc = authFunc
+}
+
+// SetAuthedPubkeysFunc stores the function returning the pubkeys a connection authenticated as
+func (i *Ingester) SetAuthedPubkeysFunc(authedPubkeys func(connectionId string) []string) {
+	i.authedPubkeys = authedPubkeys
+}
+
+// SetBus stores the bus on which accepted and deleted events are published
+func (i *Ingester) SetBus(b *bus.Bus) {
+	i.bus = b
+}
+
+// SetPolicy replaces the policy applied to new events. It is safe to call while the ingester is running
+func (i *Ingester) SetPolicy(cfg config.Policy) {
+	i.Lock()
+	defer i.Unlock()
+	i.policy = newPolicy(cfg)
+	i.limiter.setLimit(cfg.MaxEventsPerMinute)
+	i.trust.configure(cfg.WebOfTrust)
+}
+
+// SetReports replaces the thresholds and weights applied to new NIP-56 reports. It is safe to call while the ingester is running
+func (i *Ingester) SetReports(cfg config.Reports) {
+	i.Lock()
+	defer i.Unlock()
+	i.reports = cfg
+}
+
+// Reload applies the reloadable settings of the given configuration
+func (i *Ingester) Reload(cfg *config.Config) error {
+	i.SetPolicy(cfg.Policy)
+	i.SetReports(cfg.Moderation.Reports)
+	i.logger.Info().Msg("policy reloaded")
+	return nil
+}
+
+// checkProtected returns the reason a NIP-70 protected event is rejected when the connection isn't authenticated as its author
+func (i *Ingester) checkProtected(connectionId string, event nostr.Event) string {
+	if event.Tags.GetFirst([]string{"-"}) == nil {
+		return ""
+	}
+	var pubkeys []string
+	if i.authedPubkeys != nil {
+		pubkeys = i.authedPubkeys(connectionId)
+	}
+	if len(pubkeys) == 0 {
+		return "auth-required: this event may only be published by its author"
+	}
+	if !slices.Contains(pubkeys, event.PubKey) {
+		return "restricted: this event may only be published by its author"
+	}
+	return ""
+}
+
+// checkGiftWrap returns the reason a NIP-59 gift wrap is rejected when it isn't addressed to exactly one recipient
+func checkGiftWrap(event nostr.Event) string {
+	if event.Kind == nostr.KindGiftWrap && len(event.Tags.GetAll([]string{"p", ""})) != 1 {
+		return "invalid: gift wraps must have exactly one p tag"
+	}
+	return ""
+}
+
+// checkPolicy checks the given event against the protected event and gift wrap rules, the current policy, the moderation state, the web of trust and the group rules and returns the reason it is rejected, if any
+func (i *Ingester) checkPolicy(connectionId string, event nostr.Event) string {
+	if reason := i.checkProtected(connectionId, event); reason != "" {
+		return reason
+	}
+	if reason := checkGiftWrap(event); reason != "" {
+		return reason
+	}
+	i.RLock()
+	policy := i.policy
+	i.RUnlock()
+	if reason := policy.check(event); reason != "" {
+		return reason
+	}
+	if reason := i.moderation.Check(event, policy.allowlists); reason != "" {
+		return reason
+	}
+	if trusted, err := i.trust.isTrusted(event.PubKey, i.queryFunc); err != nil {
+		i.logger.Error().Err(err).Msg("failed to compute web of trust")
+		return "error: failed to check the web of trust"
+	} else if !trusted {
+		return "restricted: pubkey is not in the web of trust of this relay"
+	}
+	return i.groups.Check(event)
+}
+
+// applyGroupEvent updates the group state with a stored event, deleting the events removed by group admins and storing the new relay signed group state
+func (i *Ingester) applyGroupEvent(logger zerolog.Logger, event nostr.Event) {
+	result, err := i.groups.Apply(event)
+	if err != nil {
+		logger.Error().Err(err).Str("eventId", event.ID).Msg("failed to apply group event")
+		return
+	}
+	for _, id := range result.Delete {
+		if err := i.DeleteEvent(id); err != nil {
+			logger.Error().Err(err).Str("eventId", id).Msg("failed to delete group event")
+		}
+	}
+	for _, stateEvent := range result.Events {
+		if err := i.storeRelayEvent(stateEvent); err != nil {
+			logger.Error().Err(err).Str("eventId", stateEvent.ID).Msg("failed to store group state")
+		}
+	}
+}
+
+// storeRelayEvent stores an addressable event signed by the relay, replacing the previous version, and sends it to the filter manager
+func (i *Ingester) storeRelayEvent(event nostr.Event) error {
+	if err := i.handleReplaceableEvent(event, nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}, Tags: nostr.TagMap{"d": []string{event.Tags.GetD()}}}, ""); err != nil {
+		return err
+	}
+	envelope := &nostr.EventEnvelope{Event: event}
+	dbErrChan := make(chan error)
+	i.sendToDB <- msg.ParsedMsg{Data: envelope, Callback: func(err error) { dbErrChan <- err }}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	select {
+	case err := <-dbErrChan:
+		if err != nil {
+			return fmt.Errorf("failed to store event: %w", err)
+		}
+	case <-timer.C:
+		return errors.New("timed out waiting for response from storage backend")
+	}
+	i.forward(msg.Msg{}, envelope)
+	return nil
+}
+
+// DeleteEvent removes the event with the given id from storage. Nothing is done if the event isn't stored
+func (i *Ingester) DeleteEvent(id string) error {
+	rcvChan, err := i.queryFunc(context.Background(), nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return fmt.Errorf("failed to query storage for event: %w", err)
+	}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	var found *nostr.Event
+queryLoop:
+	for {
+		select {
+		case event, ok := <-rcvChan:
+			if !ok || event == nil {
+				break queryLoop
+			}
+			found = event
+		case <-timer.C:
+			return errors.New("timed out while querying storage for event")
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	i.logger.Debug().Str("eventId", id).Msg("sending delete to storage backend...")
+	if err := i.deleteStored("", *found); err != nil {
+		return fmt.Errorf("failed to delete event: %w", err)
+	}
+	return nil
+}
+
+// deleteStored removes a stored event from storage and publishes its deletion on the bus
+func (i *Ingester) deleteStored(connectionId string, event nostr.Event) error {
+	dbErrChan := make(chan error)
+	i.sendToDB <- msg.ParsedMsg{ConnectionId: connectionId, Data: &nostr.EventEnvelope{Event: event}, Callback: func(err error) { dbErrChan <- err }, DeleteEvent: true}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	select {
+	case err := <-dbErrChan:
+		if err != nil {
+			return err
+		}
+	case <-timer.C:
+		return errors.New("timed out waiting for response from storage backend")
+	}
+	bus.Publish(i.bus, bus.EventDeleted, bus.Event{ConnectionId: connectionId, Event: event})
+	return nil
+}
+
 // Start starts the ingest routine
 func (i *Ingester) Start() error {
 	i.logger.Info().Msg("starting up...")
@@ -81,181 +299,243 @@ queryLoop:
 			return errors.New("timed out while querying storage for any existing replaceable events")
 		}
 	}
+	// the same event, e.g. replicated back by a peer, is a duplicate and one which doesn't replace the stored one is stale, we keep the stored one
+	for _, event := range events {
+		if event.ID == newEvent.ID {
+			return ErrDuplicateEvent
+		}
+		if !replaces(newEvent, *event) {
+			return ErrStaleEvent
+		}
+	}
 	if len(events) > 0 {
 		// delete all these events
 		for _, event := range events {
-			// if the stored event is newer than the received event, we keep the latest one
-			if event.CreatedAt.Time().After(newEvent.CreatedAt.Time()) {
-				return errors.New("replaceable event is older than already stored replaceable event")
-			}
 			// send to db
 			i.logger.Debug().Str("connectionId", connectionId).Msg("sending message to storage backend...")
-			dbErrChan := make(chan error)
-			i.sendToDB <- msg.ParsedMsg{ConnectionId: connectionId, Data: &nostr.EventEnvelope{Event: *event}, Callback: func(err error) { dbErrChan <- err }, DeleteEvent: true}
-			timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
-
-			i.logger.Debug().Str("connectionId", connectionId).Msg("awaiting signal from storage backend...")
-			select {
-			case err := <-dbErrChan:
-				if err != nil {
-					return fmt.Errorf("failed to delete stale replaceable events: %w", err)
-				}
-			case <-timer.C:
-				return errors.New("timed out waiting for response from storage backend")
+			if err := i.deleteStored(connectionId, *event); err != nil {
+				return fmt.Errorf("failed to delete stale replaceable events: %w", err)
 			}
 		}
 	}
 	return nil
 }
 
+// replaces checks if the given event replaces the stored version as defined by NIP-01: the newest one is kept and the one with the lowest id when both have the same created_at
+func replaces(event, stored nostr.Event) bool {
+	if event.CreatedAt != stored.CreatedAt {
+		return event.CreatedAt > stored.CreatedAt
+	}
+	return event.ID < stored.ID
+}
+
+// sendOK sends an OK message for the given event to the client and records the decision in the access log
+func (i *Ingester) sendOK(logger zerolog.Logger, message msg.Msg, event nostr.Event, ok bool, reason string) {
+	msgBytes, err := nostr.OKEnvelope{
+		EventID: event.ID,
+		OK:      ok,
+		Reason:  reason,
+	}.MarshalJSON()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to JSON marshal message")
+	}
+	i.accessLog.Event(message.ConnectionId, message.RemoteIP, event, ok, reason)
+	i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
+}
+
+// handleEvent validates a new event, checks it against the policy and stores it. The OK state and reason are given to reply, which is called once before the event is sent to the filter manager
+func (i *Ingester) handleEvent(logger zerolog.Logger, message msg.Msg, envelope *nostr.EventEnvelope, reply func(ok bool, reason string)) {
+	if ok, err := envelope.CheckSignature(); err != nil || !ok {
+		reply(false, "error: invalid event signature or event id")
+		return
+	}
+	if reason := i.checkPolicy(message.ConnectionId, envelope.Event); reason != "" {
+		logger.Info().Str("eventId", envelope.ID).Msgf("rejecting event: %s", reason)
+		reply(false, reason)
+		return
+	}
+	switch {
+	// replaceable
+	case envelope.Kind == 0 || envelope.Kind == 3 || (envelope.Kind >= 10000 && envelope.Kind < 20000):
+		if err := i.handleReplaceableEvent(envelope.Event, nostr.Filter{Kinds: []int{envelope.Kind}, Authors: []string{envelope.PubKey}}, message.ConnectionId); errors.Is(err, ErrDuplicateEvent) {
+			reply(true, fmt.Sprintf("duplicate: %s", err.Error()))
+			return
+		} else if errors.Is(err, ErrStaleEvent) {
+			reply(false, fmt.Sprintf("invalid: %s", err.Error()))
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msg("failed to handle replaceable event")
+			reply(false, fmt.Sprintf("error: %s", err.Error()))
+			return
+		}
+	// ephemeral
+	case (envelope.Kind >= 20000 && envelope.Kind < 30000):
+		// send OK message
+		reply(true, "")
+		i.forward(message, envelope)
+		return
+	// addressable
+	case (envelope.Kind >= 30000 && envelope.Kind < 40000):
+		// check if the event has a d tag, if so then handle like a parametrized replaceable event
+		if dTag := envelope.Tags.GetD(); dTag != "" {
+			if err := i.handleReplaceableEvent(envelope.Event, nostr.Filter{Kinds: []int{envelope.Kind}, Authors: []string{envelope.PubKey}, Tags: nostr.TagMap{"d": []string{dTag}}}, message.ConnectionId); errors.Is(err, ErrDuplicateEvent) {
+				reply(true, fmt.Sprintf("duplicate: %s", err.Error()))
+				return
+			} else if errors.Is(err, ErrStaleEvent) {
+				reply(false, fmt.Sprintf("invalid: %s", err.Error()))
+				return
+			} else if err != nil {
+				logger.Error().Err(err).Msg("failed to handle replaceable event")
+				reply(false, fmt.Sprintf("error: %s", err.Error()))
+				return
+			}
+		}
+	}
+	// send to db
+	logger.Debug().Msg("sending message to storage backend...")
+	dbErrChan := make(chan error)
+	i.sendToDB <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, Data: envelope, Callback: func(err error) { dbErrChan <- err }}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	// wait for signal from storage
+	logger.Debug().Msg("awaiting signal from storage backend...")
+	select {
+	case err := <-dbErrChan:
+		if errors.Is(err, eventstore.ErrDupEvent) {
+			reply(true, fmt.Sprintf("duplicate: %s", ErrDuplicateEvent.Error()))
+			return
+		} else if err != nil {
+			// send OK error message
+			reply(false, "error: failed to store event")
+			return
+		}
+		// send OK message
+		reply(true, "")
+		i.forward(message, envelope)
+		i.applyGroupEvent(logger, envelope.Event)
+		// a follow list only changes the web of trust once stored
+		if envelope.Kind == nostr.KindFollowList {
+			if err := i.trust.update(envelope.Event, i.queryFunc); err != nil {
+				logger.Error().Err(err).Msg("failed to update web of trust")
+			}
+		}
+		if envelope.Kind == nostr.KindReporting {
+			i.handleReport(logger, envelope.Event)
+		}
+	case <-timer.C:
+		logger.Error().Err(errors.New("timed out waiting for response from storage backend")).Str("connectionId", message.ConnectionId).Msg("failed to store event")
+		reply(false, "error: failed to store event")
+	}
+}
+
+// IngestEvent runs an event which wasn't received from a websocket connection, e.g. one replicated from another relay, through the same validation, policy and storage as published events and returns its OK state and reason. The connection id names the source of the event. Such events aren't rate limited
+func (i *Ingester) IngestEvent(connectionId string, event nostr.Event) (bool, string) {
+	logger := i.logger.With().Str("connectionId", connectionId).Logger()
+	message := msg.Msg{ConnectionId: connectionId}
+	var accepted bool
+	var reason string
+	i.handleEvent(logger, message, &nostr.EventEnvelope{Event: event}, func(ok bool, why string) {
+		accepted, reason = ok, why
+		i.accessLog.Event(connectionId, "", event, ok, why)
+	})
+	return accepted, reason
+}
+
+// forward sends an accepted event to the filter manager and publishes it on the bus
+func (i *Ingester) forward(message msg.Msg, envelope *nostr.EventEnvelope) {
+	i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, Data: envelope}
+	bus.Publish(i.bus, bus.EventAccepted, bus.Event{ConnectionId: message.ConnectionId, Event: envelope.Event})
+}
+
 // ingestWorker is spun up as a go routine to parse, validate and verify new messages
 // TODO - Add a timeout to this goroutine
 func (i *Ingester) ingestWorker(message msg.Msg) {
 	defer i.Done() // TODO - Can this go routine hang on channel send?
-	i.logger.Debug().Str("connectionId", message.ConnectionId).Msg("starting ingest worker...")
-	switch envelope := nostr.ParseMessage(message.Data).(type) {
+	logger := i.logger.With().Str("connectionId", message.ConnectionId).Str("ip", message.RemoteIP).Logger()
+	logger.Debug().Msg("starting ingest worker...")
+	// NIP-77 messages are parsed first since nostr.ParseMessage would read NEG-CLOSE as a CLOSE
+	parsed := nip77.ParseNegMessage(message.Data)
+	if parsed == nil {
+		parsed = nostr.ParseMessage(message.Data)
+	}
+	switch envelope := parsed.(type) {
 	case *nostr.EventEnvelope:
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("raw event: %v\n", envelope)
-		if ok, err := envelope.CheckSignature(); err != nil || !ok {
-			msgBytes, err := nostr.OKEnvelope{
-				EventID: envelope.ID,
-				OK:      false,
-				Reason:  "error: invalid event signature or event id",
-			}.MarshalJSON()
-			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-			}
-			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
+		logger.Trace().Msgf("raw event: %v\n", envelope)
+		if !i.limiter.allow(message.ConnectionId, time.Now()) {
+			logger.Info().Str("eventId", envelope.ID).Msg("rejecting event: rate limited")
+			i.sendOK(logger, message, envelope.Event, false, "rate-limited: slow down, too many events")
 			return
 		}
-		okMsg := nostr.OKEnvelope{
-			EventID: envelope.ID,
-			OK:      true,
-			Reason:  "",
+		i.handleEvent(logger, message, envelope, func(ok bool, reason string) { i.sendOK(logger, message, envelope.Event, ok, reason) })
+	case *nostr.AuthEnvelope:
+		logger.Trace().Msgf("raw auth: %v\n", envelope)
+		var err error
+		if i.authFunc == nil {
+			err = errors.New("authentication is not supported by this relay")
+		} else {
+			err = i.authFunc(message.ConnectionId, envelope.Event)
 		}
-		switch {
-		// replaceable
-		case envelope.Kind == 0 || envelope.Kind == 3 || (envelope.Kind >= 10000 && envelope.Kind < 20000):
-			if err := i.handleReplaceableEvent(envelope.Event, nostr.Filter{Kinds: []int{envelope.Kind}, Authors: []string{envelope.PubKey}}, message.ConnectionId); err != nil {
-				i.logger.Error().Err(err).Msg("failed to handle replaceable event")
-				okMsg.OK = false
-				okMsg.Reason = fmt.Sprintf("error: %s", err.Error())
-				msgBytes, err := okMsg.MarshalJSON()
-				if err != nil {
-					i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-				}
-				i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
-				return
-			}
-		// ephemeral
-		case (envelope.Kind >= 20000 && envelope.Kind < 30000):
-			// send OK message
-			msgBytes, err := okMsg.MarshalJSON()
-			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-			}
-			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
-			// send to filter manager
-			i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, Data: envelope}
-			return
-		// addressable
-		case (envelope.Kind >= 30000 && envelope.Kind < 40000):
-			// check if the event has a d tag, if so then handle like a parametrized replaceable event
-			if dTag := envelope.Tags.GetD(); dTag != "" {
-				if err := i.handleReplaceableEvent(envelope.Event, nostr.Filter{Kinds: []int{envelope.Kind}, Authors: []string{envelope.PubKey}, Tags: nostr.TagMap{"d": []string{dTag}}}, message.ConnectionId); err != nil {
-					i.logger.Error().Err(err).Msg("failed to handle replaceable event")
-					okMsg.OK = false
-					okMsg.Reason = fmt.Sprintf("error: %s", err.Error())
-					msgBytes, err := okMsg.MarshalJSON()
-					if err != nil {
-						i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-					}
-					i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
-					return
-				}
-			}
+		reason := ""
+		if err != nil {
+			logger.Info().Err(err).Str("eventId", envelope.Event.ID).Msg("rejecting auth")
+			reason = fmt.Sprintf("invalid: %s", err.Error())
+		} else {
+			logger.Info().Str("pubkey", envelope.Event.PubKey).Msg("connection authenticated")
 		}
-		// send to db
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msg("sending message to storage backend...")
-		dbErrChan := make(chan error)
-		i.sendToDB <- msg.ParsedMsg{ConnectionId: message.ConnectionId, Data: envelope, Callback: func(err error) { dbErrChan <- err }}
-		timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
-		// wait for signal from storage
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msg("awaiting signal from storage backend...")
-		select {
-		case err := <-dbErrChan:
-			if err != nil {
-				// send OK error message
-				okMsg.OK = false
-				okMsg.Reason = "error: failed to store event"
-				// send OK message
-				msgBytes, err := okMsg.MarshalJSON()
-				if err != nil {
-					i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-				}
-				i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
-				return
-			}
-			// send OK message
-			msgBytes, err := okMsg.MarshalJSON()
-			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-			}
-			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
-			// send to filter manager
-			i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, Data: envelope}
-		case <-timer.C:
-			i.logger.Error().Err(errors.New("timed out waiting for response from storage backend")).Str("connectionId", message.ConnectionId).Msg("failed to store event")
-			msgBytes, err := nostr.OKEnvelope{
-				EventID: envelope.ID,
-				OK:      false,
-				Reason:  "error: failed to store event",
-			}.MarshalJSON()
-			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
-			}
-			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
+		msgBytes, err := nostr.OKEnvelope{
+			EventID: envelope.Event.ID,
+			OK:      reason == "",
+			Reason:  reason,
+		}.MarshalJSON()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to JSON marshal message")
 		}
+		i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
 	case *nostr.ReqEnvelope:
 		// enforce subid being 64 characters in length
 		if len(envelope.SubscriptionID) > 64 {
-			i.logger.Error().Err(ErrSubIdTooLarge).Str("connectionId", message.ConnectionId).Msg("rejecting REQ")
+			logger.Error().Err(ErrSubIdTooLarge).Msg("rejecting REQ")
+			reason := "error: subscription id exceeds 64 character limit"
+			i.accessLog.Req(message.ConnectionId, message.RemoteIP, envelope.SubscriptionID, envelope.Filters, 0, 0, reason)
 			msgBytes, err := nostr.ClosedEnvelope{
 				SubscriptionID: envelope.SubscriptionID,
-				Reason:         "error: subscription id exceeds 64 character limit",
+				Reason:         reason,
 			}.MarshalJSON()
 			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
+				logger.Fatal().Err(err).Msg("failed to JSON marshal message")
 			}
 			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes}
 			return
 		}
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("raw req: %v\n", envelope)
+		logger.Trace().Msgf("raw req: %v\n", envelope)
 		// send to filter manager
-		i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, Data: envelope}
+		i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, Data: envelope}
 	case *nostr.CloseEnvelope:
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("raw close: %v\n", envelope)
+		logger.Trace().Msgf("raw close: %v\n", envelope)
 		if err := envelope.UnmarshalJSON(message.Data); err != nil {
 			msgBytes, err := nostr.NoticeEnvelope("error: failed to parse message and continued failure to parse future messages will result in a ban").MarshalJSON()
 			if err != nil {
-				i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
+				logger.Fatal().Err(err).Msg("failed to JSON marshal message")
 			}
 			i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes, Unparseable: true}
-			i.logger.Error().Str("connectionId", message.ConnectionId).Msg("failed to parse message, skipping")
+			logger.Error().Msg("failed to parse message, skipping")
 			return
 		}
 		// send to filter manager
-		i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, Data: envelope}
+		i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, Data: envelope}
+	case *nip77.OpenEnvelope, *nip77.MessageEnvelope, *nip77.CloseEnvelope, *nip77.ErrorEnvelope:
+		logger.Trace().Msgf("raw negentropy message: %v\n", envelope)
+		// send to filter manager which holds the negentropy sessions
+		i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, Data: envelope}
 	case nil:
-		i.logger.Debug().Str("connectionId", message.ConnectionId).Msgf("raw message: %s", string(message.Data))
+		logger.Trace().Msgf("raw message: %s", string(message.Data))
 		msgBytes, err := nostr.NoticeEnvelope("error: failed to parse message and continued failure to parse future messages will result in a ban").MarshalJSON()
 		if err != nil {
-			i.logger.Fatal().Err(err).Str("connectionId", message.ConnectionId).Msg("failed to JSON marshal message")
+			logger.Fatal().Err(err).Msg("failed to JSON marshal message")
 		}
 		i.sendToWSHandler <- msg.Msg{ConnectionId: message.ConnectionId, Data: msgBytes, Unparseable: true}
-		i.logger.Error().Str("connectionId", message.ConnectionId).Msg("failed to parse message, skipping")
+		logger.Error().Msg("failed to parse message, skipping")
 	}
-	i.logger.Debug().Str("connectionId", message.ConnectionId).Msg("ingest worker routine completed")
+	logger.Debug().Msg("ingest worker routine completed")
 }
 
 // ingest is the goroutine which will receive messages over the recv channel and start up ingest workers
@@ -276,7 +556,8 @@ loop:
 				continue loop
 			}
 			if message.CloseConn {
-				i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, CloseConn: true}
+				i.limiter.forget(message.ConnectionId)
+				i.sendToFilterMgr <- msg.ParsedMsg{ConnectionId: message.ConnectionId, RemoteIP: message.RemoteIP, CloseConn: true}
 				continue loop
 			}
 			// Spin up a worker go routine which will ingest the message
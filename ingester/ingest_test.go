@@ -5,12 +5,15 @@ import (
 	"errors"
 	"os"
 	"reflect"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/bus"
 	"github.com/TheRebelOfBabylon/tandem/msg"
 	"github.com/TheRebelOfBabylon/tandem/test"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
 	"github.com/rs/zerolog"
 )
 
@@ -230,6 +233,28 @@ var (
 				Data:         &defaultClose,
 			},
 		},
+		{
+			name: "ValidCase_NegOpen",
+			inputRawMsg: msg.Msg{
+				ConnectionId: connIdOne,
+				Data:         []byte(`["NEG-OPEN","sync",{"kinds":[1]},"6100000200"]`),
+			},
+			expectedFilterMgrMsg: &msg.ParsedMsg{
+				ConnectionId: connIdOne,
+				Data:         &nip77.OpenEnvelope{SubscriptionID: "sync", Filter: nostr.Filter{Kinds: []int{1}}, Message: "6100000200"},
+			},
+		},
+		{
+			name: "ValidCase_NegClose",
+			inputRawMsg: msg.Msg{
+				ConnectionId: connIdOne,
+				Data:         []byte(`["NEG-CLOSE","sync"]`),
+			},
+			expectedFilterMgrMsg: &msg.ParsedMsg{
+				ConnectionId: connIdOne,
+				Data:         &nip77.CloseEnvelope{SubscriptionID: "sync"},
+			},
+		},
 		{
 			name: "ValidCase_InvalidMessage",
 			inputRawMsg: msg.Msg{
@@ -448,6 +473,23 @@ var ingesterReplaceableEventsTestCases = []ingesterReplaceableEventTestCase{
 			ConnectionId: connIdOne,
 		},
 	},
+	{
+		name:           "ErrorCase_Event_RepleaceableEvent_NewerEventStored",
+		connId:         connIdOne,
+		inputEventKind: 14567,
+		expectedOkMsg: &nostr.OKEnvelope{
+			OK:     false,
+			Reason: "invalid: have a newer version of this event",
+		},
+		queryFunc: func(ctx context.Context, f nostr.Filter) (chan *nostr.Event, error) {
+			queryChan := make(chan *nostr.Event)
+			go func() {
+				queryChan <- &nostr.Event{ID: "abc123", Kind: 14567, CreatedAt: nostr.Now() + 3600}
+				close(queryChan)
+			}()
+			return queryChan, nil
+		},
+	},
 	{
 		name:           "ValidCase_Event_ParametrizedRepleaceableEvent",
 		inputEventKind: 34567,
@@ -679,3 +721,102 @@ func TestIngesterReplaceableEvents(t *testing.T) {
 	}
 	t.Log("completed test")
 }
+
+// TestDeleteEventBus ensures events deleted from storage are published on the bus
+func TestDeleteEventBus(t *testing.T) {
+	ingester := NewIngester(zerolog.Nop())
+	eventBus := bus.New()
+	ingester.SetBus(eventBus)
+	stored := test.CreateRandomEvent()
+	ingester.SetQueryFunc(func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		events := make(chan *nostr.Event, 1)
+		if slices.Contains(filter.IDs, stored.ID) {
+			events <- &stored
+		}
+		close(events)
+		return events, nil
+	})
+	var deleted []bus.Event
+	bus.Subscribe(eventBus, bus.EventDeleted, func(e bus.Event) { deleted = append(deleted, e) })
+	go func() {
+		for parsedMsg := range ingester.SendToDBChannel() {
+			parsedMsg.Callback(nil)
+		}
+	}()
+	defer close(ingester.SendToDBChannel())
+	for _, id := range []string{"unknown", stored.ID} {
+		if err := ingester.DeleteEvent(id); err != nil {
+			t.Fatalf("unexpected error when deleting event %s: %v", id, err)
+		}
+	}
+	if len(deleted) != 1 || deleted[0].Event.ID != stored.ID || deleted[0].ConnectionId != "" {
+		t.Errorf("unexpected deleted events published: %v", deleted)
+	}
+}
+
+type replaceableEventTestCase struct {
+	name          string
+	event         nostr.Event
+	expectedError error
+}
+
+var (
+	storedReplaceableEvent    = nostr.Event{ID: "bbbb", Kind: 14567, CreatedAt: 10}
+	replaceableEventTestCases = []replaceableEventTestCase{
+		{
+			name:          "SameEvent",
+			event:         storedReplaceableEvent,
+			expectedError: ErrDuplicateEvent,
+		},
+		{
+			name:          "OlderEvent",
+			event:         nostr.Event{ID: "aaaa", Kind: 14567, CreatedAt: 9},
+			expectedError: ErrStaleEvent,
+		},
+		{
+			name:          "SameCreatedAtHigherId",
+			event:         nostr.Event{ID: "cccc", Kind: 14567, CreatedAt: 10},
+			expectedError: ErrStaleEvent,
+		},
+		{
+			name:  "SameCreatedAtLowerId",
+			event: nostr.Event{ID: "aaaa", Kind: 14567, CreatedAt: 10},
+		},
+		{
+			name:  "NewerEvent",
+			event: nostr.Event{ID: "cccc", Kind: 14567, CreatedAt: 11},
+		},
+	}
+)
+
+// TestHandleReplaceableEvent ensures replaceable events replace the stored version when they are newer or, with the same created_at, have a lower id
+func TestHandleReplaceableEvent(t *testing.T) {
+	ingester := NewIngester(zerolog.Nop())
+	ingester.SetQueryFunc(func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		events := make(chan *nostr.Event, 1)
+		stored := storedReplaceableEvent
+		events <- &stored
+		close(events)
+		return events, nil
+	})
+	var deleted []string
+	go func() {
+		for parsedMsg := range ingester.SendToDBChannel() {
+			deleted = append(deleted, parsedMsg.Data.(*nostr.EventEnvelope).ID)
+			parsedMsg.Callback(nil)
+		}
+	}()
+	defer close(ingester.SendToDBChannel())
+	for _, testCase := range replaceableEventTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		deleted = nil
+		err := ingester.handleReplaceableEvent(testCase.event, nostr.Filter{Kinds: []int{14567}}, connIdOne)
+		if !errors.Is(err, testCase.expectedError) {
+			t.Errorf("unexpected error for test case %s: expected %v, got %v", testCase.name, testCase.expectedError, err)
+		}
+		if replaced := len(deleted) == 1 && deleted[0] == storedReplaceableEvent.ID; replaced != (testCase.expectedError == nil) {
+			t.Errorf("unexpected deleted events for test case %s: %v", testCase.name, deleted)
+		}
+	}
+	t.Log("all tests completed")
+}
@@ -0,0 +1,103 @@
+package ingester
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	rateLimitWindow = time.Minute
+)
+
+type policy struct {
+	bannedPubkeys   map[string]struct{}
+	disallowedKinds map[int]struct{}
+	// allowlists are checked along with those of the moderation state, see moderation.Store.Check
+	allowlists moderation.Allowlists
+}
+
+// toSet converts a slice into a set for constant time lookups
+func toSet[T comparable](items []T) map[T]struct{} {
+	set := make(map[T]struct{}, len(items))
+	for _, item := range items {
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+// newPolicy builds the write policy from the policy configuration
+func newPolicy(cfg config.Policy) *policy {
+	return &policy{
+		bannedPubkeys:   toSet(cfg.BannedPubkeys),
+		disallowedKinds: toSet(cfg.DisallowedKinds),
+		allowlists:      moderation.Allowlists{Pubkeys: toSet(cfg.AllowedPubkeys), Kinds: toSet(cfg.AllowedKinds)},
+	}
+}
+
+// check returns the reason, prefixed as per NIP-01, for which the given event is rejected by the banned pubkeys and disallowed kinds of the configuration or an empty string if it is accepted. The allowlists are checked with the moderation state
+func (p *policy) check(event nostr.Event) string {
+	if _, ok := p.bannedPubkeys[event.PubKey]; ok {
+		return "blocked: pubkey is banned"
+	}
+	if _, ok := p.disallowedKinds[event.Kind]; ok {
+		return fmt.Sprintf("blocked: kind %v is not accepted by this relay", event.Kind)
+	}
+	return ""
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+type rateLimiter struct {
+	limit   int
+	windows map[string]*rateWindow
+	sync.Mutex
+}
+
+// newRateLimiter instantiates a rate limiter allowing limit events per connection per minute. A limit of 0 disables rate limiting
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+// setLimit changes the limit. Existing windows are kept so a reload doesn't reset the count of a connection
+func (r *rateLimiter) setLimit(limit int) {
+	r.Lock()
+	defer r.Unlock()
+	r.limit = limit
+}
+
+// allow checks if the given connection may publish another event and counts it if so
+func (r *rateLimiter) allow(connectionId string, now time.Time) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.limit <= 0 {
+		return true
+	}
+	window, ok := r.windows[connectionId]
+	if !ok || now.Sub(window.start) >= rateLimitWindow {
+		window = &rateWindow{start: now}
+		r.windows[connectionId] = window
+	}
+	if window.count >= r.limit {
+		return false
+	}
+	window.count++
+	return true
+}
+
+// forget removes the window of a closed connection
+func (r *rateLimiter) forget(connectionId string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.windows, connectionId)
+}
@@ -0,0 +1,178 @@
+package ingester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/storage/memory"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+type policyTestCase struct {
+	name           string
+	cfg            config.Policy
+	event          nostr.Event
+	expectedReason string
+}
+
+var (
+	otherPubkey     = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	policyTestCases = []policyTestCase{
+		{
+			name:  "NoPolicy",
+			event: defaultEvent,
+		},
+		{
+			name:           "BannedPubkey",
+			cfg:            config.Policy{BannedPubkeys: []string{defaultEvent.PubKey}},
+			event:          defaultEvent,
+			expectedReason: "blocked: pubkey is banned",
+		},
+		{
+			name:           "PubkeyNotAllowed",
+			cfg:            config.Policy{AllowedPubkeys: []string{otherPubkey}},
+			event:          defaultEvent,
+			expectedReason: "restricted: pubkey is not allowed to publish to this relay",
+		},
+		{
+			name:  "PubkeyAllowed",
+			cfg:   config.Policy{AllowedPubkeys: []string{defaultEvent.PubKey}},
+			event: defaultEvent,
+		},
+		{
+			name:           "DisallowedKind",
+			cfg:            config.Policy{DisallowedKinds: []int{1}},
+			event:          defaultEvent,
+			expectedReason: "blocked: kind 1 is not accepted by this relay",
+		},
+		{
+			name:           "KindNotAllowed",
+			cfg:            config.Policy{AllowedKinds: []int{0, 3}},
+			event:          defaultEvent,
+			expectedReason: "blocked: kind 1 is not accepted by this relay",
+		},
+	}
+)
+
+// TestPolicy ensures events are rejected according to the policy configuration
+func TestPolicy(t *testing.T) {
+	for _, testCase := range policyTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		i := NewIngester(zerolog.Nop())
+		i.SetPolicy(testCase.cfg)
+		if reason := i.checkPolicy(connIdOne, testCase.event); reason != testCase.expectedReason {
+			t.Errorf("unexpected reason for test case %s: expected %q, got %q", testCase.name, testCase.expectedReason, reason)
+		}
+	}
+	t.Log("all tests completed")
+}
+
+// TestRateLimiter ensures connections are limited per window and that a reload changes the limit
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if !limiter.allow(connIdOne, now) {
+			t.Fatalf("event %v unexpectedly rate limited", i)
+		}
+	}
+	if limiter.allow(connIdOne, now) {
+		t.Error("expected third event in the window to be rate limited")
+	}
+	if !limiter.allow("other", now) {
+		t.Error("expected rate limit to be per connection")
+	}
+	if !limiter.allow(connIdOne, now.Add(rateLimitWindow)) {
+		t.Error("expected rate limit to reset after the window")
+	}
+	limiter.setLimit(0)
+	for i := 0; i < 5; i++ {
+		if !limiter.allow(connIdOne, now) {
+			t.Fatal("expected no rate limit when limit is 0")
+		}
+	}
+	limiter.forget(connIdOne)
+	if _, ok := limiter.windows[connIdOne]; ok {
+		t.Error("expected window to be removed")
+	}
+}
+
+// TestModerationPolicy ensures the moderation state is checked after the configured policy and that their allowlists add to each other
+func TestModerationPolicy(t *testing.T) {
+	i := NewIngester(zerolog.Nop())
+	if reason := i.checkPolicy(connIdOne, defaultEvent); reason != "" {
+		t.Fatalf("unexpected reason without moderation state: %q", reason)
+	}
+	repo, _ := memory.NewModerationRepository("")
+	store, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation store: %v", err)
+	}
+	i.SetModeration(store)
+	if err := store.BanEvent(defaultEvent.ID, "illegal"); err != nil {
+		t.Fatalf("unexpected error when banning event: %v", err)
+	}
+	if reason := i.checkPolicy(connIdOne, defaultEvent); reason != "blocked: event is banned" {
+		t.Errorf("unexpected reason for banned event: %q", reason)
+	}
+	i.SetPolicy(config.Policy{BannedPubkeys: []string{defaultEvent.PubKey}})
+	if reason := i.checkPolicy(connIdOne, defaultEvent); reason != "blocked: pubkey is banned" {
+		t.Errorf("unexpected reason for pubkey banned by the configuration: %q", reason)
+	}
+	// the allowlists of the configuration and the management API add to each other
+	if err := store.AllowEvent(defaultEvent.ID); err != nil {
+		t.Fatalf("unexpected error when allowing event: %v", err)
+	}
+	i.SetPolicy(config.Policy{AllowedPubkeys: []string{otherPubkey}, AllowedKinds: []int{0}})
+	if reason := i.checkPolicy(connIdOne, defaultEvent); reason != "restricted: pubkey is not allowed to publish to this relay" {
+		t.Errorf("unexpected reason for pubkey not allowed by the configuration: %q", reason)
+	}
+	if err := store.AllowPubkey(defaultEvent.PubKey, "member"); err != nil {
+		t.Fatalf("unexpected error when allowing pubkey: %v", err)
+	}
+	if err := store.AllowKind(defaultEvent.Kind); err != nil {
+		t.Fatalf("unexpected error when allowing kind: %v", err)
+	}
+	if reason := i.checkPolicy(connIdOne, defaultEvent); reason != "" {
+		t.Errorf("unexpected reason for pubkey and kind allowed through the management API: %q", reason)
+	}
+	if reason := i.checkPolicy(connIdOne, nostr.Event{PubKey: otherPubkey, Kind: 0}); reason != "" {
+		t.Errorf("unexpected reason for pubkey and kind allowed by the configuration: %q", reason)
+	}
+}
+
+// TestProtectedEvents ensures protected events are only accepted from connections authenticated as their author
+func TestProtectedEvents(t *testing.T) {
+	i := NewIngester(zerolog.Nop())
+	protected := nostr.Event{PubKey: defaultEvent.PubKey, Kind: 1, Tags: nostr.Tags{{"-"}}}
+	if reason := i.checkPolicy(connIdOne, protected); reason != "auth-required: this event may only be published by its author" {
+		t.Errorf("unexpected reason without authentication: %q", reason)
+	}
+	authed := map[string][]string{connIdOne: {defaultEvent.PubKey}, "other-connection": {"other"}}
+	i.SetAuthedPubkeysFunc(func(connectionId string) []string { return authed[connectionId] })
+	if reason := i.checkPolicy(connIdOne, protected); reason != "" {
+		t.Errorf("unexpected reason when authenticated as the author: %q", reason)
+	}
+	if reason := i.checkPolicy("other-connection", protected); reason != "restricted: this event may only be published by its author" {
+		t.Errorf("unexpected reason when authenticated as someone else: %q", reason)
+	}
+	if reason := i.checkPolicy("other-connection", nostr.Event{PubKey: defaultEvent.PubKey, Kind: 1}); reason != "" {
+		t.Errorf("unexpected reason for unprotected event: %q", reason)
+	}
+}
+
+// TestGiftWrapPolicy ensures gift wraps are only accepted when addressed to exactly one recipient
+func TestGiftWrapPolicy(t *testing.T) {
+	i := NewIngester(zerolog.Nop())
+	for _, tags := range []nostr.Tags{{}, {{"p", defaultEvent.PubKey}, {"p", defaultEvent.PubKey}}} {
+		if reason := i.checkPolicy(connIdOne, nostr.Event{Kind: nostr.KindGiftWrap, Tags: tags}); reason != "invalid: gift wraps must have exactly one p tag" {
+			t.Errorf("unexpected reason for gift wrap with %v p tags: %q", len(tags), reason)
+		}
+	}
+	if reason := i.checkPolicy(connIdOne, nostr.Event{Kind: nostr.KindGiftWrap, Tags: nostr.Tags{{"p", defaultEvent.PubKey}}}); reason != "" {
+		t.Errorf("unexpected reason for gift wrap with one p tag: %q", reason)
+	}
+}
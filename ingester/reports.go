@@ -0,0 +1,151 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// reportTypes are the report types defined by NIP-56. Reports of any other type are counted as other
+	reportTypes = []string{"nudity", "malware", "profanity", "illegal", "spam", "impersonation", "other"}
+)
+
+// reportType returns the NIP-56 report type of the given e or p tag
+func reportType(tag nostr.Tag) string {
+	if len(tag) > 2 && slices.Contains(reportTypes, tag[2]) {
+		return tag[2]
+	}
+	return "other"
+}
+
+// parseReports returns the reports contained in a kind 1984 event: one per e tag when events are reported, one per p tag otherwise. The author of reported events is filled in from storage
+func parseReports(event nostr.Event) []moderation.Report {
+	reports := []moderation.Report{}
+	pTags := event.Tags.GetAll([]string{"p", ""})
+	eTags := event.Tags.GetAll([]string{"e", ""})
+	if len(eTags) > 0 {
+		for _, tag := range eTags {
+			// the report type may be set on the p tag instead
+			reportTag := tag
+			if len(tag) < 3 && len(pTags) > 0 {
+				reportTag = pTags[0]
+			}
+			reports = append(reports, moderation.Report{ID: event.ID, Reporter: event.PubKey, EventID: tag.Value(), Type: reportType(reportTag)})
+		}
+		return reports
+	}
+	for _, tag := range pTags {
+		if nostr.IsValidPublicKey(tag.Value()) {
+			reports = append(reports, moderation.Report{ID: event.ID, Reporter: event.PubKey, Pubkey: tag.Value(), Type: reportType(tag)})
+		}
+	}
+	return reports
+}
+
+// isMember checks if the given pubkey is part of the community of the relay: it is allowed to publish by the policy or the moderation state, or it is in the web of trust when one is configured
+func (i *Ingester) isMember(pubkey string) bool {
+	i.RLock()
+	_, allowed := i.policy.allowlists.Pubkeys[pubkey]
+	i.RUnlock()
+	if allowed || i.moderation.IsAllowedPubkey(pubkey) {
+		return true
+	}
+	if !i.trust.enabled() {
+		return false
+	}
+	trusted, err := i.trust.isTrusted(pubkey, i.queryFunc)
+	if err != nil {
+		i.logger.Error().Err(err).Msg("failed to compute web of trust")
+	}
+	return trusted
+}
+
+// IsSpam checks if the spam reports about the given event or its author reached the configured spam threshold
+func (i *Ingester) IsSpam(event *nostr.Event) bool {
+	i.RLock()
+	threshold := i.reports.SpamThreshold
+	i.RUnlock()
+	return i.moderation.IsSpam(event, threshold)
+}
+
+// handleReport counts the reports about events and pubkeys stored on this relay contained in a kind 1984 event in the moderation queue and deletes the events whose reports reached the delete threshold
+func (i *Ingester) handleReport(logger zerolog.Logger, event nostr.Event) {
+	if i.moderation == nil {
+		return
+	}
+	i.RLock()
+	thresholds := i.reports
+	i.RUnlock()
+	var weight float64
+	if thresholds.NonMemberWeight != nil {
+		weight = *thresholds.NonMemberWeight
+	}
+	if i.isMember(event.PubKey) {
+		weight = thresholds.MemberWeight
+	}
+	for _, report := range parseReports(event) {
+		// only content of this relay is moderated
+		filter := nostr.Filter{Authors: []string{report.Pubkey}, Limit: 1}
+		if report.EventID != "" {
+			filter = nostr.Filter{IDs: []string{report.EventID}, Limit: 1}
+		}
+		stored, err := i.queryFirst(filter)
+		if err != nil {
+			logger.Error().Err(err).Str("eventId", event.ID).Msg("failed to look up reported content")
+			continue
+		}
+		if stored == nil {
+			continue
+		}
+		report.Pubkey = stored.PubKey
+		report.Weight = weight
+		action, err := i.moderation.Report(report, thresholds)
+		if err != nil {
+			logger.Error().Err(err).Str("eventId", event.ID).Msg("failed to record report")
+			continue
+		}
+		if action == moderation.ActionNone {
+			continue
+		}
+		logger.Info().Str("pubkey", report.Pubkey).Str("reportedEventId", report.EventID).Str("type", report.Type).Msgf("reports reached the %s threshold", action)
+		if action == moderation.ActionDelete && report.EventID != "" {
+			if err := i.DeleteEvent(report.EventID); err != nil {
+				logger.Error().Err(err).Str("reportedEventId", report.EventID).Msg("failed to delete reported event")
+			}
+		}
+	}
+}
+
+// queryFirst returns the first stored event matching the given filter or nil if there is none
+func (i *Ingester) queryFirst(filter nostr.Filter) (*nostr.Event, error) {
+	if i.queryFunc == nil {
+		return nil, ErrQueryFuncNotSet
+	}
+	rcvChan, err := i.queryFunc(context.Background(), filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage: %w", err)
+	}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	defer timer.Stop()
+	var found *nostr.Event
+	for {
+		select {
+		case event, ok := <-rcvChan:
+			if !ok || event == nil {
+				return found, nil
+			}
+			if found == nil {
+				found = event
+			}
+		case <-timer.C:
+			return nil, errors.New("timed out while querying storage")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package ingester
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/storage/memory"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+type parseReportsTestCase struct {
+	name            string
+	tags            nostr.Tags
+	expectedReports []moderation.Report
+}
+
+var (
+	reportedPubkey        = newPubkey()
+	reportedEventId       = "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+	parseReportsTestCases = []parseReportsTestCase{
+		{
+			name: "Pubkey",
+			tags: nostr.Tags{{"p", reportedPubkey, "impersonation"}},
+			expectedReports: []moderation.Report{
+				{ID: "report", Reporter: rootPubkey, Pubkey: reportedPubkey, Type: "impersonation"},
+			},
+		},
+		{
+			name: "EventWithTypeOnETag",
+			tags: nostr.Tags{{"e", reportedEventId, "spam"}, {"p", reportedPubkey}},
+			expectedReports: []moderation.Report{
+				{ID: "report", Reporter: rootPubkey, EventID: reportedEventId, Type: "spam"},
+			},
+		},
+		{
+			name: "EventWithTypeOnPTag",
+			tags: nostr.Tags{{"e", reportedEventId}, {"p", reportedPubkey, "illegal"}},
+			expectedReports: []moderation.Report{
+				{ID: "report", Reporter: rootPubkey, EventID: reportedEventId, Type: "illegal"},
+			},
+		},
+		{
+			name: "UnknownType",
+			tags: nostr.Tags{{"p", reportedPubkey, "boring"}, {"p", "not a pubkey", "spam"}},
+			expectedReports: []moderation.Report{
+				{ID: "report", Reporter: rootPubkey, Pubkey: reportedPubkey, Type: "other"},
+			},
+		},
+	}
+)
+
+// TestParseReports ensures reports are read from the e and p tags of kind 1984 events
+func TestParseReports(t *testing.T) {
+	for _, testCase := range parseReportsTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		reports := parseReports(nostr.Event{ID: "report", PubKey: rootPubkey, Kind: nostr.KindReporting, Tags: testCase.tags})
+		if !reflect.DeepEqual(reports, testCase.expectedReports) {
+			t.Errorf("unexpected reports for test case %s: expected %v, got %v", testCase.name, testCase.expectedReports, reports)
+		}
+	}
+}
+
+// TestHandleReport ensures only reports about stored content are counted, weighted by whether the reporter is a member
+func TestHandleReport(t *testing.T) {
+	reported := nostr.Event{ID: reportedEventId, PubKey: reportedPubkey, Kind: 1, CreatedAt: 1}
+	store := &fakeFollowStore{events: append([]nostr.Event{reported}, followListStore...)}
+	repo, _ := memory.NewModerationRepository("")
+	moderationStore, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation store: %v", err)
+	}
+	i := NewIngester(zerolog.Nop())
+	i.SetQueryFunc(store.query)
+	i.SetModeration(moderationStore)
+	i.SetPolicy(config.Policy{WebOfTrust: config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: 1}})
+	nonMemberWeight := 0.25
+	i.SetReports(config.Reports{HideThreshold: 1.5, MemberWeight: 1, NonMemberWeight: &nonMemberWeight})
+	report := func(reporter, eventId string) nostr.Event {
+		return nostr.Event{ID: reporter, PubKey: reporter, Kind: nostr.KindReporting, Tags: nostr.Tags{{"e", eventId, "spam"}, {"p", reportedPubkey}}}
+	}
+	// reports about content which isn't stored are ignored
+	i.handleReport(zerolog.Nop(), report(rootPubkey, "unknown"))
+	if queue := moderationStore.EventsNeedingModeration(); len(queue) != 0 {
+		t.Fatalf("unexpected report of unknown event: %v", queue)
+	}
+	i.handleReport(zerolog.Nop(), report(strangerPubkey, reportedEventId))
+	i.handleReport(zerolog.Nop(), report(hopOnePubkey, reportedEventId))
+	queue := moderationStore.EventsNeedingModeration()
+	if len(queue) != 1 || queue[0].ID != reportedEventId || queue[0].Reason != "reported for spam 2 times, score 1.25" {
+		t.Fatalf("unexpected moderation queue: %v", queue)
+	}
+	if !moderationStore.CanRead(&reported, func() []string { return nil }) {
+		t.Error("expected event below the hide threshold to be readable")
+	}
+	i.handleReport(zerolog.Nop(), report(rootPubkey, reportedEventId))
+	if moderationStore.CanRead(&reported, func() []string { return nil }) {
+		t.Error("expected event above the hide threshold to be hidden")
+	}
+}
+
+// TestIsSpam ensures a spam report from a non-member whose reports count for nothing doesn't leave the reported event out of search results
+func TestIsSpam(t *testing.T) {
+	reported := nostr.Event{ID: reportedEventId, PubKey: reportedPubkey, Kind: 1, CreatedAt: 1}
+	store := &fakeFollowStore{events: append([]nostr.Event{reported}, followListStore...)}
+	repo, _ := memory.NewModerationRepository("")
+	moderationStore, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation store: %v", err)
+	}
+	i := NewIngester(zerolog.Nop())
+	if i.IsSpam(&reported) {
+		t.Fatal("unexpected spam without moderation store")
+	}
+	i.SetQueryFunc(store.query)
+	i.SetModeration(moderationStore)
+	i.SetPolicy(config.Policy{WebOfTrust: config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: 1}})
+	nonMemberWeight := 0.0
+	i.SetReports(config.Reports{MemberWeight: 1, NonMemberWeight: &nonMemberWeight, SpamThreshold: 1})
+	i.handleReport(zerolog.Nop(), nostr.Event{ID: "report", PubKey: strangerPubkey, Kind: nostr.KindReporting, Tags: nostr.Tags{{"e", reportedEventId, "spam"}, {"p", reportedPubkey}}})
+	if i.IsSpam(&reported) {
+		t.Error("expected event reported as spam by a non-member not to be spam")
+	}
+	i.handleReport(zerolog.Nop(), nostr.Event{ID: "member-report", PubKey: hopOnePubkey, Kind: nostr.KindReporting, Tags: nostr.Tags{{"e", reportedEventId, "spam"}, {"p", reportedPubkey}}})
+	if !i.IsSpam(&reported) {
+		t.Error("expected event reported as spam by a member to be spam")
+	}
+}
@@ -0,0 +1,227 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	// trustQueryBatchSize is the number of authors whose follow lists are queried at once. It stays below the query limit of every storage backend
+	trustQueryBatchSize = 100
+	ErrQueryFuncNotSet  = errors.New("query function not set")
+)
+
+// trustGraph tracks the pubkeys within a number of hops of the root pubkeys, following the kind 3 follow lists in storage. Storage is only queried outside of the lock so checks aren't held up while the graph is recomputed
+type trustGraph struct {
+	roots   []string
+	maxHops int
+	// follows caches the follow lists of the pubkeys within the graph whose follows are part of it. A nil list means the author has none
+	follows map[string][]string
+	// hops holds every trusted pubkey along with its distance to the closest root pubkey
+	hops  map[string]int
+	stale bool
+	// version changes whenever the roots or a follow list within the graph change, a recomputation started before is discarded
+	version uint64
+	// refreshing serializes the recomputations of the graph
+	refreshing sync.Mutex
+	sync.RWMutex
+}
+
+// newTrustGraph instantiates a disabled trust graph
+func newTrustGraph() *trustGraph {
+	return &trustGraph{
+		follows: make(map[string][]string),
+		hops:    make(map[string]int),
+	}
+}
+
+// configure changes the root pubkeys and the maximum number of hops. The graph is recomputed on the next check if they changed
+func (g *trustGraph) configure(cfg config.WebOfTrust) {
+	g.Lock()
+	defer g.Unlock()
+	if slices.Equal(g.roots, cfg.RootPubkeys) && g.maxHops == cfg.MaxHops {
+		return
+	}
+	g.roots = slices.Clone(cfg.RootPubkeys)
+	g.maxHops = cfg.MaxHops
+	g.stale = true
+	g.version++
+}
+
+// enabled checks if root pubkeys are configured
+func (g *trustGraph) enabled() bool {
+	g.RLock()
+	defer g.RUnlock()
+	return len(g.roots) > 0
+}
+
+// isTrusted checks if the given pubkey is within reach of the root pubkeys. Every pubkey is trusted when there are no root pubkeys
+func (g *trustGraph) isTrusted(pubkey string, queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) (bool, error) {
+	g.RLock()
+	if len(g.roots) == 0 {
+		g.RUnlock()
+		return true, nil
+	}
+	stale := g.stale
+	g.RUnlock()
+	if stale {
+		if err := g.refresh(queryFunc); err != nil {
+			return false, err
+		}
+	}
+	g.RLock()
+	defer g.RUnlock()
+	_, ok := g.hops[pubkey]
+	return ok, nil
+}
+
+// update replaces the cached follow list of the author of the given stored kind 3 event. The trusted pubkeys are only recomputed if the follows of the author extend the graph, the follow lists of other authors are left in storage
+func (g *trustGraph) update(event nostr.Event, queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) error {
+	g.Lock()
+	if len(g.roots) == 0 {
+		g.Unlock()
+		return nil
+	}
+	hops, ok := g.hops[event.PubKey]
+	if !g.stale && (!ok || hops >= g.maxHops) {
+		g.Unlock()
+		return nil
+	}
+	g.follows[event.PubKey] = followList(event)
+	// a recomputation in progress may have walked the previous follow list
+	g.stale = true
+	g.version++
+	g.Unlock()
+	return g.refresh(queryFunc)
+}
+
+// refresh recomputes the graph while it is stale, starting over when it changes in the meantime
+func (g *trustGraph) refresh(queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) error {
+	g.refreshing.Lock()
+	defer g.refreshing.Unlock()
+	for {
+		g.RLock()
+		stale, version, roots, maxHops := g.stale, g.version, g.roots, g.maxHops
+		g.RUnlock()
+		if !stale {
+			return nil
+		}
+		hops, err := g.walk(roots, maxHops, queryFunc)
+		if err != nil {
+			// retry on the next check
+			return err
+		}
+		g.Lock()
+		if g.version == version {
+			g.hops = hops
+			g.stale = false
+			// follow lists of pubkeys which left the graph or whose follows are past the maximum number of hops are no longer needed
+			for pubkey := range g.follows {
+				if hop, ok := hops[pubkey]; !ok || hop >= maxHops {
+					delete(g.follows, pubkey)
+				}
+			}
+		}
+		g.Unlock()
+	}
+}
+
+// walk follows the follow lists breadth first from the root pubkeys, loading the ones which aren't cached yet from storage, and returns the distance of every pubkey reached
+func (g *trustGraph) walk(roots []string, maxHops int, queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) (map[string]int, error) {
+	hops := make(map[string]int)
+	frontier := []string{}
+	for _, root := range roots {
+		if _, ok := hops[root]; !ok {
+			hops[root] = 0
+			frontier = append(frontier, root)
+		}
+	}
+	for hop := 1; hop <= maxHops && len(frontier) > 0; hop++ {
+		if err := g.load(frontier, queryFunc); err != nil {
+			return nil, err
+		}
+		next := []string{}
+		g.RLock()
+		for _, pubkey := range frontier {
+			for _, followed := range g.follows[pubkey] {
+				if _, ok := hops[followed]; !ok {
+					hops[followed] = hop
+					next = append(next, followed)
+				}
+			}
+		}
+		g.RUnlock()
+		frontier = next
+	}
+	return hops, nil
+}
+
+// load queries storage for the follow lists of the given pubkeys which aren't cached yet and caches them
+func (g *trustGraph) load(pubkeys []string, queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)) error {
+	missing := []string{}
+	g.RLock()
+	for _, pubkey := range pubkeys {
+		if _, ok := g.follows[pubkey]; !ok {
+			missing = append(missing, pubkey)
+		}
+	}
+	g.RUnlock()
+	if len(missing) > 0 && queryFunc == nil {
+		return ErrQueryFuncNotSet
+	}
+	for batch := range slices.Chunk(missing, trustQueryBatchSize) {
+		rcvChan, err := queryFunc(context.Background(), nostr.Filter{Kinds: []int{3}, Authors: batch, Limit: len(batch)})
+		if err != nil {
+			return fmt.Errorf("failed to query storage for follow lists: %w", err)
+		}
+		timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+		latest := make(map[string]*nostr.Event, len(batch))
+	queryLoop:
+		for {
+			select {
+			case event, ok := <-rcvChan:
+				if !ok || event == nil {
+					break queryLoop
+				}
+				if stored, ok := latest[event.PubKey]; !ok || event.CreatedAt > stored.CreatedAt {
+					latest[event.PubKey] = event
+				}
+			case <-timer.C:
+				return errors.New("timed out while querying storage for follow lists")
+			}
+		}
+		timer.Stop()
+		g.Lock()
+		for _, pubkey := range batch {
+			// a follow list stored while querying is newer than the one read
+			if _, ok := g.follows[pubkey]; ok {
+				continue
+			}
+			if event, ok := latest[pubkey]; ok {
+				g.follows[pubkey] = followList(*event)
+			} else {
+				g.follows[pubkey] = nil
+			}
+		}
+		g.Unlock()
+	}
+	return nil
+}
+
+// followList returns the valid pubkeys of the p tags of a kind 3 event
+func followList(event nostr.Event) []string {
+	var follows []string
+	for _, tag := range event.Tags.GetAll([]string{"p", ""}) {
+		if nostr.IsValidPublicKey(tag.Value()) {
+			follows = append(follows, tag.Value())
+		}
+	}
+	return follows
+}
@@ -0,0 +1,213 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// fakeFollowStore answers queries from the given events and counts them
+type fakeFollowStore struct {
+	events  []nostr.Event
+	queries int
+}
+
+func (s *fakeFollowStore) query(_ context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	s.queries++
+	rcvChan := make(chan *nostr.Event, len(s.events))
+	for _, event := range s.events {
+		if filter.Matches(&event) {
+			rcvChan <- &event
+		}
+	}
+	close(rcvChan)
+	return rcvChan, nil
+}
+
+// newPubkey generates a random valid pubkey
+func newPubkey() string {
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	return pubkey
+}
+
+// followListEvent creates the kind 3 event of the given author following the given pubkeys
+func followListEvent(author string, createdAt nostr.Timestamp, follows ...string) nostr.Event {
+	tags := nostr.Tags{}
+	for _, pubkey := range follows {
+		tags = append(tags, nostr.Tag{"p", pubkey})
+	}
+	return nostr.Event{PubKey: author, Kind: 3, CreatedAt: createdAt, Tags: tags}
+}
+
+type trustTestCase struct {
+	name      string
+	maxHops   int
+	trusted   []string
+	untrusted []string
+}
+
+var (
+	rootPubkey      = newPubkey()
+	hopOnePubkey    = newPubkey()
+	hopTwoPubkey    = newPubkey()
+	hopThreePubkey  = newPubkey()
+	strangerPubkey  = newPubkey()
+	followListStore = []nostr.Event{
+		followListEvent(rootPubkey, 1, rootPubkey, hopOnePubkey),
+		followListEvent(hopOnePubkey, 1, hopTwoPubkey, "not a pubkey"),
+		followListEvent(hopTwoPubkey, 1, hopThreePubkey),
+		followListEvent(strangerPubkey, 1, rootPubkey),
+	}
+	trustTestCases = []trustTestCase{
+		{
+			name:      "OneHop",
+			maxHops:   1,
+			trusted:   []string{rootPubkey, hopOnePubkey},
+			untrusted: []string{hopTwoPubkey, strangerPubkey},
+		},
+		{
+			name:      "TwoHops",
+			maxHops:   2,
+			trusted:   []string{rootPubkey, hopOnePubkey, hopTwoPubkey},
+			untrusted: []string{hopThreePubkey, strangerPubkey},
+		},
+		{
+			name:      "TenHops",
+			maxHops:   10,
+			trusted:   []string{rootPubkey, hopOnePubkey, hopTwoPubkey, hopThreePubkey},
+			untrusted: []string{strangerPubkey},
+		},
+	}
+)
+
+// TestTrustGraph ensures only pubkeys within the configured number of hops of the root pubkeys are trusted
+func TestTrustGraph(t *testing.T) {
+	for _, testCase := range trustTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		store := &fakeFollowStore{events: followListStore}
+		g := newTrustGraph()
+		g.configure(config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: testCase.maxHops})
+		for _, pubkey := range testCase.trusted {
+			if trusted, err := g.isTrusted(pubkey, store.query); err != nil || !trusted {
+				t.Errorf("expected %s to be trusted for test case %s: %v", pubkey, testCase.name, err)
+			}
+		}
+		for _, pubkey := range testCase.untrusted {
+			if trusted, err := g.isTrusted(pubkey, store.query); err != nil || trusted {
+				t.Errorf("expected %s not to be trusted for test case %s: %v", pubkey, testCase.name, err)
+			}
+		}
+	}
+}
+
+// TestTrustGraphUpdate ensures new follow lists change the trusted pubkeys without querying storage for known follow lists
+func TestTrustGraphUpdate(t *testing.T) {
+	store := &fakeFollowStore{events: followListStore}
+	g := newTrustGraph()
+	if trusted, _ := g.isTrusted(strangerPubkey, nil); !trusted {
+		t.Error("expected every pubkey to be trusted without root pubkeys")
+	}
+	g.configure(config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: 2})
+	if trusted, _ := g.isTrusted(hopTwoPubkey, store.query); !trusted {
+		t.Fatal("expected pubkey two hops away to be trusted")
+	}
+	queries := store.queries
+	// a follow list from outside the graph doesn't change it and is left in storage
+	strangerFollows := followListEvent(strangerPubkey, 2, hopThreePubkey)
+	store.events = append(slices.Clone(store.events), strangerFollows)
+	if err := g.update(strangerFollows, store.query); err != nil {
+		t.Fatalf("unexpected error when updating follow list: %v", err)
+	}
+	if trusted, _ := g.isTrusted(hopThreePubkey, store.query); trusted {
+		t.Error("expected follow list from outside the graph to be ignored")
+	}
+	if _, ok := g.follows[strangerPubkey]; ok {
+		t.Error("expected follow list from outside the graph not to be cached")
+	}
+	// unfollowing removes the pubkey from the graph
+	if err := g.update(followListEvent(hopOnePubkey, 2), store.query); err != nil {
+		t.Fatalf("unexpected error when updating follow list: %v", err)
+	}
+	if trusted, _ := g.isTrusted(hopTwoPubkey, store.query); trusted {
+		t.Error("expected unfollowed pubkey not to be trusted")
+	}
+	if store.queries != queries {
+		t.Errorf("unexpected storage queries for known follow lists: expected %v, got %v", queries, store.queries)
+	}
+	// following a new pubkey loads its follow list
+	if err := g.update(followListEvent(rootPubkey, 2, hopOnePubkey, strangerPubkey), store.query); err != nil {
+		t.Fatalf("unexpected error when updating follow list: %v", err)
+	}
+	for _, pubkey := range []string{strangerPubkey, hopThreePubkey} {
+		if trusted, _ := g.isTrusted(pubkey, store.query); !trusted {
+			t.Errorf("expected %s to be trusted after being followed", pubkey)
+		}
+	}
+	// only the follow lists whose follows are within the maximum number of hops stay cached
+	g.configure(config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: 1})
+	if trusted, _ := g.isTrusted(strangerPubkey, store.query); !trusted {
+		t.Fatal("expected pubkey one hop away to be trusted")
+	}
+	if _, ok := g.follows[rootPubkey]; !ok || len(g.follows) != 1 {
+		t.Errorf("unexpected cached follow lists: %v", g.follows)
+	}
+}
+
+// TestWebOfTrustPolicy ensures the web of trust is checked after the configured policy
+func TestWebOfTrustPolicy(t *testing.T) {
+	store := &fakeFollowStore{events: followListStore}
+	i := NewIngester(zerolog.Nop())
+	i.SetQueryFunc(store.query)
+	i.SetPolicy(config.Policy{WebOfTrust: config.WebOfTrust{RootPubkeys: []string{rootPubkey}, MaxHops: 1}})
+	if reason := i.checkPolicy(connIdOne, nostr.Event{PubKey: strangerPubkey, Kind: 1}); reason != "restricted: pubkey is not in the web of trust of this relay" {
+		t.Errorf("unexpected reason for pubkey outside of the web of trust: %q", reason)
+	}
+	if reason := i.checkPolicy(connIdOne, nostr.Event{PubKey: hopOnePubkey, Kind: 1}); reason != "" {
+		t.Errorf("unexpected reason for pubkey in the web of trust: %q", reason)
+	}
+	i.SetPolicy(config.Policy{})
+	if reason := i.checkPolicy(connIdOne, nostr.Event{PubKey: strangerPubkey, Kind: 1}); reason != "" {
+		t.Errorf("unexpected reason once the web of trust is disabled: %q", reason)
+	}
+}
+
+// TestWebOfTrustFollowListStored ensures a published follow list only changes the web of trust once it is stored
+func TestWebOfTrustFollowListStored(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	root, _ := nostr.GetPublicKey(sk)
+	followed := newPubkey()
+	i := NewIngester(zerolog.Nop())
+	i.SetQueryFunc((&fakeFollowStore{}).query)
+	i.SetPolicy(config.Policy{WebOfTrust: config.WebOfTrust{RootPubkeys: []string{root}, MaxHops: 1}})
+	storeErrs := make(chan error, 2)
+	go func() {
+		for parsedMsg := range i.SendToDBChannel() {
+			parsedMsg.Callback(<-storeErrs)
+		}
+	}()
+	defer close(i.SendToDBChannel())
+	go func() {
+		for range i.SendToFilterManager() {
+		}
+	}()
+	defer close(i.SendToFilterManager())
+	for n, storeErr := range []error{errors.New("disk full"), nil} {
+		event := followListEvent(root, nostr.Timestamp(n+1), followed)
+		if err := event.Sign(sk); err != nil {
+			t.Fatalf("unexpected error when signing follow list: %v", err)
+		}
+		storeErrs <- storeErr
+		ok, reason := i.IngestEvent(connIdOne, event)
+		if ok != (storeErr == nil) {
+			t.Fatalf("unexpected OK state for follow list: %v %q", ok, reason)
+		}
+		if trusted, err := i.trust.isTrusted(followed, nil); err != nil || trusted != ok {
+			t.Errorf("unexpected trust once the follow list was stored %v: expected %v got %v (%v)", ok, ok, trusted, err)
+		}
+	}
+}
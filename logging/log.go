@@ -3,8 +3,10 @@ package logging
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/TheRebelOfBabylon/tandem/config"
@@ -19,46 +21,124 @@ var (
 	consoleWriter      = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: formatLvlFunc, TimeLocation: time.UTC}
 )
 
+// levelState holds the base level and the per module overrides of a logger and the module loggers derived from it
+type levelState struct {
+	base    zerolog.Level
+	modules map[string]zerolog.Level
+	sync.RWMutex
+}
+
+// get returns the level of the given module, falling back to the base level
+func (l *levelState) get(module string) zerolog.Level {
+	l.RLock()
+	defer l.RUnlock()
+	if lvl, ok := l.modules[module]; ok {
+		return lvl
+	}
+	return l.base
+}
+
+// moduleHook discards events below the level configured for the module the logger belongs to
+type moduleHook struct {
+	levels *levelState
+	module string
+}
+
+// Run satisfies the zerolog.Hook interface
+func (m moduleHook) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if level < m.levels.get(m.module) {
+		e.Discard()
+	}
+}
+
 type Logger struct {
 	zerolog.Logger
+	root   zerolog.Logger // logger without a level hook, from which module loggers are derived
+	levels *levelState
 }
 
 func NewLogger() Logger {
+	return newLogger(zerolog.New(consoleWriter).With().Timestamp().Logger(), &levelState{base: zerolog.InfoLevel})
+}
+
+// Wrap returns a logger writing to the given zerolog logger, e.g. the logger of a service embedding the relay. Module loggers are derived from it and the level of the given logger is the base level until SetLevels is called
+func Wrap(logger zerolog.Logger) Logger {
+	return newLogger(logger, &levelState{base: logger.GetLevel()})
+}
+
+// newLogger wraps the given root logger. The level of an enabled root logger is lifted so that the hooks alone decide what modules log
+func newLogger(root zerolog.Logger, levels *levelState) Logger {
+	if root.GetLevel() != zerolog.Disabled {
+		root = root.Level(zerolog.TraceLevel)
+	}
 	return Logger{
-		Logger: zerolog.New(consoleWriter).With().Timestamp().Logger(),
+		Logger: root.Hook(moduleHook{levels: levels}),
+		root:   root,
+		levels: levels,
 	}
 }
 
-// setLogLevel sets the global log level
-func (log Logger) setLogLevel(lvl string) (Logger, error) {
-	var newLogger Logger
+// Module returns a logger tagged with the given module name whose level can be overridden per module
+func (log Logger) Module(name string) zerolog.Logger {
+	return log.root.With().Str("module", name).Logger().Hook(moduleHook{levels: log.levels, module: name})
+}
+
+// parseLevel converts a config log level into a zerolog level
+func parseLevel(lvl string) (zerolog.Level, error) {
 	switch lvl {
+	case "trace":
+		return zerolog.TraceLevel, nil
 	case "debug":
-		newLogger.Logger = log.Level(zerolog.DebugLevel)
+		return zerolog.DebugLevel, nil
 	case "info":
-		newLogger.Logger = log.Level(zerolog.InfoLevel)
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
 	case "error":
-		newLogger.Logger = log.Level(zerolog.ErrorLevel)
+		return zerolog.ErrorLevel, nil
 	default:
-		return log, fmt.Errorf("%w: %s", ErrInvalidLogLevel, lvl)
+		return zerolog.NoLevel, fmt.Errorf("%w: %s", ErrInvalidLogLevel, lvl)
 	}
-	return newLogger, nil
+}
+
+// SetLevels sets the base log level and the per module overrides. It can be called at runtime and affects this logger and every logger derived from it, other loggers keep their levels
+func (log Logger) SetLevels(base string, modules map[string]string) error {
+	baseLvl, err := parseLevel(base)
+	if err != nil {
+		return err
+	}
+	moduleLvls := make(map[string]zerolog.Level, len(modules))
+	for module, lvl := range modules {
+		moduleLvl, err := parseLevel(lvl)
+		if err != nil {
+			return fmt.Errorf("module %s: %w", module, err)
+		}
+		moduleLvls[module] = moduleLvl
+	}
+	log.levels.Lock()
+	log.levels.base = baseLvl
+	log.levels.modules = moduleLvls
+	log.levels.Unlock()
+	return nil
 }
 
 // Configure configure the logger
 func (log Logger) Configure(logCfg config.Log) (Logger, error) {
-	// set the log level
-	newLogger, err := log.setLogLevel(logCfg.Level)
-	if err != nil {
+	// set the log levels
+	if err := log.SetLevels(logCfg.Level, logCfg.Modules); err != nil {
 		return log, err
 	}
-	// set a file writer
+	var out io.Writer = consoleWriter
+	if logCfg.Format == config.LogFormatJSON {
+		out = os.Stdout
+	}
+	// set a file writer. Files are always written as JSON
 	if logCfg.LogFilePath != "" {
-		logFile, err := os.OpenFile(logCfg.LogFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		logFile, err := NewRotatingWriter(logCfg.LogFilePath, logCfg.MaxSize, logCfg.MaxAge, logCfg.MaxBackups)
 		if err != nil {
 			return log, fmt.Errorf("failed to open log file: %w", err)
 		}
-		newLogger.Logger = newLogger.Output(zerolog.MultiLevelWriter(consoleWriter, logFile))
+		out = zerolog.MultiLevelWriter(out, logFile)
 	}
-	return newLogger, nil
+	return newLogger(log.root.Output(out), log.levels), nil
 }
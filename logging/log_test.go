@@ -0,0 +1,171 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type moduleLevelTestCase struct {
+	name      string
+	module    string
+	level     zerolog.Level
+	shouldLog bool
+}
+
+var moduleLevelTestCases = []moduleLevelTestCase{
+	{
+		name:      "MainLogger_DebugDiscarded",
+		level:     zerolog.DebugLevel,
+		shouldLog: false,
+	},
+	{
+		name:      "MainLogger_WarnLogged",
+		level:     zerolog.WarnLevel,
+		shouldLog: true,
+	},
+	{
+		name:      "OverriddenModule_DebugLogged",
+		module:    "ingester",
+		level:     zerolog.DebugLevel,
+		shouldLog: true,
+	},
+	{
+		name:      "OverriddenModule_TraceDiscarded",
+		module:    "ingester",
+		level:     zerolog.TraceLevel,
+		shouldLog: false,
+	},
+	{
+		name:      "OtherModule_DebugDiscarded",
+		module:    "filterManager",
+		level:     zerolog.DebugLevel,
+		shouldLog: false,
+	},
+	{
+		name:      "QuietModule_WarnDiscarded",
+		module:    "websocketServer",
+		level:     zerolog.WarnLevel,
+		shouldLog: false,
+	},
+	{
+		name:      "QuietModule_ErrorLogged",
+		module:    "websocketServer",
+		level:     zerolog.ErrorLevel,
+		shouldLog: true,
+	},
+}
+
+// TestModuleLevels ensures per module overrides take precedence over the base level
+func TestModuleLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := Wrap(zerolog.New(&buf))
+	if err := logger.SetLevels("info", map[string]string{"ingester": "debug", "websocketServer": "error"}); err != nil {
+		t.Fatalf("unexpected error when setting levels: %v", err)
+	}
+	for _, testCase := range moduleLevelTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		buf.Reset()
+		l := logger.Logger
+		if testCase.module != "" {
+			l = logger.Module(testCase.module)
+		}
+		l.WithLevel(testCase.level).Msg("hello")
+		if logged := buf.Len() > 0; logged != testCase.shouldLog {
+			t.Errorf("unexpected result for test case %s: expected logged %v, got %v", testCase.name, testCase.shouldLog, logged)
+		}
+		if buf.Len() > 0 && testCase.module != "" {
+			var line map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line["module"] != testCase.module {
+				t.Errorf("unexpected log line for test case %s: %s", testCase.name, buf.String())
+			}
+		}
+	}
+	if err := logger.SetLevels("loud", nil); err == nil {
+		t.Error("expected an error for an invalid level")
+	}
+	t.Log("all tests completed")
+}
+
+// TestWrappedLevels ensures the levels of a wrapped logger start at its own level, let modules log below it and are not shared with other loggers
+func TestWrappedLevels(t *testing.T) {
+	var first, second bytes.Buffer
+	firstLogger := Wrap(zerolog.New(&first).Level(zerolog.InfoLevel))
+	secondLogger := Wrap(zerolog.New(&second).Level(zerolog.WarnLevel))
+	firstIngester, secondIngester := firstLogger.Module("ingester"), secondLogger.Module("ingester")
+	firstIngester.Info().Msg("hello")
+	secondIngester.Info().Msg("hello")
+	if first.Len() == 0 || second.Len() > 0 {
+		t.Fatalf("expected the level of the wrapped loggers to be the base level: %q, %q", first.String(), second.String())
+	}
+	first.Reset()
+	if err := firstLogger.SetLevels("info", map[string]string{"ingester": "debug"}); err != nil {
+		t.Fatalf("unexpected error when setting levels: %v", err)
+	}
+	firstIngester.Debug().Msg("hello")
+	if first.Len() == 0 {
+		t.Error("expected module debug level to log below the level of the wrapped logger")
+	}
+	secondIngester.Debug().Msg("hello")
+	secondIngester.Info().Msg("hello")
+	if second.Len() > 0 {
+		t.Errorf("expected the levels of one logger not to change another: %q", second.String())
+	}
+}
+
+// TestRotatingWriter ensures the log file is rotated once it exceeds the maximum size and that old backups are removed
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tandem.log")
+	w, err := NewRotatingWriter(path, 1, time.Hour, 2)
+	if err != nil {
+		t.Fatalf("unexpected error when opening log file: %v", err)
+	}
+	defer w.Close()
+	// files which aren't backups, sorting after them, neither count against the maximum number of backups nor are removed
+	unrelated := []string{path + ".zip", path + ".old"}
+	for _, name := range unrelated {
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatalf("unexpected error when writing %s: %v", name, err)
+		}
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	line := []byte(strings.Repeat("a", int(megabyte)/2) + "\n")
+	// each line is just over half the max size, so every write after the first rotates
+	for i := 0; i < 8; i++ {
+		now = now.Add(time.Minute)
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("unexpected error when writing: %v", err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 2 {
+		t.Errorf("unexpected number of backups: expected 2, got %v", backups)
+	}
+	for _, name := range unrelated {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error when reading log file: %v", err)
+	}
+	if info.Size() > megabyte {
+		t.Errorf("log file exceeds max size: %v", info.Size())
+	}
+	// backups older than the max age are removed on the next rotation
+	now = now.Add(2 * time.Hour)
+	w.Write(line)
+	w.Write(line)
+	backups, _ = filepath.Glob(path + ".2*")
+	if len(backups) != 1 {
+		t.Errorf("unexpected number of backups after max age: expected 1, got %v", backups)
+	}
+}
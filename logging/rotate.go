@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	megabyte         = int64(1024 * 1024)
+)
+
+type RotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	now        func() time.Time
+	sync.Mutex
+}
+
+// NewRotatingWriter opens the given log file. Once the file exceeds maxSize megabytes it is renamed with a timestamp suffix and a new file is started. Backups older than maxAge or beyond the maxBackups most recent ones are removed. Zero values disable the respective limit
+func NewRotatingWriter(path string, maxSize int, maxAge time.Duration, maxBackups int) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		path:       path,
+		maxSize:    int64(maxSize) * megabyte,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the log file in append mode
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+// Write writes to the log file, rotating it first if the write would exceed the maximum size
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current log file, opens a new one and removes stale backups. The caller must hold the lock
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+"."+w.now().UTC().Format(backupTimeFormat)); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	return w.prune()
+}
+
+// prune removes backups which are too old or too many
+func (w *RotatingWriter) prune() error {
+	if w.maxAge <= 0 && w.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return err
+	}
+	// the timestamp suffix sorts chronologically, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	kept := 0
+	for _, backup := range backups {
+		created, err := time.Parse(backupTimeFormat, strings.TrimPrefix(backup, w.path+"."))
+		if err != nil {
+			continue // not one of ours, and not counted against maxBackups
+		}
+		kept++
+		if (w.maxBackups > 0 && kept > w.maxBackups) || (w.maxAge > 0 && w.now().Sub(created) > w.maxAge) {
+			if err := os.Remove(backup); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the log file
+func (w *RotatingWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,415 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrInvalidIP = errors.New("invalid ip address")
+	// relay information fields which can be overridden, stored as the subject of relay info entries
+	infoName        = "name"
+	infoDescription = "description"
+	infoIcon        = "icon"
+)
+
+// state is the cached moderation state, indexed for the lookups done on every event and connection
+type state struct {
+	bannedPubkeys   map[string]string
+	allowedPubkeys  map[string]string
+	bannedEvents    map[string]string
+	flaggedEvents   map[string]string
+	allowedKinds    map[int]struct{}
+	disallowedKinds map[int]struct{}
+	blockedIPs      map[string]string
+	info            map[string]string
+	// reports are the scores of the reported events and pubkeys, keyed by the subject of their entry
+	reports             map[string]reportState
+	hiddenEvents        map[string]string
+	shadowBannedPubkeys map[string]string
+}
+
+// newState indexes the given entries
+func newState(entries []Entry) state {
+	st := state{
+		bannedPubkeys:       make(map[string]string),
+		allowedPubkeys:      make(map[string]string),
+		bannedEvents:        make(map[string]string),
+		flaggedEvents:       make(map[string]string),
+		allowedKinds:        make(map[int]struct{}),
+		disallowedKinds:     make(map[int]struct{}),
+		blockedIPs:          make(map[string]string),
+		info:                make(map[string]string),
+		reports:             make(map[string]reportState),
+		hiddenEvents:        make(map[string]string),
+		shadowBannedPubkeys: make(map[string]string),
+	}
+	for _, entry := range entries {
+		switch entry.Category {
+		case CategoryBannedPubkey:
+			st.bannedPubkeys[entry.Subject] = entry.Detail
+		case CategoryAllowedPubkey:
+			st.allowedPubkeys[entry.Subject] = entry.Detail
+		case CategoryBannedEvent:
+			st.bannedEvents[entry.Subject] = entry.Detail
+		case CategoryFlaggedEvent:
+			st.flaggedEvents[entry.Subject] = entry.Detail
+		case CategoryAllowedKind, CategoryDisallowedKind:
+			kind, err := strconv.Atoi(entry.Subject)
+			if err != nil {
+				continue
+			}
+			if entry.Category == CategoryAllowedKind {
+				st.allowedKinds[kind] = struct{}{}
+			} else {
+				st.disallowedKinds[kind] = struct{}{}
+			}
+		case CategoryBlockedIP:
+			st.blockedIPs[entry.Subject] = entry.Detail
+		case CategoryRelayInfo:
+			st.info[entry.Subject] = entry.Detail
+		case CategoryReport:
+			var report reportState
+			if err := json.Unmarshal([]byte(entry.Detail), &report); err != nil {
+				continue
+			}
+			st.reports[entry.Subject] = report
+		case CategoryHiddenEvent:
+			st.hiddenEvents[entry.Subject] = entry.Detail
+		case CategoryShadowBannedPubkey:
+			st.shadowBannedPubkeys[entry.Subject] = entry.Detail
+		}
+	}
+	return st
+}
+
+// Store caches the moderation state held by a repository. The cache is invalidated whenever the state is changed through the store. A nil Store is valid and accepts everything
+type Store struct {
+	repo   Repository
+	logger zerolog.Logger
+	state  state
+	stale  bool
+	// reportMu serializes reports, which read and update the score of the reported event or pubkey
+	reportMu sync.Mutex
+	sync.RWMutex
+}
+
+// NewStore loads the moderation state from the given repository
+func NewStore(repo Repository, logger zerolog.Logger) (*Store, error) {
+	s := &Store{repo: repo, logger: logger}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load moderation state: %w", err)
+	}
+	return s, nil
+}
+
+// reload replaces the cached state with the one held by the repository. The caller must hold the write lock
+func (s *Store) reload() error {
+	entries, err := s.repo.List(context.Background())
+	if err != nil {
+		return err
+	}
+	s.state = newState(entries)
+	s.stale = false
+	return nil
+}
+
+// view runs fn against the cached state, reloading it first if it was invalidated. The last known state is used if reloading fails
+func (s *Store) view(fn func(st *state)) {
+	s.RLock()
+	if !s.stale {
+		defer s.RUnlock()
+		fn(&s.state)
+		return
+	}
+	s.RUnlock()
+	s.Lock()
+	defer s.Unlock()
+	if s.stale {
+		if err := s.reload(); err != nil {
+			s.logger.Error().Err(err).Msg("failed to reload moderation state, using the last known state")
+		}
+	}
+	fn(&s.state)
+}
+
+// put creates a change inserting or updating an entry
+func put(category Category, subject, detail string) Change {
+	return Change{Entry: Entry{Category: category, Subject: subject, Detail: detail}}
+}
+
+// remove creates a change deleting an entry
+func remove(category Category, subject string) Change {
+	return Change{Entry: Entry{Category: category, Subject: subject}, Delete: true}
+}
+
+// apply writes the given changes to the repository, all or none of them, and invalidates the cache
+func (s *Store) apply(changes ...Change) error {
+	defer func() {
+		s.Lock()
+		s.stale = true
+		s.Unlock()
+	}()
+	if err := s.repo.Apply(context.Background(), changes); err != nil {
+		return fmt.Errorf("failed to update moderation state: %w", err)
+	}
+	return nil
+}
+
+// BanPubkey bans the given pubkey from publishing
+func (s *Store) BanPubkey(pubkey, reason string) error {
+	return s.apply(remove(CategoryAllowedPubkey, pubkey), remove(CategoryShadowBannedPubkey, pubkey), put(CategoryBannedPubkey, pubkey, reason))
+}
+
+// AllowPubkey lifts the ban or shadow ban of a pubkey. A pubkey which isn't banned is added to the allowlist, which restricts publishing to allowed pubkeys once it isn't empty
+func (s *Store) AllowPubkey(pubkey, reason string) error {
+	var banned, shadowBanned bool
+	s.view(func(st *state) {
+		banned = hasKey(st.bannedPubkeys, pubkey)
+		shadowBanned = hasKey(st.shadowBannedPubkeys, pubkey)
+	})
+	if banned || shadowBanned {
+		return s.apply(remove(CategoryBannedPubkey, pubkey), remove(CategoryShadowBannedPubkey, pubkey))
+	}
+	return s.apply(put(CategoryAllowedPubkey, pubkey, reason))
+}
+
+// BanEvent bans the given event id from being published again and removes it from the moderation queue
+func (s *Store) BanEvent(id, reason string) error {
+	return s.apply(append([]Change{remove(CategoryFlaggedEvent, id), put(CategoryBannedEvent, id, reason)}, s.dismiss(id)...)...)
+}
+
+// AllowEvent lifts the ban of an event and removes it from the moderation queue, showing it again if reports hid it
+func (s *Store) AllowEvent(id string) error {
+	return s.apply(append([]Change{remove(CategoryFlaggedEvent, id), remove(CategoryBannedEvent, id)}, s.dismiss(id)...)...)
+}
+
+// FlagEvent adds the given event to the moderation queue
+func (s *Store) FlagEvent(id, reason string) error {
+	return s.apply(put(CategoryFlaggedEvent, id, reason))
+}
+
+// AllowKind lifts the restriction on a disallowed kind. A kind which isn't disallowed is added to the allowed kinds, which restricts publishing to allowed kinds once it isn't empty
+func (s *Store) AllowKind(kind int) error {
+	var disallowed bool
+	s.view(func(st *state) {
+		_, disallowed = st.disallowedKinds[kind]
+	})
+	if disallowed {
+		return s.apply(remove(CategoryDisallowedKind, strconv.Itoa(kind)))
+	}
+	return s.apply(put(CategoryAllowedKind, strconv.Itoa(kind), ""))
+}
+
+// DisallowKind stops the given kind from being accepted
+func (s *Store) DisallowKind(kind int) error {
+	return s.apply(remove(CategoryAllowedKind, strconv.Itoa(kind)), put(CategoryDisallowedKind, strconv.Itoa(kind), ""))
+}
+
+// BlockIP blocks the given ip address from connecting
+func (s *Store) BlockIP(ip, reason string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%w: %s", ErrInvalidIP, ip)
+	}
+	return s.apply(put(CategoryBlockedIP, parsed.String(), reason))
+}
+
+// UnblockIP lifts the block of the given ip address
+func (s *Store) UnblockIP(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%w: %s", ErrInvalidIP, ip)
+	}
+	return s.apply(remove(CategoryBlockedIP, parsed.String()))
+}
+
+// SetRelayName overrides the configured relay name
+func (s *Store) SetRelayName(name string) error {
+	return s.apply(put(CategoryRelayInfo, infoName, name))
+}
+
+// SetRelayDescription overrides the configured relay description
+func (s *Store) SetRelayDescription(description string) error {
+	return s.apply(put(CategoryRelayInfo, infoDescription, description))
+}
+
+// SetRelayIcon overrides the configured relay icon
+func (s *Store) SetRelayIcon(icon string) error {
+	return s.apply(put(CategoryRelayInfo, infoIcon, icon))
+}
+
+// sortedKeys returns the keys of the given map in order so lists are stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pubkeyReasons lists the given pubkeys along with their reason
+func pubkeyReasons(m map[string]string) []nip86.PubKeyReason {
+	list := []nip86.PubKeyReason{}
+	for _, pubkey := range sortedKeys(m) {
+		list = append(list, nip86.PubKeyReason{PubKey: pubkey, Reason: m[pubkey]})
+	}
+	return list
+}
+
+// idReasons lists the given event ids along with their reason
+func idReasons(m map[string]string) []nip86.IDReason {
+	list := []nip86.IDReason{}
+	for _, id := range sortedKeys(m) {
+		list = append(list, nip86.IDReason{ID: id, Reason: m[id]})
+	}
+	return list
+}
+
+// BannedPubkeys lists the banned pubkeys along with the reason they were banned
+func (s *Store) BannedPubkeys() (list []nip86.PubKeyReason) {
+	s.view(func(st *state) {
+		list = pubkeyReasons(st.bannedPubkeys)
+	})
+	return list
+}
+
+// AllowedPubkeys lists the allowed pubkeys along with the reason they were allowed
+func (s *Store) AllowedPubkeys() (list []nip86.PubKeyReason) {
+	s.view(func(st *state) {
+		list = pubkeyReasons(st.allowedPubkeys)
+	})
+	return list
+}
+
+// BannedEvents lists the banned event ids along with the reason they were banned
+func (s *Store) BannedEvents() (list []nip86.IDReason) {
+	s.view(func(st *state) {
+		list = idReasons(st.bannedEvents)
+	})
+	return list
+}
+
+// EventsNeedingModeration lists the event ids in the moderation queue along with the reason they were flagged or a summary of their reports
+func (s *Store) EventsNeedingModeration() (list []nip86.IDReason) {
+	s.view(func(st *state) {
+		list = st.queue()
+	})
+	return list
+}
+
+// AllowedKinds lists the allowed kinds
+func (s *Store) AllowedKinds() []int {
+	kinds := []int{}
+	s.view(func(st *state) {
+		for kind := range st.allowedKinds {
+			kinds = append(kinds, kind)
+		}
+	})
+	slices.Sort(kinds)
+	return kinds
+}
+
+// BlockedIPs lists the blocked ip addresses along with the reason they were blocked
+func (s *Store) BlockedIPs() []nip86.IPReason {
+	list := []nip86.IPReason{}
+	s.view(func(st *state) {
+		for _, ip := range sortedKeys(st.blockedIPs) {
+			list = append(list, nip86.IPReason{IP: ip, Reason: st.blockedIPs[ip]})
+		}
+	})
+	return list
+}
+
+// IsBlocked checks if the given ip address is blocked
+func (s *Store) IsBlocked(ip string) (blocked bool) {
+	if s == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	s.view(func(st *state) {
+		_, blocked = st.blockedIPs[parsed.String()]
+	})
+	return blocked
+}
+
+// IsAllowedPubkey checks if the given pubkey was added to the allowlist
+func (s *Store) IsAllowedPubkey(pubkey string) (allowed bool) {
+	if s == nil {
+		return false
+	}
+	s.view(func(st *state) {
+		allowed = hasKey(st.allowedPubkeys, pubkey)
+	})
+	return allowed
+}
+
+// ApplyInfo overrides the given relay information with the values changed through the management API
+func (s *Store) ApplyInfo(info config.Info) config.Info {
+	if s == nil {
+		return info
+	}
+	s.view(func(st *state) {
+		for field, target := range map[string]*string{infoName: &info.Name, infoDescription: &info.Description, infoIcon: &info.Icon} {
+			if value, ok := st.info[field]; ok {
+				*target = value
+			}
+		}
+	})
+	return info
+}
+
+// Allowlists are the pubkeys and kinds allowed to publish by the configuration. The pubkeys and kinds allowed through the management API add to them
+type Allowlists struct {
+	Pubkeys map[string]struct{}
+	Kinds   map[int]struct{}
+}
+
+// Check returns the reason, prefixed as per NIP-01, for which the given event is rejected or an empty string if it is accepted. A pubkey or kind is allowed when it is in either the configured allowlists or those of the management API, publishing is only restricted when one of them isn't empty
+func (s *Store) Check(event nostr.Event, allowlists Allowlists) (reason string) {
+	check := func(st *state) {
+		_, disallowed := st.disallowedKinds[event.Kind]
+		_, kindConfigured := allowlists.Kinds[event.Kind]
+		_, kindAllowed := st.allowedKinds[event.Kind]
+		_, pubkeyConfigured := allowlists.Pubkeys[event.PubKey]
+		_, pubkeyAllowed := st.allowedPubkeys[event.PubKey]
+		switch {
+		case hasKey(st.bannedPubkeys, event.PubKey):
+			reason = "blocked: pubkey is banned"
+		case hasKey(st.bannedEvents, event.ID):
+			reason = "blocked: event is banned"
+		case len(allowlists.Pubkeys)+len(st.allowedPubkeys) > 0 && !pubkeyConfigured && !pubkeyAllowed:
+			reason = "restricted: pubkey is not allowed to publish to this relay"
+		case disallowed || (len(allowlists.Kinds)+len(st.allowedKinds) > 0 && !kindConfigured && !kindAllowed):
+			reason = fmt.Sprintf("blocked: kind %v is not accepted by this relay", event.Kind)
+		}
+	}
+	if s == nil {
+		check(&state{})
+		return reason
+	}
+	s.view(check)
+	return reason
+}
+
+// hasKey checks if the given map contains the key
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
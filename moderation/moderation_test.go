@@ -0,0 +1,243 @@
+package moderation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// fakeRepository is an in-memory Repository counting the number of times the state is listed
+type fakeRepository struct {
+	entries map[Category]map[string]string
+	lists   int
+	listErr error
+}
+
+func newFakeRepository() *fakeRepository {
+	return &fakeRepository{entries: make(map[Category]map[string]string)}
+}
+
+func (r *fakeRepository) put(entry Entry) {
+	if r.entries[entry.Category] == nil {
+		r.entries[entry.Category] = make(map[string]string)
+	}
+	r.entries[entry.Category][entry.Subject] = entry.Detail
+}
+
+func (r *fakeRepository) Apply(_ context.Context, changes []Change) error {
+	for _, c := range changes {
+		if c.Delete {
+			delete(r.entries[c.Entry.Category], c.Entry.Subject)
+		} else {
+			r.put(c.Entry)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepository) List(_ context.Context) ([]Entry, error) {
+	r.lists++
+	if r.listErr != nil {
+		return nil, r.listErr
+	}
+	entries := []Entry{}
+	for category, subjects := range r.entries {
+		for subject, detail := range subjects {
+			entries = append(entries, Entry{Category: category, Subject: subject, Detail: detail})
+		}
+	}
+	return entries, nil
+}
+
+type checkTestCase struct {
+	name           string
+	change         func(s *Store) error
+	allowlists     Allowlists
+	event          nostr.Event
+	expectedReason string
+}
+
+var (
+	testPubkey     = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	otherPubkey    = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	testEventId    = "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+	testEvent      = nostr.Event{ID: testEventId, PubKey: testPubkey, Kind: 1}
+	checkTestCases = []checkTestCase{
+		{
+			name:  "EmptyState",
+			event: testEvent,
+		},
+		{
+			name:           "BannedPubkey",
+			change:         func(s *Store) error { return s.BanPubkey(testPubkey, "spam") },
+			event:          testEvent,
+			expectedReason: "blocked: pubkey is banned",
+		},
+		{
+			name: "UnbannedPubkey",
+			change: func(s *Store) error {
+				if err := s.BanPubkey(testPubkey, "spam"); err != nil {
+					return err
+				}
+				return s.AllowPubkey(testPubkey, "")
+			},
+			event: testEvent,
+		},
+		{
+			name:           "PubkeyNotAllowed",
+			change:         func(s *Store) error { return s.AllowPubkey(otherPubkey, "member") },
+			event:          testEvent,
+			expectedReason: "restricted: pubkey is not allowed to publish to this relay",
+		},
+		{
+			name:           "PubkeyNotInConfiguredAllowlist",
+			allowlists:     Allowlists{Pubkeys: map[string]struct{}{otherPubkey: {}}},
+			event:          testEvent,
+			expectedReason: "restricted: pubkey is not allowed to publish to this relay",
+		},
+		{
+			name:       "PubkeyAllowedThroughAPI",
+			change:     func(s *Store) error { return s.AllowPubkey(testPubkey, "member") },
+			allowlists: Allowlists{Pubkeys: map[string]struct{}{otherPubkey: {}}},
+			event:      testEvent,
+		},
+		{
+			name:       "PubkeyAllowedByConfiguration",
+			change:     func(s *Store) error { return s.AllowPubkey(otherPubkey, "member") },
+			allowlists: Allowlists{Pubkeys: map[string]struct{}{testPubkey: {}}},
+			event:      testEvent,
+		},
+		{
+			name:           "BannedEvent",
+			change:         func(s *Store) error { return s.BanEvent(testEventId, "illegal") },
+			event:          testEvent,
+			expectedReason: "blocked: event is banned",
+		},
+		{
+			name: "AllowedEvent",
+			change: func(s *Store) error {
+				if err := s.BanEvent(testEventId, "illegal"); err != nil {
+					return err
+				}
+				return s.AllowEvent(testEventId)
+			},
+			event: testEvent,
+		},
+		{
+			name:           "DisallowedKind",
+			change:         func(s *Store) error { return s.DisallowKind(1) },
+			event:          testEvent,
+			expectedReason: "blocked: kind 1 is not accepted by this relay",
+		},
+		{
+			name: "ReallowedKind",
+			change: func(s *Store) error {
+				if err := s.DisallowKind(1); err != nil {
+					return err
+				}
+				return s.AllowKind(1)
+			},
+			event: testEvent,
+		},
+		{
+			name:           "KindNotAllowed",
+			change:         func(s *Store) error { return s.AllowKind(0) },
+			event:          testEvent,
+			expectedReason: "blocked: kind 1 is not accepted by this relay",
+		},
+		{
+			name:       "KindAllowedThroughAPI",
+			change:     func(s *Store) error { return s.AllowKind(1) },
+			allowlists: Allowlists{Kinds: map[int]struct{}{0: {}}},
+			event:      testEvent,
+		},
+		{
+			name:       "KindAllowedByConfiguration",
+			change:     func(s *Store) error { return s.AllowKind(0) },
+			allowlists: Allowlists{Kinds: map[int]struct{}{1: {}}},
+			event:      testEvent,
+		},
+	}
+)
+
+// TestCheck ensures events are rejected according to the moderation state
+func TestCheck(t *testing.T) {
+	for _, testCase := range checkTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		s, err := NewStore(newFakeRepository(), zerolog.Nop())
+		if err != nil {
+			t.Fatalf("unexpected error when creating store: %v", err)
+		}
+		if testCase.change != nil {
+			if err := testCase.change(s); err != nil {
+				t.Fatalf("unexpected error when changing state for test case %s: %v", testCase.name, err)
+			}
+		}
+		if reason := s.Check(testCase.event, testCase.allowlists); reason != testCase.expectedReason {
+			t.Errorf("unexpected reason for test case %s: expected %q, got %q", testCase.name, testCase.expectedReason, reason)
+		}
+	}
+	var s *Store
+	if reason := s.Check(testEvent, Allowlists{}); reason != "" {
+		t.Errorf("unexpected reason from nil store: %q", reason)
+	}
+	if reason := s.Check(testEvent, Allowlists{Kinds: map[int]struct{}{0: {}}}); reason != "blocked: kind 1 is not accepted by this relay" {
+		t.Errorf("unexpected reason from nil store with configured allowlists: %q", reason)
+	}
+}
+
+// TestCache ensures the state is only reloaded from the repository after it was changed
+func TestCache(t *testing.T) {
+	repo := newFakeRepository()
+	repo.put(Entry{Category: CategoryBannedPubkey, Subject: testPubkey, Detail: "spam"})
+	repo.put(Entry{Category: CategoryDisallowedKind, Subject: "4"})
+	repo.put(Entry{Category: CategoryRelayInfo, Subject: "name", Detail: "renamed"})
+	s, err := NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating store: %v", err)
+	}
+	if banned := s.BannedPubkeys(); len(banned) != 1 || banned[0].PubKey != testPubkey || banned[0].Reason != "spam" {
+		t.Errorf("unexpected banned pubkeys: %v", banned)
+	}
+	if reason := s.Check(nostr.Event{PubKey: otherPubkey, Kind: 4}, Allowlists{}); reason == "" {
+		t.Error("expected disallowed kind to be rejected")
+	}
+	if info := s.ApplyInfo(config.Info{Name: "configured", Description: "configured"}); info.Name != "renamed" || info.Description != "configured" {
+		t.Errorf("unexpected relay information: %v", info)
+	}
+	if repo.lists != 1 {
+		t.Errorf("unexpected number of reloads before changing the state: expected 1, got %v", repo.lists)
+	}
+	if err := s.BlockIP("::ffff:10.0.0.1", "abuse"); err != nil {
+		t.Fatalf("unexpected error when blocking ip address: %v", err)
+	}
+	if err := s.BlockIP("not an ip", ""); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("unexpected error when blocking an invalid ip address: %v", err)
+	}
+	if !s.IsBlocked("10.0.0.1") || s.IsBlocked("10.0.0.2") {
+		t.Error("unexpected blocked ip addresses after change")
+	}
+	s.IsBlocked("10.0.0.1")
+	if repo.lists != 2 {
+		t.Errorf("unexpected number of reloads after changing the state: expected 2, got %v", repo.lists)
+	}
+	// the last known state is kept if the repository fails
+	repo.listErr = errors.New("unavailable")
+	if err := s.UnblockIP("10.0.0.1"); err != nil {
+		t.Fatalf("unexpected error when unblocking ip address: %v", err)
+	}
+	if !s.IsBlocked("10.0.0.1") {
+		t.Error("expected last known state to be used when reloading fails")
+	}
+	repo.listErr = nil
+	if s.IsBlocked("10.0.0.1") {
+		t.Error("expected state to be reloaded once the repository recovers")
+	}
+	if _, err := NewStore(&fakeRepository{listErr: errors.New("unavailable")}, zerolog.Nop()); err == nil {
+		t.Error("expected error when the initial state can't be loaded")
+	}
+}
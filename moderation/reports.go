@@ -0,0 +1,192 @@
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// Action is an automatic moderation action taken once the reports about an event or a pubkey reach a threshold
+type Action string
+
+const (
+	ActionNone      Action = ""
+	ActionHide      Action = "hide"
+	ActionShadowBan Action = "shadow_ban"
+	ActionDelete    Action = "delete"
+)
+
+// Report is a single NIP-56 report, about an event when EventID is set and about a pubkey otherwise
+type Report struct {
+	// ID is the id of the kind 1984 report event
+	ID       string
+	Reporter string
+	// Pubkey is the reported pubkey or the author of the reported event
+	Pubkey  string
+	EventID string
+	Type    string
+	Weight  float64
+}
+
+// key returns the subject of the report entry the report is counted in
+func (r Report) key() string {
+	if r.EventID != "" {
+		return fmt.Sprintf("event:%s:%s", r.EventID, r.Type)
+	}
+	return fmt.Sprintf("pubkey:%s:%s", r.Pubkey, r.Type)
+}
+
+// reportState is the score of an event or pubkey for a single report type, stored as JSON in the detail of report entries
+type reportState struct {
+	Pubkey    string   `json:"pubkey"`
+	EventID   string   `json:"event_id,omitempty"`
+	Type      string   `json:"type"`
+	Score     float64  `json:"score"`
+	Reporters []string `json:"reporters"`
+	ReportIDs []string `json:"report_ids"`
+	Actions   []Action `json:"actions,omitempty"`
+}
+
+// Report counts the given report in the moderation queue and carries out the actions whose threshold the score reached. A reporter only counts once per event or pubkey and report type. The most severe action taken is returned so that the caller can delete the reported event
+func (s *Store) Report(report Report, thresholds config.Reports) (Action, error) {
+	if s == nil {
+		return ActionNone, nil
+	}
+	s.reportMu.Lock()
+	defer s.reportMu.Unlock()
+	key := report.key()
+	var (
+		current reportState
+		found   bool
+	)
+	s.view(func(st *state) {
+		current, found = st.reports[key]
+	})
+	if !found {
+		current = reportState{Pubkey: report.Pubkey, EventID: report.EventID, Type: report.Type}
+	}
+	if slices.Contains(current.Reporters, report.Reporter) {
+		return ActionNone, nil
+	}
+	previous := current.Score
+	current.Score += report.Weight
+	current.Reporters = append(current.Reporters, report.Reporter)
+	current.ReportIDs = append(current.ReportIDs, report.ID)
+	reached := func(threshold float64) bool {
+		return threshold > 0 && previous < threshold && current.Score >= threshold
+	}
+	reason := fmt.Sprintf("reported for %s", report.Type)
+	action := ActionNone
+	var actionChanges []Change
+	if reached(thresholds.HideThreshold) && report.EventID != "" {
+		action = ActionHide
+		actionChanges = append(actionChanges, put(CategoryHiddenEvent, report.EventID, reason))
+	}
+	if reached(thresholds.ShadowBanThreshold) {
+		action = ActionShadowBan
+		actionChanges = append(actionChanges, put(CategoryShadowBannedPubkey, report.Pubkey, reason))
+	}
+	if reached(thresholds.DeleteThreshold) {
+		action = ActionDelete
+		if report.EventID != "" {
+			actionChanges = append(actionChanges, put(CategoryBannedEvent, report.EventID, reason))
+			actionChanges = append(actionChanges, remove(CategoryReport, key))
+			actionChanges = append(actionChanges, s.dismiss(report.EventID)...)
+		} else {
+			actionChanges = append(actionChanges, put(CategoryBannedPubkey, report.Pubkey, reason), remove(CategoryAllowedPubkey, report.Pubkey))
+		}
+	}
+	if action != ActionNone {
+		current.Actions = append(current.Actions, action)
+	}
+	detail, err := json.Marshal(current)
+	if err != nil {
+		return ActionNone, fmt.Errorf("failed to encode report: %w", err)
+	}
+	// the report is written first so that deleting the event dismisses it
+	if err := s.apply(append([]Change{put(CategoryReport, key, string(detail))}, actionChanges...)...); err != nil {
+		return ActionNone, err
+	}
+	return action, nil
+}
+
+// dismiss returns the changes removing the given event from the moderation queue: the reports about it, the reports whose report event it is and its hidden state
+func (s *Store) dismiss(id string) []Change {
+	changes := []Change{remove(CategoryHiddenEvent, id)}
+	s.view(func(st *state) {
+		for _, key := range sortedKeys(st.reports) {
+			if report := st.reports[key]; report.EventID == id || slices.Contains(report.ReportIDs, id) {
+				changes = append(changes, remove(CategoryReport, key))
+			}
+		}
+	})
+	return changes
+}
+
+// queue lists every event needing moderation: the flagged events, the reported events and, for reports about a pubkey, the first report event
+func (st *state) queue() []nip86.IDReason {
+	reasons := make(map[string][]string)
+	for id, reason := range st.flaggedEvents {
+		reasons[id] = append(reasons[id], reason)
+	}
+	for _, key := range sortedKeys(st.reports) {
+		report := st.reports[key]
+		summary := fmt.Sprintf("reported for %s %v times, score %v", report.Type, len(report.Reporters), report.Score)
+		if len(report.Actions) > 0 {
+			actions := make([]string, len(report.Actions))
+			for i, action := range report.Actions {
+				actions[i] = string(action)
+			}
+			summary += fmt.Sprintf(", actions taken: %s", strings.Join(actions, ", "))
+		}
+		id := report.EventID
+		if id == "" {
+			if len(report.ReportIDs) == 0 {
+				continue
+			}
+			id = report.ReportIDs[0]
+			summary = fmt.Sprintf("pubkey %s %s", report.Pubkey, summary)
+		}
+		reasons[id] = append(reasons[id], summary)
+	}
+	joined := make(map[string]string, len(reasons))
+	for id, list := range reasons {
+		joined[id] = strings.Join(list, "; ")
+	}
+	return idReasons(joined)
+}
+
+// CanRead checks if the given event may be sent to a connection authenticated as the given pubkeys. Hidden events are sent to no one and the events of shadow banned pubkeys only to their author. The pubkeys are only looked up when needed
+func (s *Store) CanRead(event *nostr.Event, authedPubkeys func() []string) bool {
+	if s == nil {
+		return true
+	}
+	var hidden, shadowBanned bool
+	s.view(func(st *state) {
+		hidden = hasKey(st.hiddenEvents, event.ID)
+		shadowBanned = hasKey(st.shadowBannedPubkeys, event.PubKey)
+	})
+	if hidden {
+		return false
+	}
+	return !shadowBanned || slices.Contains(authedPubkeys(), event.PubKey)
+}
+
+// IsSpam checks if the spam reports about the given event or its author reached the given score, reports counting for nothing are never enough. Search results leave spam out unless asked for it
+func (s *Store) IsSpam(event *nostr.Event, threshold float64) (spam bool) {
+	if s == nil {
+		return false
+	}
+	reached := func(score float64) bool {
+		return score > 0 && score >= threshold
+	}
+	s.view(func(st *state) {
+		spam = reached(st.reports[Report{EventID: event.ID, Type: "spam"}.key()].Score) || reached(st.reports[Report{Pubkey: event.PubKey, Type: "spam"}.key()].Score)
+	})
+	return spam
+}
@@ -0,0 +1,180 @@
+package moderation
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/rs/zerolog"
+)
+
+var testThresholds = config.Reports{HideThreshold: 1, ShadowBanThreshold: 2, DeleteThreshold: 3}
+
+type reportTestCase struct {
+	name           string
+	reports        []Report
+	expectedAction Action
+	hidden         bool
+	shadowBanned   bool
+	banned         bool
+}
+
+// eventReports creates reports of the test event by distinct reporters with the given weights
+func eventReports(reportType string, weights ...float64) []Report {
+	reports := []Report{}
+	for i, weight := range weights {
+		reports = append(reports, Report{ID: fmt.Sprintf("report-%v", i), Reporter: fmt.Sprintf("reporter-%v", i), Pubkey: testPubkey, EventID: testEventId, Type: reportType, Weight: weight})
+	}
+	return reports
+}
+
+var reportTestCases = []reportTestCase{
+	{
+		name:           "BelowThresholds",
+		reports:        eventReports("spam", 0.5),
+		expectedAction: ActionNone,
+	},
+	{
+		name:           "Hide",
+		reports:        eventReports("spam", 0.5, 0.5),
+		expectedAction: ActionHide,
+		hidden:         true,
+	},
+	{
+		name:           "ShadowBan",
+		reports:        eventReports("spam", 1, 1),
+		expectedAction: ActionShadowBan,
+		hidden:         true,
+		shadowBanned:   true,
+	},
+	{
+		name:           "Delete",
+		reports:        eventReports("spam", 1, 1, 1),
+		expectedAction: ActionDelete,
+		shadowBanned:   true,
+		banned:         true,
+	},
+	{
+		name:           "SeparateTypes",
+		reports:        append(eventReports("spam", 0.5), eventReports("nudity", 0.5)...),
+		expectedAction: ActionNone,
+	},
+	{
+		name: "DuplicateReporter",
+		reports: []Report{
+			{ID: "report-0", Reporter: "reporter", Pubkey: testPubkey, EventID: testEventId, Type: "spam", Weight: 0.5},
+			{ID: "report-1", Reporter: "reporter", Pubkey: testPubkey, EventID: testEventId, Type: "spam", Weight: 0.5},
+		},
+		expectedAction: ActionNone,
+	},
+	{
+		name: "PubkeyDelete",
+		reports: []Report{
+			{ID: "report-0", Reporter: "reporter-0", Pubkey: testPubkey, Type: "impersonation", Weight: 3},
+		},
+		expectedAction: ActionDelete,
+		shadowBanned:   true,
+		banned:         true,
+	},
+}
+
+// TestReport ensures reports add up per event or pubkey and report type and trigger the configured actions
+func TestReport(t *testing.T) {
+	for _, testCase := range reportTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		s, err := NewStore(newFakeRepository(), zerolog.Nop())
+		if err != nil {
+			t.Fatalf("unexpected error when creating store: %v", err)
+		}
+		action := ActionNone
+		for _, report := range testCase.reports {
+			reportAction, err := s.Report(report, testThresholds)
+			if err != nil {
+				t.Fatalf("unexpected error when reporting for test case %s: %v", testCase.name, err)
+			}
+			if reportAction != ActionNone {
+				action = reportAction
+			}
+		}
+		if action != testCase.expectedAction {
+			t.Errorf("unexpected action for test case %s: expected %q, got %q", testCase.name, testCase.expectedAction, action)
+		}
+		if hidden := !s.CanRead(&testEvent, func() []string { return []string{testPubkey} }); hidden != testCase.hidden {
+			t.Errorf("unexpected hidden state for test case %s: %v", testCase.name, hidden)
+		}
+		if shadowBanned := !s.CanRead(&testEvent, func() []string { return nil }); !testCase.hidden && shadowBanned != testCase.shadowBanned {
+			t.Errorf("unexpected shadow ban state for test case %s: %v", testCase.name, shadowBanned)
+		}
+		if banned := s.Check(testEvent, Allowlists{}) != ""; banned != testCase.banned {
+			t.Errorf("unexpected ban state for test case %s: %v", testCase.name, banned)
+		}
+	}
+}
+
+// TestReportQueue ensures reports are listed as needing moderation until an admin allows or bans the event
+func TestReportQueue(t *testing.T) {
+	s, err := NewStore(newFakeRepository(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating store: %v", err)
+	}
+	for _, report := range append(eventReports("spam", 1), Report{ID: "pubkey-report", Reporter: "reporter", Pubkey: otherPubkey, Type: "spam", Weight: 0.5}) {
+		if _, err := s.Report(report, testThresholds); err != nil {
+			t.Fatalf("unexpected error when reporting: %v", err)
+		}
+	}
+	if err := s.FlagEvent(testEventId, "flagged by admin"); err != nil {
+		t.Fatalf("unexpected error when flagging event: %v", err)
+	}
+	queue := s.EventsNeedingModeration()
+	if len(queue) != 2 {
+		t.Fatalf("unexpected number of events needing moderation: %v", queue)
+	}
+	if queue[0].ID != testEventId || !strings.Contains(queue[0].Reason, "flagged by admin") || !strings.Contains(queue[0].Reason, "reported for spam 1 times, score 1, actions taken: hide") {
+		t.Errorf("unexpected reported event in queue: %v", queue[0])
+	}
+	if queue[1].ID != "pubkey-report" || !strings.Contains(queue[1].Reason, "pubkey "+otherPubkey) {
+		t.Errorf("unexpected reported pubkey in queue: %v", queue[1])
+	}
+	if err := s.AllowEvent(testEventId); err != nil {
+		t.Fatalf("unexpected error when allowing event: %v", err)
+	}
+	if !s.CanRead(&testEvent, func() []string { return nil }) {
+		t.Error("expected allowed event to be shown again")
+	}
+	if err := s.AllowEvent("pubkey-report"); err != nil {
+		t.Fatalf("unexpected error when dismissing pubkey report: %v", err)
+	}
+	if queue := s.EventsNeedingModeration(); len(queue) != 0 {
+		t.Errorf("expected empty queue, got %v", queue)
+	}
+}
+
+// TestIsSpam ensures events are spam once the spam reports about them or their author reach the threshold and never through reports counting for nothing
+func TestIsSpam(t *testing.T) {
+	s, err := NewStore(newFakeRepository(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating store: %v", err)
+	}
+	if _, err := s.Report(eventReports("nudity", 1)[0], testThresholds); err != nil {
+		t.Fatalf("unexpected error when reporting: %v", err)
+	}
+	if s.IsSpam(&testEvent, 1) {
+		t.Error("expected event reported for nudity not to be spam")
+	}
+	if _, err := s.Report(eventReports("spam", 0)[0], testThresholds); err != nil {
+		t.Fatalf("unexpected error when reporting: %v", err)
+	}
+	if s.IsSpam(&testEvent, 0) {
+		t.Error("expected event reported for spam with no weight not to be spam")
+	}
+	if _, err := s.Report(Report{ID: "report", Reporter: "reporter", Pubkey: testPubkey, Type: "spam", Weight: 0.5}, testThresholds); err != nil {
+		t.Fatalf("unexpected error when reporting: %v", err)
+	}
+	if s.IsSpam(&testEvent, 1) {
+		t.Error("expected event of author reported for spam below the threshold not to be spam")
+	}
+	if !s.IsSpam(&testEvent, 0.5) {
+		t.Error("expected event of author reported for spam to be spam")
+	}
+}
@@ -0,0 +1,44 @@
+package moderation
+
+import (
+	"context"
+)
+
+// Category groups the entries of the moderation state
+type Category string
+
+const (
+	CategoryBannedPubkey   Category = "banned_pubkey"
+	CategoryAllowedPubkey  Category = "allowed_pubkey"
+	CategoryBannedEvent    Category = "banned_event"
+	CategoryFlaggedEvent   Category = "flagged_event"
+	CategoryAllowedKind    Category = "allowed_kind"
+	CategoryDisallowedKind Category = "disallowed_kind"
+	CategoryBlockedIP      Category = "blocked_ip"
+	CategoryRelayInfo      Category = "relay_info"
+	// CategoryReport entries hold the score of a reported event or pubkey for a report type
+	CategoryReport             Category = "report"
+	CategoryHiddenEvent        Category = "hidden_event"
+	CategoryShadowBannedPubkey Category = "shadow_banned_pubkey"
+)
+
+// Entry is a single moderation decision, e.g. a banned pubkey (subject) along with the reason it was banned (detail)
+type Entry struct {
+	Category Category `json:"category"`
+	Subject  string   `json:"subject"`
+	Detail   string   `json:"detail"`
+}
+
+// Change is a single write to the repository: inserting the entry or replacing the detail of an existing entry with the same category and subject, or deleting that entry when Delete is set
+type Change struct {
+	Entry  Entry
+	Delete bool
+}
+
+// Repository persists the moderation state independently of the event store. Every storage backend provides one
+type Repository interface {
+	// Apply writes the given changes in order, atomically: when it fails none of them are written
+	Apply(ctx context.Context, changes []Change) error
+	// List returns every entry
+	List(ctx context.Context) ([]Entry, error)
+}
@@ -4,13 +4,17 @@ import "github.com/nbd-wtf/go-nostr"
 
 type Msg struct {
 	ConnectionId string
+	RemoteIP     string
 	Data         []byte
 	CloseConn    bool
 	Unparseable  bool
+	// Live marks an EVENT frame of a live subscription, the only kind of message dropped when a connection can't keep up
+	Live bool
 }
 
 type ParsedMsg struct {
 	ConnectionId string
+	RemoteIP     string
 	Data         nostr.Envelope
 	CloseConn    bool
 	Callback     func(error)
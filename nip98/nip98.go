@@ -0,0 +1,138 @@
+package nip98
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// KindHTTPAuth is the kind of the events used to authorize HTTP requests
+	KindHTTPAuth = 27235
+	// Scheme is the scheme of the Authorization header carrying the event
+	Scheme = "Nostr"
+)
+
+var (
+	ErrMissingAuthorization = errors.New("missing nostr authorization header")
+	ErrInvalidAuthorization = errors.New("invalid nostr authorization")
+	// MaxClockSkew is how far the created_at of an auth event may be from the current time
+	MaxClockSkew = time.Minute
+)
+
+// CreateAuthHeader signs an auth event for the given request and returns the value of its Authorization header. The event carries a random nonce tag so identical requests sent within the same second aren't refused as replays
+func CreateAuthHeader(secretKey, url, method string, body []byte) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	event := nostr.Event{
+		Kind:      KindHTTPAuth,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"u", url}, {"method", method}, {"nonce", hex.EncodeToString(nonce)}},
+	}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		event.Tags = append(event.Tags, nostr.Tag{"payload", hex.EncodeToString(hash[:])})
+	}
+	if err := event.Sign(secretKey); err != nil {
+		return "", err
+	}
+	return Scheme + " " + base64.StdEncoding.EncodeToString([]byte(event.String())), nil
+}
+
+// ReplayCache remembers the ids of accepted auth events while their created_at is within MaxClockSkew so each of them authorizes a single request
+type ReplayCache struct {
+	seen map[string]time.Time
+	sync.Mutex
+}
+
+// NewReplayCache creates an empty ReplayCache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[string]time.Time)}
+}
+
+// replayed records the given event id and checks if it was already recorded. Ids of events which are too old to be accepted again are forgotten
+func (c *ReplayCache) replayed(id string, createdAt, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	for seenID, seenAt := range c.seen {
+		if now.Sub(seenAt) > MaxClockSkew {
+			delete(c.seen, seenID)
+		}
+	}
+	if _, ok := c.seen[id]; ok {
+		return true
+	}
+	c.seen[id] = createdAt
+	return false
+}
+
+// ValidateRequest checks the NIP-98 Authorization header of the given request and returns the pubkey which signed it. body is the raw request body which must match the payload tag when not empty. Auth events already accepted by the replays cache are refused
+func ValidateRequest(r *http.Request, body []byte, now time.Time, replays *ReplayCache) (string, error) {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Authorization"), Scheme+" ")
+	if !ok {
+		return "", ErrMissingAuthorization
+	}
+	eventBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("%w: event is not base64 encoded", ErrInvalidAuthorization)
+	}
+	var event nostr.Event
+	if err := json.Unmarshal(eventBytes, &event); err != nil {
+		return "", fmt.Errorf("%w: failed to parse event: %v", ErrInvalidAuthorization, err)
+	}
+	if event.Kind != KindHTTPAuth {
+		return "", fmt.Errorf("%w: kind %v is not %v", ErrInvalidAuthorization, event.Kind, KindHTTPAuth)
+	}
+	if skew := now.Sub(event.CreatedAt.Time()).Abs(); skew > MaxClockSkew {
+		return "", fmt.Errorf("%w: event created_at is %v away from the current time", ErrInvalidAuthorization, skew)
+	}
+	if tag := event.Tags.GetFirst([]string{"u", ""}); tag == nil || !matchesURL(tag.Value(), r) {
+		return "", fmt.Errorf("%w: u tag does not match the request url", ErrInvalidAuthorization)
+	}
+	if tag := event.Tags.GetFirst([]string{"method", ""}); tag == nil || !strings.EqualFold(tag.Value(), r.Method) {
+		return "", fmt.Errorf("%w: method tag does not match the request method", ErrInvalidAuthorization)
+	}
+	if len(body) > 0 {
+		hash := sha256.Sum256(body)
+		if tag := event.Tags.GetFirst([]string{"payload", ""}); tag == nil || !strings.EqualFold(tag.Value(), hex.EncodeToString(hash[:])) {
+			return "", fmt.Errorf("%w: payload tag does not match the request body", ErrInvalidAuthorization)
+		}
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return "", fmt.Errorf("%w: invalid event signature or event id", ErrInvalidAuthorization)
+	}
+	if replays.replayed(event.ID, event.CreatedAt.Time(), now) {
+		return "", fmt.Errorf("%w: event was already used", ErrInvalidAuthorization)
+	}
+	return event.PubKey, nil
+}
+
+// matchesURL compares the host, path and query parameters of the u tag with those of the request. The scheme is ignored since TLS may be terminated by a proxy
+func matchesURL(tagURL string, r *http.Request) bool {
+	u, err := url.Parse(tagURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host) && normalizePath(u.Path) == normalizePath(r.URL.Path) && u.Query().Encode() == r.URL.Query().Encode()
+}
+
+// normalizePath treats an empty path and the root path the same
+func normalizePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,197 @@
+package nip98
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+type validateRequestTestCase struct {
+	name        string
+	event       func() nostr.Event
+	header      string
+	body        []byte
+	expectedErr error
+}
+
+var (
+	testSecretKey = "6b911fd37cdf5c81d4c0adb1ab7fa822ed253ab0ad9aa18d77257c88b29b718e"
+	testURL       = "https://relay.example.com/"
+	testBody      = []byte(`{"method":"supportedmethods","params":[]}`)
+	testNow       = time.Unix(1700000000, 0)
+)
+
+// newAuthEvent creates a signed auth event for the test request, modify can alter it before it is signed
+func newAuthEvent(modify func(e *nostr.Event)) func() nostr.Event {
+	return func() nostr.Event {
+		hash := sha256.Sum256(testBody)
+		event := nostr.Event{
+			Kind:      KindHTTPAuth,
+			CreatedAt: nostr.Timestamp(testNow.Unix()),
+			Tags: nostr.Tags{
+				{"u", testURL},
+				{"method", "POST"},
+				{"payload", hex.EncodeToString(hash[:])},
+			},
+		}
+		if modify != nil {
+			modify(&event)
+		}
+		if err := event.Sign(testSecretKey); err != nil {
+			panic(err)
+		}
+		return event
+	}
+}
+
+var validateRequestTestCases = []validateRequestTestCase{
+	{
+		name:  "ValidAuth",
+		event: newAuthEvent(nil),
+		body:  testBody,
+	},
+	{
+		name:        "MissingHeader",
+		header:      "Bearer token",
+		body:        testBody,
+		expectedErr: ErrMissingAuthorization,
+	},
+	{
+		name:        "NotBase64",
+		header:      "Nostr !!!",
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "WrongKind",
+		event:       newAuthEvent(func(e *nostr.Event) { e.Kind = 1 }),
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "Expired",
+		event:       newAuthEvent(func(e *nostr.Event) { e.CreatedAt = nostr.Timestamp(testNow.Add(-2 * time.Minute).Unix()) }),
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "WrongURL",
+		event:       newAuthEvent(func(e *nostr.Event) { e.Tags[0] = nostr.Tag{"u", "https://other.example.com/"} }),
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "WrongQuery",
+		event:       newAuthEvent(func(e *nostr.Event) { e.Tags[0] = nostr.Tag{"u", testURL + "?page=2"} }),
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "WrongMethod",
+		event:       newAuthEvent(func(e *nostr.Event) { e.Tags[1] = nostr.Tag{"method", "GET"} }),
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name:        "WrongPayload",
+		event:       newAuthEvent(nil),
+		body:        []byte(`{"method":"banpubkey","params":[]}`),
+		expectedErr: ErrInvalidAuthorization,
+	},
+	{
+		name: "InvalidSignature",
+		event: func() nostr.Event {
+			event := newAuthEvent(nil)()
+			event.Tags = append(event.Tags, nostr.Tag{"extra"})
+			return event
+		},
+		body:        testBody,
+		expectedErr: ErrInvalidAuthorization,
+	},
+}
+
+// TestValidateRequest ensures only correctly signed auth events matching the request are accepted
+func TestValidateRequest(t *testing.T) {
+	expectedPubkey, err := nostr.GetPublicKey(testSecretKey)
+	if err != nil {
+		t.Fatalf("unexpected error when deriving pubkey: %v", err)
+	}
+	for _, testCase := range validateRequestTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		r := httptest.NewRequest("POST", testURL, bytes.NewReader(testCase.body))
+		header := testCase.header
+		if testCase.event != nil {
+			event := testCase.event()
+			header = Scheme + " " + base64.StdEncoding.EncodeToString([]byte(event.String()))
+		}
+		r.Header.Set("Authorization", header)
+		pubkey, err := ValidateRequest(r, testCase.body, testNow, NewReplayCache())
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("unexpected error for test case %s: expected %v, got %v", testCase.name, testCase.expectedErr, err)
+		}
+		if err == nil && pubkey != expectedPubkey {
+			t.Errorf("unexpected pubkey for test case %s: expected %s, got %s", testCase.name, expectedPubkey, pubkey)
+		}
+	}
+}
+
+// TestCreateAuthHeader ensures created headers are accepted by ValidateRequest, including identical requests sent within the same second
+func TestCreateAuthHeader(t *testing.T) {
+	replays := NewReplayCache()
+	for _, body := range [][]byte{nil, testBody, testBody} {
+		header, err := CreateAuthHeader(testSecretKey, testURL, "POST", body)
+		if err != nil {
+			t.Fatalf("unexpected error when creating auth header: %v", err)
+		}
+		r := httptest.NewRequest("POST", testURL, bytes.NewReader(body))
+		r.Header.Set("Authorization", header)
+		if _, err := ValidateRequest(r, body, time.Now(), replays); err != nil {
+			t.Errorf("unexpected error when validating created auth header: %v", err)
+		}
+	}
+}
+
+// TestValidateRequestQuery ensures the query parameters of the u tag must match those of the request, in any order
+func TestValidateRequestQuery(t *testing.T) {
+	event := newAuthEvent(func(e *nostr.Event) { e.Tags[0] = nostr.Tag{"u", testURL + "?b=2&a=1"} })()
+	header := Scheme + " " + base64.StdEncoding.EncodeToString([]byte(event.String()))
+	for url, valid := range map[string]bool{testURL + "?a=1&b=2": true, testURL + "?a=1": false, testURL: false} {
+		r := httptest.NewRequest("POST", url, bytes.NewReader(testBody))
+		r.Header.Set("Authorization", header)
+		if _, err := ValidateRequest(r, testBody, testNow, NewReplayCache()); (err == nil) != valid {
+			t.Errorf("unexpected result for request to %s: expected valid %v, got %v", url, valid, err)
+		}
+	}
+}
+
+// TestValidateRequestReplay ensures an auth event authorizes a single request until it is too old to be accepted anyway
+func TestValidateRequestReplay(t *testing.T) {
+	event := newAuthEvent(nil)()
+	header := Scheme + " " + base64.StdEncoding.EncodeToString([]byte(event.String()))
+	replays := NewReplayCache()
+	for i, expectedErr := range []error{nil, ErrInvalidAuthorization} {
+		r := httptest.NewRequest("POST", testURL, bytes.NewReader(testBody))
+		r.Header.Set("Authorization", header)
+		if _, err := ValidateRequest(r, testBody, testNow, replays); !errors.Is(err, expectedErr) {
+			t.Errorf("unexpected error for request %v: expected %v, got %v", i, expectedErr, err)
+		}
+	}
+	// a newer event is accepted and the expired one forgotten
+	later := testNow.Add(2 * MaxClockSkew)
+	newer := newAuthEvent(func(e *nostr.Event) { e.CreatedAt = nostr.Timestamp(later.Unix()) })()
+	r := httptest.NewRequest("POST", testURL, bytes.NewReader(testBody))
+	r.Header.Set("Authorization", Scheme+" "+base64.StdEncoding.EncodeToString([]byte(newer.String())))
+	if _, err := ValidateRequest(r, testBody, later, replays); err != nil {
+		t.Errorf("unexpected error for a newer event: %v", err)
+	}
+	if _, ok := replays.seen[event.ID]; ok {
+		t.Error("expected expired event id to be forgotten")
+	}
+}
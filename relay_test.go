@@ -0,0 +1,175 @@
+package tandem
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// TestRelay ensures an embedded relay serves clients through its handler between Start and Stop, applying the given policy
+func TestRelay(t *testing.T) {
+	cfg := &config.Config{Moderation: config.Moderation{StatePath: filepath.Join(t.TempDir(), "moderation.json")}}
+	relay, err := New(WithConfig(cfg), WithStorage("memory://"), WithPolicy(config.Policy{DisallowedKinds: []int{7}}), WithInfo(config.Info{Name: "embedded"}), WithoutListener())
+	if err != nil {
+		t.Fatalf("unexpected error when creating relay: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/", relay.Handler())
+	srvr := httptest.NewServer(mux)
+	defer srvr.Close()
+	url := "ws" + strings.TrimPrefix(srvr.URL, "http")
+	if _, err := nostr.RelayConnect(context.Background(), url); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected connection to be refused before the relay is started, got %v", err)
+	}
+	accepted := make(chan bus.Event, 10)
+	bus.Subscribe(relay.Bus(), bus.EventAccepted, func(e bus.Event) { accepted <- e })
+	if err := relay.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error when starting relay: %v", err)
+	}
+	if err := relay.Start(context.Background()); !errors.Is(err, ErrRelayStarted) {
+		t.Errorf("unexpected error when starting relay twice: expected %v got %v", ErrRelayStarted, err)
+	}
+	client, err := nostr.RelayConnect(context.Background(), url)
+	if err != nil {
+		t.Fatalf("unexpected error when connecting to relay: %v", err)
+	}
+	defer client.Close()
+	sk := nostr.GeneratePrivateKey()
+	note := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "hello"}
+	reaction := nostr.Event{Kind: 7, CreatedAt: nostr.Now(), Content: "+"}
+	for _, event := range []*nostr.Event{&note, &reaction} {
+		if err := event.Sign(sk); err != nil {
+			t.Fatalf("unexpected error when signing event: %v", err)
+		}
+	}
+	if err := client.Publish(context.Background(), note); err != nil {
+		t.Fatalf("unexpected error when publishing event: %v", err)
+	}
+	if err := client.Publish(context.Background(), reaction); err == nil {
+		t.Error("expected event of a disallowed kind to be rejected")
+	}
+	select {
+	case e := <-accepted:
+		if e.Event.ID != note.ID {
+			t.Errorf("unexpected event accepted: %v", e.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for accepted event on the bus")
+	}
+	events, err := client.QuerySync(context.Background(), nostr.Filter{Authors: []string{note.PubKey}})
+	if err != nil {
+		t.Fatalf("unexpected error when querying relay: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != note.ID {
+		t.Errorf("unexpected events stored: %v", events)
+	}
+	if name := relay.Config().Info.Name; name != "embedded" {
+		t.Errorf("unexpected relay name %s", name)
+	}
+	if err := relay.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected error when stopping relay: %v", err)
+	}
+	if err := relay.Stop(context.Background()); !errors.Is(err, ErrRelayNotRunning) {
+		t.Errorf("unexpected error when stopping relay twice: expected %v got %v", ErrRelayNotRunning, err)
+	}
+	if err := relay.Start(context.Background()); !errors.Is(err, ErrRelayStarted) {
+		t.Errorf("unexpected error when restarting relay: expected %v got %v", ErrRelayStarted, err)
+	}
+}
+
+// TestNewInvalidConfig ensures a relay isn't created from an invalid configuration
+func TestNewInvalidConfig(t *testing.T) {
+	if _, err := New(WithStorage("postgres://localhost")); !errors.Is(err, config.ErrInvalidStorageURI) {
+		t.Errorf("unexpected error: expected %v got %v", config.ErrInvalidStorageURI, err)
+	}
+}
+
+// closingStore is a memory store recording whether it was closed
+type closingStore struct {
+	slicestore.SliceStore
+	closed bool
+}
+
+func (s *closingStore) Close() {
+	s.closed = true
+}
+
+// TestNewWithStore ensures a relay stores events in the store it is given and leaves it open when it stops
+func TestNewWithStore(t *testing.T) {
+	store := &closingStore{}
+	if err := store.Init(); err != nil {
+		t.Fatalf("unexpected error when initializing store: %v", err)
+	}
+	cfg := &config.Config{Moderation: config.Moderation{StatePath: filepath.Join(t.TempDir(), "moderation.json")}}
+	relay, err := New(WithConfig(cfg), WithStore(store), WithoutListener())
+	if err != nil {
+		t.Fatalf("unexpected error when creating relay: %v", err)
+	}
+	srvr := httptest.NewServer(relay.Handler())
+	defer srvr.Close()
+	if err := relay.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error when starting relay: %v", err)
+	}
+	client, err := nostr.RelayConnect(context.Background(), "ws"+strings.TrimPrefix(srvr.URL, "http"))
+	if err != nil {
+		t.Fatalf("unexpected error when connecting to relay: %v", err)
+	}
+	note := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Content: "hello"}
+	if err := note.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("unexpected error when signing event: %v", err)
+	}
+	if err := client.Publish(context.Background(), note); err != nil {
+		t.Fatalf("unexpected error when publishing event: %v", err)
+	}
+	client.Close()
+	if count, err := store.CountEvents(context.Background(), nostr.Filter{IDs: []string{note.ID}}); err != nil || count != 1 {
+		t.Errorf("expected event to be saved in the given store, got %v events: %v", count, err)
+	}
+	if err := relay.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected error when stopping relay: %v", err)
+	}
+	if store.closed {
+		t.Error("expected the given store to be left open")
+	}
+}
+
+// TestNewClosesOnError ensures the access log opened by New is closed again when a later step fails
+func TestNewClosesOnError(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files can't be listed on this platform")
+	}
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "moderation.json")
+	if err := os.WriteFile(statePath, []byte("not json"), 0600); err != nil {
+		t.Fatalf("unexpected error when writing moderation state: %v", err)
+	}
+	accessLogPath := filepath.Join(dir, "access.log")
+	cfg := &config.Config{
+		Moderation: config.Moderation{StatePath: statePath},
+		AccessLog:  config.AccessLog{Enabled: true, Path: accessLogPath},
+	}
+	if _, err := New(WithConfig(cfg), WithoutListener()); err == nil {
+		t.Fatal("expected an error when loading an invalid moderation state")
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatalf("unexpected error when listing open files: %v", err)
+	}
+	for _, fd := range fds {
+		if target, _ := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); target == accessLogPath {
+			t.Errorf("expected access log to be closed")
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// cursors holds the since-cursor of every upstream, the time up to which its events were replicated, and persists them to a JSON file
+type cursors struct {
+	path   string
+	values map[string]nostr.Timestamp
+	dirty  bool
+	sync.Mutex
+}
+
+// loadCursors reads the cursors from the given path. A missing file is treated as no upstream having been replicated yet
+func loadCursors(path string) (*cursors, error) {
+	c := &cursors{path: path, values: make(map[string]nostr.Timestamp)}
+	stateBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(stateBytes, &c.values); err != nil {
+		return nil, fmt.Errorf("failed to parse replication state %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// get returns the cursor of an upstream, 0 if it was never replicated
+func (c *cursors) get(url string) nostr.Timestamp {
+	c.Lock()
+	defer c.Unlock()
+	return c.values[url]
+}
+
+// advance moves the cursor of an upstream forward. Cursors never move back
+func (c *cursors) advance(url string, cursor nostr.Timestamp) {
+	c.Lock()
+	defer c.Unlock()
+	if cursor > c.values[url] {
+		c.values[url] = cursor
+		c.dirty = true
+	}
+}
+
+// save writes the cursors, if they changed, to a temporary file which then replaces the state file so a crash never leaves a partially written state behind
+func (c *cursors) save() error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	stateBytes, err := json.MarshalIndent(c.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, stateBytes, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
@@ -0,0 +1,311 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// connectionIdPrefix starts the connection id under which the events of an upstream are ingested. Such events are never pushed so they don't bounce between relays
+	connectionIdPrefix = "replication:"
+	// pageSize is the number of events asked for at once when catching up with an upstream
+	pageSize = 500
+	// pushQueueSize is the number of accepted events waiting to be pushed to an upstream. Events are dropped once it is full
+	pushQueueSize = 1024
+	// cursorOverlap is subtracted from the cursor of an upstream when resuming so events delayed by clock skew or propagation aren't missed
+	cursorOverlap  = nostr.Timestamp(60)
+	minBackoff     = time.Second
+	maxBackoff     = 5 * time.Minute
+	saveInterval   = 10 * time.Second
+	queryTimeout   = 30 * time.Second
+	publishTimeout = 10 * time.Second
+	ErrConnLost    = errors.New("connection to upstream lost")
+)
+
+// IngestFunc runs an event through the validation, policy and storage of the relay and returns its OK state and reason
+type IngestFunc func(connectionId string, event nostr.Event) (bool, string)
+
+// upstream is a relay replicated by this relay
+type upstream struct {
+	url          string
+	connectionId string
+	filters      nostr.Filters
+	// push is nil unless local events are pushed to the upstream
+	push chan nostr.Event
+	// pending is an event taken from the push queue which couldn't be sent before the connection was lost
+	pending *nostr.Event
+}
+
+// Replicator keeps this relay in sync with upstream relays. It connects to each of them as a client, ingests their stored events since its cursor and then their live events, and optionally pushes the events accepted by this relay to them
+type Replicator struct {
+	logger    zerolog.Logger
+	ingest    IngestFunc
+	upstreams []*upstream
+	cursors   *cursors
+	ctx       context.Context
+	cancel    context.CancelFunc
+	sync.WaitGroup
+}
+
+// NewReplicator creates a replicator for the configured upstreams, loading their cursors from the state file. Events are ingested with the given function
+func NewReplicator(cfg config.Replication, ingest IngestFunc, logger zerolog.Logger) (*Replicator, error) {
+	cursors, err := loadCursors(cfg.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replicator{
+		logger:  logger,
+		ingest:  ingest,
+		cursors: cursors,
+	}
+	for _, upstreamCfg := range cfg.Upstreams {
+		filters, err := upstreamCfg.NostrFilters()
+		if err != nil {
+			return nil, fmt.Errorf("invalid filters for upstream %s: %w", upstreamCfg.URL, err)
+		}
+		u := &upstream{url: upstreamCfg.URL, connectionId: connectionIdPrefix + upstreamCfg.URL, filters: filters}
+		if upstreamCfg.Push {
+			u.push = make(chan nostr.Event, pushQueueSize)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// Start starts replicating every upstream
+func (r *Replicator) Start() error {
+	r.logger.Info().Msg("starting up...")
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, u := range r.upstreams {
+		r.Add(1)
+		go r.replicate(u)
+	}
+	r.Add(1)
+	go r.saveCursors()
+	r.logger.Info().Msg("start up completed")
+	return nil
+}
+
+// Publish queues an event accepted by this relay for the upstreams it is pushed to, when it matches their filters. It is subscribed to bus.EventAccepted. Events replicated from an upstream and ephemeral events are never pushed
+func (r *Replicator) Publish(accepted bus.Event) {
+	event := accepted.Event
+	if strings.HasPrefix(accepted.ConnectionId, connectionIdPrefix) || nostr.IsEphemeralKind(event.Kind) {
+		return
+	}
+	for _, u := range r.upstreams {
+		if u.push == nil || !u.filters.Match(&event) {
+			continue
+		}
+		select {
+		case u.push <- event:
+		default:
+			r.logger.Warn().Str("upstream", u.url).Str("eventId", event.ID).Msg("push queue is full, dropping event")
+		}
+	}
+}
+
+// replicate is run as a goroutine for every upstream. It reconnects with an exponential backoff whenever the connection is lost
+func (r *Replicator) replicate(u *upstream) {
+	defer r.Done()
+	logger := r.logger.With().Str("upstream", u.url).Logger()
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := r.session(logger, u)
+		if r.ctx.Err() != nil {
+			return
+		}
+		// a session which lasted a while was connected, the next one starts over with a short delay
+		if time.Since(started) > maxBackoff {
+			backoff = minBackoff
+		}
+		logger.Warn().Err(err).Msgf("replication interrupted, reconnecting in %v...", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// session connects to an upstream, catches up with the events it stored since the cursor and then ingests its live events until the connection is lost
+func (r *Replicator) session(logger zerolog.Logger, u *upstream) error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	var pushing sync.WaitGroup
+	defer pushing.Wait()
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, u.url)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	logger.Info().Msg("connected to upstream")
+	if u.push != nil {
+		pushing.Add(1)
+		go func() {
+			defer pushing.Done()
+			r.pushEvents(ctx, logger, relay, u)
+		}()
+	}
+	started := nostr.Now()
+	if err := r.catchUp(ctx, logger, relay, u); err != nil {
+		return err
+	}
+	r.cursors.advance(u.url, started)
+	if err := r.cursors.save(); err != nil {
+		logger.Error().Err(err).Msg("failed to save replication state")
+	}
+	logger.Info().Msg("caught up with upstream, waiting for live events...")
+	sub, err := relay.Subscribe(ctx, withSince(u.filters, started-cursorOverlap))
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return ErrConnLost
+			}
+			// a failed event must be fetched again after a restart so only ingested events move the cursor. Events dated in the future must not move it past events still to come
+			if r.ingestEvent(logger, u, event) {
+				r.cursors.advance(u.url, min(event.CreatedAt, nostr.Now()))
+			}
+		case reason := <-sub.ClosedReason:
+			return fmt.Errorf("subscription closed by upstream: %s", reason)
+		case <-relay.Context().Done():
+			return ErrConnLost
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// catchUp ingests the events an upstream stored since its cursor. Relays cap the number of events returned by a query so they are fetched page by page, going back in time
+func (r *Replicator) catchUp(ctx context.Context, logger zerolog.Logger, relay *nostr.Relay, u *upstream) error {
+	var since nostr.Timestamp
+	if cursor := r.cursors.get(u.url); cursor > cursorOverlap {
+		since = cursor - cursorOverlap
+	}
+	count := 0
+	for _, filter := range withSince(u.filters, since) {
+		filter.Limit = pageSize
+		seen := make(map[string]struct{})
+		for {
+			queryCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+			events, err := relay.QuerySync(queryCtx, filter)
+			cancel()
+			if err != nil {
+				return err
+			}
+			added := 0
+			var oldest nostr.Timestamp
+			for _, event := range events {
+				if added == 0 || event.CreatedAt < oldest {
+					oldest = event.CreatedAt
+				}
+				if _, ok := seen[event.ID]; ok {
+					continue
+				}
+				seen[event.ID] = struct{}{}
+				added++
+				r.ingestEvent(logger, u, event)
+			}
+			// a page without new events means every matching event was fetched. The next page starts at the oldest event seen since others may share its timestamp
+			if added == 0 {
+				break
+			}
+			count += added
+			filter.Until = &oldest
+		}
+		// a query interrupted by a lost connection returns the events received so far
+		if !relay.IsConnected() {
+			return ErrConnLost
+		}
+	}
+	logger.Info().Msgf("fetched %v stored events from upstream", count)
+	return nil
+}
+
+// withSince returns a copy of the filters only matching events created at or after since, unless they are already more restrictive
+func withSince(filters nostr.Filters, since nostr.Timestamp) nostr.Filters {
+	copied := make(nostr.Filters, 0, len(filters))
+	for _, filter := range filters {
+		if since > 0 && (filter.Since == nil || *filter.Since < since) {
+			filter.Since = &since
+		}
+		copied = append(copied, filter)
+	}
+	return copied
+}
+
+// ingestEvent runs an event received from an upstream through the ingester and reports whether it was accepted. Events already stored are accepted as duplicates
+func (r *Replicator) ingestEvent(logger zerolog.Logger, u *upstream, event *nostr.Event) bool {
+	ok, reason := r.ingest(u.connectionId, *event)
+	if !ok {
+		logger.Debug().Str("eventId", event.ID).Msgf("event not replicated: %s", reason)
+	}
+	return ok
+}
+
+// pushEvents publishes the queued events to an upstream until the connection is lost. An event which couldn't be sent is kept for the next connection while events rejected by the upstream are dropped
+func (r *Replicator) pushEvents(ctx context.Context, logger zerolog.Logger, relay *nostr.Relay, u *upstream) {
+	for {
+		if u.pending == nil {
+			select {
+			case event := <-u.push:
+				u.pending = &event
+			case <-ctx.Done():
+				return
+			}
+		}
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		err := relay.Publish(publishCtx, *u.pending)
+		cancel()
+		if err != nil && (ctx.Err() != nil || !relay.IsConnected()) {
+			return
+		}
+		if err != nil {
+			logger.Debug().Err(err).Str("eventId", u.pending.ID).Msg("upstream rejected event")
+		}
+		u.pending = nil
+	}
+}
+
+// saveCursors is run as a goroutine to periodically persist the cursors advanced by live events
+func (r *Replicator) saveCursors() {
+	defer r.Done()
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.cursors.save(); err != nil {
+				r.logger.Error().Err(err).Msg("failed to save replication state")
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stop disconnects from every upstream and saves the cursors
+func (r *Replicator) Stop() error {
+	r.logger.Info().Msg("shutting down...")
+	r.cancel()
+	r.Wait()
+	if err := r.cursors.save(); err != nil {
+		return fmt.Errorf("failed to save replication state: %w", err)
+	}
+	r.logger.Info().Msg("shutdown completed")
+	return nil
+}
@@ -0,0 +1,202 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/filter"
+	"github.com/TheRebelOfBabylon/tandem/ingester"
+	"github.com/TheRebelOfBabylon/tandem/storage"
+	"github.com/TheRebelOfBabylon/tandem/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// testRelay is an in-process tandem relay backed by memory storage
+type testRelay struct {
+	url      string
+	ingester *ingester.Ingester
+	storage  *storage.StorageBackend
+	bus      *bus.Bus
+}
+
+// startTestRelay assembles and starts a relay listening on a free local port, it is stopped when the test ends
+func startTestRelay(t *testing.T) *testRelay {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected error when looking for a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	cfg := &config.Config{HTTP: config.HTTP{Port: port}, Storage: config.Storage{Uri: "memory://"}, Moderation: config.Moderation{StatePath: filepath.Join(t.TempDir(), "moderation.json")}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error when validating relay config: %v", err)
+	}
+	eventBus := bus.New()
+	ingest := ingester.NewIngester(zerolog.Nop())
+	ingest.SetBus(eventBus)
+	storageBackend, err := storage.Connect(cfg.Storage, zerolog.Nop(), ingest.SendToDBChannel())
+	if err != nil {
+		t.Fatalf("unexpected error when connecting to storage: %v", err)
+	}
+	ingest.SetQueryFunc(storageBackend.Store.QueryEvents)
+	filterManager := filter.NewFilterManager(ingest.SendToFilterManager(), storageBackend, zerolog.Nop())
+	wsHandler := websocket.NewWebsocketServer(cfg.HTTP, zerolog.Nop(), ingest.SendToWSHandlerChannel(), filterManager.SendChannel())
+	ingest.SetRecvChannel(wsHandler.SendChannel())
+	modules := []interface {
+		Start() error
+		Stop() error
+	}{ingest, storageBackend, filterManager, wsHandler}
+	for _, m := range modules {
+		if err := m.Start(); err != nil {
+			t.Fatalf("unexpected error when starting relay: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		slices.Reverse(modules)
+		for _, m := range modules {
+			if err := m.Stop(); err != nil {
+				t.Errorf("unexpected error when stopping relay: %v", err)
+			}
+		}
+	})
+	return &testRelay{url: fmt.Sprintf("ws://localhost:%v", port), ingester: ingest, storage: storageBackend, bus: eventBus}
+}
+
+// publish signs a new event and publishes it to the relay as a client
+func (relay *testRelay) publish(t *testing.T, sk string, kind int, content string) nostr.Event {
+	event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: content}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("unexpected error when signing event: %v", err)
+	}
+	client, err := nostr.RelayConnect(context.Background(), relay.url)
+	if err != nil {
+		t.Fatalf("unexpected error when connecting to relay: %v", err)
+	}
+	defer client.Close()
+	if err := client.Publish(context.Background(), event); err != nil {
+		t.Fatalf("unexpected error when publishing event: %v", err)
+	}
+	return event
+}
+
+// stored checks if the relay stored the event
+func (relay *testRelay) stored(t *testing.T, event nostr.Event) bool {
+	events, err := relay.storage.Store.QueryEvents(context.Background(), nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		t.Fatalf("unexpected error when querying storage: %v", err)
+	}
+	found := false
+	for range events {
+		found = true
+	}
+	return found
+}
+
+// waitStored fails the test unless the relay stores the events within a few seconds
+func (relay *testRelay) waitStored(t *testing.T, events ...nostr.Event) {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, event := range events {
+		for !relay.stored(t, event) {
+			if time.Now().After(deadline) {
+				t.Fatalf("event %q was not replicated to %s", event.Content, relay.url)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+// startReplicator creates and starts a replicator feeding the local relay
+func startReplicator(t *testing.T, cfg config.Replication, local *testRelay) *Replicator {
+	r, err := NewReplicator(cfg, local.ingester.IngestEvent, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating replicator: %v", err)
+	}
+	unsubscribe := bus.Subscribe(local.bus, bus.EventAccepted, r.Publish)
+	if err := r.Start(); err != nil {
+		t.Fatalf("unexpected error when starting replicator: %v", err)
+	}
+	t.Cleanup(unsubscribe)
+	return r
+}
+
+// TestReplicator ensures stored and live events of an upstream are replicated, local events are pushed to it and replication resumes from the saved cursor after a restart
+func TestReplicator(t *testing.T) {
+	upstream, local := startTestRelay(t), startTestRelay(t)
+	sk := nostr.GeneratePrivateKey()
+	stored := []nostr.Event{upstream.publish(t, sk, 1, "stored one"), upstream.publish(t, sk, 1, "stored two")}
+	reaction := upstream.publish(t, sk, 7, "+")
+	cfg := config.Replication{
+		StatePath: filepath.Join(t.TempDir(), "replication.json"),
+		Upstreams: []config.Upstream{{URL: upstream.url, Filters: []string{`{"kinds":[1]}`}, Push: true}},
+	}
+	r := startReplicator(t, cfg, local)
+	t.Log("waiting for stored events...")
+	local.waitStored(t, stored...)
+	t.Log("waiting for live event...")
+	local.waitStored(t, upstream.publish(t, sk, 1, "live"))
+	t.Log("waiting for pushed event...")
+	upstream.waitStored(t, local.publish(t, sk, 1, "pushed"))
+	if local.stored(t, reaction) {
+		t.Error("expected event not matching the filters to be skipped")
+	}
+	if err := r.Stop(); err != nil {
+		t.Fatalf("unexpected error when stopping replicator: %v", err)
+	}
+	if _, err := os.Stat(cfg.StatePath); err != nil {
+		t.Fatalf("expected replication state to be saved: %v", err)
+	}
+	cursors, err := loadCursors(cfg.StatePath)
+	if err != nil {
+		t.Fatalf("unexpected error when loading replication state: %v", err)
+	}
+	if cursor := cursors.get(upstream.url); cursor < stored[1].CreatedAt {
+		t.Errorf("unexpected cursor %v, expected at least %v", cursor, stored[1].CreatedAt)
+	}
+	missed := upstream.publish(t, sk, 1, "published while stopped")
+	r = startReplicator(t, cfg, local)
+	defer r.Stop()
+	t.Log("waiting for event published while stopped...")
+	local.waitStored(t, missed)
+}
+
+// TestMutualReplication ensures two relays replicating and pushing to each other accept an event once each instead of bouncing it between them
+func TestMutualReplication(t *testing.T) {
+	first, second := startTestRelay(t), startTestRelay(t)
+	var acceptedFirst, acceptedSecond atomic.Int32
+	bus.Subscribe(first.bus, bus.EventAccepted, func(bus.Event) { acceptedFirst.Add(1) })
+	bus.Subscribe(second.bus, bus.EventAccepted, func(bus.Event) { acceptedSecond.Add(1) })
+	dir := t.TempDir()
+	toSecond := startReplicator(t, config.Replication{
+		StatePath: filepath.Join(dir, "first.json"),
+		Upstreams: []config.Upstream{{URL: second.url, Filters: []string{`{"kinds":[0,1]}`}, Push: true}},
+	}, first)
+	defer toSecond.Stop()
+	toFirst := startReplicator(t, config.Replication{
+		StatePath: filepath.Join(dir, "second.json"),
+		Upstreams: []config.Upstream{{URL: first.url, Filters: []string{`{"kinds":[0,1]}`}, Push: true}},
+	}, second)
+	defer toFirst.Stop()
+	sk := nostr.GeneratePrivateKey()
+	profile := first.publish(t, sk, 0, `{"name":"tandem"}`)
+	second.waitStored(t, profile)
+	note := second.publish(t, sk, 1, "hello")
+	first.waitStored(t, note)
+	// leave time for the events to bounce back
+	time.Sleep(2 * time.Second)
+	if accepted := acceptedFirst.Load(); accepted != 2 {
+		t.Errorf("unexpected number of events accepted by the first relay: expected 2 got %v", accepted)
+	}
+	if accepted := acceptedSecond.Load(); accepted != 2 {
+		t.Errorf("unexpected number of events accepted by the second relay: expected 2 got %v", accepted)
+	}
+}
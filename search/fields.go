@@ -0,0 +1,96 @@
+package search
+
+import (
+	"encoding/json"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Field is a piece of searchable text of an event along with how much a match in it counts
+type Field struct {
+	Name  string
+	Text  string
+	Boost float64
+}
+
+var (
+	// kindFields reads the searchable fields of the kinds whose text isn't only in their content
+	kindFields = map[int]func(event *nostr.Event) []Field{
+		nostr.KindProfileMetadata:     metadataFields,
+		nostr.KindArticle:             articleFields,
+		nostr.KindSimpleGroupMetadata: groupFields,
+	}
+	// unsearchableKinds hold encrypted content
+	unsearchableKinds = []int{nostr.KindEncryptedDirectMessage, 13, nostr.KindGiftWrap}
+)
+
+// Fields returns the searchable fields of an event
+func Fields(event *nostr.Event) []Field {
+	for _, kind := range unsearchableKinds {
+		if event.Kind == kind {
+			return nil
+		}
+	}
+	fieldsFunc, ok := kindFields[event.Kind]
+	if !ok {
+		fieldsFunc = contentFields
+	}
+	return append(fieldsFunc(event), hashtagFields(event)...)
+}
+
+// contentFields returns the content of an event along with its title and subject tags, if any
+func contentFields(event *nostr.Event) []Field {
+	fields := tagFields(event, map[string]float64{"title": 3, "subject": 3})
+	return append(fields, Field{Name: "content", Text: event.Content, Boost: 1})
+}
+
+// hashtagFields returns the t tags of an event
+func hashtagFields(event *nostr.Event) []Field {
+	fields := []Field{}
+	for _, tag := range event.Tags.GetAll([]string{"t", ""}) {
+		fields = append(fields, Field{Name: "hashtag", Text: tag.Value(), Boost: 2})
+	}
+	return fields
+}
+
+// tagFields returns the values of the first tag with each of the given names
+func tagFields(event *nostr.Event, boosts map[string]float64) []Field {
+	fields := []Field{}
+	for _, name := range []string{"name", "title", "subject", "summary", "about"} {
+		boost, ok := boosts[name]
+		if !ok {
+			continue
+		}
+		if tag := event.Tags.GetFirst([]string{name, ""}); tag != nil {
+			fields = append(fields, Field{Name: name, Text: tag.Value(), Boost: boost})
+		}
+	}
+	return fields
+}
+
+// metadataFields returns the profile fields of a kind 0 event, names counting the most. Invalid metadata is searched as plain content
+func metadataFields(event *nostr.Event) []Field {
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(event.Content), &metadata); err != nil {
+		return []Field{{Name: "content", Text: event.Content, Boost: 1}}
+	}
+	fields := []Field{}
+	for _, field := range []Field{{Name: "name", Boost: 3}, {Name: "display_name", Boost: 3}, {Name: "nip05", Boost: 2}, {Name: "about", Boost: 1}, {Name: "website", Boost: 1}} {
+		if text, ok := metadata[field.Name].(string); ok && text != "" {
+			field.Text = text
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// articleFields returns the title, summary and content of a NIP-23 long-form article
+func articleFields(event *nostr.Event) []Field {
+	fields := tagFields(event, map[string]float64{"title": 3, "summary": 2})
+	return append(fields, Field{Name: "content", Text: event.Content, Boost: 1})
+}
+
+// groupFields returns the name and description of a NIP-29 group
+func groupFields(event *nostr.Event) []Field {
+	return tagFields(event, map[string]float64{"name": 3, "about": 1})
+}
@@ -0,0 +1,20 @@
+package search
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Hit is an event matching a search query along with its relevance score
+type Hit struct {
+	ID    string
+	Score float64
+}
+
+// Index finds the events matching a search query, most relevant first. Indexes maintained by the storage backend itself ignore Index and Delete
+type Index interface {
+	Index(event *nostr.Event) error
+	Delete(event *nostr.Event) error
+	Search(ctx context.Context, query Query, limit int) ([]Hit, error)
+}
@@ -0,0 +1,244 @@
+package search
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// bm25K1 and bm25B are the usual BM25 parameters, for term frequency saturation and document length normalization
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// posting is the occurrences of a word in an event
+type posting struct {
+	// weight is the number of occurrences, each counted by the boost of its field
+	weight    float64
+	positions []int
+}
+
+type document struct {
+	createdAt nostr.Timestamp
+	length    float64
+	words     []string
+}
+
+// InvertedIndex is an in-process search index for storage backends without full-text search. Events are ranked with BM25, a word in a boosted field counting as several occurrences
+type InvertedIndex struct {
+	postings    map[string]map[string]*posting
+	docs        map[string]*document
+	totalLength float64
+	sync.RWMutex
+}
+
+// NewInvertedIndex creates an empty InvertedIndex
+func NewInvertedIndex() *InvertedIndex {
+	return &InvertedIndex{
+		postings: make(map[string]map[string]*posting),
+		docs:     make(map[string]*document),
+	}
+}
+
+// Index adds the searchable fields of an event to the index
+func (x *InvertedIndex) Index(event *nostr.Event) error {
+	fields := Fields(event)
+	x.Lock()
+	defer x.Unlock()
+	if _, ok := x.docs[event.ID]; ok {
+		return nil
+	}
+	doc := &document{createdAt: event.CreatedAt}
+	position := 0
+	for _, field := range fields {
+		for _, word := range tokenize(field.Text) {
+			postings, ok := x.postings[word]
+			if !ok {
+				postings = make(map[string]*posting)
+				x.postings[word] = postings
+			}
+			p, ok := postings[event.ID]
+			if !ok {
+				p = &posting{}
+				postings[event.ID] = p
+				doc.words = append(doc.words, word)
+			}
+			p.weight += field.Boost
+			p.positions = append(p.positions, position)
+			position++
+			doc.length += field.Boost
+		}
+		// leave a gap so that phrases don't span fields
+		position++
+	}
+	if len(doc.words) == 0 {
+		return nil
+	}
+	x.docs[event.ID] = doc
+	x.totalLength += doc.length
+	return nil
+}
+
+// Delete removes an event from the index
+func (x *InvertedIndex) Delete(event *nostr.Event) error {
+	x.Lock()
+	defer x.Unlock()
+	doc, ok := x.docs[event.ID]
+	if !ok {
+		return nil
+	}
+	for _, word := range doc.words {
+		delete(x.postings[word], event.ID)
+		if len(x.postings[word]) == 0 {
+			delete(x.postings, word)
+		}
+	}
+	delete(x.docs, event.ID)
+	x.totalLength -= doc.length
+	return nil
+}
+
+// Search returns the events matching every term, prefix and phrase of the query, most relevant first
+func (x *InvertedIndex) Search(ctx context.Context, query Query, limit int) ([]Hit, error) {
+	x.RLock()
+	defer x.RUnlock()
+	hits := []Hit{}
+	if query.Empty() || len(x.docs) == 0 {
+		return hits, nil
+	}
+	// each requirement is met by any one of its words: a term by itself and a prefix by the words it starts
+	requirements := [][]string{}
+	for _, term := range query.Terms {
+		requirements = append(requirements, []string{term})
+	}
+	for _, phrase := range query.Phrases {
+		for _, word := range phrase {
+			requirements = append(requirements, []string{word})
+		}
+	}
+	for _, prefix := range query.Prefixes {
+		requirements = append(requirements, x.expand(prefix))
+	}
+	var candidates map[string]struct{}
+	for _, words := range requirements {
+		matching := make(map[string]struct{})
+		for _, word := range words {
+			for id := range x.postings[word] {
+				if _, ok := candidates[id]; candidates == nil || ok {
+					matching[id] = struct{}{}
+				}
+			}
+		}
+		if len(matching) == 0 {
+			return hits, nil
+		}
+		candidates = matching
+	}
+	avgLength := x.totalLength / float64(len(x.docs))
+	for id := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !x.matchesPhrases(id, query.Phrases) {
+			continue
+		}
+		score := 0.0
+		for _, words := range requirements {
+			best := 0.0
+			for _, word := range words {
+				best = math.Max(best, x.score(word, id, avgLength))
+			}
+			score += best
+		}
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if createdAtI, createdAtJ := x.docs[hits[i].ID].createdAt, x.docs[hits[j].ID].createdAt; createdAtI != createdAtJ {
+			return createdAtI > createdAtJ
+		}
+		return hits[i].ID < hits[j].ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// expand returns the indexed words starting with the given prefix
+func (x *InvertedIndex) expand(prefix string) []string {
+	words := []string{}
+	for word := range x.postings {
+		if strings.HasPrefix(word, prefix) {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// score returns the BM25 score of a word for an event, zero if the event doesn't contain it
+func (x *InvertedIndex) score(word, id string, avgLength float64) float64 {
+	postings := x.postings[word]
+	p, ok := postings[id]
+	if !ok {
+		return 0
+	}
+	n, df := float64(len(x.docs)), float64(len(postings))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	norm := 1 - bm25B + bm25B*x.docs[id].length/avgLength
+	return idf * p.weight * (bm25K1 + 1) / (p.weight + bm25K1*norm)
+}
+
+// matchesPhrases checks if every phrase appears as consecutive words of the event
+func (x *InvertedIndex) matchesPhrases(id string, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		if !x.matchesPhrase(id, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *InvertedIndex) matchesPhrase(id string, phrase []string) bool {
+	first, ok := x.postings[phrase[0]][id]
+	if !ok {
+		return false
+	}
+	for _, start := range first.positions {
+		found := true
+		for offset, word := range phrase[1:] {
+			p, ok := x.postings[word][id]
+			if !ok {
+				return false
+			}
+			// positions are appended in increasing order
+			if _, ok := slices.BinarySearch(p.positions, start+offset+1); !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches checks if the text of an event matches a query, regardless of its extensions
+func Matches(query Query, event *nostr.Event) bool {
+	if query.Empty() {
+		return true
+	}
+	x := NewInvertedIndex()
+	x.Index(event)
+	hits, _ := x.Search(context.Background(), query, 1)
+	return len(hits) == 1
+}
@@ -0,0 +1,117 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var testEvents = []nostr.Event{
+	{ID: "note", Kind: 1, CreatedAt: 1, Content: "I run a nostr relay written in go"},
+	{ID: "newer-note", Kind: 1, CreatedAt: 2, Content: "my relay is a nostr relay"},
+	{ID: "hashtag", Kind: 1, CreatedAt: 3, Content: "gm", Tags: nostr.Tags{{"t", "nostr"}}},
+	{ID: "metadata", Kind: nostr.KindProfileMetadata, CreatedAt: 4, Content: `{"name":"relay runner","about":"bitcoin and nostr"}`},
+	{ID: "article", Kind: nostr.KindArticle, CreatedAt: 5, Content: "a long post about bitcoin", Tags: nostr.Tags{{"title", "Running relays"}}},
+	{ID: "dm", Kind: nostr.KindEncryptedDirectMessage, CreatedAt: 6, Content: "nostr relay"},
+}
+
+type searchTestCase struct {
+	name        string
+	search      string
+	expectedIds []string
+}
+
+var searchTestCases = []searchTestCase{
+	{
+		name:        "Term",
+		search:      "nostr",
+		expectedIds: []string{"hashtag", "newer-note", "note", "metadata"},
+	},
+	{
+		name:        "AllTerms",
+		search:      "nostr relay",
+		expectedIds: []string{"newer-note", "metadata", "note"},
+	},
+	{
+		name:        "Phrase",
+		search:      `"nostr relay"`,
+		expectedIds: []string{"newer-note", "note"},
+	},
+	{
+		name:        "PhraseAcrossFields",
+		search:      `"runner bitcoin"`,
+		expectedIds: []string{},
+	},
+	{
+		name:        "Prefix",
+		search:      "run*",
+		expectedIds: []string{"metadata", "article", "note"},
+	},
+	{
+		name:        "BoostedField",
+		search:      "relay",
+		expectedIds: []string{"metadata", "newer-note", "note"},
+	},
+	{
+		name:        "NoMatch",
+		search:      "nostr fiat",
+		expectedIds: []string{},
+	},
+}
+
+// newTestIndex creates an InvertedIndex holding the test events
+func newTestIndex(t *testing.T) *InvertedIndex {
+	x := NewInvertedIndex()
+	for _, event := range testEvents {
+		if err := x.Index(&event); err != nil {
+			t.Fatalf("unexpected error when indexing event %s: %v", event.ID, err)
+		}
+	}
+	return x
+}
+
+// hitIds returns the event ids of the given hits
+func hitIds(hits []Hit) []string {
+	ids := []string{}
+	for _, hit := range hits {
+		ids = append(ids, hit.ID)
+	}
+	return ids
+}
+
+// TestInvertedIndexSearch ensures events matching all words of a query are ranked by relevance
+func TestInvertedIndexSearch(t *testing.T) {
+	x := newTestIndex(t)
+	for _, testCase := range searchTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		hits, err := x.Search(context.Background(), Parse(testCase.search), 10)
+		if err != nil {
+			t.Fatalf("unexpected error for test case %s: %v", testCase.name, err)
+		}
+		if ids := hitIds(hits); !reflect.DeepEqual(ids, testCase.expectedIds) {
+			t.Errorf("unexpected hits for test case %s: expected %v, got %v", testCase.name, testCase.expectedIds, ids)
+		}
+	}
+}
+
+// TestInvertedIndexDelete ensures deleted events are no longer found
+func TestInvertedIndexDelete(t *testing.T) {
+	x := newTestIndex(t)
+	for _, event := range testEvents[:2] {
+		if err := x.Delete(&event); err != nil {
+			t.Fatalf("unexpected error when deleting event %s: %v", event.ID, err)
+		}
+	}
+	hits, err := x.Search(context.Background(), Parse("nostr"), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ids := hitIds(hits); !reflect.DeepEqual(ids, []string{"hashtag", "metadata"}) {
+		t.Errorf("unexpected hits after deletion: %v", ids)
+	}
+	if _, ok := x.postings["go"]; ok {
+		t.Error("expected words of deleted events to be removed")
+	}
+}
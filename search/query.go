@@ -0,0 +1,88 @@
+package search
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+var (
+	// extensionKeys are the NIP-50 extensions recognized in search strings. Extensions which aren't supported are parsed and ignored
+	extensionKeys = []string{"include", "domain", "language", "sentiment", "nsfw"}
+)
+
+// Query is a parsed NIP-50 search string. Every term, prefix and phrase must match for an event to match
+type Query struct {
+	Terms []string
+	// Prefixes must each start a word of the event, they are written as prefix*
+	Prefixes []string
+	// Phrases are written between double quotes and must appear as consecutive words
+	Phrases [][]string
+	// Extensions holds the key:value extensions, e.g. language:en
+	Extensions map[string]string
+}
+
+// Empty checks if the query has no text to match, only extensions
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Prefixes) == 0 && len(q.Phrases) == 0
+}
+
+// Parse parses a NIP-50 search string. Words are case insensitive and split on anything which isn't a letter or a digit
+func Parse(search string) Query {
+	query := Query{Extensions: make(map[string]string)}
+	var (
+		current  strings.Builder
+		inPhrase bool
+	)
+	flush := func(quoted bool) {
+		raw := current.String()
+		current.Reset()
+		if quoted {
+			words := tokenize(raw)
+			if len(words) == 1 {
+				query.Terms = append(query.Terms, words[0])
+			} else if len(words) > 1 {
+				query.Phrases = append(query.Phrases, words)
+			}
+			return
+		}
+		if raw == "" {
+			return
+		}
+		if key, value, ok := strings.Cut(raw, ":"); ok && slices.Contains(extensionKeys, strings.ToLower(key)) && value != "" {
+			query.Extensions[strings.ToLower(key)] = strings.ToLower(value)
+			return
+		}
+		words := tokenize(raw)
+		if len(words) == 0 {
+			return
+		}
+		if strings.HasSuffix(raw, "*") {
+			query.Terms = append(query.Terms, words[:len(words)-1]...)
+			query.Prefixes = append(query.Prefixes, words[len(words)-1])
+			return
+		}
+		query.Terms = append(query.Terms, words...)
+	}
+	for _, r := range search {
+		switch {
+		case r == '"':
+			flush(inPhrase)
+			inPhrase = !inPhrase
+		case unicode.IsSpace(r) && !inPhrase:
+			flush(false)
+		default:
+			current.WriteRune(r)
+		}
+	}
+	// an unterminated phrase is still treated as one
+	flush(inPhrase)
+	return query
+}
+
+// tokenize splits text into lower case words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
@@ -0,0 +1,61 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+type parseTestCase struct {
+	name          string
+	search        string
+	expectedQuery Query
+}
+
+var parseTestCases = []parseTestCase{
+	{
+		name:          "Terms",
+		search:        "Nostr  Relays, in GO",
+		expectedQuery: Query{Terms: []string{"nostr", "relays", "in", "go"}, Extensions: map[string]string{}},
+	},
+	{
+		name:          "Phrase",
+		search:        `best "Nostr relay" ever`,
+		expectedQuery: Query{Terms: []string{"best", "ever"}, Phrases: [][]string{{"nostr", "relay"}}, Extensions: map[string]string{}},
+	},
+	{
+		name:          "SingleWordPhrase",
+		search:        `"nostr"`,
+		expectedQuery: Query{Terms: []string{"nostr"}, Extensions: map[string]string{}},
+	},
+	{
+		name:          "UnterminatedPhrase",
+		search:        `"nostr relay`,
+		expectedQuery: Query{Phrases: [][]string{{"nostr", "relay"}}, Extensions: map[string]string{}},
+	},
+	{
+		name:          "Prefix",
+		search:        "bitco* self-cust*",
+		expectedQuery: Query{Terms: []string{"self"}, Prefixes: []string{"bitco", "cust"}, Extensions: map[string]string{}},
+	},
+	{
+		name:          "Extensions",
+		search:        "coffee language:EN domain:example.com include:spam nsfw:false",
+		expectedQuery: Query{Terms: []string{"coffee"}, Extensions: map[string]string{"language": "en", "domain": "example.com", "include": "spam", "nsfw": "false"}},
+	},
+	{
+		name:          "UnknownExtension",
+		search:        "https://example.com",
+		expectedQuery: Query{Terms: []string{"https", "example", "com"}, Extensions: map[string]string{}},
+	},
+}
+
+// TestParse ensures terms, phrases, prefixes and extensions are read from search strings
+func TestParse(t *testing.T) {
+	for _, testCase := range parseTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		query := Parse(testCase.search)
+		if !reflect.DeepEqual(query, testCase.expectedQuery) {
+			t.Errorf("unexpected query for test case %s: expected %+v, got %+v", testCase.name, testCase.expectedQuery, query)
+		}
+	}
+}
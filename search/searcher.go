@@ -0,0 +1,229 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// defaultLimit and maxLimit bound the number of events returned for a search filter
+	defaultLimit = 100
+	maxLimit     = 500
+	// maxHits is the number of ranked hits considered for a search filter before the rest of the filter and the extensions are applied
+	maxHits = 10000
+	// queryBatchSize is the number of hits fetched from storage at once
+	queryBatchSize = 100
+)
+
+var (
+	ErrQueryFuncNotSet = errors.New("query function not set")
+)
+
+// Searcher answers NIP-50 search filters using a search index and the storage backend holding the events
+type Searcher struct {
+	index     Index
+	queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error)
+	isSpam    func(event *nostr.Event) bool
+	logger    zerolog.Logger
+}
+
+// NewSearcher creates a new Searcher
+func NewSearcher(index Index, queryFunc func(context.Context, nostr.Filter) (chan *nostr.Event, error), logger zerolog.Logger) *Searcher {
+	return &Searcher{
+		index:     index,
+		queryFunc: queryFunc,
+		logger:    logger,
+	}
+}
+
+// SetSpamFunc stores the function deciding which events are spam. Spam is left out of search results unless include:spam is searched for
+func (s *Searcher) SetSpamFunc(isSpam func(event *nostr.Event) bool) {
+	s.isSpam = isSpam
+}
+
+// QueryEvents returns the stored events matching a search filter, most relevant first. Searches made only of extensions return the newest matching events
+func (s *Searcher) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	query := Parse(filter.Search)
+	filter.Search = ""
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	} else if limit > maxLimit {
+		limit = maxLimit
+	}
+	var (
+		results []*nostr.Event
+		err     error
+	)
+	if query.Empty() {
+		filter.Limit = maxLimit
+		results, err = s.collect(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		results = s.applyExtensions(ctx, query, results)
+	} else {
+		results, err = s.rank(ctx, query, filter, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	events := make(chan *nostr.Event, len(results))
+	for _, event := range results {
+		events <- event
+	}
+	close(events)
+	return events, nil
+}
+
+// rank fetches the events hit by the query from storage in order of relevance until enough of them match the rest of the filter
+func (s *Searcher) rank(ctx context.Context, query Query, filter nostr.Filter, limit int) ([]*nostr.Event, error) {
+	hits, err := s.index.Search(ctx, query, maxHits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search index: %w", err)
+	}
+	scores := make(map[string]float64, len(hits))
+	ids := []string{}
+	for _, hit := range hits {
+		if len(filter.IDs) > 0 && !slices.Contains(filter.IDs, hit.ID) {
+			continue
+		}
+		scores[hit.ID] = hit.Score
+		ids = append(ids, hit.ID)
+	}
+	results := []*nostr.Event{}
+	for start := 0; start < len(ids) && len(results) < limit; start += queryBatchSize {
+		batch := filter
+		batch.IDs = ids[start:min(start+queryBatchSize, len(ids))]
+		batch.Limit = len(batch.IDs)
+		events, err := s.collect(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		events = s.applyExtensions(ctx, query, events)
+		// hits are ranked so sorting each batch keeps the results in order
+		sort.Slice(events, func(i, j int) bool {
+			if scores[events[i].ID] != scores[events[j].ID] {
+				return scores[events[i].ID] > scores[events[j].ID]
+			}
+			return events[i].CreatedAt > events[j].CreatedAt
+		})
+		results = append(results, events...)
+	}
+	return results, nil
+}
+
+// Matches checks if a live event matches a search string, including its extensions
+func (s *Searcher) Matches(ctx context.Context, search string, event *nostr.Event) bool {
+	query := Parse(search)
+	return Matches(query, event) && len(s.applyExtensions(ctx, query, []*nostr.Event{event})) == 1
+}
+
+// applyExtensions filters events by the language:, domain: and include:spam extensions of a query
+func (s *Searcher) applyExtensions(ctx context.Context, query Query, events []*nostr.Event) []*nostr.Event {
+	language, domain := query.Extensions["language"], query.Extensions["domain"]
+	includeSpam := query.Extensions["include"] == "spam"
+	var domains map[string]string
+	if domain != "" {
+		domains = s.domains(ctx, events)
+	}
+	filtered := []*nostr.Event{}
+	for _, event := range events {
+		if language != "" && !hasLanguage(event, language) {
+			continue
+		}
+		if domain != "" && domains[event.PubKey] != domain {
+			continue
+		}
+		if !includeSpam && s.isSpam != nil && s.isSpam(event) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+// hasLanguage checks if an event is labeled with the given ISO-639-1 language code using NIP-32 l tags
+func hasLanguage(event *nostr.Event, language string) bool {
+	for _, tag := range event.Tags.GetAll([]string{"l", ""}) {
+		if strings.EqualFold(tag.Value(), language) && (len(tag) < 3 || tag[2] == "ISO-639-1") {
+			return true
+		}
+	}
+	return false
+}
+
+// domains returns the NIP-05 domain of the authors of the given events, read from their stored kind 0 metadata. Identifiers aren't verified against the domain
+func (s *Searcher) domains(ctx context.Context, events []*nostr.Event) map[string]string {
+	domains := make(map[string]string)
+	pubkeys := []string{}
+	for _, event := range events {
+		if !slices.Contains(pubkeys, event.PubKey) {
+			pubkeys = append(pubkeys, event.PubKey)
+		}
+	}
+	createdAt := make(map[string]nostr.Timestamp)
+	for start := 0; start < len(pubkeys); start += queryBatchSize {
+		authors := pubkeys[start:min(start+queryBatchSize, len(pubkeys))]
+		metadata, err := s.collect(ctx, nostr.Filter{Authors: authors, Kinds: []int{nostr.KindProfileMetadata}, Limit: len(authors)})
+		if err != nil {
+			s.logger.Error().Err(err).Msg("failed to query author metadata")
+			continue
+		}
+		for _, event := range metadata {
+			// only the latest metadata of an author counts
+			if event.CreatedAt < createdAt[event.PubKey] {
+				continue
+			}
+			createdAt[event.PubKey] = event.CreatedAt
+			delete(domains, event.PubKey)
+			var profile struct {
+				Nip05 string `json:"nip05"`
+			}
+			if err := json.Unmarshal([]byte(event.Content), &profile); err != nil {
+				continue
+			}
+			if _, domain, ok := strings.Cut(profile.Nip05, "@"); ok {
+				domains[event.PubKey] = strings.ToLower(domain)
+			}
+		}
+	}
+	return domains
+}
+
+// collect reads all the events matching a filter from storage
+func (s *Searcher) collect(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	if s.queryFunc == nil {
+		return nil, ErrQueryFuncNotSet
+	}
+	rcvChan, err := s.queryFunc(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage: %w", err)
+	}
+	timer := time.NewTimer(5 * time.Second) // TODO - make this timeout configurable
+	defer timer.Stop()
+	events := []*nostr.Event{}
+	for {
+		select {
+		case event, ok := <-rcvChan:
+			if !ok || event == nil {
+				return events, nil
+			}
+			events = append(events, event)
+		case <-timer.C:
+			return nil, errors.New("timed out while querying storage")
+		}
+	}
+}
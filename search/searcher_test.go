@@ -0,0 +1,123 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	alicePubkey    = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	bobPubkey      = "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5"
+	searcherEvents = []nostr.Event{
+		{ID: "alice-metadata", PubKey: alicePubkey, Kind: nostr.KindProfileMetadata, CreatedAt: 1, Content: `{"name":"alice","nip05":"alice@Example.com"}`},
+		{ID: "bob-metadata", PubKey: bobPubkey, Kind: nostr.KindProfileMetadata, CreatedAt: 1, Content: `{"name":"bob","nip05":"bob@other.org"}`},
+		{ID: "alice-english", PubKey: alicePubkey, Kind: 1, CreatedAt: 2, Content: "coffee is great", Tags: nostr.Tags{{"l", "en", "ISO-639-1"}}},
+		{ID: "alice-french", PubKey: alicePubkey, Kind: 1, CreatedAt: 3, Content: "coffee c'est bon", Tags: nostr.Tags{{"l", "fr", "ISO-639-1"}}},
+		{ID: "bob-coffee", PubKey: bobPubkey, Kind: 1, CreatedAt: 4, Content: "coffee coffee coffee"},
+		{ID: "bob-spam", PubKey: bobPubkey, Kind: 1, CreatedAt: 5, Content: "buy coffee now"},
+		{ID: "bob-article", PubKey: bobPubkey, Kind: nostr.KindArticle, CreatedAt: 6, Content: "all about coffee"},
+	}
+)
+
+type searcherTestCase struct {
+	name        string
+	filter      nostr.Filter
+	expectedIds []string
+}
+
+var searcherTestCases = []searcherTestCase{
+	{
+		name:        "Ranked",
+		filter:      nostr.Filter{Search: "coffee", Kinds: []int{1}},
+		expectedIds: []string{"bob-coffee", "alice-english", "alice-french"},
+	},
+	{
+		name:        "Limit",
+		filter:      nostr.Filter{Search: "coffee", Limit: 1},
+		expectedIds: []string{"bob-coffee"},
+	},
+	{
+		name:        "Language",
+		filter:      nostr.Filter{Search: "coffee language:fr"},
+		expectedIds: []string{"alice-french"},
+	},
+	{
+		name:        "Domain",
+		filter:      nostr.Filter{Search: "coffee domain:example.com"},
+		expectedIds: []string{"alice-english", "alice-french"},
+	},
+	{
+		name:        "IncludeSpam",
+		filter:      nostr.Filter{Search: "buy include:spam"},
+		expectedIds: []string{"bob-spam"},
+	},
+	{
+		name:        "ExtensionsOnly",
+		filter:      nostr.Filter{Search: "domain:other.org", Kinds: []int{1}},
+		expectedIds: []string{"bob-coffee"},
+	},
+}
+
+// newTestSearcher creates a Searcher over a slice store holding the searcher test events, bob-spam being spam
+func newTestSearcher(t *testing.T) *Searcher {
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatalf("unexpected error when creating store: %v", err)
+	}
+	x := NewInvertedIndex()
+	for _, event := range searcherEvents {
+		if err := store.SaveEvent(context.Background(), &event); err != nil {
+			t.Fatalf("unexpected error when storing event %s: %v", event.ID, err)
+		}
+		if err := x.Index(&event); err != nil {
+			t.Fatalf("unexpected error when indexing event %s: %v", event.ID, err)
+		}
+	}
+	s := NewSearcher(x, store.QueryEvents, zerolog.Nop())
+	s.SetSpamFunc(func(event *nostr.Event) bool { return event.ID == "bob-spam" })
+	return s
+}
+
+// TestSearcherQueryEvents ensures stored events are returned by relevance and filtered by the rest of the filter and the extensions
+func TestSearcherQueryEvents(t *testing.T) {
+	s := newTestSearcher(t)
+	for _, testCase := range searcherTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		events, err := s.QueryEvents(context.Background(), testCase.filter)
+		if err != nil {
+			t.Fatalf("unexpected error for test case %s: %v", testCase.name, err)
+		}
+		ids := []string{}
+		for event := range events {
+			ids = append(ids, event.ID)
+		}
+		if !reflect.DeepEqual(ids, testCase.expectedIds) {
+			t.Errorf("unexpected events for test case %s: expected %v, got %v", testCase.name, testCase.expectedIds, ids)
+		}
+	}
+}
+
+// TestSearcherMatches ensures live events are matched against the text and the extensions of a search
+func TestSearcherMatches(t *testing.T) {
+	s := newTestSearcher(t)
+	event := &nostr.Event{ID: "live", PubKey: alicePubkey, Kind: 1, Content: "fresh coffee beans", Tags: nostr.Tags{{"l", "en", "ISO-639-1"}}}
+	for search, expected := range map[string]bool{
+		"coffee":                  true,
+		`"coffee beans"`:          true,
+		`"beans coffee"`:          false,
+		"bea*":                    true,
+		"tea":                     false,
+		"coffee language:en":      true,
+		"coffee language:fr":      false,
+		"coffee domain:other.org": false,
+	} {
+		if matches := s.Matches(context.Background(), search, event); matches != expected {
+			t.Errorf("unexpected match for search %q: expected %v, got %v", search, expected, matches)
+		}
+	}
+}
@@ -19,6 +19,7 @@ var (
 
 type InterruptHandler struct {
 	interruptChan chan os.Signal
+	reloadChan    chan struct{}
 	quitChan      chan struct{}
 	doneChan      chan struct{}
 	logger        zerolog.Logger
@@ -28,11 +29,12 @@ type InterruptHandler struct {
 func NewInterruptHandler(logger zerolog.Logger) *InterruptHandler {
 	ih := &InterruptHandler{
 		interruptChan: make(chan os.Signal),
+		reloadChan:    make(chan struct{}, 1),
 		quitChan:      make(chan struct{}),
 		doneChan:      make(chan struct{}),
 		logger:        logger,
 	}
-	signal.Notify(ih.interruptChan, signalsToCatch...)
+	signal.Notify(ih.interruptChan, append(signalsToCatch, syscall.SIGHUP)...)
 	go ih.mainHandler()
 	return ih
 }
@@ -53,6 +55,10 @@ func (i *InterruptHandler) mainHandler() {
 		select {
 		case signal := <-i.interruptChan:
 			i.logger.Info().Msgf("received %v", signal)
+			if signal == syscall.SIGHUP {
+				i.reload()
+				continue
+			}
 			shutdown()
 		case <-i.quitChan:
 			i.logger.Info().Msg("gracefully shutting down...")
@@ -63,6 +69,20 @@ func (i *InterruptHandler) mainHandler() {
 	}
 }
 
+// reload requests a configuration reload. Requests are coalesced if a reload is already pending
+func (i *InterruptHandler) reload() {
+	select {
+	case i.reloadChan <- struct{}{}:
+	default:
+		i.logger.Warn().Msg("configuration reload already pending...")
+	}
+}
+
+// ReloadChannel returns the channel used to signal that the configuration should be reloaded
+func (i *InterruptHandler) ReloadChannel() <-chan struct{} {
+	return i.reloadChan
+}
+
 // ShutdownDoneChannel returns the channel used to signal the end of the shutdown sequence
 func (i *InterruptHandler) ShutdownDoneChannel() <-chan struct{} {
 	return i.doneChan
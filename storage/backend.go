@@ -8,10 +8,13 @@ import (
 	"sync"
 
 	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
 	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/search"
 	"github.com/TheRebelOfBabylon/tandem/storage/edgedb"
 	"github.com/TheRebelOfBabylon/tandem/storage/memory"
 	"github.com/fiatjaf/eventstore"
+	edgedbstore "github.com/fiatjaf/eventstore/edgedb"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/rs/zerolog"
 )
@@ -24,10 +27,13 @@ var (
 )
 
 type StorageBackend struct {
-	Store  eventstore.Store
-	logger zerolog.Logger
-	recv   chan msg.ParsedMsg
-	quit   chan struct{}
+	Store eventstore.Store
+	// ownsStore is set when the backend connected to the store itself, only then is it closed with the backend
+	ownsStore bool
+	index     search.Index
+	logger    zerolog.Logger
+	recv      chan msg.ParsedMsg
+	quit      chan struct{}
 	sync.WaitGroup
 }
 
@@ -44,11 +50,19 @@ func Connect(cfg config.Storage, logger zerolog.Logger, recv chan msg.ParsedMsg)
 			logger.Error().Err(err).Msg("failed to connect to edge db")
 			return nil, err
 		}
+		index, err := edgedb.NewSearchIndex(dbConn.Client)
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to create edge db search index")
+			dbConn.Close()
+			return nil, err
+		}
 		return &StorageBackend{
-			Store:  dbConn,
-			logger: logger,
-			recv:   recv,
-			quit:   make(chan struct{}),
+			Store:     dbConn,
+			ownsStore: true,
+			index:     index,
+			logger:    logger,
+			recv:      recv,
+			quit:      make(chan struct{}),
 		}, nil
 	case "memory":
 		dbConn, err := memory.ConnectMemory(cfg)
@@ -56,16 +70,44 @@ func Connect(cfg config.Storage, logger zerolog.Logger, recv chan msg.ParsedMsg)
 			logger.Error().Err(err).Msg("failed to connect to memory db")
 		}
 		return &StorageBackend{
-			Store:  dbConn,
-			logger: logger,
-			recv:   recv,
-			quit:   make(chan struct{}),
+			Store:     dbConn,
+			ownsStore: true,
+			index:     search.NewInvertedIndex(),
+			logger:    logger,
+			recv:      recv,
+			quit:      make(chan struct{}),
 		}, nil
 	default:
 		return nil, fmt.Errorf("%w: %s", ErrUnsupportedBackend, parts[0])
 	}
 }
 
+// Wrap uses an initialized store as the storage backend. It is searched with an in-process index of the events stored through the backend and keeps its moderation state in the configured state file. The store belongs to the caller and is left open when the backend stops
+func Wrap(store eventstore.Store, logger zerolog.Logger, recv chan msg.ParsedMsg) *StorageBackend {
+	return &StorageBackend{
+		Store:  store,
+		index:  search.NewInvertedIndex(),
+		logger: logger,
+		recv:   recv,
+		quit:   make(chan struct{}),
+	}
+}
+
+// ModerationRepository returns the repository holding the moderation state for the connected storage backend. EdgeDB keeps it in the database while the other stores, memory included, persist it to the configured state file
+func (b *StorageBackend) ModerationRepository(cfg config.Moderation) (moderation.Repository, error) {
+	switch store := b.Store.(type) {
+	case *edgedbstore.EdgeDBBackend:
+		return edgedb.NewModerationRepository(store.Client)
+	default:
+		return memory.NewModerationRepository(cfg.StatePath)
+	}
+}
+
+// SearchIndex returns the index used to answer NIP-50 searches: the full-text search of the database when it has one, an in-process index kept up to date with stored events otherwise
+func (b *StorageBackend) SearchIndex() search.Index {
+	return b.index
+}
+
 // Start satisfies the StorageBackend interface
 func (b *StorageBackend) Start() error {
 	b.logger.Info().Msg("starting up...")
@@ -101,6 +143,9 @@ loop:
 						b.logger.Error().Str("connectionId", message.ConnectionId).Err(err).Msg("failed to delete event")
 						continue loop
 					}
+					if err := b.index.Delete(&envelope.Event); err != nil {
+						b.logger.Error().Str("connectionId", message.ConnectionId).Err(err).Msg("failed to remove event from search index")
+					}
 					message.Callback(nil)
 					continue loop
 				}
@@ -109,6 +154,9 @@ loop:
 					b.logger.Error().Str("connectionId", message.ConnectionId).Err(err).Msg("failed to store event")
 					continue loop
 				}
+				if err := b.index.Index(&envelope.Event); err != nil {
+					b.logger.Error().Str("connectionId", message.ConnectionId).Err(err).Msg("failed to add event to search index")
+				}
 				message.Callback(nil)
 			default:
 				b.logger.Warn().Str("connectionId", message.ConnectionId).Msgf("invalid type %T for message, skipping", message.Data)
@@ -123,7 +171,14 @@ func (b *StorageBackend) Stop() error {
 	b.logger.Info().Msg("shutting down...")
 	close(b.quit)
 	b.Wait()
-	b.Store.Close()
+	b.Close()
 	b.logger.Info().Msg("shutdown completed")
 	return nil
 }
+
+// Close closes the store if the backend connected to it, e.g. when the backend is discarded without being started
+func (b *StorageBackend) Close() {
+	if b.ownsStore {
+		b.Store.Close()
+	}
+}
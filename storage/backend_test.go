@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/search"
 	"github.com/TheRebelOfBabylon/tandem/test"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/rs/zerolog"
@@ -62,7 +63,17 @@ var (
 			},
 			expectedErr: ErrUnsupportedMsgType,
 		},
-		// TODO - add test case for msg with DeleteEvent set to true
+		{
+			name: "ValidCase_DeleteEvent",
+			inputMsg: msg.ParsedMsg{
+				ConnectionId: connIdOne,
+				Data: &nostr.EventEnvelope{
+					Event: defaultEvent,
+				},
+				DeleteEvent: true,
+			},
+			expectedErr: nil,
+		},
 	}
 )
 
@@ -104,4 +115,14 @@ func TestStorageBackend(t *testing.T) {
 		}
 		close(dbErrChan)
 	}
+	// the deleted event is no longer found by searches
+	hits, err := db.SearchIndex().Search(context.Background(), search.Parse("lmao"), 10)
+	if err != nil {
+		t.Fatalf("unexpected error when searching: %v", err)
+	}
+	for _, hit := range hits {
+		if hit.ID == defaultEvent.ID {
+			t.Error("expected deleted event to be removed from the search index")
+		}
+	}
 }
@@ -14,6 +14,8 @@ var (
 	queryTagsLimit    = 100
 	queryLimit        = 100
 	ErrRecvChanNotSet = errors.New("receive channel not set")
+	// ErrSchemaNotMigrated is returned when the schema tandem adds next to the events isn't in the database
+	ErrSchemaNotMigrated = errors.New("edgedb schema not migrated, run edgedb migrate from the storage directory")
 )
 
 // ConnectEdgeDB establishes the connection to edgedb
@@ -0,0 +1,67 @@
+package edgedb
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/edgedb/edgedb-go"
+)
+
+// moderationEntry is the edgedb representation of a moderation.Entry
+type moderationEntry struct {
+	Category string `edgedb:"category"`
+	Subject  string `edgedb:"subject"`
+	Detail   string `edgedb:"detail"`
+}
+
+// ModerationRepository keeps the moderation state in edgedb, next to the events
+type ModerationRepository struct {
+	client *edgedb.Client
+}
+
+var _ moderation.Repository = (*ModerationRepository)(nil)
+
+// NewModerationRepository keeps the moderation state using the given client. The moderation schema is created by the migrations in storage/dbschema
+func NewModerationRepository(client *edgedb.Client) (*ModerationRepository, error) {
+	var count int64
+	if err := client.QuerySingle(context.Background(), "SELECT count(moderation::Entry)", &count); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSchemaNotMigrated, err)
+	}
+	return &ModerationRepository{client: client}, nil
+}
+
+// Apply satisfies the moderation.Repository interface. The changes are written in a single transaction
+func (r *ModerationRepository) Apply(ctx context.Context, changes []moderation.Change) error {
+	return r.client.Tx(ctx, func(ctx context.Context, tx *edgedb.Tx) error {
+		for _, c := range changes {
+			args := map[string]interface{}{
+				"category": string(c.Entry.Category),
+				"subject":  c.Entry.Subject,
+			}
+			query := "DELETE moderation::Entry FILTER .category = <str>$category AND .subject = <str>$subject"
+			if !c.Delete {
+				query = `INSERT moderation::Entry { category := <str>$category, subject := <str>$subject, detail := <str>$detail }
+UNLESS CONFLICT ON (.category, .subject) ELSE (UPDATE moderation::Entry SET { detail := <str>$detail })`
+				args["detail"] = c.Entry.Detail
+			}
+			if err := tx.Execute(ctx, query, args); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// List satisfies the moderation.Repository interface
+func (r *ModerationRepository) List(ctx context.Context) ([]moderation.Entry, error) {
+	var dbEntries []moderationEntry
+	if err := r.client.Query(ctx, "SELECT moderation::Entry { category, subject, detail }", &dbEntries); err != nil {
+		return nil, err
+	}
+	entries := make([]moderation.Entry, 0, len(dbEntries))
+	for _, dbEntry := range dbEntries {
+		entries = append(entries, moderation.Entry{Category: moderation.Category(dbEntry.Category), Subject: dbEntry.Subject, Detail: dbEntry.Detail})
+	}
+	return entries, nil
+}
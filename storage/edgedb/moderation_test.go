@@ -0,0 +1,55 @@
+//go:build edgedb
+// +build edgedb
+
+package edgedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/test"
+)
+
+// TestEdgeDBModerationRepository tests that the edge db storage backend can store the moderation state
+func TestEdgeDBModerationRepository(t *testing.T) {
+	// connect to db
+	dbConn, err := ConnectEdgeDB(edgedbConfig())
+	if err != nil {
+		t.Fatalf("unexpected error when connection to edge db: %v", err)
+	}
+	defer dbConn.Close()
+	repo, err := NewModerationRepository(dbConn.Client)
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation repository: %v", err)
+	}
+	pubkey := test.CreateRandomEvent().PubKey
+	ctx := context.Background()
+	for _, detail := range []string{"spam", "more spam"} {
+		if err := repo.Apply(ctx, []moderation.Change{{Entry: moderation.Entry{Category: moderation.CategoryBannedPubkey, Subject: pubkey, Detail: detail}}}); err != nil {
+			t.Fatalf("unexpected error when putting entry: %v", err)
+		}
+	}
+	entries, err := repo.List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error when listing entries: %v", err)
+	}
+	var found []moderation.Entry
+	for _, entry := range entries {
+		if entry.Subject == pubkey {
+			found = append(found, entry)
+		}
+	}
+	if len(found) != 1 || found[0].Detail != "more spam" {
+		t.Errorf("unexpected entries for %s: %v", pubkey, found)
+	}
+	if err := repo.Apply(ctx, []moderation.Change{{Entry: moderation.Entry{Category: moderation.CategoryBannedPubkey, Subject: pubkey}, Delete: true}}); err != nil {
+		t.Fatalf("unexpected error when deleting entry: %v", err)
+	}
+	entries, _ = repo.List(ctx)
+	for _, entry := range entries {
+		if entry.Subject == pubkey {
+			t.Errorf("unexpected entry after deletion: %v", entry)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package edgedb
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/TheRebelOfBabylon/tandem/search"
+	"github.com/edgedb/edgedb-go"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	// prefixScanLimit is the number of newest events searched by queries made of prefixes alone, which the full-text index can't answer and which are matched with a regular expression instead
+	prefixScanLimit = 10000
+)
+
+// searchResult is an event found by the full-text search of edgedb
+type searchResult struct {
+	EventId string  `edgedb:"eventId"`
+	Score   float32 `edgedb:"score"`
+}
+
+// SearchIndex searches events with the native full-text search of edgedb, which maintains the index itself. Only the content of events is indexed
+type SearchIndex struct {
+	client *edgedb.Client
+}
+
+var _ search.Index = (*SearchIndex)(nil)
+
+// NewSearchIndex searches events using the given client. The full-text index is created by the migrations in storage/dbschema
+func NewSearchIndex(client *edgedb.Client) (*SearchIndex, error) {
+	var count int64
+	if err := client.QuerySingle(context.Background(), "SELECT count(fts::search(events::Event, 'tandem', language := 'eng'))", &count); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSchemaNotMigrated, err)
+	}
+	return &SearchIndex{client: client}, nil
+}
+
+// Index satisfies the search.Index interface
+func (x *SearchIndex) Index(event *nostr.Event) error {
+	return nil
+}
+
+// Delete satisfies the search.Index interface
+func (x *SearchIndex) Delete(event *nostr.Event) error {
+	return nil
+}
+
+// Search satisfies the search.Index interface. Terms are required words of the full-text query while phrases and prefixes are matched with regular expressions against its results. Queries made of prefixes alone only search the newest prefixScanLimit events
+func (x *SearchIndex) Search(ctx context.Context, query search.Query, limit int) ([]search.Hit, error) {
+	if query.Empty() {
+		return []search.Hit{}, nil
+	}
+	args := map[string]interface{}{"limit": int64(limit)}
+	words := []string{}
+	for _, term := range query.Terms {
+		words = append(words, "+"+term)
+	}
+	conditions := []string{}
+	for i, phrase := range query.Phrases {
+		words = append(words, fmt.Sprintf(`"%s"`, strings.Join(phrase, " ")))
+		quoted := []string{}
+		for _, word := range phrase {
+			quoted = append(quoted, `\m`+regexp.QuoteMeta(word)+`\M`)
+		}
+		conditions = append(conditions, fmt.Sprintf("re_test(<str>$phrase%v, .content)", i))
+		args[fmt.Sprintf("phrase%v", i)] = "(?i)" + strings.Join(quoted, `\W+`)
+	}
+	for i, prefix := range query.Prefixes {
+		conditions = append(conditions, fmt.Sprintf("re_test(<str>$prefix%v, .content)", i))
+		args[fmt.Sprintf("prefix%v", i)] = `(?i)\m` + regexp.QuoteMeta(prefix)
+	}
+	filter := ""
+	if len(conditions) > 0 {
+		filter = "FILTER " + strings.Join(conditions, " AND ")
+	}
+	var edgeqlQuery string
+	if len(words) == 0 {
+		// prefixes alone can't be searched in the full-text index, the regular expressions are run over a bounded number of the newest events instead of the whole table
+		args["scan"] = int64(prefixScanLimit)
+		edgeqlQuery = fmt.Sprintf(`WITH newest := (SELECT events::Event ORDER BY .createdAt DESC LIMIT <int64>$scan)
+SELECT newest { eventId, score := <float32>1 } %s ORDER BY .createdAt DESC LIMIT <int64>$limit`, filter)
+	} else {
+		args["query"] = strings.Join(words, " ")
+		edgeqlQuery = fmt.Sprintf(`WITH res := (SELECT fts::search(events::Event, <str>$query, language := 'eng'))
+SELECT res.object { eventId, score := res.score } %s ORDER BY .score DESC THEN .createdAt DESC LIMIT <int64>$limit`, filter)
+	}
+	var results []searchResult
+	if err := x.client.Query(ctx, edgeqlQuery, &results, args); err != nil {
+		return nil, err
+	}
+	hits := make([]search.Hit, 0, len(results))
+	for _, result := range results {
+		hits = append(hits, search.Hit{ID: result.EventId, Score: float64(result.Score)})
+	}
+	return hits, nil
+}
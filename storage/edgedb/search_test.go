@@ -0,0 +1,40 @@
+//go:build edgedb
+// +build edgedb
+
+package edgedb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/search"
+	"github.com/TheRebelOfBabylon/tandem/test"
+)
+
+// TestEdgeDBSearchIndex tests that the edge db storage backend can search the content of stored events
+func TestEdgeDBSearchIndex(t *testing.T) {
+	// connect to db
+	dbConn, err := ConnectEdgeDB(edgedbConfig())
+	if err != nil {
+		t.Fatalf("unexpected error when connection to edge db: %v", err)
+	}
+	defer dbConn.Close()
+	index, err := NewSearchIndex(dbConn.Client)
+	if err != nil {
+		t.Fatalf("unexpected error when creating search index: %v", err)
+	}
+	randomEvent := test.CreateRandomEvent()
+	randomEvent.Content = "searching " + randomEvent.ID + " with edgedb"
+	if err := dbConn.SaveEvent(context.Background(), &randomEvent); err != nil {
+		t.Fatalf("unexpected error when saving random event %s: %v", randomEvent.String(), err)
+	}
+	for _, s := range []string{randomEvent.ID, randomEvent.ID[:10] + "*", `"` + randomEvent.ID + ` with edgedb"`} {
+		hits, err := index.Search(context.Background(), search.Parse(s), 10)
+		if err != nil {
+			t.Fatalf("unexpected error when searching %q: %v", s, err)
+		}
+		if len(hits) != 1 || hits[0].ID != randomEvent.ID {
+			t.Errorf("unexpected hits when searching %q: %v", s, hits)
+		}
+	}
+}
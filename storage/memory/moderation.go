@@ -0,0 +1,108 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+)
+
+type entryKey struct {
+	category moderation.Category
+	subject  string
+}
+
+// ModerationRepository keeps the moderation state in memory and optionally persists it to a JSON file on every change
+type ModerationRepository struct {
+	path    string
+	entries map[entryKey]string
+	sync.RWMutex
+}
+
+var _ moderation.Repository = (*ModerationRepository)(nil)
+
+// NewModerationRepository loads the moderation state from the given path. A missing file is treated as an empty state and an empty path disables persistence
+func NewModerationRepository(path string) (*ModerationRepository, error) {
+	r := &ModerationRepository{path: path, entries: make(map[entryKey]string)}
+	if path == "" {
+		return r, nil
+	}
+	stateBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []moderation.Entry
+	if err := json.Unmarshal(stateBytes, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse moderation state %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		r.entries[entryKey{entry.Category, entry.Subject}] = entry.Detail
+	}
+	return r, nil
+}
+
+// Apply satisfies the moderation.Repository interface. The changes are made to a copy of the state which only replaces it once it is saved
+func (r *ModerationRepository) Apply(_ context.Context, changes []moderation.Change) error {
+	r.Lock()
+	defer r.Unlock()
+	entries := maps.Clone(r.entries)
+	for _, c := range changes {
+		key := entryKey{c.Entry.Category, c.Entry.Subject}
+		if c.Delete {
+			delete(entries, key)
+		} else {
+			entries[key] = c.Entry.Detail
+		}
+	}
+	if err := save(r.path, entries); err != nil {
+		return err
+	}
+	r.entries = entries
+	return nil
+}
+
+// List satisfies the moderation.Repository interface
+func (r *ModerationRepository) List(_ context.Context) ([]moderation.Entry, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return list(r.entries), nil
+}
+
+// list returns the entries ordered by category and subject so the state file is stable
+func list(entries map[entryKey]string) []moderation.Entry {
+	sorted := make([]moderation.Entry, 0, len(entries))
+	for key, detail := range entries {
+		sorted = append(sorted, moderation.Entry{Category: key.category, Subject: key.subject, Detail: detail})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Category != sorted[j].Category {
+			return sorted[i].Category < sorted[j].Category
+		}
+		return sorted[i].Subject < sorted[j].Subject
+	})
+	return sorted
+}
+
+// save writes the entries to a temporary file which then replaces the state file at the given path so a crash never leaves a partially written state behind
+func save(path string, entries map[entryKey]string) error {
+	if path == "" {
+		return nil
+	}
+	stateBytes, err := json.MarshalIndent(list(entries), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, stateBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	testPubkey  = "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	otherPubkey = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	testEventId = "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+)
+
+// TestModerationRepository ensures the moderation state survives a restart
+func TestModerationRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	repo, err := NewModerationRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error when creating repository: %v", err)
+	}
+	s, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating store: %v", err)
+	}
+	for _, change := range []func() error{
+		func() error { return s.BanPubkey(testPubkey, "spam") },
+		func() error { return s.BanEvent(testEventId, "illegal") },
+		func() error { return s.DisallowKind(4) },
+		func() error { return s.BlockIP("::ffff:10.0.0.1", "abuse") },
+		func() error { return s.BlockIP("10.0.0.2", "abuse") },
+		func() error { return s.UnblockIP("10.0.0.2") },
+		func() error { return s.SetRelayName("renamed") },
+	} {
+		if err := change(); err != nil {
+			t.Fatalf("unexpected error when changing state: %v", err)
+		}
+	}
+	reloadedRepo, err := NewModerationRepository(path)
+	if err != nil {
+		t.Fatalf("unexpected error when reloading repository: %v", err)
+	}
+	entries, _ := reloadedRepo.List(context.Background())
+	if len(entries) != 5 {
+		t.Errorf("unexpected number of entries: expected 5, got %v", len(entries))
+	}
+	reloaded, err := moderation.NewStore(reloadedRepo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when reloading store: %v", err)
+	}
+	if banned := reloaded.BannedPubkeys(); len(banned) != 1 || banned[0].PubKey != testPubkey || banned[0].Reason != "spam" {
+		t.Errorf("unexpected banned pubkeys: %v", banned)
+	}
+	if banned := reloaded.BannedEvents(); len(banned) != 1 || banned[0].ID != testEventId {
+		t.Errorf("unexpected banned events: %v", banned)
+	}
+	if reason := reloaded.Check(nostr.Event{PubKey: otherPubkey, Kind: 4}, moderation.Allowlists{}); reason == "" {
+		t.Error("expected disallowed kind to be rejected after reload")
+	}
+	if !reloaded.IsBlocked("10.0.0.1") || reloaded.IsBlocked("10.0.0.2") {
+		t.Error("unexpected blocked ip addresses after reload")
+	}
+	if info := reloaded.ApplyInfo(config.Info{Name: "configured", Description: "configured"}); info.Name != "renamed" || info.Description != "configured" {
+		t.Errorf("unexpected relay information: %v", info)
+	}
+}
+
+// TestModerationRepositoryApplyAtomic ensures changes which can't be saved leave the state untouched
+func TestModerationRepositoryApplyAtomic(t *testing.T) {
+	repo, err := NewModerationRepository(filepath.Join(t.TempDir(), "missing", "moderation.json"))
+	if err != nil {
+		t.Fatalf("unexpected error when creating repository: %v", err)
+	}
+	changes := []moderation.Change{
+		{Entry: moderation.Entry{Category: moderation.CategoryBannedPubkey, Subject: testPubkey}},
+		{Entry: moderation.Entry{Category: moderation.CategoryBannedEvent, Subject: testEventId}},
+	}
+	if err := repo.Apply(context.Background(), changes); err == nil {
+		t.Fatal("expected error when saving to a missing directory")
+	}
+	if entries, _ := repo.List(context.Background()); len(entries) != 0 {
+		t.Errorf("unexpected entries after failed change: %v", entries)
+	}
+}
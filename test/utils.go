@@ -102,6 +102,15 @@ func CompareEnvelope(t *testing.T, expected, got nostr.Envelope) {
 		if *e != *g {
 			t.Errorf("unexpected notice message: expected %v, got %v", *e, *g)
 		}
+	default:
+		// other envelopes are compared by their serialized form
+		if expected == nil || got == nil {
+			if expected != got {
+				t.Errorf("unexpected message: expected %v, got %v", expected, got)
+			}
+		} else if expected.String() != got.String() {
+			t.Errorf("unexpected %s message: expected %v, got %v", expected.Label(), expected, got)
+		}
 	}
 }
 
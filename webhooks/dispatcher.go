@@ -0,0 +1,256 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/google/uuid"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var (
+	// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body keyed with the secret of the endpoint, prefixed with sha256=
+	SignatureHeader = "X-Tandem-Signature"
+	// DeliveryHeader holds the id of the delivery, the same for every attempt, so endpoints can ignore duplicates
+	DeliveryHeader = "X-Tandem-Delivery"
+	// freshQueueSize is the number of accepted events waiting for their first attempt per endpoint. Once it is full events go straight to the retry queue
+	freshQueueSize = 1024
+	// retryInterval is how often the retry queue is checked for due deliveries
+	retryInterval = time.Second
+)
+
+// endpoint is a URL accepted events are posted to
+type endpoint struct {
+	url     string
+	secret  []byte
+	filters nostr.Filters
+	fresh   chan delivery
+}
+
+// Dispatcher posts the events accepted by the relay to the configured endpoints. Failed deliveries are retried with an exponential backoff from a persistent queue and written to the dead-letter log once every attempt failed
+type Dispatcher struct {
+	cfg        config.Webhooks
+	logger     zerolog.Logger
+	client     *http.Client
+	endpoints  []*endpoint
+	queue      *retryQueue
+	deadLetter *deadLetterLog
+	ctx        context.Context
+	cancel     context.CancelFunc
+	sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher for the configured endpoints, loading the deliveries left in the retry queue
+func NewDispatcher(cfg config.Webhooks, logger zerolog.Logger) (*Dispatcher, error) {
+	queue, err := loadRetryQueue(cfg.QueuePath)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		cfg:    cfg,
+		logger: logger,
+		client: &http.Client{Timeout: cfg.Timeout},
+		queue:  queue,
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, endpointCfg := range cfg.Endpoints {
+		filters, err := endpointCfg.NostrFilters()
+		if err != nil {
+			return nil, fmt.Errorf("invalid filters for webhook %s: %w", endpointCfg.URL, err)
+		}
+		d.endpoints = append(d.endpoints, &endpoint{
+			url:     endpointCfg.URL,
+			secret:  []byte(endpointCfg.Secret),
+			filters: filters,
+			fresh:   make(chan delivery, freshQueueSize),
+		})
+	}
+	return d, nil
+}
+
+// Start opens the dead-letter log and starts delivering to every endpoint. Queued deliveries to endpoints which are no longer configured are moved to the dead-letter log
+func (d *Dispatcher) Start() error {
+	d.logger.Info().Msg("starting up...")
+	deadLetter, err := openDeadLetterLog(d.cfg.DeadLetterPath)
+	if err != nil {
+		return fmt.Errorf("failed to open webhook dead-letter log: %w", err)
+	}
+	d.deadLetter = deadLetter
+	urls := make(map[string]struct{}, len(d.endpoints))
+	for _, e := range d.endpoints {
+		urls[e.url] = struct{}{}
+	}
+	for _, orphan := range d.queue.orphans(urls) {
+		orphan.LastError = "endpoint no longer configured"
+		d.giveUp(orphan)
+	}
+	for _, e := range d.endpoints {
+		d.Add(1)
+		go d.deliverLoop(e)
+	}
+	d.logger.Info().Msg("start up completed")
+	return nil
+}
+
+// Publish queues an event accepted by the relay for the endpoints whose filters it matches. It is subscribed to bus.EventAccepted
+func (d *Dispatcher) Publish(accepted bus.Event) {
+	event := accepted.Event
+	for _, e := range d.endpoints {
+		if !e.filters.Match(&event) {
+			continue
+		}
+		delivery := delivery{ID: uuid.NewString(), Endpoint: e.url, Event: event, NextAttempt: time.Now()}
+		// a slow endpoint must not hold up the ingester and nothing is delivered after a shutdown, the delivery waits in the retry queue instead
+		if d.ctx.Err() == nil {
+			select {
+			case e.fresh <- delivery:
+				continue
+			default:
+			}
+		}
+		if err := d.queue.put(delivery); err != nil {
+			d.logger.Error().Err(err).Str("endpoint", e.url).Str("eventId", event.ID).Msg("failed to queue webhook delivery")
+		}
+	}
+}
+
+// deliverLoop is run as a goroutine for every endpoint. It attempts new deliveries as they come and queued ones once they are due
+func (d *Dispatcher) deliverLoop(e *endpoint) {
+	defer d.Done()
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case delivery := <-e.fresh:
+			d.attempt(e, delivery)
+		case now := <-ticker.C:
+			for _, delivery := range d.queue.due(e.url, now) {
+				if d.ctx.Err() != nil {
+					return
+				}
+				d.attempt(e, delivery)
+			}
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// attempt posts a delivery to its endpoint. A failed delivery is queued for a retry after a backoff doubling with every attempt, until the attempts run out
+func (d *Dispatcher) attempt(e *endpoint, delivery delivery) {
+	logger := d.logger.With().Str("endpoint", e.url).Str("deliveryId", delivery.ID).Str("eventId", delivery.Event.ID).Logger()
+	err := d.post(e, delivery)
+	if err == nil {
+		logger.Debug().Msg("webhook delivered")
+		if err := d.queue.remove(delivery.ID); err != nil {
+			logger.Error().Err(err).Msg("failed to remove delivery from webhook queue")
+		}
+		return
+	}
+	// an attempt interrupted by a shutdown doesn't count
+	if d.ctx.Err() == nil {
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+	}
+	if delivery.Attempts >= d.cfg.MaxAttempts {
+		d.giveUp(delivery)
+		return
+	}
+	delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+	logger.Debug().Err(err).Msgf("webhook delivery failed, retrying at %v", delivery.NextAttempt)
+	if err := d.queue.put(delivery); err != nil {
+		logger.Error().Err(err).Msg("failed to queue webhook delivery")
+	}
+}
+
+// backoff returns the delay before the next attempt of a delivery
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.cfg.InitialBackoff
+	for i := 1; i < attempts && backoff < d.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, d.cfg.MaxBackoff)
+}
+
+// giveUp moves a delivery from the retry queue to the dead-letter log
+func (d *Dispatcher) giveUp(delivery delivery) {
+	logger := d.logger.With().Str("endpoint", delivery.Endpoint).Str("deliveryId", delivery.ID).Str("eventId", delivery.Event.ID).Logger()
+	logger.Warn().Str("lastError", delivery.LastError).Msgf("giving up on webhook delivery after %v attempts", delivery.Attempts)
+	if err := d.deadLetter.write(delivery); err != nil {
+		logger.Error().Err(err).Msg("failed to write to webhook dead-letter log")
+		return
+	}
+	if err := d.queue.remove(delivery.ID); err != nil {
+		logger.Error().Err(err).Msg("failed to remove delivery from webhook queue")
+	}
+}
+
+// post sends the event of a delivery to its endpoint as JSON, signed with the secret of the endpoint. Any status other than 2xx is a failure
+func (d *Dispatcher) post(e *endpoint, delivery delivery) error {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tandem")
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(e.secret, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header for a request body. Endpoints compute it with their copy of the secret and compare it to the header
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Stop stops delivering and closes the dead-letter log. Deliveries not attempted yet are saved to the retry queue so they are sent after a restart
+func (d *Dispatcher) Stop() error {
+	d.logger.Info().Msg("shutting down...")
+	d.cancel()
+	d.Wait()
+	for _, e := range d.endpoints {
+	drain:
+		for {
+			select {
+			case delivery := <-e.fresh:
+				if err := d.queue.put(delivery); err != nil {
+					d.logger.Error().Err(err).Str("endpoint", e.url).Msg("failed to queue webhook delivery")
+				}
+			default:
+				break drain
+			}
+		}
+	}
+	if err := d.deadLetter.close(); err != nil {
+		return fmt.Errorf("failed to close webhook dead-letter log: %w", err)
+	}
+	d.logger.Info().Msg("shutdown completed")
+	return nil
+}
@@ -0,0 +1,218 @@
+package webhooks
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+var testSecret = "s3cr3t"
+
+// testEndpoint records the events posted to it and fails the first requests
+type testEndpoint struct {
+	failures  int
+	requests  int
+	events    []nostr.Event
+	delivered map[string]struct{}
+	sync.Mutex
+}
+
+func (e *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+	e.requests++
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get(SignatureHeader) != Sign([]byte(testSecret), body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if e.requests <= e.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := e.delivered[r.Header.Get(DeliveryHeader)]; ok {
+		return
+	}
+	e.delivered[r.Header.Get(DeliveryHeader)] = struct{}{}
+	var event nostr.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.events = append(e.events, event)
+}
+
+func (e *testEndpoint) received() []nostr.Event {
+	e.Lock()
+	defer e.Unlock()
+	return append([]nostr.Event{}, e.events...)
+}
+
+// startTestEndpoint starts an HTTP server failing its first requests, it is stopped when the test ends
+func startTestEndpoint(t *testing.T, failures int) (*testEndpoint, string) {
+	endpoint := &testEndpoint{failures: failures, delivered: make(map[string]struct{})}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	return endpoint, server.URL
+}
+
+// newTestEvent signs a new event of the given kind
+func newTestEvent(t *testing.T, kind int) nostr.Event {
+	event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Content: "hello"}
+	if err := event.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("unexpected error when signing event: %v", err)
+	}
+	return event
+}
+
+// testConfig returns webhook settings with short backoffs, using a temporary directory for the queue and dead-letter log
+func testConfig(t *testing.T, maxAttempts int, endpoints ...string) config.Webhooks {
+	dir := t.TempDir()
+	cfg := config.Webhooks{
+		QueuePath:      filepath.Join(dir, "webhooks.json"),
+		DeadLetterPath: filepath.Join(dir, "webhooks-dead-letter.jsonl"),
+		MaxAttempts:    maxAttempts,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Timeout:        time.Second,
+	}
+	for _, url := range endpoints {
+		cfg.Endpoints = append(cfg.Endpoints, config.Endpoint{URL: url, Secret: testSecret, Filters: []string{`{"kinds":[1]}`}})
+	}
+	return cfg
+}
+
+// startDispatcher creates and starts a dispatcher
+func startDispatcher(t *testing.T, cfg config.Webhooks) *Dispatcher {
+	d, err := NewDispatcher(cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating dispatcher: %v", err)
+	}
+	if err := d.Start(); err != nil {
+		t.Fatalf("unexpected error when starting dispatcher: %v", err)
+	}
+	return d
+}
+
+// waitFor fails the test unless the condition is met within a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// queued returns the deliveries saved in the queue file
+func queued(t *testing.T, path string) []delivery {
+	q, err := loadRetryQueue(path)
+	if err != nil {
+		t.Fatalf("unexpected error when loading webhook queue: %v", err)
+	}
+	deliveries := make([]delivery, 0, len(q.deliveries))
+	for _, d := range q.deliveries {
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+func init() {
+	retryInterval = 10 * time.Millisecond
+}
+
+// TestDispatcher ensures matching events are posted signed, retried until they are delivered and dead-lettered once every attempt failed
+func TestDispatcher(t *testing.T) {
+	flaky, flakyURL := startTestEndpoint(t, 2)
+	down, downURL := startTestEndpoint(t, 1000)
+	cfg := testConfig(t, 3, flakyURL, downURL)
+	d := startDispatcher(t, cfg)
+	note, reaction := newTestEvent(t, 1), newTestEvent(t, 7)
+	d.Publish(bus.Event{ConnectionId: "conn", Event: note})
+	d.Publish(bus.Event{ConnectionId: "conn", Event: reaction})
+	waitFor(t, "delivery to flaky endpoint", func() bool { return len(flaky.received()) > 0 })
+	waitFor(t, "dead-lettered delivery", func() bool {
+		info, err := os.Stat(cfg.DeadLetterPath)
+		return err == nil && info.Size() > 0
+	})
+	waitFor(t, "empty webhook queue", func() bool { return len(queued(t, cfg.QueuePath)) == 0 })
+	if err := d.Stop(); err != nil {
+		t.Fatalf("unexpected error when stopping dispatcher: %v", err)
+	}
+	if events := flaky.received(); len(events) != 1 || events[0].ID != note.ID {
+		t.Errorf("unexpected events delivered: %v", events)
+	}
+	if down.requests != cfg.MaxAttempts {
+		t.Errorf("unexpected number of attempts %v, expected %v", down.requests, cfg.MaxAttempts)
+	}
+	file, err := os.Open(cfg.DeadLetterPath)
+	if err != nil {
+		t.Fatalf("unexpected error when opening dead-letter log: %v", err)
+	}
+	defer file.Close()
+	var dead []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("unexpected error when parsing dead-letter log: %v", err)
+		}
+		dead = append(dead, line)
+	}
+	if len(dead) != 1 || dead[0].Endpoint != downURL || dead[0].Event.ID != note.ID || dead[0].Attempts != cfg.MaxAttempts || dead[0].LastError == "" {
+		t.Errorf("unexpected dead-letter log: %v", dead)
+	}
+}
+
+// TestDispatcherResume ensures deliveries left in the retry queue are sent after a restart
+func TestDispatcherResume(t *testing.T) {
+	down, downURL := startTestEndpoint(t, 1000)
+	cfg := testConfig(t, 100, downURL)
+	d := startDispatcher(t, cfg)
+	note := newTestEvent(t, 1)
+	d.Publish(bus.Event{ConnectionId: "conn", Event: note})
+	waitFor(t, "failed attempt", func() bool {
+		down.Lock()
+		defer down.Unlock()
+		return down.requests > 0
+	})
+	if err := d.Stop(); err != nil {
+		t.Fatalf("unexpected error when stopping dispatcher: %v", err)
+	}
+	if deliveries := queued(t, cfg.QueuePath); len(deliveries) != 1 || deliveries[0].Event.ID != note.ID {
+		t.Fatalf("unexpected webhook queue: %v", deliveries)
+	}
+	// the endpoint comes back up under a new address, the queued delivery is redirected to it
+	up, upURL := startTestEndpoint(t, 0)
+	resumed := testConfig(t, 100, upURL)
+	resumed.QueuePath = cfg.QueuePath
+	queue, err := loadRetryQueue(cfg.QueuePath)
+	if err != nil {
+		t.Fatalf("unexpected error when loading webhook queue: %v", err)
+	}
+	for _, delivery := range queue.deliveries {
+		delivery.Endpoint = upURL
+		if err := queue.put(delivery); err != nil {
+			t.Fatalf("unexpected error when updating webhook queue: %v", err)
+		}
+	}
+	d = startDispatcher(t, resumed)
+	defer d.Stop()
+	waitFor(t, "resumed delivery", func() bool { return len(up.received()) > 0 })
+	if events := up.received(); len(events) != 1 || events[0].ID != note.ID {
+		t.Errorf("unexpected events delivered: %v", events)
+	}
+}
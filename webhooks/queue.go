@@ -0,0 +1,162 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// delivery is an event to be posted to an endpoint
+type delivery struct {
+	ID          string      `json:"id"`
+	Endpoint    string      `json:"endpoint"`
+	Event       nostr.Event `json:"event"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+	LastError   string      `json:"last_error,omitempty"`
+}
+
+// retryQueue holds the deliveries waiting to be retried and persists them to a JSON file so they survive a restart
+type retryQueue struct {
+	path       string
+	deliveries map[string]delivery
+	sync.Mutex
+}
+
+// loadRetryQueue reads the queued deliveries from the given path. A missing file is treated as an empty queue
+func loadRetryQueue(path string) (*retryQueue, error) {
+	q := &retryQueue{path: path, deliveries: make(map[string]delivery)}
+	queueBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var deliveries []delivery
+	if err := json.Unmarshal(queueBytes, &deliveries); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook queue %s: %w", path, err)
+	}
+	for _, d := range deliveries {
+		q.deliveries[d.ID] = d
+	}
+	return q, nil
+}
+
+// put adds or updates a delivery and saves the queue
+func (q *retryQueue) put(d delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	q.deliveries[d.ID] = d
+	return q.save()
+}
+
+// remove drops a delivery from the queue and saves it, if it was queued
+func (q *retryQueue) remove(id string) error {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.deliveries[id]; !ok {
+		return nil
+	}
+	delete(q.deliveries, id)
+	return q.save()
+}
+
+// due returns the deliveries to an endpoint whose next attempt is before now, oldest first
+func (q *retryQueue) due(endpoint string, now time.Time) []delivery {
+	q.Lock()
+	defer q.Unlock()
+	var deliveries []delivery
+	for _, d := range q.deliveries {
+		if d.Endpoint == endpoint && !d.NextAttempt.After(now) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sortDeliveries(deliveries)
+	return deliveries
+}
+
+// orphans returns the deliveries to endpoints which are no longer configured
+func (q *retryQueue) orphans(endpoints map[string]struct{}) []delivery {
+	q.Lock()
+	defer q.Unlock()
+	var deliveries []delivery
+	for _, d := range q.deliveries {
+		if _, ok := endpoints[d.Endpoint]; !ok {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sortDeliveries(deliveries)
+	return deliveries
+}
+
+// save writes the queue to a temporary file which then replaces the queue file so a crash never leaves a partially written queue behind. The lock must be held
+func (q *retryQueue) save() error {
+	deliveries := make([]delivery, 0, len(q.deliveries))
+	for _, d := range q.deliveries {
+		deliveries = append(deliveries, d)
+	}
+	sortDeliveries(deliveries)
+	queueBytes, err := json.MarshalIndent(deliveries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := q.path + ".tmp"
+	if err := os.WriteFile(tmpPath, queueBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, q.path)
+}
+
+// sortDeliveries orders deliveries by their next attempt, then by the creation time of their event
+func sortDeliveries(deliveries []delivery) {
+	slices.SortFunc(deliveries, func(a, b delivery) int {
+		if c := a.NextAttempt.Compare(b.NextAttempt); c != 0 {
+			return c
+		}
+		return int(a.Event.CreatedAt) - int(b.Event.CreatedAt)
+	})
+}
+
+// deadLetterLog appends the deliveries which failed every attempt to a file, one JSON object per line
+type deadLetterLog struct {
+	file *os.File
+	sync.Mutex
+}
+
+// deadLetter is a line of the dead-letter log
+type deadLetter struct {
+	delivery
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// openDeadLetterLog opens the dead-letter log at the given path for appending, creating it if needed
+func openDeadLetterLog(path string) (*deadLetterLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterLog{file: file}, nil
+}
+
+// write appends a failed delivery to the log
+func (l *deadLetterLog) write(d delivery) error {
+	lineBytes, err := json.Marshal(deadLetter{delivery: d, FailedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	_, err = l.file.Write(append(lineBytes, '\n'))
+	return err
+}
+
+// close closes the log file
+func (l *deadLetterLog) close() error {
+	return l.file.Close()
+}
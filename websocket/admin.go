@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+)
+
+var (
+	kickReason = "connection closed by relay operator"
+)
+
+// Stats are the relay wide counters served by the stats endpoint. Byte counts only include open connections
+type Stats struct {
+	StartedAt       time.Time `json:"started_at"`
+	Uptime          string    `json:"uptime"`
+	Connections     int       `json:"connections"`
+	Subscriptions   int       `json:"subscriptions"`
+	BytesIn         uint64    `json:"bytes_in"`
+	BytesOut        uint64    `json:"bytes_out"`
+	DroppedMessages uint64    `json:"dropped_messages"`
+}
+
+// requireAdmin only lets requests through which carry either the configured admin token as a bearer token or a NIP-98 authorization signed by one of the admin pubkeys. The admin endpoints don't exist when neither is configured
+func (s *WebsocketServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.httpConfig()
+		if cfg.AdminToken == "" && len(cfg.AdminPubkeys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		authorized := false
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && cfg.AdminToken != "" {
+			authorized = subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+		} else if pubkey, err := nip98.ValidateRequest(r, nil, time.Now(), s.authReplays); err == nil {
+			authorized = slices.Contains(cfg.AdminPubkeys, pubkey)
+		}
+		if !authorized {
+			s.logger.Warn().Str("ip", s.resolver.clientIP(r)).Msg("unauthorized request to admin endpoint")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// listConnectionsHandler responds with the metadata of all open connections
+func (s *WebsocketServer) listConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.registry.List()); err != nil {
+		s.logger.Error().Err(err).Msg("failed to JSON encode connections")
+	}
+}
+
+// statsHandler responds with relay wide counters
+func (s *WebsocketServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		StartedAt:       s.startedAt,
+		Uptime:          time.Since(s.startedAt).Round(time.Second).String(),
+		DroppedMessages: s.dropped.Load(),
+	}
+	for _, info := range s.registry.List() {
+		stats.Connections++
+		stats.Subscriptions += info.SubscriptionCount
+		stats.BytesIn += info.BytesIn
+		stats.BytesOut += info.BytesOut
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		s.logger.Error().Err(err).Msg("failed to JSON encode stats")
+	}
+}
+
+// kickConnectionHandler disconnects the connection with the id given in the path
+func (s *WebsocketServer) kickConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.registry.Kick(id, kickReason); errors.Is(err, ErrConnectionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Msgf("connection with id %s kicked by admin", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	ErrInvalidAuthKind   = errors.New("auth event must be of kind 22242")
+	ErrAuthExpired       = errors.New("auth event is too old or too far in the future")
+	ErrNoChallenge       = errors.New("no auth challenge was sent on this connection")
+	ErrChallengeMismatch = errors.New("auth event does not answer the challenge of this connection")
+	ErrRelayMismatch     = errors.New("auth event is for a different relay")
+	ErrInvalidAuthSig    = errors.New("auth event has an invalid signature")
+	// authWindow is how far the created_at of an auth event may be from the current time
+	authWindow = 10 * time.Minute
+)
+
+// newChallenge generates a random NIP-42 challenge
+func newChallenge() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Authenticate validates the given NIP-42 auth event against the challenge sent on the given connection and records the pubkey the connection authenticated as. Like NIP-98, the scheme of the relay url is ignored since TLS may be terminated by a proxy
+func (h *WebsocketServer) Authenticate(connectionId string, event nostr.Event) error {
+	if event.Kind != nostr.KindClientAuthentication {
+		return ErrInvalidAuthKind
+	}
+	if skew := time.Since(event.CreatedAt.Time()); skew > authWindow || skew < -authWindow {
+		return ErrAuthExpired
+	}
+	challenge, host, ok := h.registry.authChallenge(connectionId)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	if challenge == "" {
+		return ErrNoChallenge
+	}
+	if tag := event.Tags.GetFirst([]string{"challenge", ""}); tag == nil || tag.Value() != challenge {
+		return ErrChallengeMismatch
+	}
+	tag := event.Tags.GetFirst([]string{"relay", ""})
+	if tag == nil {
+		return ErrRelayMismatch
+	}
+	relayURL, err := url.Parse(tag.Value())
+	if err != nil || !strings.EqualFold(relayURL.Host, host) {
+		return ErrRelayMismatch
+	}
+	if ok, err := event.CheckSignature(); err != nil || !ok {
+		return ErrInvalidAuthSig
+	}
+	return h.registry.AddAuthedPubkey(connectionId, event.PubKey)
+}
+
+// AuthedPubkeys returns the pubkeys the given connection authenticated as
+func (h *WebsocketServer) AuthedPubkeys(connectionId string) []string {
+	return h.registry.AuthedPubkeys(connectionId)
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+type authTestCase struct {
+	name         string
+	connectionId string
+	event        func(secretKey string) nostr.Event
+	expectedErr  error
+}
+
+// authEvent creates a NIP-42 auth event with the given challenge and relay url
+func authEvent(secretKey, challenge, relayURL string, createdAt time.Time) nostr.Event {
+	event := nostr.Event{
+		Kind:      nostr.KindClientAuthentication,
+		CreatedAt: nostr.Timestamp(createdAt.Unix()),
+		Tags:      nostr.Tags{{"relay", relayURL}, {"challenge", challenge}},
+	}
+	event.Sign(secretKey)
+	return event
+}
+
+var authTestCases = []authTestCase{
+	{
+		name:         "Valid",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "challenge", "wss://Relay.example.com/", time.Now())
+		},
+	},
+	{
+		name:         "WrongKind",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			event := authEvent(secretKey, "challenge", "wss://relay.example.com", time.Now())
+			event.Kind = 1
+			return event
+		},
+		expectedErr: ErrInvalidAuthKind,
+	},
+	{
+		name:         "Expired",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "challenge", "wss://relay.example.com", time.Now().Add(-time.Hour))
+		},
+		expectedErr: ErrAuthExpired,
+	},
+	{
+		name:         "WrongChallenge",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "other", "wss://relay.example.com", time.Now())
+		},
+		expectedErr: ErrChallengeMismatch,
+	},
+	{
+		name:         "WrongRelay",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "challenge", "wss://other.example.com", time.Now())
+		},
+		expectedErr: ErrRelayMismatch,
+	},
+	{
+		name:         "InvalidSignature",
+		connectionId: connIdOne,
+		event: func(secretKey string) nostr.Event {
+			event := authEvent(secretKey, "challenge", "wss://relay.example.com", time.Now())
+			event.Sig = event.Sig[:len(event.Sig)-2] + "00"
+			return event
+		},
+		expectedErr: ErrInvalidAuthSig,
+	},
+	{
+		name:         "NoChallenge",
+		connectionId: connIdTwo,
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "", "wss://relay.example.com", time.Now())
+		},
+		expectedErr: ErrNoChallenge,
+	},
+	{
+		name:         "UnknownConnection",
+		connectionId: "unknown",
+		event: func(secretKey string) nostr.Event {
+			return authEvent(secretKey, "challenge", "wss://relay.example.com", time.Now())
+		},
+		expectedErr: ErrConnectionNotFound,
+	},
+}
+
+// TestAuthenticate ensures only auth events answering the challenge of the connection for this relay authenticate it
+func TestAuthenticate(t *testing.T) {
+	wsServer := NewWebsocketServer(config.HTTP{}, zerolog.Nop(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	wsServer.registry.add(connIdOne, &connectionEntry{challenge: "challenge", host: "relay.example.com"})
+	wsServer.registry.add(connIdTwo, &connectionEntry{host: "relay.example.com"})
+	for _, testCase := range authTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		secretKey := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(secretKey)
+		err := wsServer.Authenticate(testCase.connectionId, testCase.event(secretKey))
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("unexpected error for test case %s: expected %v, got %v", testCase.name, testCase.expectedErr, err)
+		}
+		if authed := slices.Contains(wsServer.AuthedPubkeys(testCase.connectionId), pubkey); authed != (testCase.expectedErr == nil) {
+			t.Errorf("unexpected authentication state for test case %s: %v", testCase.name, authed)
+		}
+	}
+}
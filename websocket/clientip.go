@@ -0,0 +1,285 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	proxyV1Prefix         = []byte("PROXY ")
+	proxyV2Signature      = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyHeaderTimeout    = 5 * time.Second
+)
+
+const (
+	proxyV1MaxLen = 107 // maximum length of a v1 header including the trailing CRLF
+)
+
+type proxyResolver struct {
+	trusted []*net.IPNet
+	sync.RWMutex
+}
+
+// parseIPNets parses a list of CIDRs or single IP addresses
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// containsIP checks if the given address belongs to any of the given networks
+func containsIP(ipNets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxyResolver parses the list of trusted proxies. Entries can be CIDRs or single IP addresses
+func newProxyResolver(trustedProxies []string) (*proxyResolver, error) {
+	p := &proxyResolver{}
+	if err := p.update(trustedProxies); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// update replaces the list of trusted proxies
+func (p *proxyResolver) update(trustedProxies []string) error {
+	trusted, err := parseIPNets(trustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.trusted = trusted
+	return nil
+}
+
+// isTrusted checks if the given address belongs to a trusted proxy
+func (p *proxyResolver) isTrusted(addr string) bool {
+	p.RLock()
+	defer p.RUnlock()
+	return containsIP(p.trusted, addr)
+}
+
+// hostFromAddr strips the port from a network address
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// clientIP resolves the real client address of a request. Forwarding headers are only honoured when the peer is a trusted proxy
+func (p *proxyResolver) clientIP(r *http.Request) string {
+	peer := hostFromAddr(r.RemoteAddr)
+	if !p.isTrusted(peer) {
+		return peer
+	}
+	// walk X-Forwarded-For from right to left, the first untrusted hop is the client
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hostFromAddr(hop))
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		if !p.isTrusted(hops[i]) || i == 0 {
+			return hops[i]
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+type proxyListener struct {
+	net.Listener
+	resolver *proxyResolver
+	logger   zerolog.Logger
+}
+
+// Accept wraps connections from trusted proxies so the PROXY protocol header is consumed before any HTTP traffic
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.resolver.isTrusted(hostFromAddr(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), logger: l.logger}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+	once       sync.Once
+	logger     zerolog.Logger
+}
+
+// parseHeader reads the PROXY protocol header once. It is run lazily from the connection's goroutine so a slow proxy cannot block Accept
+func (c *proxyConn) parseHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		if err := c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+			c.err = err
+			return
+		}
+		defer c.Conn.SetReadDeadline(time.Time{})
+		addr, err := readProxyHeader(c.reader)
+		if err != nil {
+			c.logger.Warn().Err(err).Str("peer", c.remoteAddr.String()).Msg("failed to parse PROXY protocol header")
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+// Read reads from the connection after the PROXY protocol header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.parseHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address carried by the PROXY protocol header
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.parseHeader()
+	return c.remoteAddr
+}
+
+// readProxyHeader parses a v1 or v2 PROXY protocol header. A nil address is returned when the header does not carry one (UNKNOWN or LOCAL)
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(prefix, proxyV1Prefix) {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidProxyHeader)
+	}
+	return readProxyV1Header(r)
+}
+
+// readProxyV1Header parses the human readable form, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header", ErrInvalidProxyHeader)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: malformed v1 source address", ErrInvalidProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2Header parses the binary form of the header
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidProxyHeader, verCmd>>4)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are health checks from the proxy itself
+	if verCmd&0x0F == 0x00 {
+		return nil, nil
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short v2 address block", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short v2 address block", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/test"
+	"github.com/rs/zerolog"
+)
+
+type clientIPTestCase struct {
+	name       string
+	remoteAddr string
+	headers    map[string]string
+	expectedIP string
+}
+
+var (
+	trustedProxies    = []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+	clientIPTestCases = []clientIPTestCase{
+		{
+			name:       "UntrustedPeer_HeadersIgnored",
+			remoteAddr: "203.0.113.7:5000",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4"},
+			expectedIP: "203.0.113.7",
+		},
+		{
+			name:       "TrustedPeer_NoHeaders",
+			remoteAddr: "10.1.2.3:5000",
+			expectedIP: "10.1.2.3",
+		},
+		{
+			name:       "TrustedPeer_XForwardedFor",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "TrustedPeer_XForwardedForChainSkipsTrustedHops",
+			remoteAddr: "192.168.1.1:5000",
+			headers:    map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.1, 10.0.0.5"},
+			expectedIP: "198.51.100.1",
+		},
+		{
+			name:       "TrustedPeer_XForwardedForAllTrusted",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.9, 10.0.0.5"},
+			expectedIP: "10.0.0.9",
+		},
+		{
+			name:       "TrustedPeer_XRealIP",
+			remoteAddr: "[fd00::1]:5000",
+			headers:    map[string]string{"X-Real-IP": "2001:db8::1"},
+			expectedIP: "2001:db8::1",
+		},
+		{
+			name:       "TrustedPeer_GarbageHeaders",
+			remoteAddr: "10.1.2.3:5000",
+			headers:    map[string]string{"X-Forwarded-For": "not-an-ip", "X-Real-IP": "also-not-an-ip"},
+			expectedIP: "10.1.2.3",
+		},
+	}
+)
+
+// TestClientIP ensures forwarding headers are only honoured for trusted proxies
+func TestClientIP(t *testing.T) {
+	resolver, err := newProxyResolver(trustedProxies)
+	if err != nil {
+		t.Fatalf("unexpected error when parsing trusted proxies: %v", err)
+	}
+	for _, testCase := range clientIPTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = testCase.remoteAddr
+		for key, value := range testCase.headers {
+			req.Header.Set(key, value)
+		}
+		if ip := resolver.clientIP(req); ip != testCase.expectedIP {
+			t.Errorf("unexpected client ip for test case %s: expected %s, got %s", testCase.name, testCase.expectedIP, ip)
+		}
+	}
+}
+
+// proxyV2Header builds a binary PROXY protocol header
+func proxyV2Header(cmd, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+type proxyHeaderTestCase struct {
+	name         string
+	header       []byte
+	expectedAddr string
+	expectedErr  error
+}
+
+var proxyHeaderTestCases = []proxyHeaderTestCase{
+	{
+		name:         "V1_TCP4",
+		header:       []byte("PROXY TCP4 198.51.100.1 10.0.0.1 56324 443\r\n"),
+		expectedAddr: "198.51.100.1:56324",
+	},
+	{
+		name:         "V1_TCP6",
+		header:       []byte("PROXY TCP6 2001:db8::1 fd00::1 56324 443\r\n"),
+		expectedAddr: "[2001:db8::1]:56324",
+	},
+	{
+		name:   "V1_Unknown",
+		header: []byte("PROXY UNKNOWN\r\n"),
+	},
+	{
+		name:        "V1_Malformed",
+		header:      []byte("PROXY TCP4 nope 10.0.0.1 56324 443\r\n"),
+		expectedErr: ErrInvalidProxyHeader,
+	},
+	{
+		name:        "MissingHeader",
+		header:      []byte("GET / HTTP/1.1\r\n"),
+		expectedErr: ErrInvalidProxyHeader,
+	},
+	{
+		name:         "V2_TCP4",
+		header:       proxyV2Header(0x1, 0x11, []byte{198, 51, 100, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x01, 0xBB}),
+		expectedAddr: "198.51.100.1:56324",
+	},
+	{
+		name:   "V2_Local",
+		header: proxyV2Header(0x0, 0x00, nil),
+	},
+}
+
+// TestReadProxyHeader ensures v1 and v2 PROXY protocol headers are parsed correctly
+func TestReadProxyHeader(t *testing.T) {
+	for _, testCase := range proxyHeaderTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		payload := append(append([]byte{}, testCase.header...), []byte("payload")...)
+		addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(payload)))
+		if !errors.Is(err, testCase.expectedErr) {
+			t.Errorf("unexpected error for test case %s: expected %v, got %v", testCase.name, testCase.expectedErr, err)
+			continue
+		}
+		if testCase.expectedAddr == "" && addr != nil {
+			t.Errorf("unexpected address for test case %s: %v", testCase.name, addr)
+		} else if testCase.expectedAddr != "" && (addr == nil || addr.String() != testCase.expectedAddr) {
+			t.Errorf("unexpected address for test case %s: expected %s, got %v", testCase.name, testCase.expectedAddr, addr)
+		}
+	}
+}
+
+// TestProxyConn ensures the PROXY protocol header is stripped from the stream and the client address is exposed
+func TestProxyConn(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte("PROXY TCP4 198.51.100.1 10.0.0.1 56324 443\r\nhello"))
+	}()
+	conn := &proxyConn{Conn: server, reader: bufio.NewReader(server), logger: mainLogger}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "198.51.100.1:56324" {
+		t.Errorf("unexpected remote address: expected 198.51.100.1:56324, got %s", addr)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatalf("unexpected error reading from connection: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("unexpected data read from connection: expected hello, got %s", string(data))
+	}
+}
@@ -2,122 +2,356 @@ package websocket
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/accesslog"
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
 	"github.com/TheRebelOfBabylon/tandem/msg"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/rs/zerolog"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
 	ErrRecvChanNotSet = errors.New("receive channel not set")
 )
 
+// newUpgrader creates the websocket upgrader from the HTTP configuration
+func newUpgrader(cfg config.HTTP) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		EnableCompression: cfg.Compression.Enabled,
+	}
+}
+
 type ConnMgrChannels struct {
-	Recv chan msg.Msg
-	Quit chan struct{}
+	Queue   *outboundQueue
+	Quit    chan struct{}
+	Dropped *atomic.Uint64
+	Close   func(code int, reason string, deadline time.Time)
 }
 
 type websocketConnectionManager struct {
 	id                 string
+	ip                 string
 	conn               *websocket.Conn
 	logger             zerolog.Logger
-	recv               chan msg.Msg
+	queue              *outboundQueue
 	send               chan msg.Msg
 	quit               chan struct{}
 	quitWrite          chan struct{}
 	quitSignalToServer chan string
+	dropped            atomic.Uint64
+	droppedNotified    uint64
+	bytesIn            atomic.Uint64
+	bytesOut           atomic.Uint64
+	pingInterval       time.Duration
+	pongWait           time.Duration
+	writeWait          time.Duration
+	idleTimeout        time.Duration
+	maxMessageSize     int64
+	drainTimeout       time.Duration
+	drainDeadline      time.Time
+	closeOnce          sync.Once
+	closeCode          int
+	closeReason        string
+	subscriptionCount  func(connectionId string) int
+	lastActivity       atomic.Int64
 }
 
 // newWebsocketConnectionManager instantiates a new websocket connection manager
 func newWebsocketConnectionManager(
 	id string,
+	ip string,
 	conn *websocket.Conn,
 	logger zerolog.Logger,
 	send chan msg.Msg,
-	recv chan msg.Msg,
+	queue *outboundQueue,
 	quit chan struct{},
 	quitSignalToServer chan string,
+	cfg config.HTTP,
+	subscriptionCount func(connectionId string) int,
 ) *websocketConnectionManager {
 	return &websocketConnectionManager{
 		id:                 id,
+		ip:                 ip,
 		conn:               conn,
 		logger:             logger,
 		send:               send,
-		recv:               recv,
+		queue:              queue,
 		quit:               quit,
 		quitWrite:          make(chan struct{}),
 		quitSignalToServer: quitSignalToServer,
+		pingInterval:       cfg.PingInterval,
+		pongWait:           cfg.PongWait,
+		writeWait:          cfg.WriteWait,
+		idleTimeout:        cfg.IdleTimeout,
+		maxMessageSize:     cfg.MaxMessageSize,
+		drainTimeout:       cfg.ShutdownTimeout,
+		subscriptionCount:  subscriptionCount,
+	}
+}
+
+// extendReadDeadline pushes back the read deadline of the websocket connection by the pong wait period
+func (m *websocketConnectionManager) extendReadDeadline() error {
+	if m.pongWait <= 0 {
+		return nil
 	}
+	return m.conn.SetReadDeadline(time.Now().Add(m.pongWait))
 }
 
 // read is the goroutine responsible for handling new incoming messages from the websocket connection and sending them to the ingester
 func (m *websocketConnectionManager) read() {
 	defer func() {
-		m.send <- msg.Msg{ConnectionId: m.id, CloseConn: true}
+		m.send <- msg.Msg{ConnectionId: m.id, RemoteIP: m.ip, CloseConn: true}
 		close(m.quitWrite)
 	}()
+	m.lastActivity.Store(time.Now().Unix())
+	if err := m.extendReadDeadline(); err != nil {
+		m.logger.Error().Err(err).Msg("failed to set read deadline on websocket connection")
+		return
+	}
+	m.conn.SetPongHandler(func(string) error {
+		return m.extendReadDeadline()
+	})
 	for {
-		_, msgBytes, err := m.conn.ReadMessage()
-		if err != nil && (websocket.IsCloseError(err, websocket.CloseAbnormalClosure) || errors.Is(err, net.ErrClosed)) {
+		msgBytes, err := m.readMessage()
+		var netErr net.Error
+		if err != nil && (websocket.IsCloseError(err, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure, websocket.CloseGoingAway) || errors.Is(err, net.ErrClosed)) {
 			m.logger.Info().Msg("exiting read routine...")
 			return
+		} else if err != nil && errors.Is(err, websocket.ErrReadLimit) {
+			m.logger.Warn().Msg("message from client exceeded the max message size. exiting read routine...")
+			if err := m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, ""), m.controlDeadline()); err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+				m.logger.Error().Err(err).Msg("failed to send close message over websocket connection")
+			}
+			return
+		} else if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+			m.logger.Info().Msg("no pong received from client in time. exiting read routine...")
+			return
 		} else if err != nil {
 			m.logger.Error().Err(err).Msg("failed to read message from websocket connection")
 			return
 		}
-		m.send <- msg.Msg{ConnectionId: m.id, Data: msgBytes}
+		m.lastActivity.Store(time.Now().Unix())
+		m.bytesIn.Add(uint64(len(msgBytes)))
+		if err := m.extendReadDeadline(); err != nil {
+			m.logger.Error().Err(err).Msg("failed to set read deadline on websocket connection")
+			return
+		}
+		m.send <- msg.Msg{ConnectionId: m.id, RemoteIP: m.ip, Data: msgBytes}
+	}
+}
+
+// readMessage reads the next message from the websocket connection. The max message size is enforced on the decompressed message since the websocket library only limits the size of frames on the wire
+func (m *websocketConnectionManager) readMessage() ([]byte, error) {
+	_, r, err := m.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if m.maxMessageSize <= 0 {
+		return io.ReadAll(r)
+	}
+	msgBytes, err := io.ReadAll(io.LimitReader(r, m.maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(msgBytes)) > m.maxMessageSize {
+		return nil, websocket.ErrReadLimit
+	}
+	return msgBytes, nil
+}
+
+// writeMessage sends a text message over the websocket connection, respecting the configured write deadline
+func (m *websocketConnectionManager) writeMessage(data []byte) error {
+	if m.writeWait > 0 {
+		if err := m.conn.SetWriteDeadline(m.controlDeadline()); err != nil {
+			return err
+		}
+	}
+	if err := m.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	m.bytesOut.Add(uint64(len(data)))
+	return nil
+}
+
+// controlDeadline returns the deadline for writing a control message over the websocket connection
+func (m *websocketConnectionManager) controlDeadline() time.Time {
+	if m.writeWait <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(m.writeWait)
+}
+
+// isIdle checks if the client has been inactive for longer than the idle timeout while holding no subscriptions
+func (m *websocketConnectionManager) isIdle() bool {
+	if m.idleTimeout <= 0 || m.subscriptionCount == nil {
+		return false
+	}
+	if time.Since(time.Unix(m.lastActivity.Load(), 0)) < m.idleTimeout {
+		return false
+	}
+	return m.subscriptionCount(m.id) == 0
+}
+
+// closeAndNotify closes the websocket connection and notifies the server that this connection manager quit without being told to
+func (m *websocketConnectionManager) closeAndNotify() {
+	if err := m.conn.Close(); err != nil {
+		m.logger.Error().Err(err).Msg("failed to safely close websocket connection")
+	}
+	m.notifyServer()
+}
+
+// notifyServer signals the server that this connection manager quit. The server may be shutting down and no longer listening, in which case we've been told to quit
+func (m *websocketConnectionManager) notifyServer() {
+	select {
+	case m.quitSignalToServer <- m.id:
+	case <-m.quit:
+	}
+}
+
+// close tells the connection manager to quit, sending the client a close frame with the given code and reason first. The client is given until the deadline to disconnect, or the drain timeout when the deadline is zero
+func (m *websocketConnectionManager) close(code int, reason string, deadline time.Time) {
+	m.closeOnce.Do(func() {
+		m.closeCode = code
+		m.closeReason = reason
+		m.drainDeadline = deadline
+		close(m.quit)
+	})
+}
+
+// goAway sends the client a NOTICE and close frame and waits for the client to close its side of the connection, up to the drain deadline or timeout, before closing the connection
+func (m *websocketConnectionManager) goAway() {
+	defer func() {
+		if err := m.conn.Close(); err != nil {
+			m.logger.Error().Err(err).Msg("failed to safely close websocket connection")
+		}
+	}()
+	if m.closeCode == 0 {
+		return
+	}
+	noticeBytes, err := nostr.NoticeEnvelope(m.closeReason).MarshalJSON()
+	if err != nil {
+		m.logger.Fatal().Err(err).Msg("failed to JSON marshal message")
+	}
+	if err := m.writeMessage(noticeBytes); err != nil {
+		m.logger.Warn().Err(err).Msg("failed to send close notice over websocket connection")
+		return
+	}
+	if err := m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(m.closeCode, m.closeReason), m.controlDeadline()); err != nil {
+		m.logger.Warn().Err(err).Msg("failed to send close message over websocket connection")
+		return
+	}
+	deadline := m.drainDeadline
+	if deadline.IsZero() {
+		if m.drainTimeout <= 0 {
+			return
+		}
+		deadline = time.Now().Add(m.drainTimeout)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-m.quitWrite:
+	case <-timer.C:
+		m.logger.Warn().Msg("client did not close the connection in time. force closing...")
 	}
 }
 
 // write is the go routine responsible for sending messages over the websocket connection from the ingester
 func (m *websocketConnectionManager) write() {
+	var pingC, idleC <-chan time.Time
+	if m.pingInterval > 0 {
+		pingTicker := time.NewTicker(m.pingInterval)
+		defer pingTicker.Stop()
+		pingC = pingTicker.C
+	}
+	if m.idleTimeout > 0 {
+		idleTicker := time.NewTicker(m.idleTimeout / 2)
+		defer idleTicker.Stop()
+		idleC = idleTicker.C
+	}
 loop:
 	for {
 		select {
-		case msg, ok := <-m.recv:
-			if !ok {
-				m.logger.Warn().Msg("receive from websocket handler channel unexpectedly closed. closing connection...")
-				if err := m.conn.Close(); err != nil {
-					m.logger.Error().Err(err).Msg("failed to safely close websocket connection")
-				}
-				m.quitSignalToServer <- m.id // if you quit without being told, you must notify
+		case <-m.queue.ready:
+			msg, ok, closed := m.queue.pop()
+			if closed {
+				m.logger.Warn().Msg("outbound queue from websocket handler unexpectedly closed. closing connection...")
+				m.closeAndNotify()
 				return
+			} else if !ok {
+				continue loop
 			}
 			if msg.ConnectionId != m.id {
 				m.logger.Warn().Msg("received message destined for a different connection manager. ignoring...")
 				continue loop
 			}
 			m.logger.Debug().Msgf("sending to client: %v", string(msg.Data))
-			if err := m.conn.WriteMessage(websocket.TextMessage, msg.Data); err != nil {
+			if err := m.writeMessage(msg.Data); err != nil {
 				m.logger.Error().Err(err).Msg("failed to send message over websocket connection. closing connection...")
-				if err := m.conn.Close(); err != nil {
-					m.logger.Error().Err(err).Msg("failed to safely close websocket connection")
-				}
-				m.quitSignalToServer <- m.id // if you quit without being told, you must notify
+				m.closeAndNotify()
 				return
 			}
 			m.logger.Debug().Msg("message sent to client successfully")
+			if err := m.notifyDropped(); err != nil {
+				m.logger.Error().Err(err).Msg("failed to send message over websocket connection. closing connection...")
+				m.closeAndNotify()
+				return
+			}
+		case <-pingC:
+			if err := m.conn.WriteControl(websocket.PingMessage, nil, m.controlDeadline()); err != nil {
+				m.logger.Error().Err(err).Msg("failed to send ping over websocket connection. closing connection...")
+				m.closeAndNotify()
+				return
+			}
+		case <-idleC:
+			if !m.isIdle() {
+				continue loop
+			}
+			m.logger.Info().Msgf("connection idle for more than %v without subscriptions. closing connection...", m.idleTimeout)
+			if err := m.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "idle timeout"), m.controlDeadline()); err != nil {
+				m.logger.Error().Err(err).Msg("failed to send close message over websocket connection")
+			}
+			m.closeAndNotify()
+			return
 		case <-m.quit: // if you are told to quit, no need to notify that you quit
 			m.logger.Info().Msg("exiting write routine...")
-			if err := m.conn.Close(); err != nil {
-				m.logger.Error().Err(err).Msg("failed to safely close websocket connection")
-			}
+			m.goAway()
 			return
 		case <-m.quitWrite: // if you quit without being told, you must notify
 			m.logger.Info().Msg("exiting write routine...")
-			m.quitSignalToServer <- m.id
+			m.notifyServer()
 			return
 		}
 	}
 }
 
+// notifyDropped sends a NOTICE to the client if messages were dropped from its outbound queue since the last notice
+func (m *websocketConnectionManager) notifyDropped() error {
+	dropped := m.dropped.Load()
+	if dropped == m.droppedNotified {
+		return nil
+	}
+	noticeBytes, err := nostr.NoticeEnvelope(fmt.Sprintf("warning: %v messages dropped because the connection could not keep up", dropped-m.droppedNotified)).MarshalJSON()
+	if err != nil {
+		m.logger.Fatal().Err(err).Msg("failed to JSON marshal message")
+	}
+	m.droppedNotified = dropped
+	m.logger.Warn().Msgf("%v messages dropped from outbound queue in total", dropped)
+	return m.writeMessage(noticeBytes)
+}
+
 // websocketHandler is the main handler for the initial request to connect via websockets
 func (h *WebsocketServer) websocketHandler(w http.ResponseWriter, r *http.Request) {
 	// prevent accepting new connections when shutting down
@@ -125,31 +359,88 @@ func (h *WebsocketServer) websocketHandler(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if r.Header.Get("Accept") == "application/nostr+json" {
+		h.relayInfoHandler(w, r)
+		return
+	}
+	ip := h.resolver.clientIP(r)
+	if h.isBlocked(ip) {
+		h.logger.Warn().Str("ip", ip).Msg("rejecting new connection from blocked ip address")
+		http.Error(w, blockedReason, http.StatusForbidden)
+		return
+	}
+	if err := h.acquireConn(ip); err != nil {
+		h.logger.Warn().Err(err).Str("ip", ip).Msg("rejecting new connection")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("failed to upgrade the HTTP connection to WebSocket connection")
+		h.releaseConn(ip)
 		return
 	}
+	// the websocket library replies with a 1009 close code when a message exceeds this limit
+	cfg := h.httpConfig()
+	conn.SetReadLimit(cfg.MaxMessageSize)
+	if cfg.Compression.Enabled {
+		if err := conn.SetCompressionLevel(cfg.Compression.Level); err != nil {
+			h.logger.Error().Err(err).Msg("failed to set compression level on websocket connection")
+			conn.Close()
+			h.releaseConn(ip)
+			return
+		}
+	}
 	// create a new connection manager
 	id := uuid.NewString()
-	h.logger.Info().Msgf("starting connection manager for new connection with id %s...", id)
-	recvChan := make(chan msg.Msg)
+	h.logger.Info().Str("ip", ip).Msgf("starting connection manager for new connection with id %s...", id)
+	queue := newOutboundQueue(cfg.WriteQueueSize)
 	quitChan := make(chan struct{})
-	h.connMgrChans[id] = ConnMgrChannels{Recv: recvChan, Quit: quitChan} // TODO - may need to make this map Lockable
 	connManager := newWebsocketConnectionManager(
 		id,
+		ip,
 		conn,
-		h.logger.With().Str("connMgr", id).Logger(),
+		h.logger.With().Str("connMgr", id).Str("ip", ip).Logger(),
 		h.send,
-		recvChan,
+		queue,
 		quitChan,
 		h.quitSignalFromConnMgrs,
+		cfg,
+		h.subscriptionCount,
 	)
+	connectedAt := time.Now()
+	entry := &connectionEntry{
+		chans:       ConnMgrChannels{Queue: queue, Quit: quitChan, Dropped: &connManager.dropped, Close: connManager.close},
+		remoteIP:    ip,
+		userAgent:   r.UserAgent(),
+		connectedAt: connectedAt,
+		host:        r.Host,
+		bytesIn:     &connManager.bytesIn,
+		bytesOut:    &connManager.bytesOut,
+	}
+	if cfg.Auth {
+		entry.challenge = newChallenge()
+	}
+	if !h.registry.add(id, entry) {
+		h.logger.Info().Str("ip", ip).Msgf("connection with id %s opened while shutting down, telling it to go away...", id)
+	}
+	h.accessLog.ConnectionOpened(id, ip, r.UserAgent())
+	bus.Publish(h.bus, bus.ConnectionOpened, bus.Connection{ConnectionId: id, RemoteIP: ip, UserAgent: r.UserAgent()})
+	if entry.challenge != "" {
+		authBytes, err := nostr.AuthEnvelope{Challenge: &entry.challenge}.MarshalJSON()
+		if err != nil {
+			h.logger.Fatal().Err(err).Msg("failed to JSON marshal message")
+		}
+		h.enqueue(id, entry.chans, msg.Msg{ConnectionId: id, Data: authBytes})
+	}
 	// start up the connection manager
 	h.Add(2)
 	go func() {
 		defer h.Done()
+		defer h.releaseConn(ip) // the read routine only exits once the connection is closed
 		connManager.read()
+		h.accessLog.ConnectionClosed(id, ip, time.Since(connectedAt), connManager.bytesIn.Load(), connManager.bytesOut.Load())
+		bus.Publish(h.bus, bus.ConnectionClosed, bus.Connection{ConnectionId: id, RemoteIP: ip, UserAgent: r.UserAgent()})
 	}()
 	go func() {
 		defer h.Done()
@@ -168,38 +459,38 @@ loop:
 	for {
 		select {
 		case msg, ok := <-h.recvFromIngester:
-			h.logger.Debug().Msgf("received from ingester: %v", msg)
+			h.logger.Trace().Msgf("received from ingester: %v", msg)
 			if !ok {
 				h.logger.Panic().Msg("receive from ingester channel is unexpectedely closed")
 			}
 			if msg.Unparseable {
 				// TODO - Every connectionId should get three strikes, then they're out. We should also track IP addresses and every IP address also gets three strikes. We should also track pubkeys
 			}
-			chans, ok := h.connMgrChans[msg.ConnectionId]
+			chans, ok := h.registry.channels(msg.ConnectionId)
 			if !ok {
 				h.logger.Warn().Msgf("connection manager with id %s not found in receive from ingester routine. Ignoring...", msg.ConnectionId)
 				continue loop
 			}
-			chans.Recv <- msg
+			h.enqueue(msg.ConnectionId, chans, msg)
 		case msg, ok := <-h.recvFromFilterMgr:
-			h.logger.Debug().Msgf("received from filter manager: %v", msg)
+			h.logger.Trace().Msgf("received from filter manager: %v", msg)
 			if !ok {
 				h.logger.Panic().Msg("receive from ingester channel is unexpectedely closed")
 			}
-			chans, ok := h.connMgrChans[msg.ConnectionId]
+			chans, ok := h.registry.channels(msg.ConnectionId)
 			if !ok {
 				h.logger.Warn().Msgf("connection manager with id %s not found in receive from filter manager routine. Ignoring...", msg.ConnectionId)
+				continue loop
 			}
-			chans.Recv <- msg
+			h.enqueue(msg.ConnectionId, chans, msg)
 		case connId, ok := <-h.quitSignalFromConnMgrs:
 			if !ok {
 				h.logger.Panic().Msg("quit channel for signal from connection managers unexpectedely closed")
 			}
-			if _, ok := h.connMgrChans[connId]; !ok {
+			if _, ok := h.registry.remove(connId); !ok {
 				h.logger.Warn().Msgf("received quit signal from connection manager with unknown id %s. ignoring...", connId)
 				continue loop
 			}
-			delete(h.connMgrChans, connId)
 		case <-h.quit:
 			h.logger.Info().Msg("exiting receive from ingester routine...")
 			return
@@ -207,6 +498,61 @@ loop:
 	}
 }
 
+// enqueue places a message on the outbound queue of a connection manager without blocking. When the queue is full, the configured slow consumer policy is applied. Only live events are ever dropped, a connection which can't be sent a reply is disconnected
+func (h *WebsocketServer) enqueue(connId string, chans ConnMgrChannels, message msg.Msg) {
+	if chans.Queue.push(message) {
+		return
+	}
+	switch h.httpConfig().SlowConsumerPolicy {
+	case config.SlowConsumerPolicyDropOldest:
+		// make room by dropping the oldest queued live event. A live event is dropped itself when no other one is queued
+		if chans.Queue.dropOldestLive() {
+			chans.Dropped.Add(1)
+			h.dropped.Add(1)
+			if chans.Queue.push(message) {
+				return
+			}
+		} else if message.Live {
+			chans.Dropped.Add(1)
+			h.dropped.Add(1)
+			return
+		}
+		fallthrough
+	default:
+		h.logger.Warn().Msgf("outbound queue of connection manager with id %s is full. disconnecting slow consumer...", connId)
+		chans.Dropped.Add(1)
+		h.dropped.Add(1)
+		h.registry.remove(connId)
+		chans.Close(websocket.ClosePolicyViolation, "error: connection could not keep up", time.Time{})
+	}
+}
+
+// DroppedMessages returns the total number of messages dropped from the outbound queues of all connections
+func (h *WebsocketServer) DroppedMessages() uint64 {
+	return h.dropped.Load()
+}
+
+// SetSubscriptionCountFunc stores the function used by connection managers to check how many subscriptions a connection holds
+func (h *WebsocketServer) SetSubscriptionCountFunc(subscriptionCount func(connectionId string) int) {
+	h.subscriptionCount = subscriptionCount
+	h.registry.setSubscriptionCountFunc(subscriptionCount)
+}
+
+// SetAccessLog stores the access log to which connections being opened and closed are written
+func (h *WebsocketServer) SetAccessLog(accessLog *accesslog.Logger) {
+	h.accessLog = accessLog
+}
+
+// SetBus stores the bus on which connections being opened and closed are published
+func (h *WebsocketServer) SetBus(b *bus.Bus) {
+	h.bus = b
+}
+
+// Registry returns the registry of all open connections
+func (h *WebsocketServer) Registry() *ConnectionRegistry {
+	return h.registry
+}
+
 // SendChannel is a getter function to get the websocket handlers send channel
 func (h *WebsocketServer) SendChannel() chan msg.Msg {
 	return h.send
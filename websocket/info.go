@@ -0,0 +1,66 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+var (
+	software      = "https://github.com/TheRebelOfBabylon/tandem"
+	supportedNIPs = []int{1, 2, 11, 17, 50, 56, 65, 70, 86}
+	maxSubIdLen   = 64
+)
+
+// SetInfo stores the operator supplied relay information served as the NIP-11 document
+func (s *WebsocketServer) SetInfo(info config.Info) {
+	s.Lock()
+	defer s.Unlock()
+	s.info = info
+}
+
+// AddSupportedNIPs advertises optional NIPs enabled by other modules in the relay information document
+func (s *WebsocketServer) AddSupportedNIPs(nips ...int) {
+	s.Lock()
+	defer s.Unlock()
+	s.extraNIPs = append(s.extraNIPs, nips...)
+}
+
+// relayInfoDocument builds the NIP-11 relay information document
+func (s *WebsocketServer) relayInfoDocument() nip11.RelayInformationDocument {
+	s.RLock()
+	defer s.RUnlock()
+	info := s.moderation.ApplyInfo(s.info)
+	nips := append(slices.Clone(supportedNIPs), s.extraNIPs...)
+	if s.cfg.Auth {
+		nips = append(nips, 42)
+	}
+	slices.Sort(nips)
+	return nip11.RelayInformationDocument{
+		Name:          info.Name,
+		Description:   info.Description,
+		PubKey:        info.Pubkey,
+		Contact:       info.Contact,
+		Icon:          info.Icon,
+		SupportedNIPs: nips,
+		Software:      software,
+		Limitation: &nip11.RelayLimitationDocument{
+			MaxMessageLength: int(s.cfg.MaxMessageSize),
+			MaxSubidLength:   maxSubIdLen,
+		},
+	}
+}
+
+// relayInfoHandler serves the NIP-11 relay information document
+func (s *WebsocketServer) relayInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/nostr+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	if err := json.NewEncoder(w).Encode(s.relayInfoDocument()); err != nil {
+		s.logger.Error().Err(err).Msg("failed to JSON encode relay information document")
+	}
+}
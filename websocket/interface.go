@@ -1,9 +1,32 @@
 package websocket
 
-import "github.com/TheRebelOfBabylon/tandem/msg"
+import (
+	"net/http"
+
+	"github.com/TheRebelOfBabylon/tandem/accesslog"
+	"github.com/TheRebelOfBabylon/tandem/bus"
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/nbd-wtf/go-nostr"
+)
 
 type ConnectionHandler interface {
 	Start() error
 	Stop() error
 	SendChannel() chan msg.Msg
+	SetListen(listen bool)
+	HTTPHandler() http.Handler
+	SetSubscriptionCountFunc(subscriptionCount func(connectionId string) int)
+	SetBlockedIPs(blockedIPs []string) error
+	SetInfo(info config.Info)
+	AddSupportedNIPs(nips ...int)
+	SetAccessLog(accessLog *accesslog.Logger)
+	SetBus(b *bus.Bus)
+	SetModeration(store *moderation.Store)
+	SetDeleteEventFunc(deleteEvent func(id string) error)
+	Reload(cfg *config.Config) error
+	Registry() *ConnectionRegistry
+	Authenticate(connectionId string, event nostr.Event) error
+	AuthedPubkeys(connectionId string) []string
 }
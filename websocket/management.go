@@ -0,0 +1,168 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+var (
+	ErrNotAdmin           = errors.New("pubkey is not an admin of this relay")
+	ErrIPBlockedByConfig  = errors.New("ip address is blocked by the configuration file")
+	ErrUnsupportedMethod  = errors.New("unsupported method")
+	managementContentType = "application/nostr+json+rpc"
+	supportedMethods      = []string{
+		"supportedmethods",
+		"banpubkey",
+		"listbannedpubkeys",
+		"allowpubkey",
+		"listallowedpubkeys",
+		"listeventsneedingmoderation",
+		"allowevent",
+		"banevent",
+		"listbannedevents",
+		"changerelayname",
+		"changerelaydescription",
+		"changerelayicon",
+		"allowkind",
+		"disallowkind",
+		"listallowedkinds",
+		"blockip",
+		"unblockip",
+		"listblockedips",
+	}
+)
+
+// SetModeration stores the moderation state changed through the management API
+func (s *WebsocketServer) SetModeration(store *moderation.Store) {
+	s.moderation = store
+}
+
+// SetDeleteEventFunc stores the function used to remove banned events from storage
+func (s *WebsocketServer) SetDeleteEventFunc(deleteEvent func(id string) error) {
+	s.deleteEvent = deleteEvent
+}
+
+// writeManagementResponse writes a NIP-86 response with the given status code
+func (s *WebsocketServer) writeManagementResponse(w http.ResponseWriter, statusCode int, resp nip86.Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error().Err(err).Msg("failed to JSON encode management API response")
+	}
+}
+
+// managementHandler serves the NIP-86 relay management API. Requests must carry a NIP-98 authorization signed by one of the admin pubkeys. The API doesn't exist when no admin pubkeys are configured
+func (s *WebsocketServer) managementHandler(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != managementContentType {
+		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	cfg := s.httpConfig()
+	if len(cfg.AdminPubkeys) == 0 || s.moderation == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ip := s.resolver.clientIP(r)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxMessageSize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	pubkey, err := nip98.ValidateRequest(r, body, time.Now(), s.authReplays)
+	if err == nil && !slices.Contains(cfg.AdminPubkeys, pubkey) {
+		err = ErrNotAdmin
+	}
+	if err != nil {
+		s.logger.Warn().Err(err).Str("ip", ip).Msg("unauthorized request to management API")
+		s.writeManagementResponse(w, http.StatusUnauthorized, nip86.Response{Error: err.Error()})
+		return
+	}
+	var req nip86.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.writeManagementResponse(w, http.StatusBadRequest, nip86.Response{Error: fmt.Sprintf("failed to parse request: %v", err)})
+		return
+	}
+	params, err := nip86.DecodeRequest(req)
+	if err != nil {
+		s.writeManagementResponse(w, http.StatusBadRequest, nip86.Response{Error: err.Error()})
+		return
+	}
+	logger := s.logger.With().Str("ip", ip).Str("pubkey", pubkey).Str("method", req.Method).Logger()
+	result, err := s.manage(params)
+	if err != nil {
+		logger.Error().Err(err).Msg("management API request failed")
+		s.writeManagementResponse(w, http.StatusOK, nip86.Response{Error: err.Error()})
+		return
+	}
+	logger.Info().Msgf("management API request completed: %v", req.Params)
+	s.writeManagementResponse(w, http.StatusOK, nip86.Response{Result: result})
+}
+
+// manage applies the given management API request and returns its result
+func (s *WebsocketServer) manage(params nip86.MethodParams) (any, error) {
+	var err error
+	switch p := params.(type) {
+	case nip86.SupportedMethods:
+		return supportedMethods, nil
+	case nip86.BanPubKey:
+		err = s.moderation.BanPubkey(p.PubKey, p.Reason)
+	case nip86.AllowPubKey:
+		err = s.moderation.AllowPubkey(p.PubKey, p.Reason)
+	case nip86.ListBannedPubKeys:
+		return s.moderation.BannedPubkeys(), nil
+	case nip86.ListAllowedPubKeys:
+		return s.moderation.AllowedPubkeys(), nil
+	case nip86.BanEvent:
+		if err = s.moderation.BanEvent(p.ID, p.Reason); err == nil && s.deleteEvent != nil {
+			err = s.deleteEvent(p.ID)
+		}
+	case nip86.AllowEvent:
+		err = s.moderation.AllowEvent(p.ID)
+	case nip86.ListBannedEvents:
+		return s.moderation.BannedEvents(), nil
+	case nip86.ListEventsNeedingModeration:
+		return s.moderation.EventsNeedingModeration(), nil
+	case nip86.ChangeRelayName:
+		err = s.moderation.SetRelayName(p.Name)
+	case nip86.ChangeRelayDescription:
+		err = s.moderation.SetRelayDescription(p.Description)
+	case nip86.ChangeRelayIcon:
+		err = s.moderation.SetRelayIcon(p.IconURL)
+	case nip86.AllowKind:
+		err = s.moderation.AllowKind(p.Kind)
+	case nip86.DisallowKind:
+		err = s.moderation.DisallowKind(p.Kind)
+	case nip86.ListAllowedKinds:
+		return s.moderation.AllowedKinds(), nil
+	case nip86.BlockIP:
+		if err = s.moderation.BlockIP(p.IP.String(), p.Reason); err == nil {
+			s.kickBlocked()
+		}
+	case nip86.UnblockIP:
+		s.RLock()
+		blockedByConfig := containsIP(s.blocked, p.IP.String())
+		s.RUnlock()
+		if blockedByConfig {
+			return nil, ErrIPBlockedByConfig
+		}
+		err = s.moderation.UnblockIP(p.IP.String())
+	case nip86.ListBlockedIPs:
+		return s.moderation.BlockedIPs(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, params.MethodName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return true, nil
+}
@@ -0,0 +1,233 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
+	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/TheRebelOfBabylon/tandem/storage/memory"
+	"github.com/TheRebelOfBabylon/tandem/test"
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+	"github.com/rs/zerolog"
+)
+
+type managementTestCase struct {
+	name           string
+	secretKey      string
+	contentType    string
+	method         string
+	params         []any
+	expectedStatus int
+	expectedResult string
+	expectedErr    string
+}
+
+var (
+	adminSecretKey      = "6b911fd37cdf5c81d4c0adb1ab7fa822ed253ab0ad9aa18d77257c88b29b718e"
+	otherSecretKey      = "5ee1c8000ab28edd64d74a7d951ac2dd559814887b1b9e1ac7c5f89e96125c12"
+	bannedPubkey        = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	bannedEventId       = "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+	managementTestCases = []managementTestCase{
+		{
+			name:           "MissingAuth",
+			contentType:    managementContentType,
+			method:         "supportedmethods",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "NotAdmin",
+			secretKey:      otherSecretKey,
+			contentType:    managementContentType,
+			method:         "supportedmethods",
+			expectedStatus: http.StatusUnauthorized,
+			expectedErr:    ErrNotAdmin.Error(),
+		},
+		{
+			name:           "WrongContentType",
+			secretKey:      adminSecretKey,
+			contentType:    "application/json",
+			method:         "supportedmethods",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "UnknownMethod",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "deleteeverything",
+			expectedStatus: http.StatusBadRequest,
+			expectedErr:    "unknown method 'deleteeverything'",
+		},
+		{
+			name:           "BanPubkey",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "banpubkey",
+			params:         []any{bannedPubkey, "spam"},
+			expectedStatus: http.StatusOK,
+			expectedResult: `true`,
+		},
+		{
+			name:           "ListBannedPubkeys",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "listbannedpubkeys",
+			expectedStatus: http.StatusOK,
+			expectedResult: `[{"pubkey":"` + bannedPubkey + `","reason":"spam"}]`,
+		},
+		{
+			name:           "BanEvent",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "banevent",
+			params:         []any{bannedEventId, "illegal"},
+			expectedStatus: http.StatusOK,
+			expectedResult: `true`,
+		},
+		{
+			name:           "DisallowKind",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "disallowkind",
+			params:         []any{4},
+			expectedStatus: http.StatusOK,
+			expectedResult: `true`,
+		},
+		{
+			name:           "ChangeRelayName",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "changerelayname",
+			params:         []any{"renamed"},
+			expectedStatus: http.StatusOK,
+			expectedResult: `true`,
+		},
+		{
+			name:           "UnblockIPBlockedByConfig",
+			secretKey:      adminSecretKey,
+			contentType:    managementContentType,
+			method:         "unblockip",
+			params:         []any{"10.0.0.1"},
+			expectedStatus: http.StatusOK,
+			expectedErr:    ErrIPBlockedByConfig.Error(),
+		},
+	}
+)
+
+// newManagementRequest creates a NIP-86 request, signed with a NIP-98 authorization if a secret key is given
+func newManagementRequest(t *testing.T, url, secretKey, contentType, method string, params []any) *http.Request {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(nip86.Request{Method: method, Params: params})
+	if err != nil {
+		t.Fatalf("unexpected error when marshalling request: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	if secretKey != "" {
+		header, err := nip98.CreateAuthHeader(secretKey, url, http.MethodPost, body)
+		if err != nil {
+			t.Fatalf("unexpected error when signing auth event: %v", err)
+		}
+		req.Header.Set("Authorization", header)
+	}
+	return req
+}
+
+// TestManagementAPI ensures the NIP-86 management API is only usable by admins and changes the moderation state
+func TestManagementAPI(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	adminPubkey, _ := nostr.GetPublicKey(adminSecretKey)
+	cfg := config.HTTP{
+		WriteQueueSize:     16,
+		SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+		WriteWait:          time.Second,
+		ShutdownTimeout:    time.Second,
+		MaxMessageSize:     4096,
+		AdminPubkeys:       []string{adminPubkey},
+	}
+	repo, _ := memory.NewModerationRepository("")
+	store, err := moderation.NewStore(repo, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("unexpected error when creating moderation store: %v", err)
+	}
+	wsServer := NewWebsocketServer(cfg, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	wsServer.SetModeration(store)
+	var deleted []string
+	wsServer.SetDeleteEventFunc(func(id string) error {
+		deleted = append(deleted, id)
+		return nil
+	})
+	if err := wsServer.SetBlockedIPs([]string{"10.0.0.1"}); err != nil {
+		t.Fatalf("unexpected error when setting blocked ip addresses: %v", err)
+	}
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	defer wsServer.Stop()
+	for _, testCase := range managementTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		resp, err := http.DefaultClient.Do(newManagementRequest(t, srvr.URL+"/", testCase.secretKey, testCase.contentType, testCase.method, testCase.params))
+		if err != nil {
+			t.Fatalf("unexpected error for test case %s: %v", testCase.name, err)
+		}
+		if resp.StatusCode != testCase.expectedStatus {
+			t.Errorf("unexpected status code for test case %s: expected %v, got %v", testCase.name, testCase.expectedStatus, resp.StatusCode)
+		}
+		var result nip86.Response
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if testCase.expectedErr != "" && !strings.Contains(result.Error, testCase.expectedErr) {
+			t.Errorf("unexpected error for test case %s: expected %q, got %q", testCase.name, testCase.expectedErr, result.Error)
+		}
+		if testCase.expectedResult != "" {
+			resultBytes, _ := json.Marshal(result.Result)
+			if string(resultBytes) != testCase.expectedResult {
+				t.Errorf("unexpected result for test case %s: expected %s, got %s", testCase.name, testCase.expectedResult, resultBytes)
+			}
+		}
+	}
+	// the moderation state is enforced and banned events are deleted
+	if reason := store.Check(nostr.Event{PubKey: bannedPubkey, Kind: 1}, moderation.Allowlists{}); reason != "blocked: pubkey is banned" {
+		t.Errorf("unexpected reason for banned pubkey: %q", reason)
+	}
+	if reason := store.Check(nostr.Event{Kind: 4}, moderation.Allowlists{}); reason != "blocked: kind 4 is not accepted by this relay" {
+		t.Errorf("unexpected reason for disallowed kind: %q", reason)
+	}
+	if len(deleted) != 1 || deleted[0] != bannedEventId {
+		t.Errorf("unexpected deleted events: %v", deleted)
+	}
+	if name := wsServer.relayInfoDocument().Name; name != "renamed" {
+		t.Errorf("unexpected relay name: expected renamed, got %s", name)
+	}
+	// blocking the ip address of an open connection disconnects it
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvr.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to initialize websocket client: %v", err)
+	}
+	defer client.Close()
+	resp, err := http.DefaultClient.Do(newManagementRequest(t, srvr.URL+"/", adminSecretKey, managementContentType, "blockip", []any{"127.0.0.1", "abuse"}))
+	if err != nil {
+		t.Fatalf("unexpected error when blocking ip address: %v", err)
+	}
+	resp.Body.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, notice, err := client.ReadMessage(); err != nil || !bytes.Equal(notice, test.NoticeBytes(nostr.NoticeEnvelope(blockedReason))) {
+		t.Errorf("unexpected message after blocking ip address: %s, %v", notice, err)
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"sync"
+
+	"github.com/TheRebelOfBabylon/tandem/msg"
+)
+
+// outboundQueue is the bounded queue of messages waiting to be written to a connection. Unlike a channel, it lets the oldest live events be dropped while every other message stays queued in order
+type outboundQueue struct {
+	messages []msg.Msg
+	size     int
+	closed   bool
+	// ready holds a value while messages are queued or once the queue is closed
+	ready chan struct{}
+	sync.Mutex
+}
+
+// newOutboundQueue instantiates an outbound queue holding up to size messages
+func newOutboundQueue(size int) *outboundQueue {
+	return &outboundQueue{size: size, ready: make(chan struct{}, 1)}
+}
+
+// signal wakes up the connection manager waiting on the queue. It must be called with the lock held
+func (q *outboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push appends a message to the queue, it returns false when the queue is full
+func (q *outboundQueue) push(message msg.Msg) bool {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.messages) >= q.size {
+		return false
+	}
+	q.messages = append(q.messages, message)
+	q.signal()
+	return true
+}
+
+// dropOldestLive removes the oldest live event from the queue, it returns false when none is queued
+func (q *outboundQueue) dropOldestLive() bool {
+	q.Lock()
+	defer q.Unlock()
+	for i, message := range q.messages {
+		if message.Live {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pop removes the oldest message from the queue. ok is false when the queue is empty, closed is true once it is also closed
+func (q *outboundQueue) pop() (message msg.Msg, ok, closed bool) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.messages) == 0 {
+		return msg.Msg{}, false, q.closed
+	}
+	message = q.messages[0]
+	q.messages[0] = msg.Msg{}
+	q.messages = q.messages[1:]
+	if len(q.messages) > 0 {
+		q.signal()
+	}
+	return message, true, false
+}
+
+// len returns the number of queued messages
+func (q *outboundQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.messages)
+}
+
+// close wakes up the connection manager, which closes the connection once the queued messages are written
+func (q *outboundQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	q.closed = true
+	q.signal()
+}
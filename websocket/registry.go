@@ -0,0 +1,241 @@
+package websocket
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not found")
+)
+
+// ConnectionInfo is a snapshot of the metadata of a single client connection
+type ConnectionInfo struct {
+	Id                string    `json:"id"`
+	RemoteIP          string    `json:"remote_ip"`
+	UserAgent         string    `json:"user_agent"`
+	ConnectedAt       time.Time `json:"connected_at"`
+	AuthedPubkeys     []string  `json:"authed_pubkeys"`
+	SubscriptionCount int       `json:"subscription_count"`
+	BytesIn           uint64    `json:"bytes_in"`
+	BytesOut          uint64    `json:"bytes_out"`
+	DroppedMessages   uint64    `json:"dropped_messages"`
+}
+
+type connectionEntry struct {
+	chans         ConnMgrChannels
+	remoteIP      string
+	userAgent     string
+	connectedAt   time.Time
+	authedPubkeys []string
+	challenge     string
+	host          string
+	bytesIn       *atomic.Uint64
+	bytesOut      *atomic.Uint64
+}
+
+type ConnectionRegistry struct {
+	entries           map[string]*connectionEntry
+	subscriptionCount func(connectionId string) int
+	closed            bool
+	closeDeadline     time.Time
+	sync.RWMutex
+}
+
+// NewConnectionRegistry instantiates a new connection registry
+func NewConnectionRegistry() *ConnectionRegistry {
+	return &ConnectionRegistry{
+		entries: make(map[string]*connectionEntry),
+	}
+}
+
+// add registers a new connection. Once the registry is closed the connection is told to go away instead, since the server is shutting down
+func (r *ConnectionRegistry) add(id string, entry *connectionEntry) bool {
+	r.Lock()
+	if r.closed {
+		deadline := r.closeDeadline
+		r.Unlock()
+		entry.chans.Close(websocket.CloseGoingAway, goingAwayReason, deadline)
+		return false
+	}
+	defer r.Unlock()
+	r.entries[id] = entry
+	return true
+}
+
+// remove unregisters a connection and returns its channels if it was registered
+func (r *ConnectionRegistry) remove(id string) (ConnMgrChannels, bool) {
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return ConnMgrChannels{}, false
+	}
+	delete(r.entries, id)
+	return entry.chans, true
+}
+
+// closeAll unregisters every connection and returns their channels. Connections added afterwards are told to go away with the given drain deadline
+func (r *ConnectionRegistry) closeAll(deadline time.Time) []ConnMgrChannels {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+	r.closeDeadline = deadline
+	chans := make([]ConnMgrChannels, 0, len(r.entries))
+	for id, entry := range r.entries {
+		chans = append(chans, entry.chans)
+		delete(r.entries, id)
+	}
+	return chans
+}
+
+// channels returns the channels of a registered connection
+func (r *ConnectionRegistry) channels(id string) (ConnMgrChannels, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return ConnMgrChannels{}, false
+	}
+	return entry.chans, true
+}
+
+// setSubscriptionCountFunc stores the function used to report how many subscriptions a connection holds
+func (r *ConnectionRegistry) setSubscriptionCountFunc(subscriptionCount func(connectionId string) int) {
+	r.Lock()
+	defer r.Unlock()
+	r.subscriptionCount = subscriptionCount
+}
+
+// info builds a snapshot of the given entry without its subscription count. The caller must hold the read lock
+func (r *ConnectionRegistry) info(id string, entry *connectionEntry) ConnectionInfo {
+	info := ConnectionInfo{
+		Id:            id,
+		RemoteIP:      entry.remoteIP,
+		UserAgent:     entry.userAgent,
+		ConnectedAt:   entry.connectedAt,
+		AuthedPubkeys: slices.Clone(entry.authedPubkeys),
+	}
+	if entry.bytesIn != nil {
+		info.BytesIn = entry.bytesIn.Load()
+	}
+	if entry.bytesOut != nil {
+		info.BytesOut = entry.bytesOut.Load()
+	}
+	if entry.chans.Dropped != nil {
+		info.DroppedMessages = entry.chans.Dropped.Load()
+	}
+	return info
+}
+
+// countSubscriptions fills in the subscription counts of the snapshots. It must be called without holding the lock since the filter manager takes its own lock, which it holds while looking up authenticated pubkeys here
+func (r *ConnectionRegistry) countSubscriptions(infos []ConnectionInfo) {
+	r.RLock()
+	subscriptionCount := r.subscriptionCount
+	r.RUnlock()
+	if subscriptionCount == nil {
+		return
+	}
+	for i := range infos {
+		infos[i].SubscriptionCount = subscriptionCount(infos[i].Id)
+	}
+}
+
+// Len returns the number of registered connections
+func (r *ConnectionRegistry) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.entries)
+}
+
+// Get returns the metadata of a single connection
+func (r *ConnectionRegistry) Get(id string) (ConnectionInfo, bool) {
+	r.RLock()
+	entry, ok := r.entries[id]
+	if !ok {
+		r.RUnlock()
+		return ConnectionInfo{}, false
+	}
+	infos := []ConnectionInfo{r.info(id, entry)}
+	r.RUnlock()
+	r.countSubscriptions(infos)
+	return infos[0], true
+}
+
+// List returns the metadata of all connections, oldest first
+func (r *ConnectionRegistry) List() []ConnectionInfo {
+	r.RLock()
+	infos := make([]ConnectionInfo, 0, len(r.entries))
+	for id, entry := range r.entries {
+		infos = append(infos, r.info(id, entry))
+	}
+	r.RUnlock()
+	r.countSubscriptions(infos)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	return infos
+}
+
+// AddAuthedPubkey records that the given connection authenticated as the given pubkey
+func (r *ConnectionRegistry) AddAuthedPubkey(id, pubkey string) error {
+	r.Lock()
+	defer r.Unlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	if !slices.Contains(entry.authedPubkeys, pubkey) {
+		entry.authedPubkeys = append(entry.authedPubkeys, pubkey)
+	}
+	return nil
+}
+
+// AuthedPubkey returns the first pubkey the given connection authenticated as, if any
+func (r *ConnectionRegistry) AuthedPubkey(id string) string {
+	r.RLock()
+	defer r.RUnlock()
+	entry, ok := r.entries[id]
+	if !ok || len(entry.authedPubkeys) == 0 {
+		return ""
+	}
+	return entry.authedPubkeys[0]
+}
+
+// AuthedPubkeys returns every pubkey the given connection authenticated as
+func (r *ConnectionRegistry) AuthedPubkeys(id string) []string {
+	r.RLock()
+	defer r.RUnlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(entry.authedPubkeys)
+}
+
+// authChallenge returns the NIP-42 challenge sent on the given connection and the host the client connected to
+func (r *ConnectionRegistry) authChallenge(id string) (string, string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	entry, ok := r.entries[id]
+	if !ok {
+		return "", "", false
+	}
+	return entry.challenge, entry.host, true
+}
+
+// Kick disconnects the given connection, sending the client the given reason first
+func (r *ConnectionRegistry) Kick(id, reason string) error {
+	chans, ok := r.remove(id)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	chans.Close(websocket.ClosePolicyViolation, reason, time.Time{})
+	return nil
+}
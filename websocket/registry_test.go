@@ -0,0 +1,266 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/TheRebelOfBabylon/tandem/test"
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/rs/zerolog"
+)
+
+// TestConnectionRegistry ensures connection metadata can be registered, queried and kicked
+func TestConnectionRegistry(t *testing.T) {
+	registry := NewConnectionRegistry()
+	registry.setSubscriptionCountFunc(func(connectionId string) int {
+		if connectionId == connIdOne {
+			return 3
+		}
+		return 0
+	})
+	var (
+		bytesIn, bytesOut, dropped atomic.Uint64
+		closedCode                 int
+		closedReason               string
+	)
+	bytesIn.Store(10)
+	bytesOut.Store(20)
+	dropped.Store(1)
+	now := time.Now()
+	registry.add(connIdOne, &connectionEntry{
+		chans:       ConnMgrChannels{Dropped: &dropped, Close: func(code int, reason string, _ time.Time) { closedCode, closedReason = code, reason }},
+		remoteIP:    "198.51.100.1",
+		userAgent:   "test-agent",
+		connectedAt: now,
+		bytesIn:     &bytesIn,
+		bytesOut:    &bytesOut,
+	})
+	registry.add(connIdTwo, &connectionEntry{chans: ConnMgrChannels{Close: func(int, string, time.Time) {}}, connectedAt: now.Add(time.Second)})
+	if registry.Len() != 2 {
+		t.Fatalf("unexpected number of connections: expected 2, got %v", registry.Len())
+	}
+	if err := registry.AddAuthedPubkey(connIdOne, "pubkey"); err != nil {
+		t.Errorf("unexpected error when adding authed pubkey: %v", err)
+	}
+	// adding the same pubkey twice is a no-op
+	registry.AddAuthedPubkey(connIdOne, "pubkey")
+	if err := registry.AddAuthedPubkey("unknown", "pubkey"); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("unexpected error when adding authed pubkey to unknown connection: %v", err)
+	}
+	info, ok := registry.Get(connIdOne)
+	if !ok {
+		t.Fatal("expected connection to be registered")
+	}
+	expected := ConnectionInfo{
+		Id:                connIdOne,
+		RemoteIP:          "198.51.100.1",
+		UserAgent:         "test-agent",
+		ConnectedAt:       now,
+		AuthedPubkeys:     []string{"pubkey"},
+		SubscriptionCount: 3,
+		BytesIn:           10,
+		BytesOut:          20,
+		DroppedMessages:   1,
+	}
+	if b, _ := json.Marshal(info); !bytes.Equal(b, func() []byte { b, _ := json.Marshal(expected); return b }()) {
+		t.Errorf("unexpected connection info: expected %+v, got %+v", expected, info)
+	}
+	list := registry.List()
+	if len(list) != 2 || list[0].Id != connIdOne || list[1].Id != connIdTwo {
+		t.Errorf("unexpected connection list: %+v", list)
+	}
+	if err := registry.Kick(connIdOne, "bye"); err != nil {
+		t.Errorf("unexpected error when kicking connection: %v", err)
+	}
+	if closedCode != websocket.ClosePolicyViolation || closedReason != "bye" {
+		t.Errorf("unexpected close: code %v, reason %s", closedCode, closedReason)
+	}
+	if err := registry.Kick(connIdOne, "bye"); !errors.Is(err, ErrConnectionNotFound) {
+		t.Errorf("unexpected error when kicking unknown connection: %v", err)
+	}
+	if registry.Len() != 1 {
+		t.Errorf("unexpected number of connections: expected 1, got %v", registry.Len())
+	}
+}
+
+// TestConnectionRegistrySubscriptionCountUnlocked ensures subscriptions are counted without holding the registry lock, since the filter manager looks up authenticated pubkeys while holding its own lock
+func TestConnectionRegistrySubscriptionCountUnlocked(t *testing.T) {
+	registry := NewConnectionRegistry()
+	registry.add(connIdOne, &connectionEntry{chans: ConnMgrChannels{Close: func(int, string, time.Time) {}}})
+	// taking the write lock from the count deadlocks if the registry still holds its read lock
+	registry.setSubscriptionCountFunc(func(connectionId string) int {
+		registry.AddAuthedPubkey(connectionId, "pubkey")
+		return 1
+	})
+	done := make(chan []ConnectionInfo)
+	go func() { done <- registry.List() }()
+	select {
+	case list := <-done:
+		if len(list) != 1 || list[0].SubscriptionCount != 1 {
+			t.Errorf("unexpected connection list: %+v", list)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out listing connections, the registry lock is held while counting subscriptions")
+	}
+	if info, ok := registry.Get(connIdOne); !ok || info.SubscriptionCount != 1 {
+		t.Errorf("unexpected connection info: %+v", info)
+	}
+}
+
+type adminEndpointTestCase struct {
+	name           string
+	method         string
+	path           string
+	token          string
+	secretKey      string
+	expectedStatus int
+}
+
+var adminEndpointTestCases = []adminEndpointTestCase{
+	{
+		name:           "ListConnections_MissingToken",
+		method:         http.MethodGet,
+		path:           "/admin/connections",
+		expectedStatus: http.StatusUnauthorized,
+	},
+	{
+		name:           "ListConnections_WrongToken",
+		method:         http.MethodGet,
+		path:           "/admin/connections",
+		token:          "wrong",
+		expectedStatus: http.StatusUnauthorized,
+	},
+	{
+		name:           "ListConnections_Success",
+		method:         http.MethodGet,
+		path:           "/admin/connections",
+		token:          "secret",
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:           "ListConnections_AdminPubkey",
+		method:         http.MethodGet,
+		path:           "/admin/connections",
+		secretKey:      adminSecretKey,
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:           "ListConnections_NotAdminPubkey",
+		method:         http.MethodGet,
+		path:           "/admin/connections",
+		secretKey:      otherSecretKey,
+		expectedStatus: http.StatusUnauthorized,
+	},
+	{
+		name:           "Stats_Success",
+		method:         http.MethodGet,
+		path:           "/admin/stats",
+		token:          "secret",
+		expectedStatus: http.StatusOK,
+	},
+	{
+		name:           "KickConnection_NotFound",
+		method:         http.MethodDelete,
+		path:           "/admin/connections/unknown",
+		token:          "secret",
+		expectedStatus: http.StatusNotFound,
+	},
+}
+
+// TestAdminEndpoints ensures the admin endpoints are protected by the admin token and expose the connection registry
+func TestAdminEndpoints(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	adminPubkey, _ := nostr.GetPublicKey(adminSecretKey)
+	cfg := config.HTTP{
+		WriteQueueSize:     16,
+		SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+		WriteWait:          time.Second,
+		ShutdownTimeout:    time.Second,
+		AdminToken:         "secret",
+		AdminPubkeys:       []string{adminPubkey},
+	}
+	wsServer := NewWebsocketServer(cfg, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	defer wsServer.Stop()
+	for _, testCase := range adminEndpointTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		req, _ := http.NewRequest(testCase.method, srvr.URL+testCase.path, nil)
+		if testCase.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testCase.token)
+		}
+		if testCase.secretKey != "" {
+			header, err := nip98.CreateAuthHeader(testCase.secretKey, srvr.URL+testCase.path, testCase.method, nil)
+			if err != nil {
+				t.Fatalf("unexpected error when signing auth event for test case %s: %v", testCase.name, err)
+			}
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error for test case %s: %v", testCase.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != testCase.expectedStatus {
+			t.Errorf("unexpected status code for test case %s: expected %v, got %v", testCase.name, testCase.expectedStatus, resp.StatusCode)
+		}
+	}
+	// connect a client, list it and kick it
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvr.URL, "http"), http.Header{"User-Agent": []string{"test-agent"}})
+	if err != nil {
+		t.Fatalf("failed to initialize websocket client: %v", err)
+	}
+	defer client.Close()
+	req, _ := http.NewRequest(http.MethodGet, srvr.URL+"/admin/connections", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error when listing connections: %v", err)
+	}
+	var infos []ConnectionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		t.Fatalf("unexpected error when decoding connections: %v", err)
+	}
+	resp.Body.Close()
+	if len(infos) != 1 || infos[0].UserAgent != "test-agent" || infos[0].RemoteIP != "127.0.0.1" {
+		t.Fatalf("unexpected connections: %+v", infos)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, srvr.URL+"/admin/connections/"+infos[0].Id, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error when kicking connection: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status code when kicking connection: expected %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, notice, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error when reading from websocket connection: %v", err)
+	}
+	if !bytes.Equal(notice, test.NoticeBytes(nostr.NoticeEnvelope(kickReason))) {
+		t.Errorf("unexpected notice: expected %s, got %s", test.NoticeBytes(nostr.NoticeEnvelope(kickReason)), notice)
+	}
+	if _, _, err = client.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("unexpected error when reading from websocket connection: expected close code %v, got %v", websocket.ClosePolicyViolation, err)
+	}
+}
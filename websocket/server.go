@@ -2,16 +2,33 @@ package websocket
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/TheRebelOfBabylon/tandem/accesslog"
+	"github.com/TheRebelOfBabylon/tandem/bus"
 	"github.com/TheRebelOfBabylon/tandem/config"
+	"github.com/TheRebelOfBabylon/tandem/moderation"
 	"github.com/TheRebelOfBabylon/tandem/msg"
+	"github.com/TheRebelOfBabylon/tandem/nip98"
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog"
 )
 
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsForIP = errors.New("too many connections from this ip address")
+	ErrShuttingDown            = errors.New("relay is shutting down")
+	goingAwayReason            = "relay is shutting down"
+	blockedReason              = "blocked: ip address is blocked"
+)
+
 type WebsocketServer struct {
 	http.Server
 	logger                 zerolog.Logger
@@ -19,9 +36,27 @@ type WebsocketServer struct {
 	recvFromFilterMgr      chan msg.Msg
 	send                   chan msg.Msg
 	quit                   chan struct{}
-	connMgrChans           map[string]ConnMgrChannels
+	registry               *ConnectionRegistry
 	closing                bool
 	quitSignalFromConnMgrs chan string
+	cfg                    config.HTTP
+	upgrader               *websocket.Upgrader
+	subscriptionCount      func(connectionId string) int
+	dropped                atomic.Uint64
+	startedAt              time.Time
+	redirectServer         *http.Server
+	resolver               *proxyResolver
+	authReplays            *nip98.ReplayCache
+	blocked                []*net.IPNet
+	info                   config.Info
+	extraNIPs              []int
+	accessLog              *accesslog.Logger
+	bus                    *bus.Bus
+	moderation             *moderation.Store
+	deleteEvent            func(id string) error
+	connCount              int
+	listen                 bool
+	ipConnCount            map[string]int
 	sync.WaitGroup
 	sync.RWMutex
 }
@@ -37,22 +72,67 @@ func NewWebsocketServer(cfg config.HTTP, logger zerolog.Logger, recvFromIngester
 		recvFromFilterMgr:      recvFromFilterMgr,
 		send:                   make(chan msg.Msg),
 		quit:                   make(chan struct{}),
-		connMgrChans:           make(map[string]ConnMgrChannels),
+		registry:               NewConnectionRegistry(),
+		ipConnCount:            make(map[string]int),
 		quitSignalFromConnMgrs: make(chan string),
+		cfg:                    cfg,
+		upgrader:               newUpgrader(cfg),
+		authReplays:            nip98.NewReplayCache(),
 		closing:                false,
+		listen:                 true,
 	}
-	s.Server.Handler = http.HandlerFunc(s.websocketHandler)
+	resolver, err := newProxyResolver(cfg.TrustedProxies)
+	if err != nil {
+		// the config is validated beforehand so this should never happen. Trust no one if it does
+		logger.Error().Err(err).Msg("failed to parse trusted proxies")
+		resolver = &proxyResolver{}
+	}
+	s.resolver = resolver
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.websocketHandler)
+	mux.HandleFunc("POST /", s.managementHandler)
+	mux.HandleFunc("GET /admin/connections", s.requireAdmin(s.listConnectionsHandler))
+	mux.HandleFunc("DELETE /admin/connections/{id}", s.requireAdmin(s.kickConnectionHandler))
+	mux.HandleFunc("GET /admin/stats", s.requireAdmin(s.statsHandler))
+	s.Server.Handler = mux
 	return s
 }
 
 // Start starts the HTTP server to receive websocket connections
 func (s *WebsocketServer) Start() error {
 	s.logger.Info().Msg("starting up...")
+	s.startedAt = time.Now()
+	if !s.listen {
+		s.Add(1)
+		go s.recv()
+		s.logger.Info().Msg("start up completed, serving connections through the mounted handler")
+		return nil
+	}
+	cfg := s.httpConfig()
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if cfg.ProxyProtocol {
+		listener = &proxyListener{Listener: listener, resolver: s.resolver, logger: s.logger}
+	}
+	if cfg.TLS.Enabled() {
+		if err := s.setupTLS(cfg); err != nil {
+			listener.Close()
+			return err
+		}
+	}
 	s.Add(2)
 	go func() {
 		defer s.Done()
-		s.logger.Info().Msgf("listening for incoming connections on %s...", s.Addr)
-		err := s.ListenAndServe()
+		var err error
+		if s.TLSConfig != nil {
+			s.logger.Info().Msgf("listening for incoming TLS connections on %s...", s.Addr)
+			err = s.ServeTLS(listener, "", "") // certificates are provided by the TLS config
+		} else {
+			s.logger.Info().Msgf("listening for incoming connections on %s...", s.Addr)
+			err = s.Serve(listener)
+		}
 		if errors.Is(err, http.ErrServerClosed) {
 			s.logger.Info().Msg("HTTP server safely shutdown")
 		} else if err != nil {
@@ -64,6 +144,137 @@ func (s *WebsocketServer) Start() error {
 	return nil
 }
 
+// setupTLS loads the configured certificate, starts watching it for changes and starts the optional plaintext redirect server
+func (s *WebsocketServer) setupTLS(cfg config.HTTP) error {
+	reloader, err := newCertReloader(cfg.TLS.CertPath, cfg.TLS.KeyPath, s.logger)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.TLS.ReloadInterval > 0 {
+		s.Add(1)
+		go func() {
+			defer s.Done()
+			reloader.watch(cfg.TLS.ReloadInterval, s.quit)
+		}()
+	}
+	if cfg.TLS.RedirectPort != 0 {
+		s.redirectServer = &http.Server{
+			Addr:    fmt.Sprintf("%s:%v", cfg.Host, cfg.TLS.RedirectPort),
+			Handler: redirectHandler(cfg.Port),
+		}
+		s.Add(1)
+		go func() {
+			defer s.Done()
+			s.logger.Info().Msgf("redirecting plaintext connections on %s...", s.redirectServer.Addr)
+			err := s.redirectServer.ListenAndServe()
+			if errors.Is(err, http.ErrServerClosed) {
+				s.logger.Info().Msg("HTTP redirect server safely shutdown")
+			} else if err != nil {
+				s.logger.Error().Err(err).Msg("failed to safely shutdown HTTP redirect server")
+			}
+		}()
+	}
+	return nil
+}
+
+// acquireConn reserves a connection slot for the given ip address if the global and per ip connection limits allow it. Slots count as running routines of the server, they are reserved under the same lock as the closing flag so Stop only waits once none can be reserved anymore
+func (s *WebsocketServer) acquireConn(ip string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closing {
+		return ErrShuttingDown
+	}
+	if s.cfg.MaxConnections > 0 && s.connCount >= s.cfg.MaxConnections {
+		return ErrTooManyConnections
+	}
+	if s.cfg.MaxConnectionsPerIP > 0 && s.ipConnCount[ip] >= s.cfg.MaxConnectionsPerIP {
+		return ErrTooManyConnectionsForIP
+	}
+	s.connCount++
+	s.ipConnCount[ip]++
+	s.Add(1)
+	return nil
+}
+
+// releaseConn frees the connection slot held by the given ip address
+func (s *WebsocketServer) releaseConn(ip string) {
+	s.Lock()
+	defer s.Unlock()
+	s.connCount--
+	s.ipConnCount[ip]--
+	if s.ipConnCount[ip] <= 0 {
+		delete(s.ipConnCount, ip)
+	}
+	s.Done()
+}
+
+// httpConfig returns the current HTTP configuration, which can change when the configuration is reloaded
+func (s *WebsocketServer) httpConfig() config.HTTP {
+	s.RLock()
+	defer s.RUnlock()
+	return s.cfg
+}
+
+// SetBlockedIPs replaces the list of blocked ip addresses and disconnects any open connection from a newly blocked address
+func (s *WebsocketServer) SetBlockedIPs(blockedIPs []string) error {
+	blocked, err := parseIPNets(blockedIPs)
+	if err != nil {
+		return fmt.Errorf("invalid blocked ip: %w", err)
+	}
+	s.Lock()
+	s.blocked = blocked
+	s.Unlock()
+	s.kickBlocked()
+	return nil
+}
+
+// kickBlocked disconnects any open connection from a blocked ip address
+func (s *WebsocketServer) kickBlocked() {
+	for _, info := range s.registry.List() {
+		if s.isBlocked(info.RemoteIP) {
+			s.logger.Info().Str("ip", info.RemoteIP).Msgf("disconnecting connection with id %s from blocked ip address...", info.Id)
+			s.registry.Kick(info.Id, blockedReason)
+		}
+	}
+}
+
+// isBlocked checks if the given ip address is blocked by the configuration or through the management API
+func (s *WebsocketServer) isBlocked(ip string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return containsIP(s.blocked, ip) || s.moderation.IsBlocked(ip)
+}
+
+// SetListen sets whether Start listens for connections on the configured host and port. When it doesn't, connections are only served through the handler returned by HTTPHandler, mounted by an embedding service. TLS, the redirect server and the PROXY protocol are then left to that service
+func (s *WebsocketServer) SetListen(listen bool) {
+	s.listen = listen
+}
+
+// HTTPHandler returns the handler serving websocket connections, the NIP-11 document and the management API
+func (s *WebsocketServer) HTTPHandler() http.Handler {
+	return s.Server.Handler
+}
+
+// Reload applies the reloadable settings of the given configuration. New values apply to connections opened afterwards, except for blocked ip addresses which are enforced immediately
+func (s *WebsocketServer) Reload(cfg *config.Config) error {
+	if err := s.resolver.update(cfg.HTTP.TrustedProxies); err != nil {
+		return err
+	}
+	if err := s.SetBlockedIPs(cfg.Policy.BlockedIPs); err != nil {
+		return err
+	}
+	s.SetInfo(cfg.Info)
+	s.Lock()
+	s.cfg = cfg.HTTP
+	s.Unlock()
+	s.logger.Info().Msg("configuration reloaded")
+	return nil
+}
+
 // toggleClosing will toggle the closing boolean
 func (s *WebsocketServer) toggleClosing(state bool) {
 	s.Lock()
@@ -77,15 +288,33 @@ func (s *WebsocketServer) isClosing() bool {
 	return s.closing
 }
 
-// Stop safely shuts down the HTTP server
+// Stop safely shuts down the HTTP server. Clients are sent a NOTICE and a going away close frame and are force closed if they haven't disconnected when the shutdown timeout, which also bounds the HTTP server shutdown, runs out
 func (s *WebsocketServer) Stop() error {
 	s.logger.Info().Msg("shutting down...")
 	s.toggleClosing(true)
-	s.Shutdown(context.TODO())
+	shutdownTimeout := s.httpConfig().ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if shutdownTimeout <= 0 {
+		ctx = context.Background()
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		s.logger.Warn().Err(err).Msg("failed to gracefully shutdown HTTP server. force closing...")
+		s.Close()
+	}
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			s.logger.Warn().Err(err).Msg("failed to gracefully shutdown HTTP redirect server. force closing...")
+			s.redirectServer.Close()
+		}
+	}
 	close(s.quit)
-	for _, chans := range s.connMgrChans {
-		close(chans.Quit)
-		close(chans.Recv)
+	// clients are given what is left of the shutdown timeout to disconnect
+	deadline, _ := ctx.Deadline()
+	connections := s.registry.closeAll(deadline)
+	s.logger.Info().Msgf("draining %v connections...", len(connections))
+	for _, chans := range connections {
+		chans.Close(websocket.CloseGoingAway, goingAwayReason, deadline)
 	}
 	s.Wait()
 	close(s.send)
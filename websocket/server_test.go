@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -18,13 +21,15 @@ import (
 	"github.com/TheRebelOfBabylon/tandem/test"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/rs/zerolog"
 )
 
 type wsConnMgrTestCase struct {
 	name         string
 	connId       string
-	testSequence func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string)
+	testSequence func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string)
 }
 
 var (
@@ -41,7 +46,7 @@ var (
 		{
 			name:   "Read_CloseViaQuitChan",
 			connId: connIdOne,
-			testSequence: func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
+			testSequence: func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
 				// send message
 				t.Log("sending message over websocket connection...")
 				m := randMsg()
@@ -71,7 +76,7 @@ var (
 				if err := clientConn.Close(); err != nil {
 					t.Fatalf("unexpected error when shutting down websocket client: %v", err)
 				}
-				close(recvChan)
+				queue.close()
 				close(sendChan)
 				close(quitSignalToServer)
 			},
@@ -79,7 +84,7 @@ var (
 		{
 			name:   "Read_CloseViaWebsocketConnection",
 			connId: connIdTwo,
-			testSequence: func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
+			testSequence: func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
 				t.Log("shutting down websocket connection manager and websocket connection...")
 				if err := clientConn.Close(); err != nil {
 					t.Fatalf("unexpected error when shutting down websocket client: %v", err)
@@ -98,7 +103,7 @@ var (
 				if recvConnId != connIdTwo {
 					t.Errorf("received an unexpected connection id from websocket connection manager: expected %s, got %s", connIdTwo, recvConnId)
 				}
-				close(recvChan)
+				queue.close()
 				close(sendChan)
 				close(quitSignalToServer)
 			},
@@ -106,9 +111,9 @@ var (
 		{
 			name:   "Write_ValidConnId",
 			connId: connIdOne,
-			testSequence: func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
+			testSequence: func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
 				randMessage := randMsg()
-				recvChan <- msg.Msg{ConnectionId: connIdOne, Data: randMessage}
+				queue.push(msg.Msg{ConnectionId: connIdOne, Data: randMessage})
 				// wait for it on the client side
 				_, m, err := clientConn.ReadMessage()
 				if err != nil {
@@ -136,7 +141,7 @@ var (
 				if recvConnId != connIdOne {
 					t.Errorf("received an unexpected connection id from websocket connection manager: expected %s, got %s", connIdOne, recvConnId)
 				}
-				close(recvChan)
+				queue.close()
 				close(sendChan)
 				close(quitSignalToServer)
 			},
@@ -144,9 +149,9 @@ var (
 		{
 			name:   "Write_InvalidConnId",
 			connId: connIdOne,
-			testSequence: func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
+			testSequence: func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
 				randMessage := randMsg()
-				recvChan <- msg.Msg{ConnectionId: connIdTwo, Data: randMessage}
+				queue.push(msg.Msg{ConnectionId: connIdTwo, Data: randMessage})
 				// wait for it on the client side
 				if err := clientConn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
 					t.Fatalf("unexpected error when setting read deadline on client websocket connection: %v", err)
@@ -174,16 +179,16 @@ var (
 				if recvConnId != connIdOne {
 					t.Errorf("received an unexpected connection id from websocket connection manager: expected %s, got %s", connIdOne, recvConnId)
 				}
-				close(recvChan)
+				queue.close()
 				close(sendChan)
 				close(quitSignalToServer)
 			},
 		},
 		{
-			name:   "Write_CloseRecvChan",
+			name:   "Write_CloseQueue",
 			connId: connIdOne,
-			testSequence: func(t *testing.T, clientConn *websocket.Conn, recvChan, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
-				close(recvChan)
+			testSequence: func(t *testing.T, clientConn *websocket.Conn, queue *outboundQueue, sendChan chan msg.Msg, quitChan chan struct{}, quitSignalToServer chan string) {
+				queue.close()
 				message, ok := <-sendChan
 				if !ok {
 					t.Error("websocket connection manager send channel unexpectedely closed")
@@ -218,7 +223,7 @@ func TestWebsocketConnectionManager(t *testing.T) {
 	srvr := http.Server{
 		Addr: ":8080",
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			conn, err := upgrader.Upgrade(w, r, nil)
+			conn, err := newUpgrader(config.HTTP{}).Upgrade(w, r, nil)
 			if err != nil {
 				mainLogger.Error().Err(err).Msg("failed to upgrade the HTTP connection to WebSocket connection")
 				return
@@ -249,7 +254,7 @@ func TestWebsocketConnectionManager(t *testing.T) {
 		t.Logf("starting test case %s...", testCase.name)
 		// initialize connection manager
 		wsConnMgr.id = testCase.connId
-		wsConnMgr.recv = make(chan msg.Msg)
+		wsConnMgr.queue = newOutboundQueue(16)
 		wsConnMgr.send = make(chan msg.Msg)
 		wsConnMgr.quit = make(chan struct{})
 		wsConnMgr.quitSignalToServer = make(chan string)
@@ -263,7 +268,7 @@ func TestWebsocketConnectionManager(t *testing.T) {
 			t.Fatalf("failed to initialize websocket client: %s", resp.Status)
 		}
 		defer resp.Body.Close()
-		testCase.testSequence(t, client, wsConnMgr.recv, wsConnMgr.send, wsConnMgr.quit, wsConnMgr.quitSignalToServer)
+		testCase.testSequence(t, client, wsConnMgr.queue, wsConnMgr.send, wsConnMgr.quit, wsConnMgr.quitSignalToServer)
 	}
 	t.Log("test completed")
 	// shutdown websocket server
@@ -281,8 +286,10 @@ type clientConn struct {
 }
 
 var wsServerConfig = config.HTTP{
-	Host: "localhost",
-	Port: 8080,
+	Host:               "localhost",
+	Port:               8080,
+	WriteQueueSize:     16,
+	SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
 }
 
 // TestWebsocketServer tests that the new server can accept new connections and pass them off to connection managers, properly relay messages to the correct connection manager and ensure a proper cleanup when shutting down
@@ -302,7 +309,7 @@ func TestWebsocketServer(t *testing.T) {
 		if err := srvr.Stop(); err != nil {
 			t.Errorf("unexpected error when shutting down websocket server: %v", err)
 		}
-		if sessions := len(srvr.(*WebsocketServer).connMgrChans); sessions > 0 {
+		if sessions := srvr.Registry().Len(); sessions > 0 {
 			t.Errorf("unexpected %v lingering connection manager sessions", sessions)
 		}
 		if state := srvr.(*WebsocketServer).isClosing(); !state {
@@ -325,17 +332,17 @@ func TestWebsocketServer(t *testing.T) {
 		defer resp.Body.Close()
 		time.Sleep(1 * time.Second)
 		// grab the connId
-		for connId := range srvr.(*WebsocketServer).connMgrChans {
-			if !slices.Contains(connIds, connId) {
-				connIds = append(connIds, connId)
-				clients = append(clients, clientConn{conn: client, connId: connId})
+		for _, info := range srvr.Registry().List() {
+			if !slices.Contains(connIds, info.Id) {
+				connIds = append(connIds, info.Id)
+				clients = append(clients, clientConn{conn: client, connId: info.Id})
 				break
 			}
 		}
 	}
 	time.Sleep(1 * time.Second)
 	// ensure connMgrMap is updated
-	if sessions := len(srvr.(*WebsocketServer).connMgrChans); sessions != len(clients) {
+	if sessions := srvr.Registry().Len(); sessions != len(clients) {
 		t.Errorf("unexpected number of connection manager sessions: expected %v, got %v", len(clients), sessions)
 	}
 	// send message and ensure the connId matches
@@ -398,8 +405,484 @@ func TestWebsocketServer(t *testing.T) {
 			t.Errorf("websocket server send channel message has unexpected close connection flag state: %v", message.CloseConn)
 		}
 		time.Sleep(1 * time.Second)
-		if _, ok := srvr.(*WebsocketServer).connMgrChans[client.connId]; ok {
+		if _, ok := srvr.Registry().Get(client.connId); ok {
 			t.Errorf("websocket server connection manager map still contains connection id %s when it shouldn't", client.connId)
 		}
 	}
 }
+
+type enqueueTestCase struct {
+	name      string
+	policy    string
+	queueSize int
+	numMsgs   int
+	// replies holds the indexes of the messages which aren't live events
+	replies        []int
+	expectedQueued int
+	// expectedRemaining holds the indexes of the messages left in the queue, in order
+	expectedRemaining   []int
+	expectedDropped     uint64
+	expectedDisconnects bool
+}
+
+var enqueueTestCases = []enqueueTestCase{
+	{
+		name:            "ValidCase_QueueNotFull",
+		policy:          config.SlowConsumerPolicyDisconnect,
+		queueSize:       4,
+		numMsgs:         3,
+		expectedQueued:  3,
+		expectedDropped: 0,
+	},
+	{
+		name:                "ValidCase_Disconnect",
+		policy:              config.SlowConsumerPolicyDisconnect,
+		queueSize:           2,
+		numMsgs:             3,
+		expectedQueued:      2,
+		expectedDropped:     1,
+		expectedDisconnects: true,
+	},
+	{
+		name:              "ValidCase_DropOldest",
+		policy:            config.SlowConsumerPolicyDropOldest,
+		queueSize:         2,
+		numMsgs:           5,
+		expectedQueued:    2,
+		expectedRemaining: []int{3, 4},
+		expectedDropped:   3,
+	},
+	{
+		name:              "ValidCase_DropOldestKeepsReplies",
+		policy:            config.SlowConsumerPolicyDropOldest,
+		queueSize:         3,
+		numMsgs:           5,
+		replies:           []int{0, 3},
+		expectedQueued:    3,
+		expectedRemaining: []int{0, 3, 4},
+		expectedDropped:   2,
+	},
+	{
+		name:              "ValidCase_DropOldestDropsNewLiveEvent",
+		policy:            config.SlowConsumerPolicyDropOldest,
+		queueSize:         2,
+		numMsgs:           3,
+		replies:           []int{0, 1},
+		expectedQueued:    2,
+		expectedRemaining: []int{0, 1},
+		expectedDropped:   1,
+	},
+	{
+		name:                "ValidCase_DropOldestDisconnectsOnReplies",
+		policy:              config.SlowConsumerPolicyDropOldest,
+		queueSize:           2,
+		numMsgs:             3,
+		replies:             []int{0, 1, 2},
+		expectedQueued:      2,
+		expectedDropped:     1,
+		expectedDisconnects: true,
+	},
+}
+
+// TestEnqueue ensures the slow consumer policies are applied when the outbound queue of a connection manager is full and only live events are ever dropped
+func TestEnqueue(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	for _, testCase := range enqueueTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		srvr := &WebsocketServer{
+			logger:   mainLogger.With().Str("module", "websocketServer").Logger(),
+			registry: NewConnectionRegistry(),
+			cfg:      config.HTTP{SlowConsumerPolicy: testCase.policy},
+		}
+		connMgr := &websocketConnectionManager{quit: make(chan struct{})}
+		chans := ConnMgrChannels{Queue: newOutboundQueue(testCase.queueSize), Quit: connMgr.quit, Dropped: &connMgr.dropped, Close: connMgr.close}
+		srvr.registry.add(connIdOne, &connectionEntry{chans: chans})
+		var msgs [][]byte
+		for i := 0; i < testCase.numMsgs; i++ {
+			m := randMsg()
+			msgs = append(msgs, m)
+			srvr.enqueue(connIdOne, chans, msg.Msg{ConnectionId: connIdOne, Data: m, Live: !slices.Contains(testCase.replies, i)})
+		}
+		if queued := chans.Queue.len(); queued != testCase.expectedQueued {
+			t.Errorf("unexpected number of queued messages: expected %v, got %v", testCase.expectedQueued, queued)
+		}
+		if dropped := srvr.DroppedMessages(); dropped != testCase.expectedDropped {
+			t.Errorf("unexpected number of dropped messages: expected %v, got %v", testCase.expectedDropped, dropped)
+		}
+		if dropped := connMgr.dropped.Load(); dropped != testCase.expectedDropped {
+			t.Errorf("unexpected number of dropped messages for connection manager: expected %v, got %v", testCase.expectedDropped, dropped)
+		}
+		_, registered := srvr.registry.channels(connIdOne)
+		if testCase.expectedDisconnects == registered {
+			t.Errorf("unexpected connection manager registration state: expected disconnect %v, still registered %v", testCase.expectedDisconnects, registered)
+		}
+		for _, i := range testCase.expectedRemaining {
+			m, _, _ := chans.Queue.pop()
+			if !bytes.Equal(m.Data, msgs[i]) {
+				t.Errorf("unexpected message in queue: expected message %v, got %v", i, m.Data)
+			}
+		}
+	}
+}
+
+type keepaliveTestCase struct {
+	name              string
+	cfg               config.HTTP
+	subscriptionCount func(connectionId string) int
+	clientReads       bool
+}
+
+var keepaliveTestCases = []keepaliveTestCase{
+	{
+		name: "PongTimeout",
+		cfg: config.HTTP{
+			PingInterval: 100 * time.Millisecond,
+			PongWait:     300 * time.Millisecond,
+			WriteWait:    time.Second,
+		},
+		clientReads: false, // the client only answers pings while reading
+	},
+	{
+		name: "IdleWithoutSubscriptions",
+		cfg: config.HTTP{
+			PingInterval: 100 * time.Millisecond,
+			PongWait:     time.Second,
+			WriteWait:    time.Second,
+			IdleTimeout:  300 * time.Millisecond,
+		},
+		subscriptionCount: func(string) int { return 0 },
+		clientReads:       true,
+	},
+}
+
+// TestWebsocketConnectionManagerKeepalive ensures dead and idle connections are closed and reported through the close connection path
+func TestWebsocketConnectionManagerKeepalive(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	for _, testCase := range keepaliveTestCases {
+		t.Logf("starting test case %s...", testCase.name)
+		sendChan := make(chan msg.Msg)
+		quitSignalToServer := make(chan string, 1)
+		var wg sync.WaitGroup
+		srvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := newUpgrader(config.HTTP{}).Upgrade(w, r, nil)
+			if err != nil {
+				mainLogger.Error().Err(err).Msg("failed to upgrade the HTTP connection to WebSocket connection")
+				return
+			}
+			connMgr := newWebsocketConnectionManager(connIdOne, "", conn, mainLogger.With().Str("module", "connMgr").Logger(), sendChan, newOutboundQueue(16), make(chan struct{}), quitSignalToServer, testCase.cfg, testCase.subscriptionCount)
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				connMgr.read()
+			}()
+			go func() {
+				defer wg.Done()
+				connMgr.write()
+			}()
+		}))
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvr.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("failed to initialize websocket client: %v", err)
+		}
+		if testCase.clientReads {
+			go func() {
+				for {
+					if _, _, err := client.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		timeout := time.NewTimer(5 * time.Second)
+		select {
+		case message := <-sendChan:
+			if !reflect.DeepEqual(message, msg.Msg{ConnectionId: connIdOne, CloseConn: true}) {
+				t.Errorf("received unexpected message from websocket connection manager: expected %v, got %v", msg.Msg{ConnectionId: connIdOne, CloseConn: true}, message)
+			}
+		case <-timeout.C:
+			t.Errorf("test case %s timed out waiting for connection to be closed", testCase.name)
+		}
+		if connId := <-quitSignalToServer; connId != connIdOne {
+			t.Errorf("received an unexpected connection id from websocket connection manager: expected %s, got %s", connIdOne, connId)
+		}
+		wg.Wait()
+		client.Close()
+		srvr.Close()
+	}
+}
+
+// TestWebsocketHandlerCompressionAndMessageSize ensures permessage-deflate is negotiated when enabled and that messages exceeding the max message size close the connection with the appropriate close code
+func TestWebsocketHandlerCompressionAndMessageSize(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	cfg := config.HTTP{
+		WriteQueueSize:     16,
+		SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+		ReadBufferSize:     1024,
+		WriteBufferSize:    1024,
+		MaxMessageSize:     64,
+		Compression: config.Compression{
+			Enabled: true,
+			Level:   9,
+		},
+	}
+	wsServer := NewWebsocketServer(cfg, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	// drain everything the connection managers send to the server
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-wsServer.SendChannel():
+			case <-wsServer.quitSignalFromConnMgrs:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	dialer := websocket.Dialer{EnableCompression: true}
+	client, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srvr.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to initialize websocket client: %v", err)
+	}
+	defer client.Close()
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("permessage-deflate was not negotiated: got extensions %q", ext)
+	}
+	// send a message which is too large
+	if err := client.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("a"), 128)); err != nil {
+		t.Fatalf("unexpected error when sending message over websocket connection: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("unexpected error when reading from websocket connection: expected close code %v, got %v", websocket.CloseMessageTooBig, err)
+	}
+}
+
+// TestConnectionLimitsAndDrain ensures connection limits are enforced and that clients are told the relay is going away when the server stops
+func TestConnectionLimitsAndDrain(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	cfg := config.HTTP{
+		WriteQueueSize:      16,
+		SlowConsumerPolicy:  config.SlowConsumerPolicyDisconnect,
+		MaxConnections:      2,
+		MaxConnectionsPerIP: 1,
+		WriteWait:           time.Second,
+		ShutdownTimeout:     2 * time.Second,
+	}
+	wsServer := NewWebsocketServer(cfg, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	// drain everything the connection managers send to the server until it stops
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	url := "ws" + strings.TrimPrefix(srvr.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize websocket client: %v", err)
+	}
+	defer client.Close()
+	// a second connection from the same ip is rejected
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Fatal("expected second connection from the same ip address to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response to second connection: expected status %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+	// stop the server and ensure the client is told why
+	stopped := make(chan error)
+	go func() {
+		stopped <- wsServer.Stop()
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, notice, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error when reading from websocket connection: %v", err)
+	}
+	if !bytes.Equal(notice, test.NoticeBytes(nostr.NoticeEnvelope(goingAwayReason))) {
+		t.Errorf("unexpected notice: expected %s, got %s", test.NoticeBytes(nostr.NoticeEnvelope(goingAwayReason)), notice)
+	}
+	_, _, err = client.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("unexpected error when reading from websocket connection: expected close code %v, got %v", websocket.CloseGoingAway, err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("unexpected error when stopping websocket server: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for websocket server to stop")
+	}
+	if wsServer.connCount != 0 || len(wsServer.ipConnCount) != 0 {
+		t.Errorf("unexpected lingering connection slots: %v global, %v ip addresses", wsServer.connCount, len(wsServer.ipConnCount))
+	}
+}
+
+// TestConnectDuringStop ensures a connection which took its slot before the server started shutting down but registers after the connections were drained is still told to go away, instead of holding up Stop
+func TestConnectDuringStop(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	cfg := config.HTTP{
+		WriteQueueSize:     16,
+		SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+		WriteWait:          time.Second,
+		PongWait:           time.Minute,
+		ShutdownTimeout:    2 * time.Second,
+	}
+	wsServer := NewWebsocketServer(cfg, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	// hold the upgrade, which happens between taking a slot and registering the connection, until the connections are drained
+	upgrading := make(chan struct{})
+	wsServer.upgrader.CheckOrigin = func(r *http.Request) bool {
+		close(upgrading)
+		for {
+			wsServer.registry.RLock()
+			closed := wsServer.registry.closed
+			wsServer.registry.RUnlock()
+			if closed {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	dialed := make(chan *websocket.Conn, 1)
+	go func() {
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srvr.URL, "http"), nil)
+		if err != nil {
+			t.Errorf("failed to initialize websocket client: %v", err)
+		}
+		dialed <- client
+	}()
+	<-upgrading
+	stopped := make(chan error)
+	go func() {
+		stopped <- wsServer.Stop()
+	}()
+	client := <-dialed
+	if client == nil {
+		t.FailNow()
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, notice, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error when reading from websocket connection: %v", err)
+	}
+	if !bytes.Equal(notice, test.NoticeBytes(nostr.NoticeEnvelope(goingAwayReason))) {
+		t.Errorf("unexpected notice: expected %s, got %s", test.NoticeBytes(nostr.NoticeEnvelope(goingAwayReason)), notice)
+	}
+	if _, _, err = client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("unexpected error when reading from websocket connection: expected close code %v, got %v", websocket.CloseGoingAway, err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("unexpected error when stopping websocket server: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for websocket server to stop")
+	}
+}
+
+// TestReload ensures the relay information document, blocked ip addresses and admin token are applied live
+func TestReload(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	cfg := &config.Config{
+		HTTP: config.HTTP{
+			WriteQueueSize:     16,
+			SlowConsumerPolicy: config.SlowConsumerPolicyDisconnect,
+			WriteWait:          time.Second,
+			ShutdownTimeout:    time.Second,
+			MaxMessageSize:     1024,
+		},
+	}
+	wsServer := NewWebsocketServer(cfg.HTTP, mainLogger.With().Str("module", "websocketServer").Logger(), make(chan msg.Msg), make(chan msg.Msg)).(*WebsocketServer)
+	go func() {
+		for range wsServer.SendChannel() {
+		}
+	}()
+	srvr := httptest.NewServer(wsServer.Handler)
+	defer srvr.Close()
+	defer wsServer.Stop()
+	url := "ws" + strings.TrimPrefix(srvr.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to initialize websocket client: %v", err)
+	}
+	defer client.Close()
+	// admin endpoints are disabled until a token is configured
+	req, _ := http.NewRequest(http.MethodGet, srvr.URL+"/admin/connections", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error when listing connections: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status code: expected %v, got %v", http.StatusNotFound, resp.StatusCode)
+	}
+	// reload with a name, an admin token and the client's ip address blocked
+	cfg.HTTP.AdminToken = "secret"
+	cfg.Policy.BlockedIPs = []string{"127.0.0.0/8"}
+	cfg.Info.Name = "tandem test relay"
+	if err := wsServer.Reload(cfg); err != nil {
+		t.Fatalf("unexpected error when reloading: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, notice, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("unexpected error when reading from websocket connection: %v", err)
+	}
+	if !bytes.Equal(notice, test.NoticeBytes(nostr.NoticeEnvelope(blockedReason))) {
+		t.Errorf("unexpected notice: expected %s, got %s", test.NoticeBytes(nostr.NoticeEnvelope(blockedReason)), notice)
+	}
+	if _, _, err = client.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("unexpected error when reading from websocket connection: expected close code %v, got %v", websocket.ClosePolicyViolation, err)
+	}
+	// new connections from the blocked ip address are rejected
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected connection from blocked ip address to be rejected with status %v, got %v", http.StatusForbidden, resp)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error when listing connections: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: expected %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+	// the relay information document reflects the reloaded config
+	req, _ = http.NewRequest(http.MethodGet, srvr.URL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error when fetching relay information document: %v", err)
+	}
+	defer resp.Body.Close()
+	var info nip11.RelayInformationDocument
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("unexpected error when decoding relay information document: %v", err)
+	}
+	if info.Name != cfg.Info.Name || info.Limitation == nil || info.Limitation.MaxMessageLength != 1024 {
+		t.Errorf("unexpected relay information document: %+v", info)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("expected relay information document to allow cross origin requests")
+	}
+}
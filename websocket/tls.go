@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrCertNotLoaded = errors.New("certificate not loaded")
+)
+
+type certReloader struct {
+	certPath    string
+	keyPath     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	logger      zerolog.Logger
+	sync.RWMutex
+}
+
+// newCertReloader instantiates a new certificate reloader and loads the certificate from disk
+func newCertReloader(certPath, keyPath string, logger zerolog.Logger) (*certReloader, error) {
+	c := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		logger:   logger,
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificate and key pair from disk if either file changed since the last load and reports whether a new certificate was loaded
+func (c *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat key: %w", err)
+	}
+	c.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime)
+	c.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
+
+// watch is the goroutine which periodically checks the certificate and key for changes. The previous certificate is kept if the new one fails to load
+func (c *certReloader) watch(interval time.Duration, quit chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				c.logger.Error().Err(err).Msg("failed to reload TLS certificate, keeping the previous one")
+				continue
+			}
+			if reloaded {
+				c.logger.Info().Msg("TLS certificate reloaded")
+			}
+		case <-quit:
+			c.logger.Info().Msg("exiting certificate reload routine...")
+			return
+		}
+	}
+}
+
+// GetCertificate returns the most recently loaded certificate. It is called for every TLS handshake so existing connections are unaffected by a reload
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.cert == nil {
+		return nil, ErrCertNotLoaded
+	}
+	return c.cert, nil
+}
+
+// redirectHandler redirects plaintext HTTP requests to the same host on the given TLS port
+func redirectHandler(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := "https://" + net.JoinHostPort(host, strconv.Itoa(tlsPort)) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
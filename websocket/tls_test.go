@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheRebelOfBabylon/tandem/test"
+	"github.com/rs/zerolog"
+)
+
+// writeSelfSignedCert writes a new self-signed certificate and key pair to the given paths with the given modification time
+func writeSelfSignedCert(t *testing.T, certPath, keyPath string, modTime time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial number: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modification time: %v", err)
+		}
+	}
+	return certDer
+}
+
+// TestCertReloader ensures certificates are reloaded when they change on disk and that a broken certificate does not replace a working one
+func TestCertReloader(t *testing.T) {
+	// initialize logger
+	mainLogger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339, FormatLevel: test.FormatLvlFunc, TimeLocation: time.UTC}).With().Timestamp().Logger()
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	firstCert := writeSelfSignedCert(t, certPath, keyPath, now)
+	reloader, err := newCertReloader(certPath, keyPath, mainLogger)
+	if err != nil {
+		t.Fatalf("unexpected error when loading certificate: %v", err)
+	}
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("unexpected error when getting certificate: %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], firstCert) {
+		t.Error("unexpected certificate loaded")
+	}
+	// nothing changed
+	if reloaded, err := reloader.reload(); err != nil || reloaded {
+		t.Errorf("unexpected reload of unchanged certificate: reloaded %v, err %v", reloaded, err)
+	}
+	// rotate the certificate
+	secondCert := writeSelfSignedCert(t, certPath, keyPath, now.Add(time.Minute))
+	if reloaded, err := reloader.reload(); err != nil || !reloaded {
+		t.Errorf("expected certificate to be reloaded: reloaded %v, err %v", reloaded, err)
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], secondCert) {
+		t.Error("certificate was not replaced after reload")
+	}
+	// a broken certificate keeps the previous one
+	if err := os.WriteFile(certPath, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.Chtimes(certPath, now.Add(2*time.Minute), now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("failed to set modification time: %v", err)
+	}
+	if _, err := reloader.reload(); err == nil {
+		t.Error("expected an error when reloading a broken certificate")
+	}
+	cert, _ = reloader.GetCertificate(nil)
+	if !bytes.Equal(cert.Certificate[0], secondCert) {
+		t.Error("broken certificate replaced the previous certificate")
+	}
+}
+
+// TestRedirectHandler ensures plaintext requests are redirected to the TLS port
+func TestRedirectHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://relay.example.com:8080/some/path?q=1", nil)
+	rec := httptest.NewRecorder()
+	redirectHandler(443).ServeHTTP(rec, req)
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Errorf("unexpected status code: expected %v, got %v", http.StatusPermanentRedirect, rec.Code)
+	}
+	if location := rec.Header().Get("Location"); location != "https://relay.example.com:443/some/path?q=1" {
+		t.Errorf("unexpected redirect location: %s", location)
+	}
+}